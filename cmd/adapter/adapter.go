@@ -25,12 +25,18 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	basecmd "github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/cmd"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	resmetrics "github.com/kubernetes-incubator/metrics-server/pkg/apiserver/generic"
+	pmodel "github.com/prometheus/common/model"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apiserver/pkg/util/logs"
 	"k8s.io/client-go/rest"
@@ -57,51 +63,192 @@ type PrometheusAdapter struct {
 	PrometheusCAFile string
 	// PrometheusTokenFile points to the file that contains the bearer token when connecting with Prometheus
 	PrometheusTokenFile string
+	// PrometheusReplicaURLs are the URLs of additional replicas of the Prometheus at PrometheusURL.
+	PrometheusReplicaURLs []string
+	// PrometheusHealthCheckInterval is the interval at which Prometheus replicas are health-checked.
+	PrometheusHealthCheckInterval time.Duration
+	// PrometheusReplicaTimeout is the amount of time to wait for a single Prometheus replica before failing over.
+	PrometheusReplicaTimeout time.Duration
+	// PrometheusMergeSeries sends discovery requests to every healthy Prometheus replica and merges the results.
+	PrometheusMergeSeries bool
+	// PrometheusQueryTimeout is the maximum amount of time to wait for Prometheus when fetching metrics.
+	PrometheusQueryTimeout time.Duration
+	// MetricsQueryCacheTTL is how long to cache the results of metrics queries for,
+	// unless a rule specifies its own.  Zero disables caching.
+	MetricsQueryCacheTTL time.Duration
+	// MetricsMaxNamesPerQuery is the largest number of objects to fetch metrics for in a
+	// single query.  Requests for more objects are split into several queries.
+	MetricsMaxNamesPerQuery int
+	// EnforceNamespaceTenancy restricts every selector in the queries for namespaced custom
+	// and external metrics requests to the requested namespace, and drops results from
+	// other namespaces.
+	EnforceNamespaceTenancy bool
+	// PrometheusHeaders are extra headers (in the form `Name=Value`) to send with every request to Prometheus.
+	PrometheusHeaders []string
+	// PrometheusNamespaceTenantHeader is the header used to send the namespace of each request as its tenant ID.
+	PrometheusNamespaceTenantHeader string
+	// PrometheusPartialResponse is sent as the `partial_response` query parameter, if set on the command line.
+	PrometheusPartialResponse bool
+	// PrometheusDedup is sent as the `dedup` query parameter, if set on the command line.
+	PrometheusDedup bool
 	// AdapterConfigFile points to the file containing the metrics discovery configuration.
 	AdapterConfigFile string
 	// MetricsRelistInterval is the interval at which to relist the set of available metrics
 	MetricsRelistInterval time.Duration
 	// MetricsMaxAge is the period to query available metrics for
 	MetricsMaxAge time.Duration
-
+	// MetricsFailedDiscoveryExpiry is the period for which to keep the last known
+	// metrics for rules whose metrics can't currently be listed.  Zero keeps them
+	// until they can be listed again.
+	MetricsFailedDiscoveryExpiry time.Duration
+	// ConfigReloadInterval is the interval at which to check the metrics discovery
+	// configuration file for changes.  Zero disables reloading.
+	ConfigReloadInterval time.Duration
+	// ObjectCacheMaxResources is the maximum number of resources to watch in order to
+	// resolve label selectors locally.  Zero disables the cache.
+	ObjectCacheMaxResources int
+
+	// configMu guards metricsConfig, which is replaced when the configuration
+	// is reloaded, and serializes reloads
+	configMu      sync.Mutex
 	metricsConfig *adaptercfg.MetricsDiscoveryConfig
+	configWatcher *adaptercfg.Watcher
+
+	// the following are populated as the corresponding APIs are set up,
+	// and are used to apply reloaded configuration
+	cmLister    cmprov.CustomMetricsLister
+	emLister    cmprov.MetricsLister
+	resProvider resprov.ReloadableMetricsProvider
+	// ownerRollups records whether pod ownership is being tracked
+	// in order to roll up pod metrics onto the owners of the pods
+	ownerRollups bool
 }
 
-func (cmd *PrometheusAdapter) makePromClient() (prom.Client, error) {
-	baseURL, err := url.Parse(cmd.PrometheusURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid Prometheus URL %q: %v", baseURL, err)
+// makePromClients constructs a client for the default Prometheus backend
+// (configured via flags), as well as one for each backend in the metrics
+// discovery configuration.  Health checks for replicated backends run until
+// the given channel is closed.
+func (cmd *PrometheusAdapter) makePromClients(stopCh <-chan struct{}) (prom.Backends, error) {
+	defaultBackend := adaptercfg.Backend{
+		Name:                prom.DefaultBackend,
+		URL:                 cmd.PrometheusURL,
+		CAFile:              cmd.PrometheusCAFile,
+		TokenFile:           cmd.PrometheusTokenFile,
+		AuthConfig:          cmd.PrometheusAuthConf,
+		AuthInCluster:       cmd.PrometheusAuthInCluster,
+		ReplicaURLs:         cmd.PrometheusReplicaURLs,
+		HealthCheckInterval: pmodel.Duration(cmd.PrometheusHealthCheckInterval),
+		ReplicaTimeout:      pmodel.Duration(cmd.PrometheusReplicaTimeout),
+		MergeSeries:         cmd.PrometheusMergeSeries,
+
+		NamespaceTenantHeader: cmd.PrometheusNamespaceTenantHeader,
+	}
+	if len(cmd.PrometheusHeaders) > 0 {
+		defaultBackend.Headers = make(map[string]string, len(cmd.PrometheusHeaders))
+		for _, header := range cmd.PrometheusHeaders {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid Prometheus header %q: must be of the form Name=Value", header)
+			}
+			defaultBackend.Headers[parts[0]] = parts[1]
+		}
+	}
+	if cmd.Flags().Changed("prometheus-partial-response") {
+		defaultBackend.PartialResponse = &cmd.PrometheusPartialResponse
+	}
+	if cmd.Flags().Changed("prometheus-dedup") {
+		defaultBackend.Dedup = &cmd.PrometheusDedup
 	}
 
+	backends := append([]adaptercfg.Backend{defaultBackend}, cmd.currentConfig().Backends...)
+	clients := make(prom.Backends, len(backends))
+	for _, backend := range backends {
+		if _, exists := clients[backend.Name]; exists {
+			return nil, fmt.Errorf("duplicate Prometheus backend %q", backend.Name)
+		}
+		client, err := makePromClient(backend, stopCh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct client for Prometheus backend %q: %v", backend.Name, err)
+		}
+		clients[backend.Name] = client
+	}
+
+	return clients, nil
+}
+
+// makePromClient constructs a client for a single Prometheus backend.  If the
+// backend has multiple replicas, the client fails over between them.
+func makePromClient(backend adaptercfg.Backend, stopCh <-chan struct{}) (prom.Client, error) {
 	var httpClient *http.Client
 
-	if cmd.PrometheusCAFile != "" {
-		prometheusCAClient, err := makePrometheusCAClient(cmd.PrometheusCAFile)
+	if backend.CAFile != "" {
+		prometheusCAClient, err := makePrometheusCAClient(backend.CAFile)
 		if err != nil {
 			return nil, err
 		}
 		httpClient = prometheusCAClient
-		glog.Info("successfully loaded ca from file")
+		glog.Infof("successfully loaded ca from file for Prometheus backend %q", backend.Name)
 	} else {
-		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(cmd.PrometheusAuthInCluster, cmd.PrometheusAuthConf)
+		kubeconfigHTTPClient, err := makeKubeconfigHTTPClient(backend.AuthInCluster, backend.AuthConfig)
 		if err != nil {
 			return nil, err
 		}
 		httpClient = kubeconfigHTTPClient
-		glog.Info("successfully using in-cluster auth")
+		glog.Infof("successfully using in-cluster auth for Prometheus backend %q", backend.Name)
 	}
 
-	if cmd.PrometheusTokenFile != "" {
-		data, err := ioutil.ReadFile(cmd.PrometheusTokenFile)
+	if backend.TokenFile != "" {
+		data, err := ioutil.ReadFile(backend.TokenFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read prometheus-token-file: %v", err)
+			return nil, fmt.Errorf("failed to read token file %q: %v", backend.TokenFile, err)
 		}
 		httpClient.Transport = transport.NewBearerAuthRoundTripper(string(data), httpClient.Transport)
 	}
 
-	genericPromClient := prom.NewGenericAPIClient(httpClient, baseURL)
-	instrumentedGenericPromClient := mprom.InstrumentGenericAPIClient(genericPromClient, baseURL.String())
-	return prom.NewClientForAPI(instrumentedGenericPromClient), nil
+	clientOpts := prom.GenericAPIClientOptions{
+		Headers:     http.Header{},
+		QueryParams: url.Values{},
+	}
+	for name, value := range backend.Headers {
+		clientOpts.Headers.Set(name, value)
+	}
+	if backend.PartialResponse != nil {
+		clientOpts.QueryParams.Set("partial_response", strconv.FormatBool(*backend.PartialResponse))
+	}
+	if backend.Dedup != nil {
+		clientOpts.QueryParams.Set("dedup", strconv.FormatBool(*backend.Dedup))
+	}
+
+	replicas := make([]prom.Replica, 0, len(backend.ReplicaURLs)+1)
+	for _, rawURL := range append([]string{backend.URL}, backend.ReplicaURLs...) {
+		baseURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Prometheus URL %q: %v", rawURL, err)
+		}
+		genericPromClient := prom.NewGenericAPIClientWithOptions(httpClient, baseURL, clientOpts)
+		replicas = append(replicas, prom.Replica{
+			Name:   baseURL.String(),
+			Client: mprom.InstrumentGenericAPIClient(genericPromClient, baseURL.String(), backend.Name),
+		})
+	}
+
+	genericClient := replicas[0].Client
+	if len(replicas) > 1 {
+		failoverClient := prom.NewFailoverAPIClient(replicas, prom.FailoverOptions{
+			HealthCheckInterval: time.Duration(backend.HealthCheckInterval),
+			RequestTimeout:      time.Duration(backend.ReplicaTimeout),
+			MergeSeries:         backend.MergeSeries,
+		})
+		failoverClient.RunUntil(stopCh)
+		glog.Infof("failing over between %d replicas for Prometheus backend %q", len(replicas), backend.Name)
+		genericClient = failoverClient
+	}
+
+	if backend.NamespaceTenantHeader != "" {
+		genericClient = prom.NewTenantAPIClient(genericClient, backend.NamespaceTenantHeader, backend.NamespaceTenants)
+	}
+
+	return prom.NewClientForAPI(genericClient), nil
 }
 
 func (cmd *PrometheusAdapter) addFlags() {
@@ -115,6 +262,25 @@ func (cmd *PrometheusAdapter) addFlags() {
 		"Optional CA file to use when connecting with Prometheus")
 	cmd.Flags().StringVar(&cmd.PrometheusTokenFile, "prometheus-token-file", cmd.PrometheusTokenFile,
 		"Optional file containing the bearer token to use when connecting with Prometheus")
+	cmd.Flags().StringSliceVar(&cmd.PrometheusReplicaURLs, "prometheus-replica-url", cmd.PrometheusReplicaURLs,
+		"URL for connecting to an additional replica of the Prometheus given by --prometheus-url.  "+
+			"May be specified multiple times.  Requests fail over between replicas when one is unavailable.")
+	cmd.Flags().DurationVar(&cmd.PrometheusHealthCheckInterval, "prometheus-health-check-interval", cmd.PrometheusHealthCheckInterval,
+		"interval at which to health-check Prometheus replicas")
+	cmd.Flags().DurationVar(&cmd.PrometheusReplicaTimeout, "prometheus-replica-timeout", cmd.PrometheusReplicaTimeout,
+		"maximum time to wait for a single Prometheus replica before failing over to the next one (0 for no limit)")
+	cmd.Flags().BoolVar(&cmd.PrometheusMergeSeries, "prometheus-merge-series", cmd.PrometheusMergeSeries,
+		"send metrics discovery requests to every healthy Prometheus replica, and merge the results")
+	cmd.Flags().DurationVar(&cmd.PrometheusQueryTimeout, "prometheus-query-timeout", cmd.PrometheusQueryTimeout,
+		"maximum time to wait for Prometheus when fetching metrics for a single request (0 for no limit)")
+	cmd.Flags().StringArrayVar(&cmd.PrometheusHeaders, "prometheus-header", cmd.PrometheusHeaders,
+		"extra header, in the form Name=Value, to send with every request to Prometheus (e.g. a tenant ID).  May be specified multiple times.")
+	cmd.Flags().StringVar(&cmd.PrometheusNamespaceTenantHeader, "prometheus-namespace-tenant-header", cmd.PrometheusNamespaceTenantHeader,
+		"header (e.g. X-Scope-OrgID) used to send the namespace of each metrics request to Prometheus as its tenant ID")
+	cmd.Flags().BoolVar(&cmd.PrometheusPartialResponse, "prometheus-partial-response", cmd.PrometheusPartialResponse,
+		"value of the partial_response query parameter to send to Prometheus (e.g. Thanos), if set")
+	cmd.Flags().BoolVar(&cmd.PrometheusDedup, "prometheus-dedup", cmd.PrometheusDedup,
+		"value of the dedup query parameter to send to Prometheus (e.g. Thanos), if set")
 	cmd.Flags().StringVar(&cmd.AdapterConfigFile, "config", cmd.AdapterConfigFile,
 		"Configuration file containing details of how to transform between Prometheus metrics "+
 			"and custom metrics API resources")
@@ -122,6 +288,23 @@ func (cmd *PrometheusAdapter) addFlags() {
 		"interval at which to re-list the set of all available metrics from Prometheus")
 	cmd.Flags().DurationVar(&cmd.MetricsMaxAge, "metrics-max-age", cmd.MetricsMaxAge, ""+
 		"period for which to query the set of available metrics from Prometheus")
+	cmd.Flags().DurationVar(&cmd.MetricsFailedDiscoveryExpiry, "metrics-failed-discovery-expiry", cmd.MetricsFailedDiscoveryExpiry, ""+
+		"period for which to keep serving the last known metrics for discovery rules whose metrics "+
+		"can't currently be listed from Prometheus (0 to keep them until listing succeeds again)")
+	cmd.Flags().DurationVar(&cmd.MetricsQueryCacheTTL, "metrics-query-cache-ttl", cmd.MetricsQueryCacheTTL, ""+
+		"how long to cache the results of custom and external metrics queries for, unless a rule specifies "+
+		"its own cacheTTL (0 to disable caching, although identical queries in flight are still coalesced)")
+	cmd.Flags().IntVar(&cmd.MetricsMaxNamesPerQuery, "metrics-max-names-per-query", cmd.MetricsMaxNamesPerQuery, ""+
+		"maximum number of objects to fetch custom or resource metrics for in a single query; requests for "+
+		"more objects are split into several concurrent queries (0 for no limit)")
+	cmd.Flags().BoolVar(&cmd.EnforceNamespaceTenancy, "enforce-namespace-tenancy", cmd.EnforceNamespaceTenancy, ""+
+		"restrict every selector in the queries for namespaced custom and external metrics requests to the "+
+		"requested namespace, and drop any results from other namespaces")
+	cmd.Flags().DurationVar(&cmd.ConfigReloadInterval, "config-reload-interval", cmd.ConfigReloadInterval, ""+
+		"interval at which to check the metrics discovery configuration file for changes (0 to disable reloading)")
+	cmd.Flags().IntVar(&cmd.ObjectCacheMaxResources, "object-cache-max-resources", cmd.ObjectCacheMaxResources, ""+
+		"maximum number of resources to watch in order to resolve label selectors for custom metrics locally, "+
+		"instead of listing objects from the API server on every request (0 to disable caching)")
 }
 
 func (cmd *PrometheusAdapter) loadConfig() error {
@@ -133,14 +316,51 @@ func (cmd *PrometheusAdapter) loadConfig() error {
 	if err != nil {
 		return fmt.Errorf("unable to load metrics discovery configuration: %v", err)
 	}
+	if err := checkRuleBackends(metricsConfig); err != nil {
+		return err
+	}
 
+	cmd.configMu.Lock()
 	cmd.metricsConfig = metricsConfig
+	cmd.configMu.Unlock()
+
+	// snapshot the file for reloading now, so that we don't miss changes
+	// made while we're setting everything else up
+	if cmd.ConfigReloadInterval != 0 {
+		cmd.configWatcher, err = adaptercfg.NewWatcher(cmd.AdapterConfigFile, cmd.ConfigReloadInterval, cmd.reloadConfig)
+		if err != nil {
+			return fmt.Errorf("unable to watch metrics discovery configuration for changes: %v", err)
+		}
+	}
 
 	return nil
 }
 
-func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
-	if len(cmd.metricsConfig.Rules) == 0 {
+// currentConfig returns the metrics discovery configuration currently in effect.
+func (cmd *PrometheusAdapter) currentConfig() *adaptercfg.MetricsDiscoveryConfig {
+	cmd.configMu.Lock()
+	defer cmd.configMu.Unlock()
+	return cmd.metricsConfig
+}
+
+// providerOptions collects the flags which configure the custom and external
+// metrics providers.
+func (cmd *PrometheusAdapter) providerOptions() cmprov.ProviderOptions {
+	return cmprov.ProviderOptions{
+		UpdateInterval: cmd.MetricsRelistInterval,
+		MaxAge:         cmd.MetricsMaxAge,
+		FailureExpiry:  cmd.MetricsFailedDiscoveryExpiry,
+
+		QueryTimeout:      cmd.PrometheusQueryTimeout,
+		CacheTTL:          cmd.MetricsQueryCacheTTL,
+		MaxNamesPerQuery:  cmd.MetricsMaxNamesPerQuery,
+		EnforceNamespaces: cmd.EnforceNamespaceTenancy,
+	}
+}
+
+func (cmd *PrometheusAdapter) makeProvider(promClients prom.Backends, stopCh <-chan struct{}) (provider.CustomMetricsProvider, error) {
+	metricsConfig := cmd.currentConfig()
+	if !hasCustomMetrics(metricsConfig) {
 		return nil, nil
 	}
 
@@ -159,20 +379,77 @@ func (cmd *PrometheusAdapter) makeProvider(promClient prom.Client, stopCh <-chan
 	}
 
 	// extract the namers
-	namers, err := cmprov.NamersFromConfig(cmd.metricsConfig, mapper)
+	namers, err := cmprov.NamersFromConfig(metricsConfig, mapper)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
+	derived, err := cmprov.DerivedMetricsFromConfig(metricsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct derived metrics: %v", err)
+	}
+
+	// set up the lister used to resolve label selectors
+	objects := cmprov.NewDynamicObjectLister(mapper, dynClient)
+	if cmd.ObjectCacheMaxResources > 0 {
+		cachingLister := cmprov.NewCachingObjectLister(mapper, dynClient, cmd.ObjectCacheMaxResources)
+		cachingLister.RunUntil(stopCh)
+		objects = cachingLister
+	}
+
+	// if any rules roll up pod metrics onto their owners, track pod ownership
+	// (the informers are started along with the server)
+	var owners cmprov.OwnerResolver
+	if hasOwnerRollups(metricsConfig) {
+		informers, err := cmd.Informers()
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct informers: %v", err)
+		}
+		owners = cmprov.NewOwnerResolver(mapper, informers.Core().V1().Pods().Lister(), informers.Apps().V1().ReplicaSets().Lister())
+		cmd.ownerRollups = true
+	}
 
 	// construct the provider and start it
-	cmProvider, runner := cmprov.NewPrometheusProvider(mapper, dynClient, promClient, namers, cmd.MetricsRelistInterval, cmd.MetricsMaxAge)
+	cmProvider, runner := cmprov.NewPrometheusProvider(mapper, objects, owners, promClients, namers, cmd.providerOptions())
+	runner.SetDerivedMetrics(derived)
 	runner.RunUntil(stopCh)
+	cmd.cmLister = runner
 
 	return cmProvider, nil
 }
 
-func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClient prom.Client) error {
-	if cmd.metricsConfig.ResourceRules == nil {
+func (cmd *PrometheusAdapter) makeExternalProvider(promClients prom.Backends, stopCh <-chan struct{}) (provider.ExternalMetricsProvider, error) {
+	metricsConfig := cmd.currentConfig()
+	if len(metricsConfig.ExternalRules) == 0 {
+		return nil, nil
+	}
+
+	if cmd.MetricsMaxAge < cmd.MetricsRelistInterval {
+		return nil, fmt.Errorf("max age must not be less than relist interval")
+	}
+
+	// grab the mapper
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct RESTMapper: %v", err)
+	}
+
+	// extract the namers
+	namers, err := cmprov.ExternalNamersFromConfig(metricsConfig, mapper)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct naming scheme from external metrics rules: %v", err)
+	}
+
+	// construct the provider and start it
+	emProvider, runner := cmprov.NewExternalPrometheusProvider(promClients, namers, cmd.providerOptions())
+	runner.RunUntil(stopCh)
+	cmd.emLister = runner
+
+	return emProvider, nil
+}
+
+func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClients prom.Backends) error {
+	metricsConfig := cmd.currentConfig()
+	if metricsConfig.ResourceRules == nil {
 		// bail if we don't have rules for setting things up
 		return nil
 	}
@@ -182,10 +459,11 @@ func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClient prom.Client) erro
 		return err
 	}
 
-	provider, err := resprov.NewProvider(promClient, mapper, cmd.metricsConfig.ResourceRules)
+	provider, err := resprov.NewProvider(promClients, mapper, metricsConfig.ResourceRules, metricsConfig.GlobalLabelMatchers, cmd.PrometheusQueryTimeout, cmd.MetricsMaxNamesPerQuery)
 	if err != nil {
 		return fmt.Errorf("unable to construct resource metrics API provider: %v", err)
 	}
+	cmd.resProvider = provider
 
 	provCfg := &resmetrics.ProviderConfig{
 		Node: provider,
@@ -208,15 +486,105 @@ func (cmd *PrometheusAdapter) addResourceMetricsAPI(promClient prom.Client) erro
 	return nil
 }
 
+// reloadConfig validates the given metrics discovery configuration, and applies it
+// to each of the running providers.  If any part of the configuration is invalid,
+// nothing is applied, and the previous configuration remains in effect.  Since
+// APIs can't be installed or removed once the server is running, reloading may
+// not enable or disable any of the metrics APIs.
+func (cmd *PrometheusAdapter) reloadConfig(newConfig *adaptercfg.MetricsDiscoveryConfig) error {
+	mapper, err := cmd.RESTMapper()
+	if err != nil {
+		return fmt.Errorf("unable to construct RESTMapper: %v", err)
+	}
+	return cmd.applyConfig(newConfig, mapper)
+}
+
+// applyConfig validates the given metrics discovery configuration, constructing
+// everything needed by each of the running providers, and only then applies it to
+// all of them, so that a configuration is never partially applied.
+func (cmd *PrometheusAdapter) applyConfig(newConfig *adaptercfg.MetricsDiscoveryConfig, mapper apimeta.RESTMapper) error {
+	cmd.configMu.Lock()
+	defer cmd.configMu.Unlock()
+
+	if hasCustomMetrics(newConfig) != (cmd.cmLister != nil) {
+		return fmt.Errorf("adding or removing all discovery rules and static metrics requires a restart")
+	}
+	if (len(newConfig.ExternalRules) > 0) != (cmd.emLister != nil) {
+		return fmt.Errorf("adding or removing all external discovery rules requires a restart")
+	}
+	if (newConfig.ResourceRules != nil) != (cmd.resProvider != nil) {
+		return fmt.Errorf("adding or removing resource rules requires a restart")
+	}
+	if !reflect.DeepEqual(newConfig.Backends, cmd.metricsConfig.Backends) {
+		return fmt.Errorf("changing Prometheus backends requires a restart")
+	}
+	if hasOwnerRollups(newConfig) && !cmd.ownerRollups {
+		return fmt.Errorf("adding the first owner rollup requires a restart")
+	}
+	if err := checkRuleBackends(newConfig); err != nil {
+		return err
+	}
+
+	// construct everything first, so that we don't partially apply an invalid config
+	var namers, externalNamers []cmprov.MetricNamer
+	var derived []*cmprov.DerivedMetric
+	var resourceRules *resprov.PreparedRules
+	var err error
+	if cmd.cmLister != nil {
+		namers, err = cmprov.NamersFromConfig(newConfig, mapper)
+		if err != nil {
+			return fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
+		}
+		derived, err = cmprov.DerivedMetricsFromConfig(newConfig)
+		if err != nil {
+			return fmt.Errorf("unable to construct derived metrics: %v", err)
+		}
+	}
+	if cmd.emLister != nil {
+		externalNamers, err = cmprov.ExternalNamersFromConfig(newConfig, mapper)
+		if err != nil {
+			return fmt.Errorf("unable to construct naming scheme from external metrics rules: %v", err)
+		}
+	}
+	if cmd.resProvider != nil {
+		resourceRules, err = cmd.resProvider.PrepareRules(newConfig.ResourceRules, newConfig.GlobalLabelMatchers)
+		if err != nil {
+			return fmt.Errorf("unable to construct resource metrics API rules: %v", err)
+		}
+	}
+
+	// then swap everything over (none of which can fail)
+	if cmd.resProvider != nil {
+		cmd.resProvider.SetRules(resourceRules)
+	}
+	if cmd.cmLister != nil {
+		// the relist triggered by updating the namers picks up the new derived metrics
+		cmd.cmLister.SetDerivedMetrics(derived)
+		cmd.cmLister.UpdateNamers(namers)
+	}
+	if cmd.emLister != nil {
+		cmd.emLister.UpdateNamers(externalNamers)
+	}
+	cmd.metricsConfig = newConfig
+
+	return nil
+}
+
 func main() {
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
 	// set up flags
 	cmd := &PrometheusAdapter{
-		PrometheusURL:         "https://localhost",
-		MetricsRelistInterval: 10 * time.Minute,
-		MetricsMaxAge:         20 * time.Minute,
+		PrometheusURL:                 "https://localhost",
+		PrometheusHealthCheckInterval: prom.DefaultHealthCheckInterval,
+		PrometheusQueryTimeout:        30 * time.Second,
+		MetricsRelistInterval:         10 * time.Minute,
+		MetricsMaxAge:                 20 * time.Minute,
+		MetricsFailedDiscoveryExpiry:  30 * time.Minute,
+		MetricsMaxNamesPerQuery:       500,
+		ConfigReloadInterval:          30 * time.Second,
+		ObjectCacheMaxResources:       20,
 	}
 	cmd.Name = "prometheus-metrics-adapter"
 	cmd.addFlags()
@@ -225,19 +593,19 @@ func main() {
 		glog.Fatalf("unable to parse flags: %v", err)
 	}
 
-	// make the prometheus client
-	promClient, err := cmd.makePromClient()
-	if err != nil {
-		glog.Fatalf("unable to construct Prometheus client: %v", err)
-	}
-
 	// load the config
 	if err := cmd.loadConfig(); err != nil {
 		glog.Fatalf("unable to load metrics discovery config: %v", err)
 	}
 
+	// make the prometheus clients
+	promClients, err := cmd.makePromClients(wait.NeverStop)
+	if err != nil {
+		glog.Fatalf("unable to construct Prometheus client: %v", err)
+	}
+
 	// construct the provider
-	cmProvider, err := cmd.makeProvider(promClient, wait.NeverStop)
+	cmProvider, err := cmd.makeProvider(promClients, wait.NeverStop)
 	if err != nil {
 		glog.Fatalf("unable to construct custom metrics provider: %v", err)
 	}
@@ -247,17 +615,68 @@ func main() {
 		cmd.WithCustomMetrics(cmProvider)
 	}
 
+	// construct the external provider
+	emProvider, err := cmd.makeExternalProvider(promClients, wait.NeverStop)
+	if err != nil {
+		glog.Fatalf("unable to construct external metrics provider: %v", err)
+	}
+
+	// attach the provider to the server, if it's needed
+	if emProvider != nil {
+		cmd.WithExternalMetrics(emProvider)
+	}
+
 	// attach resource metrics support, if it's needed
-	if err := cmd.addResourceMetricsAPI(promClient); err != nil {
+	if err := cmd.addResourceMetricsAPI(promClients); err != nil {
 		glog.Fatalf("unable to install resource metrics API: %v", err)
 	}
 
+	// start watching for configuration changes, if enabled
+	if cmd.configWatcher != nil {
+		cmd.configWatcher.RunUntil(wait.NeverStop)
+	}
+
 	// run the server
 	if err := cmd.Run(wait.NeverStop); err != nil {
 		glog.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
 }
 
+// checkRuleBackends checks that every rule in the given configuration refers
+// to a Prometheus backend that exists.
+func checkRuleBackends(cfg *adaptercfg.MetricsDiscoveryConfig) error {
+	known := map[string]bool{"": true, prom.DefaultBackend: true}
+	for _, backend := range cfg.Backends {
+		known[backend.Name] = true
+	}
+
+	for i, rule := range cfg.Rules {
+		if !known[rule.Backend] {
+			return fmt.Errorf("rule %d (series query %q) refers to unknown Prometheus backend %q", i, rule.SeriesQuery, rule.Backend)
+		}
+	}
+	for i, rule := range cfg.ExternalRules {
+		if !known[rule.Backend] {
+			return fmt.Errorf("external rule %d (series query %q) refers to unknown Prometheus backend %q", i, rule.SeriesQuery, rule.Backend)
+		}
+	}
+	for _, metric := range cfg.StaticMetrics {
+		if !known[metric.Backend] {
+			return fmt.Errorf("static metric %q refers to unknown Prometheus backend %q", metric.Name, metric.Backend)
+		}
+	}
+	if cfg.ResourceRules != nil {
+		if !known[cfg.ResourceRules.CPU.Backend] {
+			return fmt.Errorf("CPU resource rule refers to unknown Prometheus backend %q", cfg.ResourceRules.CPU.Backend)
+		}
+		if !known[cfg.ResourceRules.Memory.Backend] {
+			return fmt.Errorf("memory resource rule refers to unknown Prometheus backend %q", cfg.ResourceRules.Memory.Backend)
+		}
+	}
+
+	return nil
+}
+
 // makeKubeconfigHTTPClient constructs an HTTP for connecting with the given auth options.
 func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.Client, error) {
 	// make sure we're not trying to use two different sources of auth
@@ -265,9 +684,10 @@ func makeKubeconfigHTTPClient(inClusterAuth bool, kubeConfigPath string) (*http.
 		return nil, fmt.Errorf("may not use both in-cluster auth and an explicit kubeconfig at the same time")
 	}
 
-	// return the default client if we're using no auth
+	// use the default transport if we're using no auth.  Each backend gets its
+	// own client, since the transport is wrapped to add bearer tokens.
 	if !inClusterAuth && kubeConfigPath == "" {
-		return http.DefaultClient, nil
+		return &http.Client{Transport: http.DefaultTransport}, nil
 	}
 
 	var authConf *rest.Config
@@ -312,3 +732,20 @@ func makePrometheusCAClient(caFilename string) (*http.Client, error) {
 		},
 	}, nil
 }
+
+// hasCustomMetrics checks if the given config has any rules or static
+// metrics for the custom metrics API.
+func hasCustomMetrics(cfg *adaptercfg.MetricsDiscoveryConfig) bool {
+	return len(cfg.Rules) > 0 || len(cfg.StaticMetrics) > 0
+}
+
+// hasOwnerRollups checks if any rule in the given configuration rolls up
+// pod metrics onto the owners of the pods.
+func hasOwnerRollups(cfg *adaptercfg.MetricsDiscoveryConfig) bool {
+	for _, rule := range cfg.Rules {
+		if rule.OwnerRollup != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	"github.com/directxman12/k8s-prometheus-adapter/cmd/config-gen/utils"
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	adaptercfg "github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	cmprov "github.com/directxman12/k8s-prometheus-adapter/pkg/custom-provider"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+	resprov "github.com/directxman12/k8s-prometheus-adapter/pkg/resourceprovider"
+)
+
+// fakeLister records the namers and derived metrics it's given.
+type fakeLister struct {
+	mu      sync.Mutex
+	namers  []cmprov.MetricNamer
+	derived []*cmprov.DerivedMetric
+	updates int
+}
+
+func (l *fakeLister) Run()                              {}
+func (l *fakeLister) RunUntil(stopChan <-chan struct{}) {}
+
+func (l *fakeLister) UpdateNamers(namers []cmprov.MetricNamer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.namers = namers
+	l.updates++
+}
+
+func (l *fakeLister) SetDerivedMetrics(derived []*cmprov.DerivedMetric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.derived = derived
+}
+
+func (l *fakeLister) numUpdates() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.updates
+}
+
+// recordingResourceProvider counts the rules applied to a real resource provider.
+type recordingResourceProvider struct {
+	resprov.ReloadableMetricsProvider
+
+	mu      sync.Mutex
+	applied int
+}
+
+func (p *recordingResourceProvider) SetRules(rules *resprov.PreparedRules) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ReloadableMetricsProvider.SetRules(rules)
+	p.applied++
+}
+
+func (p *recordingResourceProvider) numApplied() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.applied
+}
+
+func testConfig() *adaptercfg.MetricsDiscoveryConfig {
+	cfg := utils.DefaultConfig(1*time.Minute, "")
+	cfg.ExternalRules = []adaptercfg.DiscoveryRule{
+		{
+			SeriesQuery:  `{__name__=~"^queue_.*"}`,
+			Name:         adaptercfg.NameMapping{Matches: "^queue_(.*)$"},
+			MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (queue)",
+		},
+	}
+	return cfg
+}
+
+var _ = Describe("Configuration reloading", func() {
+	var (
+		cmd         *PrometheusAdapter
+		cmLister    *fakeLister
+		emLister    *fakeLister
+		resProvider *recordingResourceProvider
+	)
+
+	BeforeEach(func() {
+		cfg := testConfig()
+		prov, err := resprov.NewProvider(prom.Backends{prom.DefaultBackend: &fakeprom.FakePrometheusClient{}}, mapper.NewStatic(), cfg.ResourceRules, nil, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		cmLister = &fakeLister{}
+		emLister = &fakeLister{}
+		resProvider = &recordingResourceProvider{ReloadableMetricsProvider: prov}
+		cmd = &PrometheusAdapter{
+			metricsConfig: cfg,
+			cmLister:      cmLister,
+			emLister:      emLister,
+			resProvider:   resProvider,
+		}
+	})
+
+	It("should apply a valid configuration to every provider", func() {
+		newConfig := testConfig()
+		newConfig.Rules = newConfig.Rules[:1]
+
+		Expect(cmd.applyConfig(newConfig, mapper.NewStatic())).To(Succeed())
+		Expect(cmLister.namers).To(HaveLen(1))
+		Expect(emLister.namers).To(HaveLen(1))
+		Expect(resProvider.numApplied()).To(Equal(1))
+		Expect(cmd.currentConfig()).To(BeIdenticalTo(newConfig))
+	})
+
+	It("should apply nothing if the external rules are invalid", func() {
+		oldConfig := cmd.currentConfig()
+		newConfig := testConfig()
+		newConfig.ExternalRules[0].Name.Matches = "^queue_(.*$"
+
+		Expect(cmd.applyConfig(newConfig, mapper.NewStatic())).NotTo(Succeed())
+		Expect(cmLister.numUpdates()).To(BeZero())
+		Expect(emLister.numUpdates()).To(BeZero())
+		Expect(resProvider.numApplied()).To(BeZero())
+		Expect(cmd.currentConfig()).To(BeIdenticalTo(oldConfig))
+	})
+
+	It("should apply nothing if the resource rules are invalid", func() {
+		oldConfig := cmd.currentConfig()
+		newConfig := testConfig()
+		newConfig.ResourceRules.CPU.ContainerQuery = "sum(<<.Series"
+
+		Expect(cmd.applyConfig(newConfig, mapper.NewStatic())).NotTo(Succeed())
+		Expect(cmLister.numUpdates()).To(BeZero())
+		Expect(emLister.numUpdates()).To(BeZero())
+		Expect(resProvider.numApplied()).To(BeZero())
+		Expect(cmd.currentConfig()).To(BeIdenticalTo(oldConfig))
+	})
+
+	It("should allow the configuration to be read while it's being reloaded", func() {
+		stop := make(chan struct{})
+		var readers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				defer GinkgoRecover()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						Expect(cmd.currentConfig()).NotTo(BeNil())
+					}
+				}
+			}()
+		}
+
+		for i := 0; i < 10; i++ {
+			Expect(cmd.applyConfig(testConfig(), mapper.NewStatic())).To(Succeed())
+		}
+		close(stop)
+		readers.Wait()
+
+		Expect(cmLister.numUpdates()).To(Equal(10))
+		Expect(resProvider.numApplied()).To(Equal(10))
+	})
+})
+
+var _ = Describe("Prometheus clients", func() {
+	var tokenDir string
+
+	BeforeEach(func() {
+		var err error
+		tokenDir, err = ioutil.TempDir("", "adapter-tokens")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tokenDir)).To(Succeed())
+	})
+
+	// tokenServer starts a Prometheus stand-in which records the Authorization
+	// header of each request it receives.
+	tokenServer := func(mu *sync.Mutex, authHeaders *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*authHeaders = append(*authHeaders, r.Header.Get("Authorization"))
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+	}
+
+	It("should only send each backend's bearer token to that backend", func() {
+		var mu sync.Mutex
+		var firstHeaders, secondHeaders []string
+		firstServer := tokenServer(&mu, &firstHeaders)
+		defer firstServer.Close()
+		secondServer := tokenServer(&mu, &secondHeaders)
+		defer secondServer.Close()
+
+		firstTokenFile := filepath.Join(tokenDir, "first")
+		Expect(ioutil.WriteFile(firstTokenFile, []byte("first-token"), 0600)).To(Succeed())
+		secondTokenFile := filepath.Join(tokenDir, "second")
+		Expect(ioutil.WriteFile(secondTokenFile, []byte("second-token"), 0600)).To(Succeed())
+
+		By("constructing clients for two backends with different token files")
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		firstClient, err := makePromClient(adaptercfg.Backend{Name: "first", URL: firstServer.URL, TokenFile: firstTokenFile}, stopCh)
+		Expect(err).NotTo(HaveOccurred())
+		secondClient, err := makePromClient(adaptercfg.Backend{Name: "second", URL: secondServer.URL, TokenFile: secondTokenFile}, stopCh)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("checking that each backend only receives its own token")
+		_, err = firstClient.Query(context.Background(), pmodel.Now(), "up")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = secondClient.Query(context.Background(), pmodel.Now(), "up")
+		Expect(err).NotTo(HaveOccurred())
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(firstHeaders).To(ConsistOf("Bearer first-token"))
+		Expect(secondHeaders).To(ConsistOf("Bearer second-token"))
+
+		By("checking that the shared default client was left alone")
+		Expect(http.DefaultClient.Transport).To(BeNil())
+	})
+})
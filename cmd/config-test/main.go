@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/spf13/cobra"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	cmprov "github.com/directxman12/k8s-prometheus-adapter/pkg/custom-provider"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+func main() {
+	var configFile string
+	var seriesFile string
+	var kubeconfig string
+	var objects []string
+
+	cmd := &cobra.Command{
+		Use:   "config-test",
+		Short: "Show the metrics a config would expose for a set of recorded series",
+		Long: `Show the custom metrics that a discovery config would expose, given
+a set of series recorded from Prometheus, without deploying the adapter.
+The series file should contain the output of Prometheus's /api/v1/series
+endpoint (either the full response, or just the "data" list).  For each
+object passed via --object, the exact query that the adapter would send to
+Prometheus is printed for every metric available on that object.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			if configFile == "" || seriesFile == "" {
+				return fmt.Errorf("both --config and --series must be specified")
+			}
+
+			cfg, err := config.FromFile(configFile)
+			if err != nil {
+				return err
+			}
+			series, err := seriesFromFile(seriesFile)
+			if err != nil {
+				return err
+			}
+			restMapper, err := mapper.NewForKubeconfig(kubeconfig)
+			if err != nil {
+				return err
+			}
+
+			registry, err := registryForSeries(cfg, restMapper, series)
+			if err != nil {
+				return err
+			}
+
+			metrics := registry.ListAllMetrics()
+			sort.Slice(metrics, func(i, j int) bool {
+				return metrics[i].String() < metrics[j].String()
+			})
+			fmt.Println("Metrics:")
+			for _, info := range metrics {
+				fmt.Printf("  %s\n", info)
+			}
+
+			for _, objectRaw := range objects {
+				if err := printQueries(os.Stdout, registry, restMapper, metrics, objectRaw); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&configFile, "config", "c", "",
+		"metrics discovery configuration file to test")
+	cmd.Flags().StringVar(&seriesFile, "series", "",
+		"file containing the series recorded from Prometheus's /api/v1/series endpoint")
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "",
+		"kubeconfig file pointing at a cluster whose resources should be used to resolve resources.  "+
+			"If not specified, only the built-in Kubernetes resources are known")
+	cmd.Flags().StringArrayVar(&objects, "object", nil,
+		"object for which to print the metrics queries, of the form <resource>/<namespace>/<name> "+
+			"for namespaced resources or <resource>/<name> for root-scoped resources (may be repeated)")
+
+	cmd.AddCommand(newUnitCommand())
+
+	// the packages used to load the config log through glog, which complains
+	// about logging before the Go flags have been parsed, and logs to files by
+	// default.  Log to stderr instead, and expose the glog flags (e.g. -v) via cobra.
+	flag.Set("logtostderr", "true")
+	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.Parse([]string{})
+
+	if err := cmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to test config: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// seriesFromFile loads series from the output of Prometheus's /api/v1/series endpoint.
+// Both the full response and just the list of series are accepted.
+func seriesFromFile(filename string) ([]prom.Series, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load series file: %v", err)
+	}
+
+	var series []prom.Series
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &series)
+	} else {
+		var resp prom.APIResponse
+		if err := json.Unmarshal(trimmed, &resp); err != nil {
+			return nil, fmt.Errorf("unable to parse series file: %v", err)
+		}
+		if resp.Status == prom.ResponseError {
+			return nil, fmt.Errorf("series file contains an error response: %s: %s", resp.ErrorType, resp.Error)
+		}
+		err = json.Unmarshal(resp.Data, &series)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse series file: %v", err)
+	}
+
+	return series, nil
+}
+
+// registryForSeries populates a series registry as the adapter would, if Prometheus
+// contained the given series.
+func registryForSeries(cfg *config.MetricsDiscoveryConfig, restMapper apimeta.RESTMapper, series []prom.Series) (cmprov.SeriesRegistry, error) {
+	namers, err := cmprov.NamersFromConfig(cfg, restMapper)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
+	}
+	derived, err := cmprov.DerivedMetricsFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct derived metrics: %v", err)
+	}
+
+	seriesByNamer := make([][]prom.Series, len(namers))
+	for i, namer := range namers {
+		if static := namer.StaticSeries(); static != nil {
+			seriesByNamer[i] = static
+			continue
+		}
+		sel, err := promql.ParseSelector(string(namer.Selector()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse series query %q: %v", namer.Selector(), err)
+		}
+
+		var selected []prom.Series
+		for _, s := range series {
+			if promql.MatchesSeries(sel, s.Name, s.Labels) {
+				selected = append(selected, s)
+			}
+		}
+		seriesByNamer[i] = namer.FilterSeries(selected)
+	}
+
+	registry := cmprov.NewBasicSeriesRegistry(restMapper)
+	registry.SetDerivedMetrics(derived)
+	if err := registry.SetSeries(seriesByNamer, namers); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// printQueries prints the query for each of the given metrics available on the given object.
+func printQueries(out io.Writer, registry cmprov.SeriesRegistry, restMapper apimeta.RESTMapper, metrics []provider.CustomMetricInfo, objectRaw string) error {
+	parts := strings.Split(objectRaw, "/")
+	var resource, namespace, name string
+	switch len(parts) {
+	case 2:
+		resource, name = parts[0], parts[1]
+	case 3:
+		resource, namespace, name = parts[0], parts[1], parts[2]
+	default:
+		return fmt.Errorf("invalid object %q: must be of the form <resource>/<namespace>/<name> or <resource>/<name>", objectRaw)
+	}
+
+	groupResource := schema.ParseGroupResource(resource)
+	normalized, _, err := provider.CustomMetricInfo{GroupResource: groupResource}.Normalized(restMapper)
+	if err != nil {
+		return fmt.Errorf("unable to resolve resource %q: %v", resource, err)
+	}
+
+	fmt.Fprintf(out, "\nQueries for %s:\n", objectRaw)
+	found := false
+	for _, info := range metrics {
+		if info.GroupResource != normalized.GroupResource || info.Namespaced != (namespace != "") {
+			continue
+		}
+		found = true
+
+		query, ok := registry.QueryForMetric(info, namespace, name)
+		if !ok {
+			fmt.Fprintf(out, "  %s: unable to construct query (rerun with -v=10 for details)\n", info.Metric)
+			continue
+		}
+		fmt.Fprintf(out, "  %s: %s\n", info.Metric, query)
+	}
+	if !found {
+		fmt.Fprintf(out, "  (no metrics available)\n")
+	}
+
+	return nil
+}
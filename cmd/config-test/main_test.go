@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+)
+
+const testConfig = `
+rules:
+- seriesQuery: 'http_requests_total{namespace!="",pod!=""}'
+  resources:
+    overrides:
+      namespace: {resource: "namespace"}
+      pod: {resource: "pod"}
+  name:
+    matches: "^(.*)_total$"
+    as: "${1}_per_second"
+  metricsQuery: 'sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)'
+- seriesQuery: 'node_load1'
+  resources:
+    template: "<<.Resource>>"
+  metricsQuery: 'max(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`
+
+var podSeries = prom.Series{Name: "http_requests_total", Labels: pmodel.LabelSet{"namespace": "ns1", "pod": "pod1"}}
+
+type seriesFileTestCase struct {
+	title    string
+	contents string
+
+	expectedSeries []prom.Series
+	expectedErr    string
+}
+
+type printQueriesTestCase struct {
+	title  string
+	object string
+
+	expectedOutput string
+	expectedErr    string
+}
+
+var _ = Describe("config-test", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "config-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("loading series files", func() {
+		testCases := []seriesFileTestCase{
+			{
+				title:          "a full API response",
+				contents:       `{"status": "success", "data": [{"__name__": "http_requests_total", "namespace": "ns1", "pod": "pod1"}]}`,
+				expectedSeries: []prom.Series{podSeries},
+			},
+			{
+				title:          "a bare list of series, with surrounding whitespace",
+				contents:       "\n  [{\"__name__\": \"http_requests_total\", \"namespace\": \"ns1\", \"pod\": \"pod1\"}]\n",
+				expectedSeries: []prom.Series{podSeries},
+			},
+			{
+				title:          "an empty list of series",
+				contents:       `{"status": "success", "data": []}`,
+				expectedSeries: []prom.Series{},
+			},
+			{
+				title:       "an error response",
+				contents:    `{"status": "error", "errorType": "bad_data", "error": "invalid selector"}`,
+				expectedErr: "series file contains an error response: bad_data: invalid selector",
+			},
+			{
+				title:       "invalid JSON",
+				contents:    `{"status": "success", "data": [`,
+				expectedErr: "unable to parse series file",
+			},
+			{
+				title:       "data that isn't a list of series",
+				contents:    `{"status": "success", "data": {"resultType": "vector"}}`,
+				expectedErr: "unable to parse series file",
+			},
+		}
+
+		for _, tc := range testCases {
+			tc := tc // copy to avoid iteration variable issues
+			It(fmt.Sprintf("should handle %s", tc.title), func() {
+				filename := filepath.Join(tmpDir, "series.json")
+				Expect(ioutil.WriteFile(filename, []byte(tc.contents), 0644)).To(Succeed())
+
+				series, err := seriesFromFile(filename)
+				if tc.expectedErr != "" {
+					Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(series).To(Equal(tc.expectedSeries))
+			})
+		}
+
+		It("should fail on a missing file", func() {
+			_, err := seriesFromFile(filepath.Join(tmpDir, "missing.json"))
+			Expect(err).To(MatchError(ContainSubstring("unable to load series file")))
+		})
+	})
+
+	Describe("printing queries", func() {
+		testCases := []printQueriesTestCase{
+			{
+				title:  "a namespaced object",
+				object: "pods/ns1/pod1",
+				expectedOutput: "\nQueries for pods/ns1/pod1:\n" +
+					"  http_requests_per_second: sum by(pod) (rate(http_requests_total{namespace=\"ns1\",pod=\"pod1\"}[2m]))\n",
+			},
+			{
+				title:  "a root-scoped object",
+				object: "nodes/node1",
+				expectedOutput: "\nQueries for nodes/node1:\n" +
+					"  node_load1: max by(node) (node_load1{node=\"node1\"})\n",
+			},
+			{
+				title:  "an object with no metrics",
+				object: "services/ns1/svc1",
+				expectedOutput: "\nQueries for services/ns1/svc1:\n" +
+					"  (no metrics available)\n",
+			},
+			{
+				title:  "a namespaced resource given without a namespace",
+				object: "pods/pod1",
+				expectedOutput: "\nQueries for pods/pod1:\n" +
+					"  (no metrics available)\n",
+			},
+			{
+				title:       "a malformed object",
+				object:      "pods/ns1/pod1/extra",
+				expectedErr: "invalid object \"pods/ns1/pod1/extra\"",
+			},
+			{
+				title:       "an unknown resource",
+				object:      "widgets/ns1/widget1",
+				expectedErr: "unable to resolve resource \"widgets\"",
+			},
+		}
+
+		for _, tc := range testCases {
+			tc := tc // copy to avoid iteration variable issues
+			It(fmt.Sprintf("should handle %s", tc.title), func() {
+				cfg, err := config.FromYAML([]byte(testConfig))
+				Expect(err).NotTo(HaveOccurred())
+				restMapper := mapper.NewStatic()
+
+				registry, err := registryForSeries(cfg, restMapper, []prom.Series{
+					podSeries,
+					{Name: "node_load1", Labels: pmodel.LabelSet{"node": "node1"}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var out bytes.Buffer
+				err = printQueries(&out, registry, restMapper, registry.ListAllMetrics(), tc.object)
+				if tc.expectedErr != "" {
+					Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+					return
+				}
+				Expect(err).NotTo(HaveOccurred())
+				Expect(out.String()).To(Equal(tc.expectedOutput))
+			})
+		}
+	})
+})
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/ruletest"
+)
+
+// newUnitCommand constructs the command that runs declarative unit tests for configs.
+func newUnitCommand() *cobra.Command {
+	var kubeconfig string
+
+	cmd := &cobra.Command{
+		Use:   "unit TEST_FILE...",
+		Short: "Run unit tests for a config against series described in test files",
+		Long: `Run unit tests for a discovery config.  Each test file references the
+config under test, and describes input series (along with their samples),
+the custom metrics that should be discovered from those series, and the
+values that the adapter should return for particular objects.  Queries are
+evaluated against an in-memory Prometheus, so no cluster or Prometheus is
+required.`,
+		Args:          cobra.MinimumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(c *cobra.Command, args []string) error {
+			restMapper, err := mapper.NewForKubeconfig(kubeconfig)
+			if err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, filename := range args {
+				testFile, err := ruletest.FromFile(filename)
+				if err != nil {
+					return err
+				}
+				results, err := ruletest.Run(testFile, restMapper)
+				if err != nil {
+					return fmt.Errorf("unable to run tests in %s: %v", filename, err)
+				}
+
+				for _, result := range results {
+					if result.Passed() {
+						fmt.Printf("PASS: %s: %s\n", filename, result.Name)
+						continue
+					}
+					failed++
+					fmt.Printf("FAIL: %s: %s\n", filename, result.Name)
+					for _, failure := range result.Failures {
+						fmt.Printf("    %s\n", failure)
+					}
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d test(s) failed", failed)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "",
+		"kubeconfig file pointing at a cluster whose resources should be used to resolve resources.  "+
+			"If not specified, only the built-in Kubernetes resources are known")
+
+	return cmd
+}
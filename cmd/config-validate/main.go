@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/directxman12/k8s-prometheus-adapter/cmd/config-validate/validation"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+)
+
+func main() {
+	var kubeconfig string
+	var strict bool
+
+	cmd := &cobra.Command{
+		Use:   "config-validate CONFIG_FILE",
+		Short: "Check a metrics discovery config for problems",
+		Long: `Check a metrics discovery config for problems without running the adapter.
+This loads the config the same way the adapter does, checks that the series
+queries and rendered metrics queries are valid PromQL, that the 'as' name
+templates only refer to capture groups that exist, and that no two rules can
+match the same series.  Problems are reported along with the index of the rule
+and the line at which it starts.  By default, the built-in Kubernetes resources
+are used to resolve resource overrides; pass --kubeconfig to use the resources
+available in a live cluster instead.`,
+		Args: cobra.ExactArgs(1),
+		// problems are reported individually, so don't bury them under the usage text
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(c *cobra.Command, args []string) error {
+			filename := args[0]
+			cfg, err := config.FromFile(filename)
+			if err != nil {
+				return err
+			}
+			contents, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("unable to load metrics discovery config file: %v", err)
+			}
+
+			restMapper, err := mapper.NewForKubeconfig(kubeconfig)
+			if err != nil {
+				return err
+			}
+
+			problems := validation.Validate(cfg, restMapper, validation.FindRuleLines(contents))
+			numErrors, numWarnings := 0, 0
+			for _, problem := range problems {
+				fmt.Printf("%s: %s\n", filename, problem)
+				if problem.Severity == validation.SeverityError {
+					numErrors++
+				} else {
+					numWarnings++
+				}
+			}
+
+			if numErrors > 0 || (strict && numWarnings > 0) {
+				return fmt.Errorf("found %d error(s) and %d warning(s)", numErrors, numWarnings)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "",
+		"kubeconfig file pointing at a cluster whose resources should be used to resolve resource overrides.  "+
+			"If not specified, only the built-in Kubernetes resources are known")
+	cmd.Flags().BoolVar(&strict, "strict", false,
+		"treat warnings (such as overlapping rules) as errors")
+
+	// the packages used to load the config log through glog, which complains
+	// about logging before the Go flags have been parsed, and logs to files by
+	// default.  Log to stderr instead, and expose the glog flags (e.g. -v) via cobra.
+	flag.Set("logtostderr", "true")
+	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	flag.CommandLine.Parse([]string{})
+
+	if err := cmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(1)
+	}
+}
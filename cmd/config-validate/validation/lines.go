@@ -0,0 +1,80 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// RuleLines records the (1-indexed) line numbers at which each top-level
+// section (e.g. "rules" or "externalRules") and each rule in those sections
+// start in the original YAML.
+type RuleLines struct {
+	sections map[string]int
+	items    map[string][]int
+}
+
+// LineFor returns the line number of the given rule in the given section
+// (or of the section itself, if index is negative), or 0 if unknown.
+func (l *RuleLines) LineFor(section string, index int) int {
+	if l == nil {
+		return 0
+	}
+	if index < 0 {
+		return l.sections[section]
+	}
+	lines := l.items[section]
+	if index >= len(lines) {
+		return 0
+	}
+	return lines[index]
+}
+
+// FindRuleLines locates the start of each list item in the top-level rule
+// sections of the given YAML document.  It only understands block-style lists,
+// which is what both config-gen and hand-written configs use.  Other layouts
+// just result in missing line numbers.
+func FindRuleLines(contents []byte) *RuleLines {
+	res := &RuleLines{
+		sections: make(map[string]int),
+		items:    make(map[string][]int),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNum := 0
+	section := ""
+	itemIndent := -1
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			// a new top-level key
+			section = ""
+			itemIndent = -1
+			if colon := strings.Index(trimmed, ":"); colon > 0 {
+				section = strings.TrimSpace(trimmed[:colon])
+				res.sections[section] = lineNum
+			}
+			continue
+		}
+		if section == "" || (trimmed != "-" && !strings.HasPrefix(trimmed, "- ")) {
+			continue
+		}
+
+		// the first list item determines the indentation of the rest
+		if itemIndent == -1 {
+			itemIndent = indent
+		}
+		if indent == itemIndent {
+			res.items[section] = append(res.items[section], lineNum)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,331 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxOverlapStates bounds the number of states explored when checking whether
+// two rules overlap, so that pathological regular expressions can't hang the check.
+const maxOverlapStates = 10000
+
+// metricNameAlphabet contains every character that may appear in a metric name.
+var metricNameAlphabet = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_:")
+
+// validMetricName matches any valid metric name.
+var validMetricName = mustNameConstraint(`[a-zA-Z_:][a-zA-Z0-9_:]*`, true, false)
+
+// nameConstraint restricts the set of series names accepted by a rule.
+type nameConstraint struct {
+	prog *syntax.Prog
+	// negated indicates that names matched by prog are rejected, instead of accepted.
+	negated bool
+
+	// closures memoizes the results of closure
+	closures map[closureKey][]uint32
+}
+
+type closureKey struct {
+	pcs           string
+	before, after rune
+}
+
+// newNameConstraint compiles a constraint from the given regular expression.
+// Anchored expressions must match the whole name (as in PromQL), while unanchored
+// expressions may match any part of the name (as in series filters).
+func newNameConstraint(expr string, anchored bool, negated bool) (*nameConstraint, error) {
+	if anchored {
+		expr = "^(?:" + expr + ")$"
+	} else {
+		expr = "(?s:.*)(?:" + expr + ")(?s:.*)"
+	}
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	return &nameConstraint{
+		prog:     prog,
+		negated:  negated,
+		closures: make(map[closureKey][]uint32),
+	}, nil
+}
+
+func mustNameConstraint(expr string, anchored bool, negated bool) *nameConstraint {
+	constraint, err := newNameConstraint(expr, anchored, negated)
+	if err != nil {
+		panic(err)
+	}
+	return constraint
+}
+
+// nameConstraintsForRule produces the constraints on the series names accepted by a rule,
+// combining the series query, the series filters, and the name matcher.
+func nameConstraintsForRule(rule config.DiscoveryRule, sel *parser.VectorSelector) ([]*nameConstraint, error) {
+	var constraints []*nameConstraint
+	add := func(expr string, anchored, negated bool) error {
+		constraint, err := newNameConstraint(expr, anchored, negated)
+		if err != nil {
+			return fmt.Errorf("unable to compile %q: %v", expr, err)
+		}
+		constraints = append(constraints, constraint)
+		return nil
+	}
+
+	// the metric name is always among the matchers, even when it's given outside of the braces
+	for _, matcher := range sel.LabelMatchers {
+		if matcher.Name != pmodel.MetricNameLabel {
+			continue
+		}
+		var err error
+		switch matcher.Type {
+		case plabels.MatchEqual:
+			err = add(regexp.QuoteMeta(matcher.Value), true, false)
+		case plabels.MatchNotEqual:
+			err = add(regexp.QuoteMeta(matcher.Value), true, true)
+		case plabels.MatchRegexp:
+			err = add(matcher.Value, true, false)
+		case plabels.MatchNotRegexp:
+			err = add(matcher.Value, true, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, filter := range rule.SeriesFilters {
+		var err error
+		if filter.Is != "" {
+			err = add(filter.Is, false, false)
+		} else {
+			err = add(filter.IsNot, false, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.Name.Matches != "" {
+		if err := add(rule.Name.Matches, false, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return constraints, nil
+}
+
+// labelsConflict checks if the non-name label matchers of the two selectors
+// obviously can't both match the same series (e.g. `a="x"` and `a="y"`).
+func labelsConflict(a, b *parser.VectorSelector) bool {
+	for _, matcherA := range a.LabelMatchers {
+		if matcherA.Name == pmodel.MetricNameLabel {
+			continue
+		}
+		for _, matcherB := range b.LabelMatchers {
+			if matcherA.Name != matcherB.Name {
+				continue
+			}
+			if matchersConflict(matcherA, matcherB) || matchersConflict(matcherB, matcherA) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchersConflict(a, b *plabels.Matcher) bool {
+	if a.Type != plabels.MatchEqual {
+		return false
+	}
+	switch b.Type {
+	case plabels.MatchEqual:
+		return a.Value != b.Value
+	case plabels.MatchNotEqual:
+		return a.Value == b.Value
+	}
+	return false
+}
+
+// findCommonName searches for a valid metric name accepted by all of the given
+// constraints, returning the shortest such name.  If the search space is too large
+// to be fully explored, an error is returned.
+func findCommonName(constraints []*nameConstraint) (string, bool, error) {
+	constraints = append([]*nameConstraint{validMetricName}, constraints...)
+
+	type state struct {
+		pcs    [][]uint32
+		before rune
+		name   string
+	}
+
+	start := state{pcs: make([][]uint32, len(constraints)), before: -1}
+	for i, constraint := range constraints {
+		start.pcs[i] = []uint32{uint32(constraint.prog.Start)}
+	}
+
+	seen := map[string]bool{stateKey(start.pcs, start.before): true}
+	queue := []state{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if acceptsAll(constraints, current.pcs, current.before) {
+			return current.name, true, nil
+		}
+
+	NextRune:
+		for _, r := range metricNameAlphabet {
+			next := state{pcs: make([][]uint32, len(constraints)), before: r, name: current.name + string(r)}
+			for i, constraint := range constraints {
+				next.pcs[i] = constraint.step(current.pcs[i], current.before, r)
+				// positive constraints that can't match anymore will never accept
+				if len(next.pcs[i]) == 0 && !constraint.negated {
+					continue NextRune
+				}
+			}
+
+			key := stateKey(next.pcs, next.before)
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= maxOverlapStates {
+				return "", false, fmt.Errorf("the expressions are too complex to check")
+			}
+			seen[key] = true
+			queue = append(queue, next)
+		}
+	}
+
+	return "", false, nil
+}
+
+func acceptsAll(constraints []*nameConstraint, pcs [][]uint32, before rune) bool {
+	for i, constraint := range constraints {
+		if constraint.accepts(pcs[i], before) == constraint.negated {
+			return false
+		}
+	}
+	return true
+}
+
+// step computes the set of instructions reached after consuming r.
+func (c *nameConstraint) step(pcs []uint32, before rune, r rune) []uint32 {
+	var next []uint32
+	for _, pc := range c.closure(pcs, before, r) {
+		inst := &c.prog.Inst[pc]
+		matches := false
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1:
+			matches = inst.MatchRune(r)
+		case syntax.InstRuneAny:
+			matches = true
+		case syntax.InstRuneAnyNotNL:
+			matches = r != '\n'
+		}
+		if matches {
+			next = append(next, inst.Out)
+		}
+	}
+	return sortedUnique(next)
+}
+
+// accepts checks if the given set of instructions matches at the end of the input.
+func (c *nameConstraint) accepts(pcs []uint32, before rune) bool {
+	for _, pc := range c.closure(pcs, before, -1) {
+		if c.prog.Inst[pc].Op == syntax.InstMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// closure follows all empty transitions from the given instructions, returning the
+// instructions that consume input (or match).
+func (c *nameConstraint) closure(pcs []uint32, before, after rune) []uint32 {
+	key := closureKey{pcs: pcsKey(pcs), before: wordClass(before), after: wordClass(after)}
+	if res, cached := c.closures[key]; cached {
+		return res
+	}
+
+	var res []uint32
+	visited := make(map[uint32]bool)
+	stack := append([]uint32(nil), pcs...)
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[pc] {
+			continue
+		}
+		visited[pc] = true
+
+		inst := &c.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			if inst.MatchEmptyWidth(before, after) {
+				stack = append(stack, inst.Out)
+			}
+		case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			res = append(res, pc)
+		}
+	}
+
+	res = sortedUnique(res)
+	c.closures[key] = res
+	return res
+}
+
+// wordClass maps a rune to a representative rune with the same behavior for
+// empty-width assertions, so that closures can be shared between runes.
+func wordClass(r rune) rune {
+	switch {
+	case r == -1 || r == '\n':
+		return r
+	case syntax.IsWordChar(r):
+		return 'a'
+	default:
+		return ':'
+	}
+}
+
+func sortedUnique(pcs []uint32) []uint32 {
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	res := pcs[:0]
+	for i, pc := range pcs {
+		if i == 0 || pc != pcs[i-1] {
+			res = append(res, pc)
+		}
+	}
+	return res
+}
+
+func pcsKey(pcs []uint32) string {
+	parts := make([]string, len(pcs))
+	for i, pc := range pcs {
+		parts[i] = fmt.Sprint(pc)
+	}
+	return strings.Join(parts, ",")
+}
+
+func stateKey(pcs [][]uint32, before rune) string {
+	parts := make([]string, len(pcs)+1)
+	parts[0] = string(wordClass(before))
+	for i, set := range pcs {
+		parts[i+1] = pcsKey(set)
+	}
+	return strings.Join(parts, "|")
+}
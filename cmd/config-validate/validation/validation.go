@@ -0,0 +1,503 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	provider "github.com/directxman12/k8s-prometheus-adapter/pkg/custom-provider"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+const (
+	// exampleSeries, exampleNamespace, and exampleName are used to render
+	// query templates so that the results can be checked.
+	exampleSeries    = "example_series"
+	exampleNamespace = "example-namespace"
+	exampleName      = "example-name"
+)
+
+var (
+	nsGroupResource   = schema.GroupResource{Resource: "namespaces"}
+	podGroupResource  = schema.GroupResource{Resource: "pods"}
+	nodeGroupResource = schema.GroupResource{Resource: "nodes"}
+)
+
+// Severity indicates how serious a problem is.
+type Severity string
+
+const (
+	// SeverityError indicates that the adapter will reject the config,
+	// or that part of the config can never work.
+	SeverityError Severity = "error"
+	// SeverityWarning indicates that the adapter will accept the config,
+	// but that it probably doesn't do what was intended.
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is a single problem found in a config.
+type Problem struct {
+	Severity Severity
+	// Section is the config section containing the problem (e.g. "rules").
+	Section string
+	// Index is the index of the offending rule in the section, or -1
+	// if the problem applies to the whole section.
+	Index int
+	// Line is the line in the config file at which the offending rule
+	// (or section) starts, or 0 if unknown.
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	location := p.Section
+	if p.Index >= 0 {
+		location = fmt.Sprintf("%s[%d]", p.Section, p.Index)
+	}
+	if p.Line > 0 {
+		location = fmt.Sprintf("%s (line %d)", location, p.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, p.Severity, p.Message)
+}
+
+// Validate checks the given config for problems, using the given RESTMapper to
+// resolve resources, and the given line information to locate problems in the
+// original file.
+func Validate(cfg *config.MetricsDiscoveryConfig, mapper apimeta.RESTMapper, lines *RuleLines) []Problem {
+	v := &validator{
+		mapper: mapper,
+		lines:  lines,
+	}
+
+	v.validateBackends(cfg.Backends)
+	v.validateGlobalLabelMatchers(cfg.GlobalLabelMatchers)
+	v.validateRules("rules", cfg.Rules, false)
+	v.validateRules("externalRules", cfg.ExternalRules, true)
+	if cfg.ResourceRules != nil {
+		v.validateResourceRules(cfg.ResourceRules)
+	}
+	v.validateStaticMetrics(cfg.StaticMetrics)
+	v.validateDerivedMetrics(cfg.DerivedMetrics)
+
+	return v.problems
+}
+
+type validator struct {
+	mapper   apimeta.RESTMapper
+	lines    *RuleLines
+	problems []Problem
+
+	// backends holds the names of the configured Prometheus backends.
+	backends map[string]bool
+}
+
+func (v *validator) report(severity Severity, section string, index int, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Severity: severity,
+		Section:  section,
+		Index:    index,
+		Line:     v.lines.LineFor(section, index),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// validateBackends checks the configured Prometheus backends, and records
+// their names so that rules can be checked against them.
+func (v *validator) validateBackends(backends []config.Backend) {
+	v.backends = map[string]bool{prom.DefaultBackend: true}
+	for i, backend := range backends {
+		switch {
+		case backend.Name == "":
+			v.report(SeverityError, "backends", i, "name must be specified")
+		case backend.Name == prom.DefaultBackend:
+			v.report(SeverityError, "backends", i, "name %q is reserved for the backend given by --prometheus-url", backend.Name)
+		case v.backends[backend.Name]:
+			v.report(SeverityError, "backends", i, "duplicate backend name %q", backend.Name)
+		default:
+			v.backends[backend.Name] = true
+		}
+		if backend.URL == "" {
+			v.report(SeverityError, "backends", i, "url must be specified")
+		}
+	}
+}
+
+// validateGlobalLabelMatchers checks that each global label matcher is a single
+// valid PromQL label matcher.
+func (v *validator) validateGlobalLabelMatchers(matchers []string) {
+	for i, matcher := range matchers {
+		if _, err := naming.ParseLabelMatchers([]string{matcher}); err != nil {
+			v.report(SeverityError, "globalLabelMatchers", i, "%v", err)
+		}
+	}
+}
+
+// checkBackend checks that the named backend exists.  An empty name refers
+// to the default backend.
+func (v *validator) checkBackend(name string) error {
+	if name != "" && !v.backends[name] {
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	return nil
+}
+
+// validateStaticMetrics checks each static metric, rendering its metrics query
+// for the first of its resources.
+func (v *validator) validateStaticMetrics(metrics []config.StaticMetric) {
+	for i, metric := range metrics {
+		errorf := func(format string, args ...interface{}) {
+			v.report(SeverityError, "staticMetrics", i, format, args...)
+		}
+
+		if err := v.checkBackend(metric.Backend); err != nil {
+			errorf("%v", err)
+		}
+		if metric.MetricsQuery == "" {
+			errorf("metricsQuery must be specified")
+			continue
+		}
+		namer, err := provider.NamerFromStaticMetric(metric, v.mapper)
+		if err != nil {
+			errorf("%v", err)
+			continue
+		}
+
+		series := namer.StaticSeries()[0]
+		resources, namespaced := namer.ResourcesForSeries(series)
+		namespace := ""
+		if namespaced && resources[0] != nsGroupResource {
+			namespace = exampleNamespace
+		}
+		if _, err := namer.QueryForSeries(series.Name, resources[0], namespace, exampleName); err != nil {
+			errorf("unable to render metricsQuery %q: %v", metric.MetricsQuery, err)
+		}
+	}
+}
+
+// validateDerivedMetrics checks each derived metric, and that derived metrics
+// only refer to discovered metrics.
+func (v *validator) validateDerivedMetrics(derivedMetrics []config.DerivedMetric) {
+	names := make(map[string]bool, len(derivedMetrics))
+	for i, derivedCfg := range derivedMetrics {
+		if names[derivedCfg.Name] {
+			v.report(SeverityError, "derivedMetrics", i, "duplicate derived metric %q", derivedCfg.Name)
+		}
+		names[derivedCfg.Name] = true
+	}
+
+	for i, derivedCfg := range derivedMetrics {
+		derived, err := provider.DerivedMetricFromConfig(derivedCfg)
+		if err != nil {
+			v.report(SeverityError, "derivedMetrics", i, "%v", err)
+			continue
+		}
+		for _, metric := range derived.Metrics {
+			if names[metric] {
+				v.report(SeverityError, "derivedMetrics", i, "may not refer to another derived metric (%q)", metric)
+			}
+		}
+	}
+}
+
+// checkedRule holds the information needed to check a rule for overlaps with other rules.
+type checkedRule struct {
+	index       int
+	selector    *parser.VectorSelector
+	constraints []*nameConstraint
+}
+
+func (v *validator) validateRules(section string, rules []config.DiscoveryRule, external bool) {
+	var checked []checkedRule
+	for i, rule := range rules {
+		if res, ok := v.validateRule(section, i, rule, external); ok {
+			checked = append(checked, res)
+		}
+	}
+
+	for j := range checked {
+		for i := 0; i < j; i++ {
+			v.checkOverlap(section, checked[i], checked[j])
+		}
+	}
+}
+
+// validateRule checks a single discovery rule, returning information for checking
+// overlaps if the rule is otherwise valid.
+func (v *validator) validateRule(section string, index int, rule config.DiscoveryRule, external bool) (checkedRule, bool) {
+	errorf := func(format string, args ...interface{}) {
+		v.report(SeverityError, section, index, format, args...)
+	}
+
+	valid := true
+	if err := v.checkBackend(rule.Backend); err != nil {
+		errorf("%v", err)
+		valid = false
+	}
+	if rule.SeriesQuery == "" {
+		errorf("seriesQuery must be specified")
+		return checkedRule{}, false
+	}
+	sel, err := promql.ParseSelector(rule.SeriesQuery)
+	if err != nil {
+		errorf("invalid seriesQuery %q: %v", rule.SeriesQuery, err)
+		valid = false
+	}
+
+	namer, err := provider.NamerFromRule(rule, v.mapper)
+	if err != nil {
+		errorf("%v", err)
+		return checkedRule{}, false
+	}
+
+	for _, msg := range checkNameAs(rule.Name) {
+		errorf("%s", msg)
+		valid = false
+	}
+
+	if rule.MetricsQuery == "" {
+		errorf("metricsQuery must be specified")
+		valid = false
+	} else if _, err := v.renderRuleQuery(namer, rule, external); err != nil {
+		errorf("unable to render metricsQuery %q: %v", rule.MetricsQuery, err)
+		valid = false
+	}
+
+	if rule.OwnerRollup != nil && external {
+		errorf("ownerRollup may not be used for external rules")
+		valid = false
+	}
+	if rule.SelectorJoin != nil {
+		if external {
+			errorf("selectorJoin may not be used for external rules")
+			valid = false
+		} else if query, err := v.renderSelectorJoinQuery(namer, rule); err != nil {
+			errorf("unable to render selector join: %v", err)
+			valid = false
+		} else if _, err := parser.ParseExpr(string(query)); err != nil {
+			errorf("selectorJoin renders to invalid PromQL %q: %v", query, err)
+			valid = false
+		}
+	}
+
+	if !valid {
+		return checkedRule{}, false
+	}
+
+	constraints, err := nameConstraintsForRule(rule, sel)
+	if err != nil {
+		errorf("unable to check for overlapping rules: %v", err)
+		return checkedRule{}, false
+	}
+	return checkedRule{index: index, selector: sel, constraints: constraints}, true
+}
+
+// renderRuleQuery renders the rule's metrics query with example arguments.  For
+// custom metrics rules, one of the resources associated with the rule is used.
+func (v *validator) renderRuleQuery(namer provider.MetricNamer, rule config.DiscoveryRule, external bool) (prom.Selector, error) {
+	namespace := ""
+	if _, err := namer.LabelForResource(nsGroupResource); err == nil {
+		namespace = exampleNamespace
+	}
+
+	if external {
+		return namer.QueryForExternalSeries(exampleSeries, namespace, labels.Everything())
+	}
+
+	resource, found := exampleResource(namer, rule)
+	if !found {
+		return "", fmt.Errorf("the rule doesn't associate series with any resources")
+	}
+	if resource == nsGroupResource {
+		return namer.QueryForSeries(exampleSeries, resource, "", exampleNamespace)
+	}
+	return namer.QueryForSeries(exampleSeries, resource, namespace, exampleName)
+}
+
+// renderSelectorJoinQuery renders the rule's metrics query, joined against the
+// series carrying object labels, with example arguments.
+func (v *validator) renderSelectorJoinQuery(namer provider.MetricNamer, rule config.DiscoveryRule) (prom.Selector, error) {
+	resource, found := exampleResource(namer, rule)
+	if !found {
+		return "", fmt.Errorf("the rule doesn't associate series with any resources")
+	}
+	namespace := ""
+	if _, err := namer.LabelForResource(nsGroupResource); err == nil && resource != nsGroupResource {
+		namespace = exampleNamespace
+	}
+	return namer.QueryForObjectSelector(exampleSeries, resource, namespace, labels.SelectorFromSet(labels.Set{"app": "example"}))
+}
+
+// exampleResource picks a resource that the given rule could associate series with,
+// preferring resources other than namespaces.
+func exampleResource(namer provider.MetricNamer, rule config.DiscoveryRule) (schema.GroupResource, bool) {
+	if rule.Resources.Template != "" {
+		return podGroupResource, true
+	}
+
+	overrideLabels := make([]string, 0, len(rule.Resources.Overrides))
+	for lbl := range rule.Resources.Overrides {
+		overrideLabels = append(overrideLabels, lbl)
+	}
+	sort.Strings(overrideLabels)
+
+	found := false
+	for _, lbl := range overrideLabels {
+		resources, _ := namer.ResourcesForSeries(prom.Series{
+			Name:   exampleSeries,
+			Labels: pmodel.LabelSet{pmodel.LabelName(lbl): exampleName},
+		})
+		for _, resource := range resources {
+			if resource != nsGroupResource {
+				return resource, true
+			}
+			found = true
+		}
+	}
+
+	return nsGroupResource, found
+}
+
+// asTemplateRef matches a reference to a capture group in a regexp expansion template.
+var asTemplateRef = regexp.MustCompile(`\$(?:\$|\{([^}]*)\}|([a-zA-Z0-9_]*))`)
+
+// checkNameAs checks that every capture group referenced by the `as` template exists
+// in the `matches` regular expression.
+func checkNameAs(name config.NameMapping) []string {
+	if name.As == "" {
+		return nil
+	}
+	matchesRaw := name.Matches
+	if matchesRaw == "" {
+		matchesRaw = ".*"
+	}
+	matches, err := regexp.Compile(matchesRaw)
+	if err != nil {
+		// reported elsewhere
+		return nil
+	}
+
+	knownNames := make(map[string]bool)
+	for _, subexpName := range matches.SubexpNames() {
+		if subexpName != "" {
+			knownNames[subexpName] = true
+		}
+	}
+
+	var msgs []string
+	for _, ref := range asTemplateRef.FindAllStringSubmatch(name.As, -1) {
+		if ref[0] == "$$" {
+			continue
+		}
+		refName := ref[1] + ref[2]
+		if refName == "" {
+			msgs = append(msgs, fmt.Sprintf("`as` template %q contains a '$' that doesn't refer to a capture group (use '$$' for a literal '$')", name.As))
+			continue
+		}
+
+		if num, err := strconv.Atoi(refName); err == nil {
+			if num > matches.NumSubexp() {
+				msgs = append(msgs, fmt.Sprintf("`as` template %q refers to capture group %d, but %q only has %d capture group(s)", name.As, num, matchesRaw, matches.NumSubexp()))
+			}
+			continue
+		}
+		if knownNames[refName] {
+			continue
+		}
+		if refName[0] >= '0' && refName[0] <= '9' && ref[2] != "" {
+			msgs = append(msgs, fmt.Sprintf("`as` template %q refers to capture group %q, which doesn't exist in %q (use braces, as in \"${1}_suffix\", to separate a numbered group from the text following it)", name.As, refName, matchesRaw))
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("`as` template %q refers to capture group %q, which doesn't exist in %q", name.As, refName, matchesRaw))
+	}
+
+	return msgs
+}
+
+// checkOverlap warns if any series name could be matched by both rules.
+func (v *validator) checkOverlap(section string, first, second checkedRule) {
+	if labelsConflict(first.selector, second.selector) {
+		return
+	}
+
+	constraints := append(append([]*nameConstraint(nil), first.constraints...), second.constraints...)
+	name, overlaps, err := findCommonName(constraints)
+	firstDesc := fmt.Sprintf("%s[%d]", section, first.index)
+	if line := v.lines.LineFor(section, first.index); line > 0 {
+		firstDesc = fmt.Sprintf("%s (line %d)", firstDesc, line)
+	}
+	if err != nil {
+		v.report(SeverityWarning, section, second.index, "unable to check for overlap with %s: %v", firstDesc, err)
+		return
+	}
+	if overlaps {
+		v.report(SeverityWarning, section, second.index, "rule overlaps with %s (both match series named %q); rules must be mutually exclusive", firstDesc, name)
+	}
+}
+
+func (v *validator) validateResourceRules(rules *config.ResourceRules) {
+	errorf := func(format string, args ...interface{}) {
+		v.report(SeverityError, "resourceRules", -1, format, args...)
+	}
+
+	for _, res := range []struct {
+		name string
+		rule config.ResourceRule
+	}{
+		{name: "cpu", rule: rules.CPU},
+		{name: "memory", rule: rules.Memory},
+	} {
+		if err := v.checkBackend(res.rule.Backend); err != nil {
+			errorf("invalid %s backend: %v", res.name, err)
+		}
+
+		converter, err := naming.NewResourceConverter(res.rule.Resources.Template, res.rule.Resources.Overrides, v.mapper)
+		if err != nil {
+			errorf("invalid %s resources: %v", res.name, err)
+			continue
+		}
+
+		v.validateResourceQuery(res.name, "containerQuery", res.rule.ContainerQuery, converter, func(query naming.MetricsQuery) (prom.Selector, error) {
+			return query.Build("", podGroupResource, exampleNamespace, []string{res.rule.ContainerLabel}, exampleName)
+		})
+		v.validateResourceQuery(res.name, "nodeQuery", res.rule.NodeQuery, converter, func(query naming.MetricsQuery) (prom.Selector, error) {
+			return query.Build("", nodeGroupResource, "", nil, exampleName)
+		})
+
+		if res.rule.ContainerLabel == "" {
+			errorf("%s containerLabel must be specified", res.name)
+		}
+	}
+
+	if rules.Window == 0 {
+		v.report(SeverityWarning, "resourceRules", -1, "window is not set, so resource metrics will be reported with a zero-length window")
+	}
+}
+
+func (v *validator) validateResourceQuery(resourceName, queryName, queryTemplate string, converter naming.ResourceConverter, build func(naming.MetricsQuery) (prom.Selector, error)) {
+	errorf := func(format string, args ...interface{}) {
+		v.report(SeverityError, "resourceRules", -1, format, args...)
+	}
+
+	if queryTemplate == "" {
+		errorf("%s %s must be specified", resourceName, queryName)
+		return
+	}
+	query, err := naming.NewMetricsQuery(queryTemplate, converter)
+	if err != nil {
+		errorf("%s %s is invalid: %v", resourceName, queryName, err)
+		return
+	}
+	if _, err := build(query); err != nil {
+		errorf("unable to render %s %s %q: %v", resourceName, queryName, queryTemplate, err)
+	}
+}
@@ -0,0 +1,248 @@
+package validation
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/directxman12/k8s-prometheus-adapter/cmd/config-gen/utils"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+)
+
+const overlappingConfig = `rules:
+# all http metrics
+- seriesQuery: '{__name__=~"^http_.*",namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  name:
+    matches: "^(.*)_total$"
+    as: "${1}_per_second"
+  metricsQuery: 'sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)'
+
+# request metrics
+- seriesQuery: '{namespace!="",__name__!~"^container_.*"}'
+  seriesFilters:
+  - isNot: "_seconds_total$"
+  resources:
+    template: <<.Resource>>
+  name:
+    matches: "^(.*)_requests_total$"
+  metricsQuery: 'sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)'
+
+# node metrics, split by job
+- seriesQuery: '{__name__="bar",job="a"}'
+  resources:
+    overrides:
+      node: {resource: "nodes"}
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+- seriesQuery: '{__name__="bar",job="b"}'
+  resources:
+    overrides:
+      node: {resource: "nodes"}
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`
+
+func validateYAML(contents string) []Problem {
+	cfg, err := config.FromYAML([]byte(contents))
+	Expect(err).NotTo(HaveOccurred())
+	return Validate(cfg, mapper.NewStatic(), FindRuleLines([]byte(contents)))
+}
+
+var _ = Describe("Config Validation", func() {
+	It("should not report any problems with the default config", func() {
+		cfg := utils.DefaultConfig(1*time.Minute, "kube_")
+		Expect(Validate(cfg, mapper.NewStatic(), nil)).To(BeEmpty())
+	})
+
+	It("should find the line at which each rule starts", func() {
+		lines := FindRuleLines([]byte(overlappingConfig))
+		Expect(lines.LineFor("rules", -1)).To(Equal(1))
+		Expect(lines.LineFor("rules", 0)).To(Equal(3))
+		Expect(lines.LineFor("rules", 1)).To(Equal(12))
+		Expect(lines.LineFor("rules", 3)).To(Equal(27))
+		Expect(lines.LineFor("rules", 4)).To(Equal(0))
+		Expect(lines.LineFor("externalRules", 0)).To(Equal(0))
+	})
+
+	It("should warn about rules that match the same series, with an example series", func() {
+		problems := validateYAML(overlappingConfig)
+		Expect(problems).To(ConsistOf(Problem{
+			Severity: SeverityWarning,
+			Section:  "rules",
+			Index:    1,
+			Line:     12,
+			Message:  `rule overlaps with rules[0] (line 3) (both match series named "http_requests_total"); rules must be mutually exclusive`,
+		}))
+	})
+
+	It("should report references to missing capture groups in name templates", func() {
+		Expect(checkNameAs(config.NameMapping{Matches: "^(.*)_total$", As: "${1}_per_second"})).To(BeEmpty())
+		Expect(checkNameAs(config.NameMapping{Matches: "^(?P<base>.*)_total$", As: "$base$$"})).To(BeEmpty())
+
+		Expect(checkNameAs(config.NameMapping{Matches: "^(.*)_total$", As: "$1_per_second"})).To(ConsistOf(ContainSubstring(`capture group "1_per_second"`)))
+		Expect(checkNameAs(config.NameMapping{Matches: "^(.*)_(.*)$", As: "${3}"})).To(ConsistOf(ContainSubstring("only has 2 capture group(s)")))
+		Expect(checkNameAs(config.NameMapping{Matches: "^(?P<base>.*)$", As: "$other"})).To(ConsistOf(ContainSubstring(`capture group "other"`)))
+	})
+
+	It("should report invalid queries, with the rule index and line", func() {
+		problems := validateYAML(`rules:
+- seriesQuery: 'foo{'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+- seriesQuery: 'foo'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m]) by (<<.GroupBy>>)'
+`)
+		Expect(problems).To(HaveLen(2))
+		Expect(problems[0].Index).To(Equal(0))
+		Expect(problems[0].Line).To(Equal(2))
+		Expect(problems[0].Message).To(HavePrefix("invalid seriesQuery"))
+		Expect(problems[1].Index).To(Equal(1))
+		Expect(problems[1].Line).To(Equal(6))
+		Expect(problems[1].Message).To(ContainSubstring(`unable to parse metrics query template "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m]) by (<<.GroupBy>>)"`))
+		Expect(problems[1].Message).To(ContainSubstring("unexpected <by> in aggregation"))
+	})
+
+	It("should report invalid resource rules", func() {
+		problems := validateYAML(`resourceRules:
+  cpu:
+    containerQuery: sum(rate(container_cpu_usage_seconds_total{<<.LabelMatchers>>}[1m])) by (<<.GroupBy>>)
+    nodeQuery: sum(rate(container_cpu_usage_seconds_total{<<.LabelMatchers>>, id='/'}[1m])) by (<<.GroupBy>>
+    resources:
+      overrides:
+        namespace: {resource: "namespace"}
+        pod_name: {resource: "pod"}
+        instance: {resource: "node"}
+    containerLabel: container_name
+  memory:
+    containerQuery: sum(container_memory_working_set_bytes{<<.LabelMatchers>>}) by (<<.GroupBy>>)
+    nodeQuery: sum(container_memory_working_set_bytes{<<.LabelMatchers>>,id='/'}) by (<<.GroupBy>>)
+    resources:
+      overrides:
+        namespace: {resource: "namespace"}
+        pod_name: {resource: "pod"}
+        instance: {resource: "node"}
+    containerLabel: container_name
+  window: 1m
+`)
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Section).To(Equal("resourceRules"))
+		Expect(problems[0].Line).To(Equal(1))
+		Expect(problems[0].Message).To(HavePrefix("cpu nodeQuery"))
+	})
+
+	It("should report invalid backends and references to unknown backends", func() {
+		problems := validateYAML(`backends:
+- name: thanos
+  url: http://thanos:9090
+- name: thanos
+  url: http://thanos-2:9090
+- name: default
+rules:
+- seriesQuery: 'foo{namespace!=""}'
+  backend: thanos
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+- seriesQuery: 'bar{namespace!=""}'
+  backend: cortex
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`)
+		Expect(problems).To(ConsistOf(
+			Problem{Severity: SeverityError, Section: "backends", Index: 1, Line: 4, Message: `duplicate backend name "thanos"`},
+			Problem{Severity: SeverityError, Section: "backends", Index: 2, Line: 6, Message: `name "default" is reserved for the backend given by --prometheus-url`},
+			Problem{Severity: SeverityError, Section: "backends", Index: 2, Line: 6, Message: "url must be specified"},
+			Problem{Severity: SeverityError, Section: "rules", Index: 1, Line: 13, Message: `unknown backend "cortex"`},
+		))
+	})
+
+	It("should report invalid global label matchers", func() {
+		problems := validateYAML(`globalLabelMatchers:
+- cluster="prod-eu"
+- cluster
+- region!="us",zone="a"
+`)
+		Expect(problems).To(HaveLen(2))
+		Expect(problems[0].Index).To(Equal(1))
+		Expect(problems[0].Line).To(Equal(3))
+		Expect(problems[0].Message).To(HavePrefix(`invalid label matcher "cluster"`))
+		Expect(problems[1].Index).To(Equal(2))
+		Expect(problems[1].Message).To(ContainSubstring("expected a single matcher"))
+	})
+
+	It("should check selector joins, and reject them for external rules", func() {
+		problems := validateYAML(`rules:
+- seriesQuery: 'foo{namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+  selectorJoin: {}
+- seriesQuery: 'bar{namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+  selectorJoin:
+    series: 'kube_<<.Resource>>_labels{'
+externalRules:
+- seriesQuery: 'queue_depth'
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>})'
+  selectorJoin: {}
+`)
+		Expect(problems).To(HaveLen(2))
+		Expect(problems[0].Section).To(Equal("rules"))
+		Expect(problems[0].Index).To(Equal(1))
+		Expect(problems[0].Message).To(HavePrefix("selectorJoin renders to invalid PromQL"))
+		Expect(problems[1].Section).To(Equal("externalRules"))
+		Expect(problems[1].Message).To(Equal("selectorJoin may not be used for external rules"))
+	})
+
+	It("should check derived metrics", func() {
+		problems := validateYAML(`rules:
+- seriesQuery: 'foo{namespace!="",pod!=""}'
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+derivedMetrics:
+- name: foo_ratio
+  expression: 'foo / bar'
+- name: foo_ratio_doubled
+  expression: 'foo_ratio * 2'
+- name: foo_filtered
+  expression: 'foo{pod="somepod"}'
+`)
+		Expect(problems).To(ConsistOf(
+			Problem{Severity: SeverityError, Section: "derivedMetrics", Index: 1, Line: 9, Message: `may not refer to another derived metric ("foo_ratio")`},
+			Problem{Severity: SeverityError, Section: "derivedMetrics", Index: 2, Line: 11, Message: `derived metric "foo_filtered" may only refer to other metrics by name, not foo{pod="somepod"}`},
+		))
+	})
+
+	It("should check static metrics", func() {
+		problems := validateYAML(`staticMetrics:
+- name: http_requests_per_second
+  seriesName: http_requests_total
+  groupResources:
+  - resource: pods
+  resources:
+    template: <<.Resource>>
+  metricsQuery: 'sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)'
+- name: node_load
+  groupResources:
+  - resource: pods
+  resources:
+    overrides:
+      pod: {resource: "pods"}
+  metricsQuery: 'sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)'
+`)
+		Expect(problems).To(HaveLen(1))
+		Expect(problems[0].Section).To(Equal("staticMetrics"))
+		Expect(problems[0].Index).To(Equal(1))
+		Expect(problems[0].Line).To(Equal(9))
+		Expect(problems[0].Message).To(HavePrefix(`static metric "node_load" has namespaced resources, but doesn't map namespaces to a label`))
+	})
+})
@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -43,21 +44,117 @@ type GenericAPIClient interface {
 	Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error)
 }
 
+// StreamingAPIClient is a GenericAPIClient which can also decode the data of a
+// response while it's being read, instead of holding the whole response in memory.
+type StreamingAPIClient interface {
+	GenericAPIClient
+	// DoStreaming makes a request like Do, but passes a decoder positioned at the
+	// start of the response's `data` field to decodeData, instead of returning the
+	// data as part of the response.
+	DoStreaming(ctx context.Context, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (APIResponse, error)
+}
+
+// DoStreaming makes a request using the given client, decoding the response data
+// with decodeData.  The data is streamed if the client is a StreamingAPIClient, and
+// is otherwise decoded from the buffered response.
+func DoStreaming(ctx context.Context, client GenericAPIClient, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (APIResponse, error) {
+	if streamingClient, canStream := client.(StreamingAPIClient); canStream {
+		return streamingClient.DoStreaming(ctx, verb, endpoint, query, decodeData)
+	}
+
+	res, err := client.Do(ctx, verb, endpoint, query)
+	if err != nil {
+		return res, err
+	}
+	if err := decodeData(json.NewDecoder(bytes.NewReader(res.Data))); err != nil {
+		return res, &Error{
+			Type: ErrBadResponse,
+			Msg:  err.Error(),
+		}
+	}
+	res.Data = nil
+	return res, nil
+}
+
+// GenericAPIClientOptions configures extra information sent with each request
+// made by a generic API client.
+type GenericAPIClientOptions struct {
+	// Headers are added to every request (e.g. a static tenant ID for a multi-tenant
+	// gateway).  Headers attached to the request context with WithHeaders take
+	// precedence over these.
+	Headers http.Header
+	// QueryParams are added to every request (e.g. Thanos's `partial_response`
+	// or `dedup` parameters), unless the request sets them itself.
+	QueryParams url.Values
+}
+
+// maxGETQueryLength is the length of the encoded query above which GET requests
+// are sent as form-encoded POST requests instead, so that queries for many objects
+// don't exceed the URL length limits of Prometheus or of proxies in front of it.
+const maxGETQueryLength = 4096
+
+// postableEndpoints are the endpoints which accept form-encoded POST requests
+// in place of GET requests.  Other endpoints (such as label values) only accept
+// GET requests, so long queries to them are always sent as GET requests.
+var postableEndpoints = map[string]bool{
+	queryURL:      true,
+	queryRangeURL: true,
+	seriesURL:     true,
+	labelNamesURL: true,
+}
+
 // httpAPIClient is a GenericAPIClient implemented in terms of an underlying http.Client.
 type httpAPIClient struct {
 	client  *http.Client
 	baseURL *url.URL
+	opts    GenericAPIClientOptions
 }
 
 func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	return c.do(ctx, verb, endpoint, query, nil)
+}
+
+func (c *httpAPIClient) DoStreaming(ctx context.Context, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (APIResponse, error) {
+	return c.do(ctx, verb, endpoint, query, decodeData)
+}
+
+// do makes a request, decoding the response data with decodeData if it's not nil,
+// and otherwise storing it in the returned response.
+func (c *httpAPIClient) do(ctx context.Context, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (APIResponse, error) {
 	u := *c.baseURL
 	u.Path = path.Join(c.baseURL.Path, endpoint)
-	u.RawQuery = query.Encode()
-	req, err := http.NewRequest(verb, u.String(), nil)
+	if len(c.opts.QueryParams) > 0 {
+		fullQuery := url.Values{}
+		for key, vals := range c.opts.QueryParams {
+			fullQuery[key] = vals
+		}
+		for key, vals := range query {
+			fullQuery[key] = vals
+		}
+		query = fullQuery
+	}
+	encodedQuery := query.Encode()
+	var body io.Reader
+	if verb == http.MethodGet && len(encodedQuery) > maxGETQueryLength && postableEndpoints[endpoint] {
+		verb = http.MethodPost
+		body = strings.NewReader(encodedQuery)
+	} else {
+		u.RawQuery = encodedQuery
+	}
+	req, err := http.NewRequest(verb, u.String(), body)
 	if err != nil {
 		return APIResponse{}, fmt.Errorf("error constructing HTTP request to Prometheus: %v", err)
 	}
-	req.WithContext(ctx)
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for key, vals := range c.opts.Headers {
+		req.Header[key] = vals
+	}
+	for key, vals := range headersFromContext(ctx) {
+		req.Header[key] = vals
+	}
 
 	resp, err := c.client.Do(req)
 	defer func() {
@@ -84,18 +181,23 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 		}
 	}
 
-	var body io.Reader = resp.Body
+	var respBody io.Reader = resp.Body
 	if glog.V(8) {
-		data, err := ioutil.ReadAll(body)
+		data, err := ioutil.ReadAll(respBody)
 		if err != nil {
 			return APIResponse{}, fmt.Errorf("unable to log response body: %v", err)
 		}
 		glog.Infof("Response Body: %s", string(data))
-		body = bytes.NewReader(data)
+		respBody = bytes.NewReader(data)
 	}
 
 	var res APIResponse
-	if err = json.NewDecoder(body).Decode(&res); err != nil {
+	if decodeData != nil {
+		res, err = decodeStreamingResponse(respBody, decodeData)
+	} else {
+		err = json.NewDecoder(respBody).Decode(&res)
+	}
+	if err != nil {
 		return APIResponse{}, &Error{
 			Type: ErrBadResponse,
 			Msg:  err.Error(),
@@ -109,21 +211,84 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 		}
 	}
 
+	for _, warning := range res.Warnings {
+		glog.Warningf("Prometheus returned a warning for %s %s: %s", verb, u.String(), warning)
+	}
+
 	return res, nil
 }
 
+// decodeStreamingResponse decodes an API response from the given reader, passing
+// a decoder positioned at the start of its `data` field to decodeData, instead of
+// storing the data in the response.
+func decodeStreamingResponse(body io.Reader, decodeData func(*json.Decoder) error) (APIResponse, error) {
+	var res APIResponse
+	dec := json.NewDecoder(body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return res, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return res, err
+		}
+		switch tok {
+		case "data":
+			err = decodeData(dec)
+		case "status":
+			err = dec.Decode(&res.Status)
+		case "errorType":
+			err = dec.Decode(&res.ErrorType)
+		case "error":
+			err = dec.Decode(&res.Error)
+		case "warnings":
+			err = dec.Decode(&res.Warnings)
+		default:
+			var ignored json.RawMessage
+			err = dec.Decode(&ignored)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token from the given decoder, checking that it's
+// the given delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q, got %v", delim, tok)
+	}
+	return nil
+}
+
 // NewGenericAPIClient builds a new generic Prometheus API client for the given base URL and HTTP Client.
 func NewGenericAPIClient(client *http.Client, baseURL *url.URL) GenericAPIClient {
+	return NewGenericAPIClientWithOptions(client, baseURL, GenericAPIClientOptions{})
+}
+
+// NewGenericAPIClientWithOptions builds a new generic Prometheus API client for the given
+// base URL and HTTP Client, sending the extra headers and query parameters from the given
+// options with each request.
+func NewGenericAPIClientWithOptions(client *http.Client, baseURL *url.URL, opts GenericAPIClientOptions) GenericAPIClient {
 	return &httpAPIClient{
 		client:  client,
 		baseURL: baseURL,
+		opts:    opts,
 	}
 }
 
 const (
-	queryURL      = "/api/v1/query"
-	queryRangeURL = "/api/v1/query_range"
-	seriesURL     = "/api/v1/series"
+	queryURL       = "/api/v1/query"
+	queryRangeURL  = "/api/v1/query_range"
+	seriesURL      = "/api/v1/series"
+	labelValuesURL = "/api/v1/label/%s/values"
+	labelNamesURL  = "/api/v1/labels"
 )
 
 // queryClient is a Client that connects to the Prometheus HTTP API.
@@ -157,14 +322,76 @@ func (h *queryClient) Series(ctx context.Context, interval model.Interval, selec
 		vals.Add("match[]", string(selector))
 	}
 
-	res, err := h.api.Do(ctx, "GET", seriesURL, vals)
+	// decode the series one at a time, so that we never hold the raw response
+	// for the whole list (which can be huge) in memory
+	var seriesRes []Series
+	_, err := DoStreaming(ctx, h.api, "GET", seriesURL, vals, func(dec *json.Decoder) error {
+		return decodeList(dec, func(dec *json.Decoder) error {
+			var series Series
+			if err := dec.Decode(&series); err != nil {
+				return err
+			}
+			seriesRes = append(seriesRes, series)
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
+	return seriesRes, nil
+}
 
-	var seriesRes []Series
-	err = json.Unmarshal(res.Data, &seriesRes)
-	return seriesRes, err
+func (h *queryClient) LabelValues(ctx context.Context, interval model.Interval, label string, selectors ...Selector) ([]string, error) {
+	return h.listLabels(ctx, fmt.Sprintf(labelValuesURL, url.PathEscape(label)), interval, selectors)
+}
+
+func (h *queryClient) LabelNames(ctx context.Context, interval model.Interval, selectors ...Selector) ([]string, error) {
+	return h.listLabels(ctx, labelNamesURL, interval, selectors)
+}
+
+// listLabels fetches a list of label names or values from the given endpoint.
+func (h *queryClient) listLabels(ctx context.Context, endpoint string, interval model.Interval, selectors []Selector) ([]string, error) {
+	vals := url.Values{}
+	if interval.Start != 0 {
+		vals.Set("start", interval.Start.String())
+	}
+	if interval.End != 0 {
+		vals.Set("end", interval.End.String())
+	}
+
+	for _, selector := range selectors {
+		vals.Add("match[]", string(selector))
+	}
+
+	res, err := h.api.Do(ctx, "GET", endpoint, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	err = json.Unmarshal(res.Data, &labels)
+	return labels, err
+}
+
+// decodeList decodes a JSON list (or null) from the given decoder, calling
+// decodeItem to decode each item in turn.
+func decodeList(dec *json.Decoder, decodeItem func(*json.Decoder) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("expected a list, got %v", tok)
+	}
+	for dec.More() {
+		if err := decodeItem(dec); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
 }
 
 func (h *queryClient) Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error) {
@@ -214,11 +441,30 @@ func (h *queryClient) QueryRange(ctx context.Context, r Range, query Selector) (
 	return queryRes, err
 }
 
+// WithQueryTimeout returns a context derived from the given one which is cancelled
+// after the given timeout.  A zero timeout leaves the deadline (if any) unchanged.
+func WithQueryTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// NewRequestContext returns the context for the queries made on behalf of a
+// single metrics API request, cancelled after the given timeout (zero for no
+// limit).  The metrics API servers don't pass their request contexts through
+// the provider interfaces, so abandoned requests can't cancel their queries,
+// and the timeout is the only limit on them.  Once the provider interfaces
+// take a context, this should be replaced by WithQueryTimeout on that context.
+func NewRequestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return WithQueryTimeout(context.Background(), timeout)
+}
+
 // timeoutFromContext checks the context for a deadline and calculates a "timeout" duration from it,
 // when present
 func timeoutFromContext(ctx context.Context) (time.Duration, bool) {
 	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
-		return time.Now().Sub(deadline), true
+		return deadline.Sub(time.Now()), true
 	}
 
 	return time.Duration(0), false
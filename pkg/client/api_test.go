@@ -0,0 +1,275 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+)
+
+var _ = Describe("Generic API Client", func() {
+	var (
+		server      *httptest.Server
+		lastRequest *http.Request
+		client      GenericAPIClient
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lastRequest = r
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "success", "data": [], "warnings": ["partial response: store unavailable"]}`))
+		}))
+		baseURL, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		headers := http.Header{}
+		headers.Set("X-Scope-OrgID", "cluster")
+		client = NewGenericAPIClientWithOptions(server.Client(), baseURL, GenericAPIClientOptions{
+			Headers:     headers,
+			QueryParams: url.Values{"partial_response": []string{"false"}, "dedup": []string{"true"}},
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should send the configured headers and query parameters with each request", func() {
+		_, err := client.Do(context.Background(), "GET", seriesURL, url.Values{"dedup": []string{"false"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Header.Get("X-Scope-OrgID")).To(Equal("cluster"))
+		Expect(lastRequest.URL.Query().Get("partial_response")).To(Equal("false"))
+
+		By("letting the request override the configured query parameters")
+		Expect(lastRequest.URL.Query().Get("dedup")).To(Equal("false"))
+	})
+
+	It("should return any warnings from the response", func() {
+		resp, err := client.Do(context.Background(), "GET", seriesURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Warnings).To(ConsistOf("partial response: store unavailable"))
+	})
+
+	It("should send the tenant for the namespace of each request, when asked to", func() {
+		tenantClient := NewTenantAPIClient(client, "X-Scope-OrgID", map[string]string{"team-a-dev": "team-a"})
+
+		_, err := tenantClient.Do(WithNamespace(context.Background(), "team-a-dev"), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Header.Get("X-Scope-OrgID")).To(Equal("team-a"))
+
+		By("falling back to the namespace name for unlisted namespaces")
+		_, err = tenantClient.Do(WithNamespace(context.Background(), "team-b"), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Header.Get("X-Scope-OrgID")).To(Equal("team-b"))
+
+		By("using the static headers for requests without a namespace")
+		_, err = tenantClient.Do(context.Background(), "GET", seriesURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Header.Get("X-Scope-OrgID")).To(Equal("cluster"))
+	})
+
+	It("should give up on requests when their context is done", func() {
+		blocked := make(chan struct{})
+		defer close(blocked)
+		slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-blocked:
+			case <-r.Context().Done():
+			}
+		}))
+		defer slowServer.Close()
+		baseURL, err := url.Parse(slowServer.URL)
+		Expect(err).NotTo(HaveOccurred())
+		slowClient := NewGenericAPIClient(slowServer.Client(), baseURL)
+
+		ctx, cancel := WithQueryTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = slowClient.Do(ctx, "GET", queryURL, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should pass the time remaining before the context's deadline to Prometheus", func() {
+		ctx, cancel := WithQueryTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := NewClientForAPI(client).Query(ctx, 0, "up")
+		Expect(err).To(HaveOccurred()) // the fake server doesn't return a query result
+		timeout, err := time.ParseDuration(lastRequest.URL.Query().Get("timeout"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timeout).To(BeNumerically(">", 50*time.Second))
+	})
+})
+
+var _ = Describe("Prometheus Client", func() {
+	var (
+		server      *httptest.Server
+		lastRequest *http.Request
+		lastForm    url.Values
+		response    string
+		client      Client
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lastRequest = r
+			Expect(r.ParseForm()).To(Succeed())
+			lastForm = r.Form
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(response))
+		}))
+		baseURL, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		client = NewClient(server.Client(), baseURL)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should decode listed series as they're streamed", func() {
+		response = `{"status": "success", "data": [{"__name__": "up", "job": "a"}, {"__name__": "up", "job": "b"}], "warnings": []}`
+		series, err := client.Series(context.Background(), model.Interval{}, `{__name__="up"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(series).To(Equal([]Series{
+			{Name: "up", Labels: model.LabelSet{"job": "a"}},
+			{Name: "up", Labels: model.LabelSet{"job": "b"}},
+		}))
+		Expect(lastRequest.URL.Query()["match[]"]).To(ConsistOf(`{__name__="up"}`))
+
+		By("returning error responses as errors")
+		response = `{"status": "error", "errorType": "timeout", "error": "query timed out"}`
+		_, err = client.Series(context.Background(), model.Interval{}, `{__name__="up"}`)
+		Expect(err).To(MatchError("timeout: query timed out"))
+
+		By("rejecting malformed responses")
+		response = `{"status": "success", "data": {"__name__": "up"}}`
+		_, err = client.Series(context.Background(), model.Interval{}, `{__name__="up"}`)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should list the values of a label for the given series", func() {
+		response = `{"status": "success", "data": ["kube-system", "somens"]}`
+		values, err := client.LabelValues(context.Background(), model.Interval{Start: 1000}, "namespace", `{__name__="up"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values).To(Equal([]string{"kube-system", "somens"}))
+		Expect(lastRequest.URL.Path).To(Equal("/api/v1/label/namespace/values"))
+		Expect(lastRequest.URL.Query()["match[]"]).To(ConsistOf(`{__name__="up"}`))
+		Expect(lastRequest.URL.Query().Get("start")).To(Equal("1"))
+
+		By("listing the names of the labels for the given series")
+		response = `{"status": "success", "data": ["__name__", "job"]}`
+		names, err := client.LabelNames(context.Background(), model.Interval{}, `{__name__="up"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{"__name__", "job"}))
+		Expect(lastRequest.URL.Path).To(Equal("/api/v1/labels"))
+	})
+	It("should send long queries as form-encoded POST requests", func() {
+		response = `{"status": "success", "data": {"resultType": "vector", "result": []}}`
+		_, err := client.Query(context.Background(), 0, `up{pod="somepod"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Method).To(Equal(http.MethodGet))
+
+		longQuery := Selector(`up{pod=~"` + strings.Repeat("somepod|", 1000) + `somepod"}`)
+		_, err = client.Query(context.Background(), 0, longQuery)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastRequest.Method).To(Equal(http.MethodPost))
+		Expect(lastRequest.Header.Get("Content-Type")).To(Equal("application/x-www-form-urlencoded"))
+		Expect(lastRequest.URL.RawQuery).To(BeEmpty())
+		Expect(lastForm.Get("query")).To(Equal(string(longQuery)))
+	})
+
+	It("should only send long queries as POST requests to endpoints that accept them", func() {
+		longSelector := Selector(`up{pod=~"` + strings.Repeat("somepod|", 1000) + `somepod"}`)
+		testCases := []struct {
+			name           string
+			response       string
+			call           func() error
+			expectedPath   string
+			expectedMethod string
+		}{
+			{
+				name:     "query",
+				response: `{"status": "success", "data": {"resultType": "vector", "result": []}}`,
+				call: func() error {
+					_, err := client.Query(context.Background(), 0, longSelector)
+					return err
+				},
+				expectedPath:   "/api/v1/query",
+				expectedMethod: http.MethodPost,
+			},
+			{
+				name:     "query_range",
+				response: `{"status": "success", "data": {"resultType": "matrix", "result": []}}`,
+				call: func() error {
+					_, err := client.QueryRange(context.Background(), Range{Start: 0, End: 60000, Step: 30 * time.Second}, longSelector)
+					return err
+				},
+				expectedPath:   "/api/v1/query_range",
+				expectedMethod: http.MethodPost,
+			},
+			{
+				name:     "series",
+				response: `{"status": "success", "data": []}`,
+				call: func() error {
+					_, err := client.Series(context.Background(), model.Interval{}, longSelector)
+					return err
+				},
+				expectedPath:   "/api/v1/series",
+				expectedMethod: http.MethodPost,
+			},
+			{
+				name:     "label names",
+				response: `{"status": "success", "data": []}`,
+				call: func() error {
+					_, err := client.LabelNames(context.Background(), model.Interval{}, longSelector)
+					return err
+				},
+				expectedPath:   "/api/v1/labels",
+				expectedMethod: http.MethodPost,
+			},
+			{
+				name:     "label values",
+				response: `{"status": "success", "data": []}`,
+				call: func() error {
+					_, err := client.LabelValues(context.Background(), model.Interval{}, "pod", longSelector)
+					return err
+				},
+				expectedPath:   "/api/v1/label/pod/values",
+				expectedMethod: http.MethodGet,
+			},
+		}
+
+		for _, tc := range testCases {
+			By(fmt.Sprintf("checking the method used for %s", tc.name))
+			response = tc.response
+			Expect(tc.call()).To(Succeed())
+			Expect(lastRequest.URL.Path).To(Equal(tc.expectedPath))
+			Expect(lastRequest.Method).To(Equal(tc.expectedMethod))
+		}
+	})
+})
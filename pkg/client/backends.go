@@ -0,0 +1,40 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+)
+
+// DefaultBackend is the name of the backend used by rules that don't specify one.
+const DefaultBackend = "default"
+
+// Backends holds a client for each named Prometheus backend.
+type Backends map[string]Client
+
+// For returns the client for the named backend.  An empty name
+// refers to the default backend.
+func (b Backends) For(name string) (Client, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+	client, found := b[name]
+	if !found {
+		return nil, fmt.Errorf("unknown Prometheus backend %q", name)
+	}
+	return client, nil
+}
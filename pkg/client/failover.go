@@ -0,0 +1,285 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// DefaultHealthCheckInterval is the default interval at which replicas are health-checked.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// Replica is a single replica of a Prometheus server, such as one half of an HA pair.
+type Replica struct {
+	// Name identifies the replica in logs (normally its URL).
+	Name string
+	// Client is used to make requests to the replica.
+	Client GenericAPIClient
+}
+
+// FailoverOptions configures how a FailoverAPIClient spreads requests across replicas.
+type FailoverOptions struct {
+	// HealthCheckInterval is the interval at which replicas are health-checked.
+	// If zero, DefaultHealthCheckInterval is used.
+	HealthCheckInterval time.Duration
+	// RequestTimeout is the maximum amount of time to wait for a single replica
+	// before failing over to the next one.  If zero, requests to each replica
+	// are only limited by the request context.
+	RequestTimeout time.Duration
+	// MergeSeries causes series requests to be sent to every healthy replica,
+	// with the results merged and deduplicated, so that series only present on
+	// one replica (e.g. because the other was recently restarted) are still
+	// discovered.
+	MergeSeries bool
+}
+
+// FailoverAPIClient is a GenericAPIClient that sends requests to one of several
+// replicas of a Prometheus server, preferring healthy replicas (in the order
+// given), and failing over to the next replica when a request errors out or
+// times out.  Replicas are marked unhealthy when a request to them fails, and
+// healthy again once they pass a health check or successfully serve a request.
+type FailoverAPIClient struct {
+	replicas []Replica
+	opts     FailoverOptions
+
+	mu      sync.RWMutex
+	healthy []bool
+}
+
+// NewFailoverAPIClient constructs a new FailoverAPIClient for the given replicas,
+// which are initially assumed to be healthy.  Call RunUntil to start health checks.
+func NewFailoverAPIClient(replicas []Replica, opts FailoverOptions) *FailoverAPIClient {
+	if opts.HealthCheckInterval == 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	healthy := make([]bool, len(replicas))
+	for i := range healthy {
+		healthy[i] = true
+	}
+	return &FailoverAPIClient{
+		replicas: replicas,
+		opts:     opts,
+		healthy:  healthy,
+	}
+}
+
+// RunUntil periodically health-checks each replica until the given channel is closed.
+func (c *FailoverAPIClient) RunUntil(stopChan <-chan struct{}) {
+	go wait.Until(c.checkHealth, c.opts.HealthCheckInterval, stopChan)
+}
+
+// checkHealth health-checks every replica by running a trivial query against it.
+func (c *FailoverAPIClient) checkHealth() {
+	var wg sync.WaitGroup
+	for i := range c.replicas {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.HealthCheckInterval)
+			defer cancel()
+			_, err := c.doReplica(ctx, idx, "GET", queryURL, url.Values{"query": []string{"1"}})
+			c.setHealthy(idx, err == nil, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// setHealthy records the health of the given replica, logging changes.
+func (c *FailoverAPIClient) setHealthy(idx int, healthy bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.healthy[idx] == healthy {
+		return
+	}
+	c.healthy[idx] = healthy
+	if healthy {
+		glog.Infof("Prometheus replica %s is healthy again", c.replicas[idx].Name)
+	} else {
+		glog.Warningf("marking Prometheus replica %s as unhealthy: %v", c.replicas[idx].Name, err)
+	}
+}
+
+// replicaOrder returns the indices of the replicas in the order in which they
+// should be tried: healthy replicas first, then unhealthy ones as a last resort.
+func (c *FailoverAPIClient) replicaOrder() (healthy, unhealthy []int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i, isHealthy := range c.healthy {
+		if isHealthy {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return healthy, unhealthy
+}
+
+// doReplica makes a request to a single replica, giving up after the configured
+// request timeout.
+func (c *FailoverAPIClient) doReplica(ctx context.Context, idx int, verb, endpoint string, query url.Values) (APIResponse, error) {
+	if c.opts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.RequestTimeout)
+		defer cancel()
+	}
+
+	type result struct {
+		resp APIResponse
+		err  error
+	}
+	resChan := make(chan result, 1)
+	go func() {
+		resp, err := c.replicas[idx].Client.Do(ctx, verb, endpoint, query)
+		resChan <- result{resp: resp, err: err}
+	}()
+
+	select {
+	case res := <-resChan:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return APIResponse{}, &Error{
+			Type: ErrTimeout,
+			Msg:  fmt.Sprintf("request to replica %s did not complete: %v", c.replicas[idx].Name, ctx.Err()),
+		}
+	}
+}
+
+// shouldFailOver checks if the given error from a replica means that the
+// request should be retried on another replica.  Errors caused by the
+// request itself (such as an invalid query) would occur on every replica.
+func shouldFailOver(err error) bool {
+	if apiErr, isAPIErr := err.(*Error); isAPIErr && apiErr.Type == ErrBadData {
+		return false
+	}
+	return true
+}
+
+func (c *FailoverAPIClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	if c.opts.MergeSeries && endpoint == seriesURL {
+		return c.doMerged(ctx, verb, endpoint, query)
+	}
+
+	healthy, unhealthy := c.replicaOrder()
+	var lastErr error
+	for _, idx := range append(healthy, unhealthy...) {
+		resp, err := c.doReplica(ctx, idx, verb, endpoint, query)
+		if err == nil {
+			c.setHealthy(idx, true, nil)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, so this says nothing about the replica
+			return resp, err
+		}
+		if !shouldFailOver(err) {
+			return resp, err
+		}
+		c.setHealthy(idx, false, err)
+		lastErr = err
+	}
+
+	return APIResponse{}, fmt.Errorf("unable to complete request on any Prometheus replica: %v", lastErr)
+}
+
+// doMerged sends a series request to every healthy replica (or every replica,
+// if none are healthy), and merges the results.  It only fails if no replica
+// returned a result.
+func (c *FailoverAPIClient) doMerged(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	targets, unhealthy := c.replicaOrder()
+	if len(targets) == 0 {
+		targets = unhealthy
+	}
+
+	responses := make([]APIResponse, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, idx := range targets {
+		wg.Add(1)
+		go func(i, idx int) {
+			defer wg.Done()
+			responses[i], errs[i] = c.doReplica(ctx, idx, verb, endpoint, query)
+		}(i, idx)
+	}
+	wg.Wait()
+
+	var lastErr error
+	var successful []APIResponse
+	for i, idx := range targets {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			if ctx.Err() == nil && shouldFailOver(errs[i]) {
+				c.setHealthy(idx, false, errs[i])
+			}
+			continue
+		}
+		c.setHealthy(idx, true, nil)
+		successful = append(successful, responses[i])
+	}
+
+	if len(successful) == 0 {
+		return APIResponse{}, fmt.Errorf("unable to complete request on any Prometheus replica: %v", lastErr)
+	}
+	if len(successful) == 1 {
+		return successful[0], nil
+	}
+
+	data, err := mergeSeriesData(successful)
+	if err != nil {
+		return APIResponse{}, &Error{
+			Type: ErrBadResponse,
+			Msg:  fmt.Sprintf("unable to merge series from Prometheus replicas: %v", err),
+		}
+	}
+	var warnings []string
+	for _, resp := range successful {
+		warnings = append(warnings, resp.Warnings...)
+	}
+	return APIResponse{Status: ResponseSucceeded, Data: data, Warnings: warnings}, nil
+}
+
+// mergeSeriesData merges the series lists from several series responses,
+// removing duplicates.
+func mergeSeriesData(responses []APIResponse) (json.RawMessage, error) {
+	seen := make(map[model.Fingerprint]struct{})
+	merged := []model.Metric{}
+	for _, resp := range responses {
+		var series []model.Metric
+		if err := json.Unmarshal(resp.Data, &series); err != nil {
+			return nil, err
+		}
+		for _, metric := range series {
+			fingerprint := metric.Fingerprint()
+			if _, exists := seen[fingerprint]; exists {
+				continue
+			}
+			seen[fingerprint] = struct{}{}
+			merged = append(merged, metric)
+		}
+	}
+	return json.Marshal(merged)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+)
+
+// fakeReplica is a GenericAPIClient which returns a fixed response or error,
+// recording the endpoints it was asked for.
+type fakeReplica struct {
+	mu       sync.Mutex
+	data     string
+	err      error
+	delay    time.Duration
+	requests []string
+}
+
+func (r *fakeReplica) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	r.mu.Lock()
+	r.requests = append(r.requests, endpoint)
+	data, err, delay := r.data, r.err, r.delay
+	r.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return APIResponse{}, ctx.Err()
+		}
+	}
+	if err != nil {
+		return APIResponse{}, err
+	}
+	return APIResponse{Status: ResponseSucceeded, Data: json.RawMessage(data)}, nil
+}
+
+func (r *fakeReplica) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+var _ = Describe("Failover API Client", func() {
+	var (
+		first, second *fakeReplica
+	)
+
+	BeforeEach(func() {
+		first = &fakeReplica{data: `"first"`}
+		second = &fakeReplica{data: `"second"`}
+	})
+
+	newClient := func(opts FailoverOptions) *FailoverAPIClient {
+		return NewFailoverAPIClient([]Replica{
+			{Name: "first", Client: first},
+			{Name: "second", Client: second},
+		}, opts)
+	}
+
+	It("should prefer the first healthy replica", func() {
+		client := newClient(FailoverOptions{})
+		resp, err := client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(resp.Data)).To(Equal(`"first"`))
+		Expect(second.requestCount()).To(BeZero())
+	})
+
+	It("should fail over when a replica errors out, and avoid it until it recovers", func() {
+		client := newClient(FailoverOptions{})
+		first.err = fmt.Errorf("connection refused")
+
+		resp, err := client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(resp.Data)).To(Equal(`"second"`))
+
+		By("skipping the unhealthy replica on subsequent requests")
+		_, err = client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.requestCount()).To(Equal(1))
+
+		By("using the replica again once it passes a health check")
+		first.err = nil
+		client.checkHealth()
+		resp, err = client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(resp.Data)).To(Equal(`"first"`))
+	})
+
+	It("should fail over when a replica times out", func() {
+		client := newClient(FailoverOptions{RequestTimeout: 10 * time.Millisecond})
+		first.delay = time.Minute
+
+		resp, err := client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(resp.Data)).To(Equal(`"second"`))
+	})
+
+	It("should not fail over on errors caused by the request itself", func() {
+		client := newClient(FailoverOptions{})
+		first.err = &Error{Type: ErrBadData, Msg: "parse error"}
+
+		_, err := client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(second.requestCount()).To(BeZero())
+	})
+
+	It("should return an error when no replica can complete the request", func() {
+		client := newClient(FailoverOptions{})
+		first.err = fmt.Errorf("connection refused")
+		second.err = fmt.Errorf("no route to host")
+
+		_, err := client.Do(context.Background(), "GET", queryURL, nil)
+		Expect(err).To(MatchError(ContainSubstring("no route to host")))
+	})
+
+	It("should merge and deduplicate series from every healthy replica when asked to", func() {
+		client := newClient(FailoverOptions{MergeSeries: true})
+		first.data = `[{"__name__": "up", "job": "a"}, {"__name__": "up", "job": "b"}]`
+		second.data = `[{"__name__": "up", "job": "b"}, {"__name__": "up", "job": "c"}]`
+
+		resp, err := client.Do(context.Background(), "GET", seriesURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		var series []pmodel.Metric
+		Expect(json.Unmarshal(resp.Data, &series)).To(Succeed())
+		Expect(series).To(ConsistOf(
+			pmodel.Metric{"__name__": "up", "job": "a"},
+			pmodel.Metric{"__name__": "up", "job": "b"},
+			pmodel.Metric{"__name__": "up", "job": "c"},
+		))
+
+		By("still returning results when one of the replicas fails")
+		second.err = fmt.Errorf("connection refused")
+		resp, err = client.Do(context.Background(), "GET", seriesURL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(json.Unmarshal(resp.Data, &series)).To(Succeed())
+		Expect(series).To(HaveLen(2))
+	})
+})
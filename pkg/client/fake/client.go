@@ -34,6 +34,10 @@ type FakePrometheusClient struct {
 	SeriesResults map[prom.Selector][]prom.Series
 	// QueryResults are non-error responses to Query
 	QueryResults map[prom.Selector]prom.QueryResult
+	// LabelValuesResults are responses to LabelValues, by label name
+	LabelValuesResults map[string][]string
+	// LabelNamesResults are responses to LabelNames, by (first) selector
+	LabelNamesResults map[prom.Selector][]string
 }
 
 func (c *FakePrometheusClient) Series(_ context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
@@ -53,6 +57,33 @@ func (c *FakePrometheusClient) Series(_ context.Context, interval pmodel.Interva
 	return res, nil
 }
 
+func (c *FakePrometheusClient) LabelValues(_ context.Context, interval pmodel.Interval, label string, selectors ...prom.Selector) ([]string, error) {
+	if (interval.Start != 0 && interval.Start < c.AcceptableInterval.Start) || (interval.End != 0 && interval.End > c.AcceptableInterval.End) {
+		return nil, fmt.Errorf("interval [%v, %v] for query is outside range [%v, %v]", interval.Start, interval.End, c.AcceptableInterval.Start, c.AcceptableInterval.End)
+	}
+	for _, sel := range selectors {
+		if err, found := c.ErrQueries[sel]; found {
+			return nil, err
+		}
+	}
+
+	return c.LabelValuesResults[label], nil
+}
+
+func (c *FakePrometheusClient) LabelNames(_ context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]string, error) {
+	if (interval.Start != 0 && interval.Start < c.AcceptableInterval.Start) || (interval.End != 0 && interval.End > c.AcceptableInterval.End) {
+		return nil, fmt.Errorf("interval [%v, %v] for query is outside range [%v, %v]", interval.Start, interval.End, c.AcceptableInterval.Start, c.AcceptableInterval.End)
+	}
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	if err, found := c.ErrQueries[selectors[0]]; found {
+		return nil, err
+	}
+
+	return c.LabelNamesResults[selectors[0]], nil
+}
+
 func (c *FakePrometheusClient) Query(_ context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
 	if t < c.AcceptableInterval.Start || t > c.AcceptableInterval.End {
 		return prom.QueryResult{}, fmt.Errorf("time %v for query is outside range [%v, %v]", t, c.AcceptableInterval.Start, c.AcceptableInterval.End)
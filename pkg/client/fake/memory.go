@@ -0,0 +1,189 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// InMemoryPrometheusClient is an instance of prom.Client which evaluates
+// queries against a fixed set of series, held in memory.  Unlike
+// FakePrometheusClient, it actually evaluates the PromQL it's given,
+// so it can be used to test the queries produced by the adapter.
+type InMemoryPrometheusClient struct {
+	// Data contains the series and samples to query against.
+	Data pmodel.Matrix
+	// LookbackDelta is how far back instant vector selectors look for
+	// samples.  If zero, the Prometheus default is used.
+	LookbackDelta time.Duration
+}
+
+var _ prom.Client = &InMemoryPrometheusClient{}
+
+// Select returns the samples of all series matching the given selector between
+// start and end, inclusive.  It implements promql.Storage.
+func (c *InMemoryPrometheusClient) Select(sel *parser.VectorSelector, start, end pmodel.Time) pmodel.Matrix {
+	res := pmodel.Matrix{}
+	for _, stream := range c.Data {
+		name := string(stream.Metric[pmodel.MetricNameLabel])
+		if !promql.MatchesSeries(sel, name, pmodel.LabelSet(stream.Metric)) {
+			continue
+		}
+
+		var values []pmodel.SamplePair
+		for _, sample := range stream.Values {
+			if sample.Timestamp >= start && sample.Timestamp <= end {
+				values = append(values, sample)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		res = append(res, &pmodel.SampleStream{Metric: stream.Metric, Values: values})
+	}
+	return res
+}
+
+func (c *InMemoryPrometheusClient) engine() *promql.Engine {
+	return &promql.Engine{Storage: c, LookbackDelta: c.LookbackDelta}
+}
+
+func (c *InMemoryPrometheusClient) Series(_ context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	start, end := interval.Start, interval.End
+	if end == 0 {
+		end = pmodel.Latest
+	}
+
+	res := []prom.Series{}
+	seen := make(map[pmodel.Fingerprint]bool)
+	for _, selStr := range selectors {
+		sel, err := promql.ParseSelector(string(selStr))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse series selector %q: %v", selStr, err)
+		}
+
+		for _, stream := range c.Select(sel, start, end) {
+			fp := stream.Metric.Fingerprint()
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+
+			lbls := pmodel.LabelSet(stream.Metric).Clone()
+			delete(lbls, pmodel.MetricNameLabel)
+			res = append(res, prom.Series{
+				Name:   string(stream.Metric[pmodel.MetricNameLabel]),
+				Labels: lbls,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (c *InMemoryPrometheusClient) LabelValues(ctx context.Context, interval pmodel.Interval, label string, selectors ...prom.Selector) ([]string, error) {
+	if len(selectors) == 0 {
+		selectors = []prom.Selector{`{__name__=~".+"}`}
+	}
+	series, err := c.Series(ctx, interval, selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	seen := make(map[pmodel.LabelValue]bool)
+	for _, s := range series {
+		value := s.Labels[pmodel.LabelName(label)]
+		if label == pmodel.MetricNameLabel {
+			value = pmodel.LabelValue(s.Name)
+		}
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, string(value))
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (c *InMemoryPrometheusClient) LabelNames(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]string, error) {
+	if len(selectors) == 0 {
+		selectors = []prom.Selector{`{__name__=~".+"}`}
+	}
+	series, err := c.Series(ctx, interval, selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{pmodel.MetricNameLabel}
+	seen := map[pmodel.LabelName]bool{pmodel.MetricNameLabel: true}
+	for _, s := range series {
+		for name := range s.Labels {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *InMemoryPrometheusClient) Query(_ context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	expr, err := parser.ParseExpr(string(query))
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+
+	res, err := c.engine().Eval(expr, t)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+
+	switch val := res.(type) {
+	case pmodel.Vector:
+		return prom.QueryResult{Type: pmodel.ValVector, Vector: &val}, nil
+	case *pmodel.Scalar:
+		return prom.QueryResult{Type: pmodel.ValScalar, Scalar: val}, nil
+	case pmodel.Matrix:
+		return prom.QueryResult{Type: pmodel.ValMatrix, Matrix: &val}, nil
+	}
+	return prom.QueryResult{}, fmt.Errorf("unsupported result type %s for query %q", res.Type(), query)
+}
+
+func (c *InMemoryPrometheusClient) QueryRange(_ context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
+	expr, err := parser.ParseExpr(string(query))
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+
+	res, err := c.engine().EvalRange(expr, r.Start, r.End, r.Step)
+	if err != nil {
+		return prom.QueryResult{}, err
+	}
+	return prom.QueryResult{Type: pmodel.ValMatrix, Matrix: &res}, nil
+}
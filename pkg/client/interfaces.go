@@ -47,6 +47,12 @@ type Range struct {
 type Client interface {
 	// Series lists the time series matching the given series selectors
 	Series(ctx context.Context, interval model.Interval, selectors ...Selector) ([]Series, error)
+	// LabelValues lists the values of the given label on the time series matching
+	// the given series selectors (or on all time series, if none are given).
+	LabelValues(ctx context.Context, interval model.Interval, label string, selectors ...Selector) ([]string, error)
+	// LabelNames lists the names of the labels on the time series matching the
+	// given series selectors (or on all time series, if none are given).
+	LabelNames(ctx context.Context, interval model.Interval, selectors ...Selector) ([]string, error)
 	// Query runs a non-range query at the given time.
 	Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error)
 	// QueryRange runs a range query at the given time.
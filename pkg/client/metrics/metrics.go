@@ -17,6 +17,7 @@ package metrics
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
 	"time"
 
@@ -32,25 +33,50 @@ var (
 	queryLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "cmgateway_prometheus_query_latency_seconds",
-			Help:    "Prometheus client query latency in seconds.  Broken down by target prometheus endpoint and target server",
+			Help:    "Prometheus client query latency in seconds.  Broken down by target prometheus endpoint, target server, and backend name",
 			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 10),
 		},
-		[]string{"endpoint", "server"},
+		[]string{"endpoint", "server", "backend"},
+	)
+
+	// queryWarnings counts the warnings returned along with successful
+	// responses (e.g. partial responses from Thanos or Cortex).
+	queryWarnings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_prometheus_query_warnings_total",
+			Help: "Number of warnings returned by Prometheus along with query results.  Broken down by target prometheus endpoint, target server, and backend name",
+		},
+		[]string{"endpoint", "server", "backend"},
 	)
 )
 
 func init() {
 	prometheus.MustRegister(queryLatency)
+	prometheus.MustRegister(queryWarnings)
 }
 
 // instrumentedClient is a client.GenericAPIClient which instruments calls to Do,
 // capturing request latency.
 type instrumentedGenericClient struct {
-	serverName string
-	client     client.GenericAPIClient
+	serverName  string
+	backendName string
+	client      client.GenericAPIClient
 }
 
 func (c *instrumentedGenericClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (client.APIResponse, error) {
+	return c.instrument(endpoint, func() (client.APIResponse, error) {
+		return c.client.Do(ctx, verb, endpoint, query)
+	})
+}
+
+func (c *instrumentedGenericClient) DoStreaming(ctx context.Context, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (client.APIResponse, error) {
+	return c.instrument(endpoint, func() (client.APIResponse, error) {
+		return client.DoStreaming(ctx, c.client, verb, endpoint, query, decodeData)
+	})
+}
+
+// instrument records the latency of, and any warnings returned by, the given request.
+func (c *instrumentedGenericClient) instrument(endpoint string, do func() (client.APIResponse, error)) (client.APIResponse, error) {
 	startTime := time.Now()
 	var err error
 	defer func() {
@@ -62,17 +88,23 @@ func (c *instrumentedGenericClient) Do(ctx context.Context, verb, endpoint strin
 				return
 			}
 		}
-		queryLatency.With(prometheus.Labels{"endpoint": endpoint, "server": c.serverName}).Observe(endTime.Sub(startTime).Seconds())
+		queryLatency.With(prometheus.Labels{"endpoint": endpoint, "server": c.serverName, "backend": c.backendName}).Observe(endTime.Sub(startTime).Seconds())
 	}()
 
 	var resp client.APIResponse
-	resp, err = c.client.Do(ctx, verb, endpoint, query)
+	resp, err = do()
+	if len(resp.Warnings) > 0 {
+		queryWarnings.With(prometheus.Labels{"endpoint": endpoint, "server": c.serverName, "backend": c.backendName}).Add(float64(len(resp.Warnings)))
+	}
 	return resp, err
 }
 
-func InstrumentGenericAPIClient(client client.GenericAPIClient, serverName string) client.GenericAPIClient {
+// InstrumentGenericAPIClient wraps the given client, recording the latency of its
+// requests, labeled with the given server and backend names.
+func InstrumentGenericAPIClient(client client.GenericAPIClient, serverName, backendName string) client.GenericAPIClient {
 	return &instrumentedGenericClient{
-		serverName: serverName,
-		client:     client,
+		serverName:  serverName,
+		backendName: backendName,
+		client:      client,
 	}
 }
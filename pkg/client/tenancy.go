@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+type contextKey int
+
+const (
+	headersKey contextKey = iota
+	namespaceKey
+)
+
+// WithHeaders returns a context which causes the given headers to be sent with
+// any requests made using it.  Headers from any parent context are kept, unless
+// overridden.
+func WithHeaders(ctx context.Context, headers http.Header) context.Context {
+	merged := http.Header{}
+	for key, vals := range headersFromContext(ctx) {
+		merged[key] = vals
+	}
+	for key, vals := range headers {
+		merged[key] = vals
+	}
+	return context.WithValue(ctx, headersKey, merged)
+}
+
+// headersFromContext returns the headers attached to the given context, if any.
+func headersFromContext(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(headersKey).(http.Header)
+	return headers
+}
+
+// WithNamespace returns a context which records that requests made using it are
+// on behalf of the given namespace.  An empty namespace means that the requests
+// aren't specific to any one namespace.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey, namespace)
+}
+
+// NamespaceFromContext returns the namespace that requests made using the given
+// context are on behalf of, if any.
+func NamespaceFromContext(ctx context.Context) (string, bool) {
+	namespace, ok := ctx.Value(namespaceKey).(string)
+	return namespace, ok && namespace != ""
+}
+
+// tenantAPIClient is a GenericAPIClient which identifies the tenant for each
+// request using a header derived from the request's namespace.
+type tenantAPIClient struct {
+	client  GenericAPIClient
+	header  string
+	tenants map[string]string
+}
+
+// NewTenantAPIClient wraps the given client, setting the given header to the tenant
+// ID for the namespace of each request (as set with WithNamespace).  The tenant ID
+// for a namespace is looked up in the given map, falling back to the name of the
+// namespace itself.  Requests without a namespace are passed through unchanged,
+// so any static tenant header configured on the underlying client applies to them.
+func NewTenantAPIClient(client GenericAPIClient, header string, tenants map[string]string) GenericAPIClient {
+	return &tenantAPIClient{
+		client:  client,
+		header:  header,
+		tenants: tenants,
+	}
+}
+
+func (c *tenantAPIClient) Do(ctx context.Context, verb, endpoint string, query url.Values) (APIResponse, error) {
+	return c.client.Do(c.tenantContext(ctx), verb, endpoint, query)
+}
+
+func (c *tenantAPIClient) DoStreaming(ctx context.Context, verb, endpoint string, query url.Values, decodeData func(*json.Decoder) error) (APIResponse, error) {
+	return DoStreaming(c.tenantContext(ctx), c.client, verb, endpoint, query, decodeData)
+}
+
+// tenantContext attaches the tenant header for the request's namespace (if any)
+// to the given context.
+func (c *tenantAPIClient) tenantContext(ctx context.Context) context.Context {
+	namespace, hasNamespace := NamespaceFromContext(ctx)
+	if !hasNamespace {
+		return ctx
+	}
+	tenant, found := c.tenants[namespace]
+	if !found {
+		tenant = namespace
+	}
+	headers := http.Header{}
+	headers.Set(c.header, tenant)
+	return WithHeaders(ctx, headers)
+}
@@ -60,4 +60,8 @@ type APIResponse struct {
 	ErrorType ErrorType `json:"errorType"`
 	// Error is the error message, if this is an error response.
 	Error string `json:"error"`
+
+	// Warnings contains any warnings returned along with the response
+	// (for instance, when a query only returned partial results).
+	Warnings []string `json:"warnings,omitempty"`
 }
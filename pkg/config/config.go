@@ -11,6 +11,112 @@ type MetricsDiscoveryConfig struct {
 	// will make only a single API call.
 	Rules         []DiscoveryRule `yaml:"rules"`
 	ResourceRules *ResourceRules  `yaml:"resourceRules,omitempty"`
+	// ExternalRules specifies how to discover and map Prometheus metrics to
+	// external metrics API metrics.  They follow the same format as Rules,
+	// except that the only resource considered is the namespace, which is
+	// used to scope queries when the discovered series has a namespace label.
+	ExternalRules []DiscoveryRule `yaml:"externalRules,omitempty"`
+	// Backends specifies additional Prometheus servers that rules may query.
+	// Rules which don't specify a backend use the server configured on the
+	// command line, which is known as the "default" backend.
+	Backends []Backend `yaml:"backends,omitempty"`
+	// DerivedMetrics specifies custom metrics which are computed from other
+	// custom metrics discovered by Rules, for the same object.
+	DerivedMetrics []DerivedMetric `yaml:"derivedMetrics,omitempty"`
+	// StaticMetrics declares custom metrics directly, for cases where listing
+	// the matching series from Prometheus would be too expensive.
+	StaticMetrics []StaticMetric `yaml:"staticMetrics,omitempty"`
+	// GlobalLabelMatchers are PromQL label matchers (e.g. `cluster="prod-eu"`)
+	// which are added to every series query used for discovery, and to every
+	// selector in every query for custom, external, and resource metrics, so
+	// that no rule can read series which don't match them.
+	GlobalLabelMatchers []string `yaml:"globalLabelMatchers,omitempty"`
+}
+
+// StaticMetric declares a custom metric, along with the resources which have
+// it, without discovering any series.  The metric is registered as if a series
+// with a label for each of its resources had been discovered.
+type StaticMetric struct {
+	// Name is the name of the metric in the custom metrics API.
+	Name string `yaml:"name"`
+	// SeriesName is the name of the Prometheus series backing the metric,
+	// which is passed to MetricsQuery as `.Series`.  Defaults to Name.
+	SeriesName string `yaml:"seriesName,omitempty"`
+	// GroupResources lists the resources which have this metric.
+	GroupResources []GroupResource `yaml:"groupResources"`
+	// Resources specifies how the metric's resources (and namespaces) map to
+	// Prometheus labels, as for discovery rules.  Each resource in GroupResources
+	// (and namespaces, if any of them are namespaced) must map to a label.
+	Resources ResourceMapping `yaml:"resources"`
+	// MetricsQuery specifies modifications to the metrics query, as for discovery rules.
+	MetricsQuery string `yaml:"metricsQuery"`
+	// Backend names the Prometheus backend to query, as for discovery rules.
+	Backend string `yaml:"backend,omitempty"`
+	// MaxSampleAge specifies the age beyond which samples are considered
+	// stale, as for discovery rules.
+	MaxSampleAge pmodel.Duration `yaml:"maxSampleAge,omitempty"`
+	// Window specifies the window to report with the metric, as for discovery rules.
+	Window pmodel.Duration `yaml:"window,omitempty"`
+}
+
+// DerivedMetric describes a custom metric computed from other custom metrics.
+type DerivedMetric struct {
+	// Name is the name of the metric in the custom metrics API.
+	Name string `yaml:"name"`
+	// Expression is a PromQL expression which refers to other custom metrics
+	// by their names in the custom metrics API (e.g. `errors_per_second /
+	// requests_per_second`).  Each name is replaced by the query for that
+	// metric, so the metric is available for every resource which all of the
+	// referenced metrics are available for.
+	Expression string `yaml:"expression"`
+}
+
+// Backend describes how to connect to a Prometheus server.
+type Backend struct {
+	// Name is used to refer to this backend from rules.
+	Name string `yaml:"name"`
+	// URL is the URL used to connect to this Prometheus server.
+	URL string `yaml:"url"`
+	// CAFile points to the file containing the CA used to verify this server's certificate.
+	CAFile string `yaml:"caFile,omitempty"`
+	// TokenFile points to the file containing the bearer token used to authenticate
+	// with this server.
+	TokenFile string `yaml:"tokenFile,omitempty"`
+	// AuthConfig is a kubeconfig file containing the auth details used to connect to
+	// this server.  It may not be used in conjunction with CAFile.
+	AuthConfig string `yaml:"authConfig,omitempty"`
+	// AuthInCluster enables using the auth details from the in-cluster kubeconfig to
+	// connect to this server.  It may not be used in conjunction with CAFile.
+	AuthInCluster bool `yaml:"authInCluster,omitempty"`
+	// ReplicaURLs are the URLs of additional replicas of this server (for instance,
+	// the other half of an HA pair).  If any are specified, requests fail over
+	// between the replicas when one is unavailable.
+	ReplicaURLs []string `yaml:"replicaURLs,omitempty"`
+	// HealthCheckInterval is the interval at which replicas are health-checked.
+	HealthCheckInterval pmodel.Duration `yaml:"healthCheckInterval,omitempty"`
+	// ReplicaTimeout is the amount of time to wait for a single replica before
+	// failing over to the next one.  If zero, only the request's own deadline applies.
+	ReplicaTimeout pmodel.Duration `yaml:"replicaTimeout,omitempty"`
+	// MergeSeries sends discovery requests to every healthy replica and merges
+	// the results, instead of only using the first healthy replica.
+	MergeSeries bool `yaml:"mergeSeries,omitempty"`
+	// Headers are sent with every request to this server (for instance, a static
+	// tenant ID for a multi-tenant gateway).
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// NamespaceTenantHeader is the name of a header (such as `X-Scope-OrgID`) which
+	// identifies the tenant for requests on behalf of a particular namespace.
+	// Requests which aren't specific to a namespace (such as discovery) only
+	// send the static Headers.
+	NamespaceTenantHeader string `yaml:"namespaceTenantHeader,omitempty"`
+	// NamespaceTenants maps namespaces to tenant IDs for NamespaceTenantHeader.
+	// Namespaces which aren't listed use their own name as their tenant ID.
+	NamespaceTenants map[string]string `yaml:"namespaceTenants,omitempty"`
+	// PartialResponse, if set, is sent as the `partial_response` query parameter
+	// (as understood by Thanos) with every request.
+	PartialResponse *bool `yaml:"partialResponse,omitempty"`
+	// Dedup, if set, is sent as the `dedup` query parameter (as understood by
+	// Thanos) with every request.
+	Dedup *bool `yaml:"dedup,omitempty"`
 }
 
 // DiscoveryRule describes a set of rules for transforming Prometheus metrics to/from
@@ -37,6 +143,92 @@ type DiscoveryRule struct {
 	// `.GroupBy` is the comma-separated expected group-by label names. The delimeters
 	// are `<<` and `>>`.
 	MetricsQuery string `yaml:"metricsQuery,omitempty"`
+	// Backend is the name of the Prometheus backend to discover and query
+	// series from.  If empty, the default backend is used.
+	Backend string `yaml:"backend,omitempty"`
+	// MaxSampleAge is the age beyond which samples returned by the metrics query
+	// are considered stale, and reported as missing instead of being served.
+	// If zero, samples are never considered stale.
+	MaxSampleAge pmodel.Duration `yaml:"maxSampleAge,omitempty"`
+	// Window is the window reported with each metric value.  If zero, it is
+	// the largest range used in the rendered metrics query (e.g. `2m` for
+	// `rate(foo[2m])`), or nothing, if the query doesn't use any ranges.
+	Window pmodel.Duration `yaml:"window,omitempty"`
+	// CacheTTL is how long the results of the metrics query are cached for,
+	// so that identical requests made in quick succession (e.g. by several
+	// HPAs) only query Prometheus once.  If zero, the adapter's default is
+	// used.  Negative values disable caching for the rule.
+	CacheTTL pmodel.Duration `yaml:"cacheTTL,omitempty"`
+	// RelistInterval is the interval at which to relist the series matching
+	// the series query.  If zero, the adapter's relist interval is used.
+	RelistInterval pmodel.Duration `yaml:"relistInterval,omitempty"`
+	// MaxAge is the period for which series matching the series query are
+	// kept after they were last seen.  It must not be less than the relist
+	// interval.  If zero, the adapter's max age is used.
+	MaxAge pmodel.Duration `yaml:"maxAge,omitempty"`
+	// Discovery, if set, configures how the series matching the series query
+	// are listed, for series queries which match too many series to list
+	// in a single request.
+	Discovery *SeriesDiscovery `yaml:"discovery,omitempty"`
+	// SelectorJoin, if set, causes label selectors for this rule's metrics
+	// to be resolved in Prometheus, by joining the metrics query against
+	// series which carry the labels of each object, instead of by listing
+	// objects from the Kubernetes API.  It may not be used for external rules.
+	SelectorJoin *SelectorJoin `yaml:"selectorJoin,omitempty"`
+	// OwnerRollup, if set, causes this rule's pod metrics to also be exposed
+	// on the objects which own those pods (such as deployments), by aggregating
+	// the values for each owner's pods.  It may not be used for external rules.
+	OwnerRollup *OwnerRollup `yaml:"ownerRollup,omitempty"`
+}
+
+// SeriesDiscovery describes how to split up listing the series for a rule, so
+// that Prometheus doesn't have to return them all in a single response.
+type SeriesDiscovery struct {
+	// Strategy is how the series are discovered: `series` (the default) lists
+	// every series, while `labels` only lists the names of the metrics and of
+	// the labels on each metric, which is much cheaper for metrics with many
+	// series.  With `labels`, each metric is treated as a single series
+	// carrying every label seen on any of its series.
+	Strategy string `yaml:"strategy,omitempty"`
+	// TimeSlice, if set, splits the period over which series are listed into
+	// slices of at most this length, which are listed one after another.
+	TimeSlice pmodel.Duration `yaml:"timeSlice,omitempty"`
+	// ShardLabel, if set, causes the series to be listed separately for each
+	// value of the given label (e.g. `namespace`), plus once for series without
+	// the label.  The values are found using the label values API.
+	ShardLabel string `yaml:"shardLabel,omitempty"`
+}
+
+// OwnerRollup describes how to roll up pod metrics onto the owners of the pods.
+// Owners are found by following the controller references of each pod, through
+// its ReplicaSet (if any).
+type OwnerRollup struct {
+	// Resources are the owner group-resources on which to expose metrics.  They
+	// default to deployments, statefulsets, daemonsets, replicasets, and jobs.
+	Resources []GroupResource `yaml:"resources,omitempty"`
+	// Aggregation is the function used to combine the values for each pod:
+	// one of `sum` (the default), `avg`, `max`, or `min`.
+	Aggregation string `yaml:"aggregation,omitempty"`
+}
+
+// SelectorJoin describes series which carry the labels of Kubernetes objects,
+// such as the `kube_<resource>_labels` series exported by kube-state-metrics.
+// The templates are passed the `.Group` and `.Resource` fields, as for the
+// resource template, and use the delimiters `<<` and `>>`.
+type SelectorJoin struct {
+	// Series is a template for the name of the series carrying the labels of
+	// each object.  It defaults to `kube_<<.Resource>>_labels`.
+	Series string `yaml:"series,omitempty"`
+	// ObjectLabel is a template for the label on those series which contains
+	// the name of the object.  It defaults to `<<.Resource>>`.
+	ObjectLabel string `yaml:"objectLabel,omitempty"`
+	// NamespaceLabel is the label on those series which contains the namespace
+	// of the object.  It defaults to `namespace`.
+	NamespaceLabel string `yaml:"namespaceLabel,omitempty"`
+	// LabelPrefix is prepended to each Kubernetes label name (with characters
+	// not valid in Prometheus label names replaced by underscores) to produce
+	// the corresponding label on those series.  It defaults to `label_`.
+	LabelPrefix string `yaml:"labelPrefix,omitempty"`
 }
 
 // RegexFilter is a filter that matches positively or negatively against a regex.
@@ -105,4 +297,7 @@ type ResourceRule struct {
 	// ContainerLabel indicates the name of the Prometheus label containing the container name
 	// (since "container" is not a resource, this can't go in the `resources` block, but is similar).
 	ContainerLabel string `yaml:"containerLabel"`
+	// Backend is the name of the Prometheus backend to query.  If empty,
+	// the default backend is used.
+	Backend string `yaml:"backend,omitempty"`
 }
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	// configReloads counts the attempts to reload the metrics discovery configuration,
+	// broken down by whether or not the reload succeeded.
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_config_reloads_total",
+			Help: "Number of attempts to reload the metrics discovery configuration.  Broken down by result (success or failure)",
+		},
+		[]string{"result"},
+	)
+
+	// configLastReloadSuccessful records whether or not the last reload succeeded.
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cmgateway_config_last_reload_successful",
+			Help: "Whether the last attempt to reload the metrics discovery configuration succeeded (1) or failed (0)",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(configReloads, configLastReloadSuccessful)
+}
+
+// ReloadFunc applies a newly loaded configuration.  If it returns an error,
+// the configuration is considered to be invalid, and the caller is expected
+// to have kept using the previous configuration.
+type ReloadFunc func(cfg *MetricsDiscoveryConfig) error
+
+// Watcher periodically checks a configuration file for changes, and calls
+// a ReloadFunc with the new configuration when the contents change.  Since it
+// compares file contents instead of relying on filesystem events, it handles
+// atomic symlink swaps (as performed for ConfigMap volume mounts) transparently.
+type Watcher struct {
+	filename string
+	interval time.Duration
+	reload   ReloadFunc
+
+	// lastContents holds the contents of the file as of the last check.
+	lastContents []byte
+}
+
+// NewWatcher constructs a new Watcher for the given file.  The current contents
+// of the file are considered to be already loaded.
+func NewWatcher(filename string, interval time.Duration, reload ReloadFunc) (*Watcher, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load metrics discovery config file: %v", err)
+	}
+
+	configLastReloadSuccessful.Set(1)
+
+	return &Watcher{
+		filename:     filename,
+		interval:     interval,
+		reload:       reload,
+		lastContents: contents,
+	}, nil
+}
+
+// RunUntil checks for changes to the configuration file until the given channel is closed.
+func (w *Watcher) RunUntil(stopChan <-chan struct{}) {
+	go wait.Until(func() {
+		if err := w.checkForChanges(); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}, w.interval, stopChan)
+}
+
+// checkForChanges reloads the configuration if the file contents have changed since
+// the last check.  Invalid contents are only reported once, and aren't retried until
+// the file changes again.
+func (w *Watcher) checkForChanges() error {
+	contents, err := ioutil.ReadFile(w.filename)
+	if err != nil {
+		return fmt.Errorf("unable to check metrics discovery config file for changes: %v", err)
+	}
+	if bytes.Equal(contents, w.lastContents) {
+		return nil
+	}
+
+	glog.Infof("metrics discovery config file %q changed, reloading", w.filename)
+	w.lastContents = contents
+
+	cfg, err := FromYAML(contents)
+	if err == nil {
+		err = w.reload(cfg)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return fmt.Errorf("unable to reload metrics discovery config, keeping the previous config: %v", err)
+	}
+
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	glog.Infof("successfully reloaded metrics discovery config from %q", w.filename)
+
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+// DerivedMetric is a custom metric computed from other custom metrics
+// of the same object.
+type DerivedMetric struct {
+	// Name is the name of the metric in the custom metrics API.
+	Name string
+	// Metrics are the names of the metrics referred to by the expression,
+	// in the order in which they first appear.
+	Metrics []string
+
+	// expression is the (validated) expression for the metric, in terms
+	// of the metrics it refers to.
+	expression string
+}
+
+// DerivedMetricsFromConfig produces the derived metrics described by the given config.
+func DerivedMetricsFromConfig(cfg *config.MetricsDiscoveryConfig) ([]*DerivedMetric, error) {
+	derivedMetrics := make([]*DerivedMetric, len(cfg.DerivedMetrics))
+	names := make(map[string]struct{}, len(cfg.DerivedMetrics))
+	for i, derivedCfg := range cfg.DerivedMetrics {
+		derived, err := DerivedMetricFromConfig(derivedCfg)
+		if err != nil {
+			return nil, err
+		}
+		if _, duplicate := names[derived.Name]; duplicate {
+			return nil, fmt.Errorf("duplicate derived metric %q", derived.Name)
+		}
+		names[derived.Name] = struct{}{}
+		derivedMetrics[i] = derived
+	}
+
+	// derived metrics are computed from discovered metrics only
+	for _, derived := range derivedMetrics {
+		for _, metric := range derived.Metrics {
+			if _, isDerived := names[metric]; isDerived {
+				return nil, fmt.Errorf("derived metric %q may not refer to another derived metric (%q)", derived.Name, metric)
+			}
+		}
+	}
+
+	return derivedMetrics, nil
+}
+
+// DerivedMetricFromConfig checks and produces a single derived metric.  It doesn't
+// check the metric against other derived metrics.
+func DerivedMetricFromConfig(cfg config.DerivedMetric) (*DerivedMetric, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("derived metric name must be specified")
+	}
+	expr, err := parser.ParseExpr(cfg.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q for derived metric %q: %v", cfg.Expression, cfg.Name, err)
+	}
+	if expr.Type() != parser.ValueTypeVector {
+		return nil, fmt.Errorf("expression %q for derived metric %q must produce an instant vector, not a %s", cfg.Expression, cfg.Name, parser.DocumentedType(expr.Type()))
+	}
+
+	derived := &DerivedMetric{
+		Name:       cfg.Name,
+		expression: cfg.Expression,
+	}
+	seen := make(map[string]struct{})
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			// a selector by name alone has only the matcher for the name
+			if e.Name == "" || len(e.LabelMatchers) != 1 || e.OriginalOffset != 0 || e.Timestamp != nil || e.StartOrEnd != 0 {
+				err = fmt.Errorf("derived metric %q may only refer to other metrics by name, not %s", cfg.Name, e)
+				return err
+			}
+			if _, alreadySeen := seen[e.Name]; !alreadySeen {
+				seen[e.Name] = struct{}{}
+				derived.Metrics = append(derived.Metrics, e.Name)
+			}
+		case *parser.MatrixSelector:
+			err = fmt.Errorf("derived metric %q may only refer to other metrics by name, not %s", cfg.Name, e)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(derived.Metrics) == 0 {
+		return nil, fmt.Errorf("derived metric %q must refer to at least one other metric", cfg.Name)
+	}
+	if _, selfReferential := seen[cfg.Name]; selfReferential {
+		return nil, fmt.Errorf("derived metric %q may not refer to itself", cfg.Name)
+	}
+
+	return derived, nil
+}
+
+// Query produces the query for the derived metric, by replacing each metric
+// that it refers to with the given query for that metric.
+func (m *DerivedMetric) Query(metricQueries map[string]prom.Selector) (prom.Selector, error) {
+	expr, err := parser.ParseExpr(m.expression)
+	if err != nil {
+		// this should have been caught when constructing the metric
+		return "", fmt.Errorf("invalid expression for derived metric %q: %v", m.Name, err)
+	}
+
+	expr = promql.Rewrite(expr, func(node parser.Expr) parser.Expr {
+		sel, isSel := node.(*parser.VectorSelector)
+		if !isSel {
+			return nil
+		}
+		query, found := metricQueries[sel.Name]
+		if !found {
+			err = fmt.Errorf("no query for metric %q", sel.Name)
+			return node
+		}
+		return &parser.ParenExpr{Expr: rawQuery(query)}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return prom.Selector(expr.String()), nil
+}
+
+// rawQuery is an already-rendered query which evaluates to an instant vector,
+// for use as part of a larger expression.
+type rawQuery prom.Selector
+
+func (q rawQuery) String() string { return string(q) }
+
+func (q rawQuery) Type() parser.ValueType { return parser.ValueTypeVector }
+
+func (q rawQuery) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+
+func (q rawQuery) PromQLExpr() {}
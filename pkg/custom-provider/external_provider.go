@@ -0,0 +1,160 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+type externalPrometheusProvider struct {
+	promClients prom.Backends
+
+	// queryTimeout bounds each request for metrics (zero for no limit).
+	queryTimeout time.Duration
+	// cache caches (and coalesces) query results, for cacheTTL by default.
+	cache    *queryCache
+	cacheTTL time.Duration
+	// enforceNamespaces restricts queries (and results) to the requested namespace.
+	enforceNamespaces bool
+
+	ExternalSeriesRegistry
+}
+
+// NewExternalPrometheusProvider constructs a new ExternalMetricsProvider which exposes
+// the series discovered by the given namers as external metrics.  Series discovery and
+// queries are configured by opts.
+func NewExternalPrometheusProvider(promClients prom.Backends, namers []MetricNamer, opts ProviderOptions) (provider.ExternalMetricsProvider, MetricsLister) {
+	registry := &basicExternalSeriesRegistry{}
+	lister := &cachingExternalMetricsLister{
+		ExternalSeriesRegistry: registry,
+		seriesLister:           newSeriesLister("external", promClients, namers, opts.UpdateInterval, opts.MaxAge, opts.FailureExpiry, registry),
+	}
+
+	return &externalPrometheusProvider{
+		promClients:  promClients,
+		queryTimeout: opts.QueryTimeout,
+		cache:        newQueryCache("external", opts.QueryTimeout),
+		cacheTTL:     opts.CacheTTL,
+
+		enforceNamespaces: opts.EnforceNamespaces,
+
+		ExternalSeriesRegistry: lister,
+	}, lister
+}
+
+func (p *externalPrometheusProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	query, found := p.QueryForExternalMetric(namespace, info.Metric, metricSelector)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(schema.GroupResource{}, info.Metric)
+	}
+
+	namer, found := p.NamerForExternalMetric(info.Metric)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(schema.GroupResource{}, info.Metric)
+	}
+	promClient, err := p.promClients.For(namer.Backend())
+	if err != nil {
+		glog.Errorf("unable to fetch external metric %q: %v", info.Metric, err)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
+
+	var enforcer *namespaceEnforcer
+	if p.enforceNamespaces {
+		enforcer, err = newNamespaceEnforcer("external", namer, namespace)
+		if err == nil {
+			query, err = enforcer.EnforceQuery(query)
+		}
+		if err != nil {
+			glog.Errorf("unable to fetch external metric %q: %v", info.Metric, err)
+			return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		}
+	}
+
+	ctx, cancel := prom.NewRequestContext(p.queryTimeout)
+	defer cancel()
+	now := pmodel.Now()
+	queryResults, err := p.cache.Query(ctx, promClient, namer.Backend(), namespace, query, cacheTTLFor(namer, p.cacheTTL))
+	if err != nil {
+		glog.Errorf("unable to fetch external metrics from prometheus: %v", err)
+		// don't leak implementation details to the user
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
+
+	if queryResults.Type != pmodel.ValVector {
+		glog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
+
+	samples := *queryResults.Vector
+	if enforcer != nil {
+		samples = enforcer.FilterResults(samples)
+	}
+
+	window := windowFor(namer, query)
+	res := []external_metrics.ExternalMetricValue{}
+	for _, sample := range dropStaleSamples(samples, namer.MaxSampleAge(), now) {
+		if sample == nil {
+			// skip empty values
+			continue
+		}
+		res = append(res, *p.externalMetricFor(sample, window, info))
+	}
+
+	return &external_metrics.ExternalMetricValueList{
+		Items: res,
+	}, nil
+}
+
+// externalMetricFor converts a single Prometheus sample into an external metric value,
+// using the sample's labels as the metric labels.
+func (p *externalPrometheusProvider) externalMetricFor(sample *pmodel.Sample, window *int64, info provider.ExternalMetricInfo) *external_metrics.ExternalMetricValue {
+	metricLabels := make(map[string]string, len(sample.Metric))
+	for lbl, val := range sample.Metric {
+		if lbl == pmodel.MetricNameLabel {
+			continue
+		}
+		metricLabels[string(lbl)] = string(val)
+	}
+
+	return &external_metrics.ExternalMetricValue{
+		MetricName:    info.Metric,
+		MetricLabels:  metricLabels,
+		Timestamp:     metav1.Time{Time: sample.Timestamp.Time()},
+		WindowSeconds: window,
+		Value:         *resource.NewMilliQuantity(int64(sample.Value*1000.0), resource.DecimalSI),
+	}
+}
+
+// cachingExternalMetricsLister is an ExternalSeriesRegistry which is periodically
+// populated with the series discovered by its seriesLister.
+type cachingExternalMetricsLister struct {
+	ExternalSeriesRegistry
+	*seriesLister
+}
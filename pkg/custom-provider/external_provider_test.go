@@ -0,0 +1,174 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+const queueSeriesQuery = `{__name__=~"^queue_.*"}`
+
+func setupExternalPrometheusProvider() (provider.ExternalMetricsProvider, *fakeprom.FakePrometheusClient) {
+	fakeProm := &fakeprom.FakePrometheusClient{}
+
+	cfg := &config.MetricsDiscoveryConfig{
+		ExternalRules: []config.DiscoveryRule{
+			{
+				SeriesQuery: queueSeriesQuery,
+				Resources: config.ResourceMapping{
+					Overrides: map[string]config.GroupResource{
+						"namespace": {Resource: "namespace"},
+					},
+				},
+				Name:         config.NameMapping{Matches: "^queue_(.*)$"},
+				MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (queue)",
+			},
+		},
+	}
+	namers, err := ExternalNamersFromConfig(cfg, restMapper())
+	Expect(err).NotTo(HaveOccurred())
+
+	prov, _ := NewExternalPrometheusProvider(prom.Backends{prom.DefaultBackend: fakeProm}, namers, ProviderOptions{UpdateInterval: fakeProviderUpdateInterval, MaxAge: fakeProviderStartDuration})
+
+	fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+		prom.Selector(queueSeriesQuery): {
+			{
+				Name:   "queue_depth",
+				Labels: pmodel.LabelSet{"queue": "orders", "namespace": "somens"},
+			},
+			{
+				Name:   "queue_saas_backlog",
+				Labels: pmodel.LabelSet{"queue": "billing"},
+			},
+		},
+	}
+
+	return prov, fakeProm
+}
+
+var _ = Describe("External Metrics Provider", func() {
+	var (
+		prov     provider.ExternalMetricsProvider
+		fakeProm *fakeprom.FakePrometheusClient
+	)
+
+	BeforeEach(func() {
+		prov, fakeProm = setupExternalPrometheusProvider()
+
+		startTime := pmodel.Now().Add(-1*fakeProviderUpdateInterval - fakeProviderUpdateInterval/10)
+		fakeProm.AcceptableInterval = pmodel.Interval{Start: startTime, End: pmodel.Now().Add(1 * time.Minute)}
+
+		lister := prov.(*externalPrometheusProvider).ExternalSeriesRegistry.(*cachingExternalMetricsLister)
+		Expect(lister.updateMetrics()).To(Succeed())
+	})
+
+	It("should list all external metrics", func() {
+		Expect(prov.ListAllExternalMetrics()).To(ConsistOf(
+			provider.ExternalMetricInfo{Metric: "depth"},
+			provider.ExternalMetricInfo{Metric: "saas_backlog"},
+		))
+	})
+
+	It("should translate the metric selector into label matchers, scoped to the namespace", func() {
+		selector, err := labels.Parse("queue in (orders,returns),env!=dev,region")
+		Expect(err).NotTo(HaveOccurred())
+
+		query := prom.Selector(`sum by(queue) (queue_depth{env!="dev",namespace="somens",queue=~"orders|returns",region!=""})`)
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					{
+						Metric:    pmodel.Metric{"queue": "orders"},
+						Value:     pmodel.SampleValue(42),
+						Timestamp: pmodel.Now(),
+					},
+				},
+			},
+		}
+
+		res, err := prov.GetExternalMetric("somens", selector, provider.ExternalMetricInfo{Metric: "depth"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Items).To(HaveLen(1))
+		Expect(res.Items[0].MetricName).To(Equal("depth"))
+		Expect(res.Items[0].MetricLabels).To(Equal(map[string]string{"queue": "orders"}))
+		Expect(res.Items[0].Value.MilliValue()).To(Equal(int64(42000)))
+	})
+
+	It("should not scope metrics without a namespace label to the namespace", func() {
+		query := prom.Selector(`sum by(queue) (queue_saas_backlog{queue="billing"})`)
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					{
+						Metric:    pmodel.Metric{"queue": "billing"},
+						Value:     pmodel.SampleValue(3),
+						Timestamp: pmodel.Now(),
+					},
+				},
+			},
+		}
+
+		res, err := prov.GetExternalMetric("somens", labels.SelectorFromSet(labels.Set{"queue": "billing"}), provider.ExternalMetricInfo{Metric: "saas_backlog"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Items).To(HaveLen(1))
+	})
+
+	It("should restrict queries and results to the namespace when enforcing namespace tenancy", func() {
+		prov.(*externalPrometheusProvider).enforceNamespaces = true
+
+		query := prom.Selector(`sum by(queue) (queue_saas_backlog{namespace="somens",queue="billing"})`)
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					{
+						Metric:    pmodel.Metric{"queue": "billing"},
+						Value:     pmodel.SampleValue(3),
+						Timestamp: pmodel.Now(),
+					},
+					{
+						Metric:    pmodel.Metric{"queue": "billing", "namespace": "otherns"},
+						Value:     pmodel.SampleValue(5),
+						Timestamp: pmodel.Now(),
+					},
+				},
+			},
+		}
+
+		res, err := prov.GetExternalMetric("somens", labels.SelectorFromSet(labels.Set{"queue": "billing"}), provider.ExternalMetricInfo{Metric: "saas_backlog"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Items).To(HaveLen(1))
+		Expect(res.Items[0].Value.MilliValue()).To(Equal(int64(3000)))
+	})
+
+	It("should return a not-found error for unknown metrics", func() {
+		_, err := prov.GetExternalMetric("somens", labels.Everything(), provider.ExternalMetricInfo{Metric: "nonexistent"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+// ExternalSeriesRegistry provides conversions between Prometheus series and ExternalMetricInfo
+type ExternalSeriesRegistry interface {
+	// SetSeries replaces the known series in this registry.
+	// Each slice in series should correspond to a MetricNamer in namers.
+	SetSeries(series [][]prom.Series, namers []MetricNamer) error
+	// ListAllExternalMetrics lists all external metrics known to this registry
+	ListAllExternalMetrics() []provider.ExternalMetricInfo
+	// QueryForExternalMetric produces the query for the given external metric, restricted
+	// to the given namespace (if the metric is namespaced) and metric selector.
+	QueryForExternalMetric(namespace string, metricName string, metricSelector labels.Selector) (query prom.Selector, found bool)
+	// NamerForExternalMetric returns the namer responsible for the given external metric, which
+	// determines (amongst other things) the Prometheus backend that should be queried for it.
+	NamerForExternalMetric(metricName string) (namer MetricNamer, found bool)
+}
+
+type externalSeriesInfo struct {
+	// seriesName is the name of the corresponding Prometheus series
+	seriesName string
+
+	// namespaced indicates whether or not the series has a namespace label
+	namespaced bool
+
+	// namer is the MetricNamer used to name this series
+	namer MetricNamer
+}
+
+// basicExternalSeriesRegistry is a basic ExternalSeriesRegistry
+type basicExternalSeriesRegistry struct {
+	mu sync.RWMutex
+
+	// info maps external metric names to information about the corresponding series
+	info map[string]externalSeriesInfo
+	// metrics is the list of all known external metrics
+	metrics []provider.ExternalMetricInfo
+}
+
+func (r *basicExternalSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers []MetricNamer) error {
+	if len(newSeriesSlices) != len(namers) {
+		return fmt.Errorf("need one set of series per namer")
+	}
+
+	newInfo := make(map[string]externalSeriesInfo)
+	for i, newSeries := range newSeriesSlices {
+		namer := namers[i]
+		for _, series := range newSeries {
+			name, err := namer.MetricNameForSeries(series)
+			if err != nil {
+				glog.Errorf("unable to name series %q, skipping: %v", series.String(), err)
+				continue
+			}
+			_, namespaced := namer.ResourcesForSeries(series)
+
+			// a metric is considered namespaced if any of its series are
+			if existing, ok := newInfo[name]; ok && existing.namespaced {
+				namespaced = true
+			}
+
+			newInfo[name] = externalSeriesInfo{
+				seriesName: series.Name,
+				namespaced: namespaced,
+				namer:      namer,
+			}
+		}
+	}
+
+	// regenerate metrics
+	newMetrics := make([]provider.ExternalMetricInfo, 0, len(newInfo))
+	for name := range newInfo {
+		newMetrics = append(newMetrics, provider.ExternalMetricInfo{Metric: name})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.info = newInfo
+	r.metrics = newMetrics
+
+	return nil
+}
+
+func (r *basicExternalSeriesRegistry) ListAllExternalMetrics() []provider.ExternalMetricInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.metrics
+}
+
+func (r *basicExternalSeriesRegistry) NamerForExternalMetric(metricName string) (MetricNamer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info, infoFound := r.info[metricName]
+	if !infoFound {
+		return nil, false
+	}
+	return info.namer, true
+}
+
+func (r *basicExternalSeriesRegistry) QueryForExternalMetric(namespace string, metricName string, metricSelector labels.Selector) (prom.Selector, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info, infoFound := r.info[metricName]
+	if !infoFound {
+		glog.V(10).Infof("external metric %q not registered", metricName)
+		return "", false
+	}
+
+	// only scope the query to the namespace if the series can actually be scoped
+	if !info.namespaced {
+		namespace = ""
+	}
+
+	query, err := info.namer.QueryForExternalSeries(info.seriesName, namespace, metricSelector)
+	if err != nil {
+		glog.Errorf("unable to construct query for external metric %q: %v", metricName, err)
+		return "", false
+	}
+
+	return query, true
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	plabels "github.com/prometheus/prometheus/model/labels"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
+)
+
+// globalMatchersNamer is a MetricNamer which adds a set of label matchers to the
+// series query used for discovery, and to every selector in the queries it produces.
+type globalMatchersNamer struct {
+	MetricNamer
+
+	selector prom.Selector
+	matchers []*plabels.Matcher
+}
+
+// withGlobalLabelMatchers wraps each of the given namers so that they only ever select
+// series matching the given label matchers.  The namers are returned as-is if there
+// aren't any matchers.
+func withGlobalLabelMatchers(namers []MetricNamer, rawMatchers []string) ([]MetricNamer, error) {
+	if len(rawMatchers) == 0 {
+		return namers, nil
+	}
+	matchers, err := naming.ParseLabelMatchers(rawMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global label matchers: %v", err)
+	}
+
+	res := make([]MetricNamer, len(namers))
+	for i, namer := range namers {
+		selector, err := naming.EnforceLabelMatchers(namer.Selector(), matchers)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply global label matchers to series query %q: %v", namer.Selector(), err)
+		}
+		res[i] = &globalMatchersNamer{
+			MetricNamer: namer,
+			selector:    selector,
+			matchers:    matchers,
+		}
+	}
+	return res, nil
+}
+
+func (n *globalMatchersNamer) Selector() prom.Selector {
+	return n.selector
+}
+
+func (n *globalMatchersNamer) QueryForSeries(series string, resource schema.GroupResource, namespace string, names ...string) (prom.Selector, error) {
+	query, err := n.MetricNamer.QueryForSeries(series, resource, namespace, names...)
+	if err != nil {
+		return "", err
+	}
+	return naming.EnforceLabelMatchers(query, n.matchers)
+}
+
+func (n *globalMatchersNamer) QueryForObjectSelector(series string, resource schema.GroupResource, namespace string, objectSelector labels.Selector) (prom.Selector, error) {
+	query, err := n.MetricNamer.QueryForObjectSelector(series, resource, namespace, objectSelector)
+	if err != nil {
+		return "", err
+	}
+	return naming.EnforceLabelMatchers(query, n.matchers)
+}
+
+func (n *globalMatchersNamer) QueryForExternalSeries(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error) {
+	query, err := n.MetricNamer.QueryForExternalSeries(series, namespace, metricSelector)
+	if err != nil {
+		return "", err
+	}
+	return naming.EnforceLabelMatchers(query, n.matchers)
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
@@ -29,11 +31,53 @@ type MetricNamer interface {
 	// constraints beyond the series query.  It's assumed that the series given
 	// already match the series query.
 	FilterSeries(series []prom.Series) []prom.Series
+	// StaticSeries returns the series for namers whose series are declared
+	// instead of discovered, or nil for namers whose series are discovered
+	// using Selector.
+	StaticSeries() []prom.Series
 	// MetricNameForSeries returns the name (as presented in the API) for a given series.
 	MetricNameForSeries(series prom.Series) (string, error)
 	// QueryForSeries returns the query for a given series (not API metric name), with
 	// the given namespace name (if relevant), resource, and resource names.
 	QueryForSeries(series string, resource schema.GroupResource, namespace string, names ...string) (prom.Selector, error)
+	// QueryForObjectSelector returns the query for a given series (not API metric name) on
+	// all objects of the given resource in the given namespace (if relevant) matching the
+	// given object selector, resolving the selector in Prometheus.  It may only be used if
+	// JoinsSelectors returns true.
+	QueryForObjectSelector(series string, resource schema.GroupResource, namespace string, objectSelector labels.Selector) (prom.Selector, error)
+	// JoinsSelectors checks whether label selectors for this namer's metrics should be
+	// resolved in Prometheus (using QueryForObjectSelector) instead of by listing objects.
+	JoinsSelectors() bool
+	// JoinedSeries returns the name of the series which QueryForObjectSelector joins
+	// queries for the given resource against, and the label carrying the namespace of
+	// each object on that series.  It may only be used if JoinsSelectors returns true.
+	JoinedSeries(resource schema.GroupResource) (series string, namespaceLabel string, err error)
+	// OwnerRollup returns how this namer's pod metrics are rolled up onto the owners
+	// of the pods, or nil if they aren't.
+	OwnerRollup() *OwnerRollup
+	// QueryForExternalSeries returns the query for a given series (not API metric name) when
+	// exposed as an external metric, with the given namespace name (if relevant) and metric selector.
+	QueryForExternalSeries(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error)
+	// Backend returns the name of the Prometheus backend that series for this
+	// namer should be listed from and queried against (empty for the default).
+	Backend() string
+	// MaxSampleAge returns the age beyond which samples returned by queries for
+	// this namer's metrics are considered stale (zero for no limit).
+	MaxSampleAge() time.Duration
+	// Window returns the window to report with this namer's metrics, or zero if
+	// it should be determined from the query.
+	Window() time.Duration
+	// RelistInterval returns the interval at which to relist this namer's series,
+	// or zero to use the default.
+	RelistInterval() time.Duration
+	// SeriesMaxAge returns the period for which this namer's series are kept after
+	// they were last seen, or zero to use the default.
+	SeriesMaxAge() time.Duration
+	// DiscoveryOptions returns how this namer's series should be listed.
+	DiscoveryOptions() DiscoveryOptions
+	// CacheTTL returns how long the results of queries for this namer's metrics
+	// are cached for, or zero to use the default (negative to disable caching).
+	CacheTTL() time.Duration
 
 	naming.ResourceConverter
 }
@@ -42,6 +86,46 @@ func (r *metricNamer) Selector() prom.Selector {
 	return r.seriesQuery
 }
 
+func (r *metricNamer) StaticSeries() []prom.Series {
+	return nil
+}
+
+func (r *metricNamer) Backend() string {
+	return r.backend
+}
+
+func (r *metricNamer) MaxSampleAge() time.Duration {
+	return r.maxSampleAge
+}
+
+func (r *metricNamer) Window() time.Duration {
+	return r.window
+}
+
+func (r *metricNamer) RelistInterval() time.Duration {
+	return r.relistInterval
+}
+
+func (r *metricNamer) SeriesMaxAge() time.Duration {
+	return r.seriesMaxAge
+}
+
+func (r *metricNamer) CacheTTL() time.Duration {
+	return r.cacheTTL
+}
+
+func (r *metricNamer) DiscoveryOptions() DiscoveryOptions {
+	return r.discovery
+}
+
+func (r *metricNamer) JoinsSelectors() bool {
+	return r.selectorJoin != nil
+}
+
+func (r *metricNamer) OwnerRollup() *OwnerRollup {
+	return r.ownerRollup
+}
+
 // reMatcher either positively or negatively matches a regex
 type reMatcher struct {
 	regex    *regexp.Regexp
@@ -87,6 +171,15 @@ type metricNamer struct {
 	nameMatches    *regexp.Regexp
 	nameAs         string
 	seriesMatchers []*reMatcher
+	backend        string
+	maxSampleAge   time.Duration
+	window         time.Duration
+	relistInterval time.Duration
+	seriesMaxAge   time.Duration
+	discovery      DiscoveryOptions
+	cacheTTL       time.Duration
+	selectorJoin   naming.SelectorJoin
+	ownerRollup    *OwnerRollup
 
 	naming.ResourceConverter
 }
@@ -115,6 +208,28 @@ func (n *metricNamer) QueryForSeries(series string, resource schema.GroupResourc
 	return n.metricsQuery.Build(series, resource, namespace, nil, names...)
 }
 
+func (n *metricNamer) QueryForObjectSelector(series string, resource schema.GroupResource, namespace string, objectSelector labels.Selector) (prom.Selector, error) {
+	if n.selectorJoin == nil {
+		return "", fmt.Errorf("label selectors for series %q can't be resolved in Prometheus", series)
+	}
+	query, err := n.metricsQuery.Build(series, resource, namespace, nil)
+	if err != nil {
+		return "", err
+	}
+	return n.selectorJoin.Join(query, resource, namespace, objectSelector)
+}
+
+func (n *metricNamer) JoinedSeries(resource schema.GroupResource) (string, string, error) {
+	if n.selectorJoin == nil {
+		return "", "", fmt.Errorf("label selectors for resource %s can't be resolved in Prometheus", resource.String())
+	}
+	return n.selectorJoin.JoinedSeries(resource)
+}
+
+func (n *metricNamer) QueryForExternalSeries(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error) {
+	return n.metricsQuery.BuildExternal(series, namespace, metricSelector)
+}
+
 func (n *metricNamer) MetricNameForSeries(series prom.Series) (string, error) {
 	matches := n.nameMatches.FindStringSubmatchIndex(series.Name)
 	if matches == nil {
@@ -124,73 +239,150 @@ func (n *metricNamer) MetricNameForSeries(series prom.Series) (string, error) {
 	return string(outNameBytes), nil
 }
 
-// NamersFromConfig produces a MetricNamer for each rule in the given config.
+// NamersFromConfig produces a MetricNamer for each rule, followed by one for
+// each static metric, in the given config.  The namers apply the config's global
+// label matchers.
 func NamersFromConfig(cfg *config.MetricsDiscoveryConfig, mapper apimeta.RESTMapper) ([]MetricNamer, error) {
-	namers := make([]MetricNamer, len(cfg.Rules))
+	namers, err := namersFromRules(cfg.Rules, mapper)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, metric := range cfg.StaticMetrics {
+		namer, err := NamerFromStaticMetric(metric, mapper)
+		if err != nil {
+			return nil, err
+		}
+		namers = append(namers, namer)
+	}
+
+	return withGlobalLabelMatchers(namers, cfg.GlobalLabelMatchers)
+}
+
+// ExternalNamersFromConfig produces a MetricNamer for each external rule in the given
+// config.  The namers apply the config's global label matchers.
+func ExternalNamersFromConfig(cfg *config.MetricsDiscoveryConfig, mapper apimeta.RESTMapper) ([]MetricNamer, error) {
+	namers, err := namersFromRules(cfg.ExternalRules, mapper)
+	if err != nil {
+		return nil, err
+	}
+	return withGlobalLabelMatchers(namers, cfg.GlobalLabelMatchers)
+}
+
+// namersFromRules produces a MetricNamer for each of the given rules.
+func namersFromRules(rules []config.DiscoveryRule, mapper apimeta.RESTMapper) ([]MetricNamer, error) {
+	namers := make([]MetricNamer, len(rules))
 
-	for i, rule := range cfg.Rules {
-		resConv, err := naming.NewResourceConverter(rule.Resources.Template, rule.Resources.Overrides, mapper)
+	for i, rule := range rules {
+		namer, err := NamerFromRule(rule, mapper)
 		if err != nil {
 			return nil, err
 		}
+		namers[i] = namer
+	}
+
+	return namers, nil
+}
+
+// NamerFromRule produces a MetricNamer for a single discovery rule.
+func NamerFromRule(rule config.DiscoveryRule, mapper apimeta.RESTMapper) (MetricNamer, error) {
+	resConv, err := naming.NewResourceConverter(rule.Resources.Template, rule.Resources.Overrides, mapper)
+	if err != nil {
+		return nil, err
+	}
 
-		metricsQuery, err := naming.NewMetricsQuery(rule.MetricsQuery, resConv)
+	metricsQuery, err := naming.NewMetricsQuery(rule.MetricsQuery, resConv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct metrics query associated with series query %q: %v", rule.SeriesQuery, err)
+	}
+
+	if rule.RelistInterval < 0 || rule.MaxAge < 0 {
+		return nil, fmt.Errorf("relist interval and max age associated with series query %q may not be negative", rule.SeriesQuery)
+	}
+	if rule.RelistInterval != 0 && rule.MaxAge != 0 && rule.MaxAge < rule.RelistInterval {
+		return nil, fmt.Errorf("max age %s associated with series query %q must not be less than relist interval %s", rule.MaxAge, rule.SeriesQuery, rule.RelistInterval)
+	}
+
+	var discovery DiscoveryOptions
+	if rule.Discovery != nil {
+		discovery, err = discoveryOptionsFromConfig(*rule.Discovery, prom.Selector(rule.SeriesQuery))
 		if err != nil {
-			return nil, fmt.Errorf("unable to construct metrics query associated with series query %q: %v", rule.SeriesQuery, err)
+			return nil, fmt.Errorf("invalid discovery options associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+	}
 
-		seriesMatchers := make([]*reMatcher, len(rule.SeriesFilters))
-		for i, filterRaw := range rule.SeriesFilters {
-			matcher, err := newReMatcher(filterRaw)
-			if err != nil {
-				return nil, fmt.Errorf("unable to generate series name filter associated with series query %q: %v", rule.SeriesQuery, err)
-			}
-			seriesMatchers[i] = matcher
+	var selectorJoin naming.SelectorJoin
+	if rule.SelectorJoin != nil {
+		selectorJoin, err = naming.NewSelectorJoin(*rule.SelectorJoin, resConv, mapper)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct selector join associated with series query %q: %v", rule.SeriesQuery, err)
 		}
-		if rule.Name.Matches != "" {
-			matcher, err := newReMatcher(config.RegexFilter{Is: rule.Name.Matches})
-			if err != nil {
-				return nil, fmt.Errorf("unable to generate series name filter from name rules associated with series query %q: %v", rule.SeriesQuery, err)
-			}
-			seriesMatchers = append(seriesMatchers, matcher)
+	}
+
+	var ownerRollup *OwnerRollup
+	if rule.OwnerRollup != nil {
+		ownerRollup, err = ownerRollupFromConfig(*rule.OwnerRollup, mapper)
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner rollup associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+	}
 
-		var nameMatches *regexp.Regexp
-		if rule.Name.Matches != "" {
-			nameMatches, err = regexp.Compile(rule.Name.Matches)
-			if err != nil {
-				return nil, fmt.Errorf("unable to compile series name match expression %q associated with series query %q: %v", rule.Name.Matches, rule.SeriesQuery, err)
-			}
-		} else {
-			// this will always succeed
-			nameMatches = regexp.MustCompile(".*")
+	seriesMatchers := make([]*reMatcher, len(rule.SeriesFilters))
+	for i, filterRaw := range rule.SeriesFilters {
+		matcher, err := newReMatcher(filterRaw)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate series name filter associated with series query %q: %v", rule.SeriesQuery, err)
 		}
-		nameAs := rule.Name.As
-		if nameAs == "" {
-			// check if we have an obvious default
-			subexpNames := nameMatches.SubexpNames()
-			if len(subexpNames) == 1 {
-				// no capture groups, use the whole thing
-				nameAs = "$0"
-			} else if len(subexpNames) == 2 {
-				// one capture group, use that
-				nameAs = "$1"
-			} else {
-				return nil, fmt.Errorf("must specify an 'as' value for name matcher %q associated with series query %q", rule.Name.Matches, rule.SeriesQuery)
-			}
+		seriesMatchers[i] = matcher
+	}
+	if rule.Name.Matches != "" {
+		matcher, err := newReMatcher(config.RegexFilter{Is: rule.Name.Matches})
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate series name filter from name rules associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+		seriesMatchers = append(seriesMatchers, matcher)
+	}
 
-		namer := &metricNamer{
-			seriesQuery:       prom.Selector(rule.SeriesQuery),
-			metricsQuery:      metricsQuery,
-			nameMatches:       nameMatches,
-			nameAs:            nameAs,
-			seriesMatchers:    seriesMatchers,
-			ResourceConverter: resConv,
+	var nameMatches *regexp.Regexp
+	if rule.Name.Matches != "" {
+		nameMatches, err = regexp.Compile(rule.Name.Matches)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile series name match expression %q associated with series query %q: %v", rule.Name.Matches, rule.SeriesQuery, err)
+		}
+	} else {
+		// this will always succeed
+		nameMatches = regexp.MustCompile(".*")
+	}
+	nameAs := rule.Name.As
+	if nameAs == "" {
+		// check if we have an obvious default
+		subexpNames := nameMatches.SubexpNames()
+		if len(subexpNames) == 1 {
+			// no capture groups, use the whole thing
+			nameAs = "$0"
+		} else if len(subexpNames) == 2 {
+			// one capture group, use that
+			nameAs = "$1"
+		} else {
+			return nil, fmt.Errorf("must specify an 'as' value for name matcher %q associated with series query %q", rule.Name.Matches, rule.SeriesQuery)
 		}
-
-		namers[i] = namer
 	}
 
-	return namers, nil
+	return &metricNamer{
+		seriesQuery:       prom.Selector(rule.SeriesQuery),
+		metricsQuery:      metricsQuery,
+		nameMatches:       nameMatches,
+		nameAs:            nameAs,
+		seriesMatchers:    seriesMatchers,
+		backend:           rule.Backend,
+		maxSampleAge:      time.Duration(rule.MaxSampleAge),
+		window:            time.Duration(rule.Window),
+		relistInterval:    time.Duration(rule.RelistInterval),
+		seriesMaxAge:      time.Duration(rule.MaxAge),
+		discovery:         discovery,
+		cacheTTL:          time.Duration(rule.CacheTTL),
+		selectorJoin:      selectorJoin,
+		ownerRollup:       ownerRollup,
+		ResourceConverter: resConv,
+	}, nil
 }
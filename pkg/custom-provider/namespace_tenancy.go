@@ -0,0 +1,116 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
+)
+
+var (
+	// namespaceTenancyDroppedSamples counts the result samples dropped because
+	// they belonged to a namespace other than the one requested.
+	namespaceTenancyDroppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_namespace_tenancy_dropped_samples_total",
+			Help: "Number of query result samples dropped because their namespace label didn't match the requested namespace.  Broken down by API",
+		},
+		[]string{"api"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(namespaceTenancyDroppedSamples)
+}
+
+// namespaceEnforcer restricts queries and their results to a single namespace,
+// so that metrics requests for one namespace can't read the series of another,
+// whatever the query template does.
+type namespaceEnforcer struct {
+	// api names the metrics API being served, for use in metrics.
+	api       string
+	label     pmodel.LabelName
+	namespace string
+	// seriesLabels holds the namespace label to use for selectors of particular
+	// series (e.g. the series joined against to resolve label selectors), which
+	// don't use the same label as the rule's series.
+	seriesLabels map[string]pmodel.LabelName
+}
+
+// newNamespaceEnforcer constructs a namespaceEnforcer for the given namespace, using
+// the label which the given converter maps namespaces to.
+func newNamespaceEnforcer(api string, converter naming.ResourceConverter, namespace string) (*namespaceEnforcer, error) {
+	label, err := converter.LabelForResource(nsGroupResource)
+	if err != nil {
+		return nil, fmt.Errorf("unable to restrict query to namespace %q, since namespaces aren't mapped to a label: %v", namespace, err)
+	}
+	return &namespaceEnforcer{
+		api:       api,
+		label:     label,
+		namespace: namespace,
+	}, nil
+}
+
+// UseLabelForSeries restricts selectors for the given series to the namespace
+// using the given label, instead of the label used for the rest of the query.
+func (e *namespaceEnforcer) UseLabelForSeries(series string, label pmodel.LabelName) {
+	if e.seriesLabels == nil {
+		e.seriesLabels = make(map[string]pmodel.LabelName)
+	}
+	e.seriesLabels[series] = label
+}
+
+// EnforceQuery adds a matcher for the namespace to every selector in the given query.
+func (e *namespaceEnforcer) EnforceQuery(query prom.Selector) (prom.Selector, error) {
+	seriesMatchers := make(map[string][]*plabels.Matcher, len(e.seriesLabels))
+	for series, label := range e.seriesLabels {
+		seriesMatchers[series] = []*plabels.Matcher{
+			plabels.MustNewMatcher(plabels.MatchEqual, string(label), e.namespace),
+		}
+	}
+	return naming.EnforceLabelMatchersBySeries(query, []*plabels.Matcher{
+		plabels.MustNewMatcher(plabels.MatchEqual, string(e.label), e.namespace),
+	}, seriesMatchers)
+}
+
+// FilterResults drops the samples whose namespace label is set to a different
+// namespace.  Samples without the label (e.g. because the query aggregated it
+// away) are kept, since they can only have come from the namespace's series.
+func (e *namespaceEnforcer) FilterResults(samples pmodel.Vector) pmodel.Vector {
+	res := make(pmodel.Vector, 0, len(samples))
+	for _, sample := range samples {
+		if sample == nil {
+			continue
+		}
+		if ns, present := sample.Metric[e.label]; present && string(ns) != e.namespace {
+			continue
+		}
+		res = append(res, sample)
+	}
+	if dropped := len(samples) - len(res); dropped > 0 {
+		glog.Warningf("dropped %d sample(s) from namespaces other than %q from the results of a %s metrics query", dropped, e.namespace, e.api)
+		namespaceTenancyDroppedSamples.WithLabelValues(e.api).Add(float64(dropped))
+	}
+	return res
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// objectCacheResources tracks the number of resources being watched by the object cache.
+	objectCacheResources = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cmgateway_object_cache_watched_resources",
+			Help: "Number of resources watched in order to resolve label selectors locally",
+		},
+	)
+
+	// objectCacheObjects tracks the number of objects in the object cache.
+	objectCacheObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cmgateway_object_cache_objects",
+			Help: "Number of objects cached in order to resolve label selectors locally.  Broken down by resource",
+		},
+		[]string{"resource"},
+	)
+
+	// objectCacheLookups counts label selector lookups, broken down by whether
+	// they were served from the cache or by listing from the API server.
+	objectCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_object_cache_lookups_total",
+			Help: "Number of label selector lookups.  Broken down by source (cache or apiserver)",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(objectCacheResources, objectCacheObjects, objectCacheLookups)
+}
+
+// ObjectLister knows how to find the names of the objects described by a metric
+// which match a label selector.
+type ObjectLister interface {
+	// ListObjectNames lists the names of all objects of the resource for the given
+	// metric matching the given selector.  Namespace may be empty if the metric is
+	// for a root-scoped resource.
+	ListObjectNames(namespace string, selector labels.Selector, info provider.CustomMetricInfo) ([]string, error)
+}
+
+type dynamicObjectLister struct {
+	mapper apimeta.RESTMapper
+	client dynamic.Interface
+}
+
+// NewDynamicObjectLister constructs an ObjectLister which lists objects from the
+// API server on every call, using the given dynamic client.
+func NewDynamicObjectLister(mapper apimeta.RESTMapper, client dynamic.Interface) ObjectLister {
+	return &dynamicObjectLister{
+		mapper: mapper,
+		client: client,
+	}
+}
+
+func (l *dynamicObjectLister) ListObjectNames(namespace string, selector labels.Selector, info provider.CustomMetricInfo) ([]string, error) {
+	objectCacheLookups.WithLabelValues("apiserver").Inc()
+	return helpers.ListObjectNames(l.mapper, l.client, namespace, selector, info)
+}
+
+// CachingObjectLister is an ObjectLister which resolves label selectors against
+// a local cache of objects.  Watches are started lazily, the first time objects of
+// a given resource are requested, and at most a fixed number of resources are
+// watched.  Requests for other resources, or for resources whose cache hasn't
+// synced yet, are served by listing objects from the API server.  Only the
+// metadata needed to resolve label selectors is kept in the cache.
+type CachingObjectLister struct {
+	mapper       apimeta.RESTMapper
+	client       dynamic.Interface
+	fallback     ObjectLister
+	maxResources int
+
+	mu        sync.Mutex
+	stopChan  <-chan struct{}
+	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+	refused   map[schema.GroupVersionResource]struct{}
+}
+
+// NewCachingObjectLister constructs a CachingObjectLister which watches at most
+// maxResources resources using the given dynamic client.  No watches are started
+// until RunUntil is called.
+func NewCachingObjectLister(mapper apimeta.RESTMapper, client dynamic.Interface, maxResources int) *CachingObjectLister {
+	return &CachingObjectLister{
+		mapper:       mapper,
+		client:       client,
+		fallback:     NewDynamicObjectLister(mapper, client),
+		maxResources: maxResources,
+		informers:    make(map[schema.GroupVersionResource]cache.SharedIndexInformer),
+		refused:      make(map[schema.GroupVersionResource]struct{}),
+	}
+}
+
+// RunUntil allows watches to be started, stopping them once the given channel is closed.
+func (l *CachingObjectLister) RunUntil(stopChan <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopChan = stopChan
+}
+
+func (l *CachingObjectLister) ListObjectNames(namespace string, selector labels.Selector, info provider.CustomMetricInfo) ([]string, error) {
+	res, err := helpers.ResourceFor(l.mapper, info)
+	if err != nil {
+		return nil, err
+	}
+
+	informer, found := l.informerFor(res)
+	if !found || !informer.HasSynced() {
+		return l.fallback.ListObjectNames(namespace, selector, info)
+	}
+
+	var names []string
+	appendName := func(obj interface{}) {
+		names = append(names, obj.(*unstructured.Unstructured).GetName())
+	}
+	if info.Namespaced {
+		err = cache.ListAllByNamespace(informer.GetIndexer(), namespace, selector, appendName)
+	} else {
+		err = cache.ListAll(informer.GetStore(), selector, appendName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objectCacheLookups.WithLabelValues("cache").Inc()
+	return names, nil
+}
+
+// informerFor returns the informer for the given resource, starting it if
+// necessary.  It returns false if the resource can't be watched.
+func (l *CachingObjectLister) informerFor(res schema.GroupVersionResource) (cache.SharedIndexInformer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if informer, found := l.informers[res]; found {
+		return informer, true
+	}
+	if l.stopChan == nil {
+		return nil, false
+	}
+	if len(l.informers) >= l.maxResources {
+		if _, alreadyRefused := l.refused[res]; !alreadyRefused {
+			glog.Warningf("not caching objects for %s: already watching the maximum of %d resources, falling back to listing from the API server", res.String(), l.maxResources)
+			l.refused[res] = struct{}{}
+		}
+		return nil, false
+	}
+
+	informer := l.newInformer(res)
+	l.informers[res] = informer
+	objectCacheResources.Set(float64(len(l.informers)))
+	glog.V(2).Infof("started caching objects for %s", res.String())
+	go informer.Run(l.stopChan)
+
+	return informer, true
+}
+
+// newInformer constructs an informer which caches the metadata of all
+// objects of the given resource.
+func (l *CachingObjectLister) newInformer(res schema.GroupVersionResource) cache.SharedIndexInformer {
+	resClient := l.client.Resource(res)
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			list, err := resClient.List(opts)
+			if err != nil {
+				return nil, err
+			}
+			stripped := &unstructured.UnstructuredList{Object: list.Object}
+			stripped.Items = make([]unstructured.Unstructured, len(list.Items))
+			for i := range list.Items {
+				stripped.Items[i] = *stripToMetadata(&list.Items[i])
+			}
+			return stripped, nil
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			w, err := resClient.Watch(opts)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(evt watch.Event) (watch.Event, bool) {
+				if obj, isUnstructured := evt.Object.(*unstructured.Unstructured); isUnstructured && evt.Type != watch.Error {
+					evt.Object = stripToMetadata(obj)
+				}
+				return evt, true
+			}), nil
+		},
+	}
+
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 0, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	})
+
+	groupResource := res.GroupResource()
+	objects := objectCacheObjects.WithLabelValues(groupResource.String())
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { objects.Inc() },
+		DeleteFunc: func(interface{}) { objects.Dec() },
+	})
+
+	return informer
+}
+
+// stripToMetadata returns a copy of the given object containing just the
+// metadata needed to resolve label selectors.
+func stripToMetadata(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	stripped := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	stripped.SetAPIVersion(obj.GetAPIVersion())
+	stripped.SetKind(obj.GetKind())
+	stripped.SetNamespace(obj.GetNamespace())
+	stripped.SetName(obj.GetName())
+	stripped.SetUID(obj.GetUID())
+	stripped.SetResourceVersion(obj.GetResourceVersion())
+	stripped.SetLabels(obj.GetLabels())
+	return stripped
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// listWatchDynamicClient is a dynamic client which only supports listing and
+// watching, counting the number of list calls it receives.
+type listWatchDynamicClient struct {
+	mu       sync.Mutex
+	objects  []unstructured.Unstructured
+	lists    int
+	watchers []*watch.FakeWatcher
+}
+
+func (c *listWatchDynamicClient) Resource(res schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &listWatchResourceClient{client: c, resource: res}
+}
+
+func (c *listWatchDynamicClient) listCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lists
+}
+
+type listWatchResourceClient struct {
+	// embedded so that we satisfy the interface -- calling unimplemented methods panics
+	dynamic.NamespaceableResourceInterface
+
+	client    *listWatchDynamicClient
+	resource  schema.GroupVersionResource
+	namespace string
+}
+
+func (c *listWatchResourceClient) Namespace(ns string) dynamic.ResourceInterface {
+	return &listWatchResourceClient{client: c.client, resource: c.resource, namespace: ns}
+}
+
+func (c *listWatchResourceClient) List(opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	c.client.lists++
+
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{}}
+	list.SetResourceVersion("1")
+	for _, obj := range c.client.objects {
+		if c.namespace != "" && obj.GetNamespace() != c.namespace {
+			continue
+		}
+		if selector.Matches(labels.Set(obj.GetLabels())) {
+			list.Items = append(list.Items, obj)
+		}
+	}
+	return list, nil
+}
+
+func (c *listWatchResourceClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	watcher := watch.NewFake()
+	c.client.watchers = append(c.client.watchers, watcher)
+	return watcher, nil
+}
+
+func testPod(namespace, name string, lbls map[string]string) unstructured.Unstructured {
+	pod := unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"nodeName": "somenode"},
+	}}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace(namespace)
+	pod.SetName(name)
+	pod.SetLabels(lbls)
+	return pod
+}
+
+var _ = Describe("Caching Object Lister", func() {
+	var (
+		client   *listWatchDynamicClient
+		stopChan chan struct{}
+		podInfo  provider.CustomMetricInfo
+		nodeInfo provider.CustomMetricInfo
+	)
+
+	BeforeEach(func() {
+		client = &listWatchDynamicClient{
+			objects: []unstructured.Unstructured{
+				testPod("somens", "pod1", map[string]string{"app": "web"}),
+				testPod("somens", "pod2", map[string]string{"app": "db"}),
+				testPod("otherns", "pod3", map[string]string{"app": "web"}),
+			},
+		}
+		stopChan = make(chan struct{})
+		podInfo = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"}
+		nodeInfo = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_gigawatts"}
+	})
+
+	AfterEach(func() {
+		close(stopChan)
+	})
+
+	It("should resolve label selectors from the cache once it has synced", func() {
+		lister := NewCachingObjectLister(restMapper(), client, 10)
+		lister.RunUntil(stopChan)
+		selector := labels.SelectorFromSet(labels.Set{"app": "web"})
+
+		By("listing from the API server while the cache syncs")
+		names, err := lister.ListObjectNames("somens", selector, podInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("pod1"))
+
+		By("waiting for the cache to sync, and checking that lookups no longer list")
+		Eventually(func() bool {
+			informer, found := lister.informerFor(schema.GroupVersionResource{Version: "v1", Resource: "pods"})
+			return found && informer.HasSynced()
+		}).Should(BeTrue())
+		listsBefore := client.listCount()
+
+		names, err = lister.ListObjectNames("somens", selector, podInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("pod1"))
+		names, err = lister.ListObjectNames("otherns", labels.Everything(), podInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("pod3"))
+		Expect(client.listCount()).To(Equal(listsBefore))
+
+		By("checking that only metadata is kept in the cache")
+		informer, _ := lister.informerFor(schema.GroupVersionResource{Version: "v1", Resource: "pods"})
+		for _, obj := range informer.GetStore().List() {
+			Expect(obj.(*unstructured.Unstructured).Object).NotTo(HaveKey("spec"))
+		}
+	})
+
+	It("should list from the API server once the maximum number of resources are watched", func() {
+		lister := NewCachingObjectLister(restMapper(), client, 1)
+		lister.RunUntil(stopChan)
+
+		_, err := lister.ListObjectNames("somens", labels.Everything(), podInfo)
+		Expect(err).NotTo(HaveOccurred())
+		_, found := lister.informerFor(schema.GroupVersionResource{Version: "v1", Resource: "nodes"})
+		Expect(found).To(BeFalse())
+
+		listsBefore := client.listCount()
+		_, err = lister.ListObjectNames("", labels.Everything(), nodeInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.listCount()).To(BeNumerically(">", listsBefore))
+	})
+
+	It("should not start watches before it is run", func() {
+		lister := NewCachingObjectLister(restMapper(), client, 10)
+
+		names, err := lister.ListObjectNames("somens", labels.Everything(), podInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("pod1", "pod2"))
+		_, found := lister.informerFor(schema.GroupVersionResource{Version: "v1", Resource: "pods"})
+		Expect(found).To(BeFalse())
+	})
+})
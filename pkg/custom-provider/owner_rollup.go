@@ -0,0 +1,222 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+var podGroupResource = schema.GroupResource{Resource: "pods"}
+
+// defaultRollupOwners are the owners onto which pod metrics are rolled up,
+// if a rule doesn't list any.  Owners which aren't served by the cluster are
+// skipped.
+var defaultRollupOwners = []config.GroupResource{
+	{Group: "apps", Resource: "deployments"},
+	{Group: "apps", Resource: "statefulsets"},
+	{Group: "apps", Resource: "daemonsets"},
+	{Group: "apps", Resource: "replicasets"},
+	{Group: "batch", Resource: "jobs"},
+}
+
+// OwnerRollup describes how a namer's pod metrics are rolled up onto the
+// objects which own the pods.
+type OwnerRollup struct {
+	// Owners are the (normalized) group-resources onto which metrics are rolled up.
+	Owners []schema.GroupResource
+	// Aggregation is the function used to combine the values for each pod.
+	Aggregation string
+}
+
+// ownerRollupFromConfig normalizes and checks the given rollup configuration.
+func ownerRollupFromConfig(cfg config.OwnerRollup, mapper apimeta.RESTMapper) (*OwnerRollup, error) {
+	rollup := &OwnerRollup{Aggregation: cfg.Aggregation}
+	switch rollup.Aggregation {
+	case "":
+		rollup.Aggregation = "sum"
+	case "sum", "avg", "max", "min":
+	default:
+		return nil, fmt.Errorf("unknown owner rollup aggregation %q (must be one of sum, avg, max, or min)", cfg.Aggregation)
+	}
+
+	resources := cfg.Resources
+	useDefaults := len(resources) == 0
+	if useDefaults {
+		resources = defaultRollupOwners
+	}
+	for _, res := range resources {
+		info, _, err := provider.CustomMetricInfo{
+			GroupResource: schema.GroupResource{Group: res.Group, Resource: res.Resource},
+		}.Normalized(mapper)
+		if err != nil {
+			if useDefaults {
+				glog.V(2).Infof("not rolling up pod metrics onto %s: %v", res.Resource, err)
+				continue
+			}
+			return nil, fmt.Errorf("unable to normalize owner rollup group-resource %v: %v", res, err)
+		}
+		rollup.Owners = append(rollup.Owners, info.GroupResource)
+	}
+
+	return rollup, nil
+}
+
+// aggregateSamples combines the given pod samples into a single sample, using the
+// given aggregation.  The combined sample has the timestamp of the oldest sample.
+func aggregateSamples(aggregation string, samples []*pmodel.Sample) *pmodel.Sample {
+	res := &pmodel.Sample{
+		Value:     samples[0].Value,
+		Timestamp: samples[0].Timestamp,
+	}
+	for _, sample := range samples[1:] {
+		switch aggregation {
+		case "max":
+			if sample.Value > res.Value {
+				res.Value = sample.Value
+			}
+		case "min":
+			if sample.Value < res.Value {
+				res.Value = sample.Value
+			}
+		default:
+			res.Value += sample.Value
+		}
+		if sample.Timestamp.Before(res.Timestamp) {
+			res.Timestamp = sample.Timestamp
+		}
+	}
+	if aggregation == "avg" {
+		res.Value /= pmodel.SampleValue(len(samples))
+	}
+	return res
+}
+
+// OwnerResolver finds the pods owned by workload objects, such as deployments.
+type OwnerResolver interface {
+	// PodsForOwners returns the names of the pods in the given namespace which are
+	// controlled (directly, or through a ReplicaSet) by each of the named objects
+	// of the given group-resource.
+	PodsForOwners(owner schema.GroupResource, namespace string, names []string) (map[string][]string, error)
+}
+
+type listerOwnerResolver struct {
+	mapper      apimeta.RESTMapper
+	pods        corelisters.PodLister
+	replicaSets appslisters.ReplicaSetLister
+}
+
+// NewOwnerResolver constructs an OwnerResolver which follows controller references
+// using the given (informer-backed) listers.
+func NewOwnerResolver(mapper apimeta.RESTMapper, pods corelisters.PodLister, replicaSets appslisters.ReplicaSetLister) OwnerResolver {
+	return &listerOwnerResolver{
+		mapper:      mapper,
+		pods:        pods,
+		replicaSets: replicaSets,
+	}
+}
+
+// objectRef refers to an object in a known namespace.
+type objectRef struct {
+	groupResource schema.GroupResource
+	name          string
+}
+
+func (r *listerOwnerResolver) PodsForOwners(owner schema.GroupResource, namespace string, names []string) (map[string][]string, error) {
+	wanted := sets.NewString(names...)
+	pods, err := r.pods.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %v", err)
+	}
+
+	res := make(map[string][]string)
+	for _, pod := range pods {
+		for _, ref := range r.ownersOf(namespace, pod) {
+			if ref.groupResource == owner && wanted.Has(ref.name) {
+				res[ref.name] = append(res[ref.name], pod.Name)
+			}
+		}
+	}
+	for _, podNames := range res {
+		sort.Strings(podNames)
+	}
+	return res, nil
+}
+
+// ownersOf returns the controller of the given pod, plus the controller of
+// that, if the pod is controlled by a ReplicaSet.
+func (r *listerOwnerResolver) ownersOf(namespace string, pod *corev1.Pod) []objectRef {
+	controllerRef := metav1.GetControllerOf(pod)
+	if controllerRef == nil {
+		return nil
+	}
+	owner, err := r.refFor(controllerRef)
+	if err != nil {
+		glog.V(4).Infof("unable to resolve controller of pod %s/%s: %v", namespace, pod.Name, err)
+		return nil
+	}
+	owners := []objectRef{owner}
+	if owner.groupResource.Resource != "replicasets" {
+		return owners
+	}
+
+	replicaSet, err := r.replicaSets.ReplicaSets(namespace).Get(owner.name)
+	if err != nil {
+		// the ReplicaSet may not be in the cache yet
+		return owners
+	}
+	if rsControllerRef := metav1.GetControllerOf(replicaSet); rsControllerRef != nil {
+		rsOwner, err := r.refFor(rsControllerRef)
+		if err != nil {
+			glog.V(4).Infof("unable to resolve controller of replicaset %s/%s: %v", namespace, owner.name, err)
+			return owners
+		}
+		owners = append(owners, rsOwner)
+	}
+	return owners
+}
+
+// refFor converts an owner reference into a reference to a normalized group-resource.
+func (r *listerOwnerResolver) refFor(ref *metav1.OwnerReference) (objectRef, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return objectRef{}, err
+	}
+	mapping, err := r.mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: ref.Kind}, gv.Version)
+	if err != nil {
+		return objectRef{}, err
+	}
+	info, _, err := provider.CustomMetricInfo{GroupResource: mapping.Resource.GroupResource()}.Normalized(r.mapper)
+	if err != nil {
+		return objectRef{}, err
+	}
+	return objectRef{groupResource: info.GroupResource, name: ref.Name}, nil
+}
@@ -19,6 +19,8 @@ package provider
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,52 +33,93 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
-	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/dynamic"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
 )
 
-// Runnable represents something that can be run until told to stop.
-type Runnable interface {
-	// Run runs the runnable forever.
-	Run()
-	// RunUntil runs the runnable until the given channel is closed.
-	RunUntil(stopChan <-chan struct{})
-}
-
 type prometheusProvider struct {
-	mapper     apimeta.RESTMapper
-	kubeClient dynamic.Interface
-	promClient prom.Client
+	mapper      apimeta.RESTMapper
+	objects     ObjectLister
+	owners      OwnerResolver
+	promClients prom.Backends
+
+	// queryTimeout bounds each request for metrics (zero for no limit).
+	queryTimeout time.Duration
+	// cache caches (and coalesces) query results, for cacheTTL by default.
+	cache    *queryCache
+	cacheTTL time.Duration
+	// maxNamesPerQuery is the largest number of objects that a single query
+	// is made for (zero for no limit).
+	maxNamesPerQuery int
+	// enforceNamespaces restricts the queries (and results) for namespaced
+	// requests to the requested namespace.
+	enforceNamespaces bool
 
 	SeriesRegistry
 }
 
-func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers []MetricNamer, updateInterval time.Duration, maxAge time.Duration) (provider.CustomMetricsProvider, Runnable) {
-	lister := &cachingMetricsLister{
-		updateInterval: updateInterval,
-		maxAge:         maxAge,
-		promClient:     promClient,
-		namers:         namers,
+// ProviderOptions configure how a provider discovers series and queries
+// Prometheus for metrics.  Zero values disable the corresponding limit or
+// feature.
+type ProviderOptions struct {
+	// UpdateInterval is the interval at which series are relisted.
+	UpdateInterval time.Duration
+	// MaxAge is the period to list series over.
+	MaxAge time.Duration
+	// FailureExpiry is how long to keep the last known series for a namer
+	// whose series can't currently be listed (zero for no limit).
+	FailureExpiry time.Duration
+
+	// QueryTimeout is how long to wait for Prometheus when fetching metrics
+	// (zero for no limit).
+	QueryTimeout time.Duration
+	// CacheTTL is how long to cache query results for, unless a namer
+	// specifies its own.  Identical queries in flight at the same time are
+	// coalesced even if caching is disabled.
+	CacheTTL time.Duration
+	// MaxNamesPerQuery is the largest number of objects that a single query
+	// is made for (zero for no limit).  Requests for more objects are split
+	// into several queries, which are run concurrently.  It only applies
+	// to custom metrics.
+	MaxNamesPerQuery int
+	// EnforceNamespaces restricts every selector in the queries for
+	// namespaced requests to the requested namespace, and drops any results
+	// from other namespaces.
+	EnforceNamespaces bool
+}
 
-		SeriesRegistry: &basicSeriesRegistry{
-			mapper: mapper,
-		},
+// NewPrometheusProvider constructs a new CustomMetricsProvider which exposes the series
+// discovered by the given namers, using the given ObjectLister to resolve label selectors,
+// and the given OwnerResolver (which may be nil if no rules roll up pod metrics) to find
+// the pods owned by objects.  Series discovery and queries are configured by opts.
+func NewPrometheusProvider(mapper apimeta.RESTMapper, objects ObjectLister, owners OwnerResolver, promClients prom.Backends, namers []MetricNamer, opts ProviderOptions) (provider.CustomMetricsProvider, CustomMetricsLister) {
+	registry := &basicSeriesRegistry{
+		mapper: mapper,
+	}
+	lister := &cachingMetricsLister{
+		SeriesRegistry: registry,
+		seriesLister:   newSeriesLister("custom", promClients, namers, opts.UpdateInterval, opts.MaxAge, opts.FailureExpiry, registry),
 	}
 
 	return &prometheusProvider{
-		mapper:     mapper,
-		kubeClient: kubeClient,
-		promClient: promClient,
+		mapper:       mapper,
+		objects:      objects,
+		owners:       owners,
+		promClients:  promClients,
+		queryTimeout: opts.QueryTimeout,
+		cache:        newQueryCache("custom", opts.QueryTimeout),
+		cacheTTL:     opts.CacheTTL,
+
+		maxNamesPerQuery:  opts.MaxNamesPerQuery,
+		enforceNamespaces: opts.EnforceNamespaces,
 
 		SeriesRegistry: lister,
 	}, lister
 }
 
-func (p *prometheusProvider) metricFor(value pmodel.SampleValue, name types.NamespacedName, info provider.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
+func (p *prometheusProvider) metricFor(sample *pmodel.Sample, window *int64, name types.NamespacedName, info provider.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
 	ref, err := helpers.ReferenceFor(p.mapper, name, info)
 	if err != nil {
 		return nil, err
@@ -85,13 +128,13 @@ func (p *prometheusProvider) metricFor(value pmodel.SampleValue, name types.Name
 	return &custom_metrics.MetricValue{
 		DescribedObject: ref,
 		MetricName:      info.Metric,
-		// TODO(directxman12): use the right timestamp
-		Timestamp: metav1.Time{time.Now()},
-		Value:     *resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI),
+		Timestamp:       metav1.Time{Time: sample.Timestamp.Time()},
+		WindowSeconds:   window,
+		Value:           *resource.NewMilliQuantity(int64(sample.Value*1000.0), resource.DecimalSI),
 	}, nil
 }
 
-func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.CustomMetricInfo, namespace string, names []string) (*custom_metrics.MetricValueList, error) {
+func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, window *int64, info provider.CustomMetricInfo, namespace string, names []string) (*custom_metrics.MetricValueList, error) {
 	values, found := p.MatchValuesToNames(info, valueSet)
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
@@ -103,7 +146,7 @@ func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.Cu
 			continue
 		}
 
-		value, err := p.metricFor(values[name], types.NamespacedName{Namespace: namespace, Name: name}, info)
+		value, err := p.metricFor(values[name], window, types.NamespacedName{Namespace: namespace, Name: name}, info)
 		if err != nil {
 			return nil, err
 		}
@@ -115,31 +158,120 @@ func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.Cu
 	}, nil
 }
 
-func (p *prometheusProvider) buildQuery(info provider.CustomMetricInfo, namespace string, names ...string) (pmodel.Vector, error) {
+// buildQuery queries Prometheus for the given metric on the given objects, returning
+// the (non-stale) results, along with the window to report with them.  If there are too
+// many objects for a single query, the objects are split into chunks, which are
+// queried concurrently, and the results are merged.
+func (p *prometheusProvider) buildQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, names ...string) (pmodel.Vector, *int64, error) {
+	chunks := naming.ChunkNames(names, p.maxNamesPerQuery)
+	if len(chunks) == 1 {
+		return p.buildChunkQuery(ctx, info, namespace, names)
+	}
+
+	results := make([]pmodel.Vector, len(chunks))
+	windows := make([]*int64, len(chunks))
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	for i, chunk := range chunks {
+		go func(i int, chunk []string) {
+			defer wg.Done()
+			results[i], windows[i], errs[i] = p.buildChunkQuery(ctx, info, namespace, chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	var merged pmodel.Vector
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+		merged = append(merged, results[i]...)
+	}
+	return merged, windows[0], nil
+}
+
+// buildChunkQuery queries Prometheus for the given metric on the given objects
+// with a single query.
+func (p *prometheusProvider) buildChunkQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, names []string) (pmodel.Vector, *int64, error) {
 	query, found := p.QueryForMetric(info, namespace, names...)
 	if !found {
-		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		return nil, nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
+	return p.runQuery(ctx, info, namespace, query)
+}
 
-	// TODO: use an actual context
-	queryResults, err := p.promClient.Query(context.TODO(), pmodel.Now(), query)
+// runQuery runs the given query for the given metric, returning the (non-stale)
+// results, along with the window to report with them.
+func (p *prometheusProvider) runQuery(ctx context.Context, info provider.CustomMetricInfo, namespace string, query prom.Selector) (pmodel.Vector, *int64, error) {
+	namer, found := p.NamerForMetric(info)
+	if !found {
+		return nil, nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	promClient, err := p.promClients.For(namer.Backend())
+	if err != nil {
+		glog.Errorf("unable to fetch metric %s: %v", info.String(), err)
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
+
+	var enforcer *namespaceEnforcer
+	if p.enforceNamespaces && namespace != "" {
+		enforcer, err = newNamespaceEnforcer("custom", namer, namespace)
+		if err == nil && namer.JoinsSelectors() {
+			// the series carrying object labels use their own namespace label
+			var joinedSeries, joinedNamespaceLabel string
+			joinedSeries, joinedNamespaceLabel, err = namer.JoinedSeries(info.GroupResource)
+			if err == nil {
+				enforcer.UseLabelForSeries(joinedSeries, pmodel.LabelName(joinedNamespaceLabel))
+			}
+		}
+		if err == nil {
+			query, err = enforcer.EnforceQuery(query)
+		}
+		if err != nil {
+			glog.Errorf("unable to fetch metric %s: %v", info.String(), err)
+			return nil, nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		}
+	}
+
+	now := pmodel.Now()
+	queryResults, err := p.cache.Query(ctx, promClient, namer.Backend(), namespace, query, cacheTTLFor(namer, p.cacheTTL))
 	if err != nil {
 		glog.Errorf("unable to fetch metrics from prometheus: %v", err)
 		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
 	}
 
 	if queryResults.Type != pmodel.ValVector {
 		glog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
 	}
 
-	return *queryResults.Vector, nil
+	samples := *queryResults.Vector
+	if enforcer != nil {
+		samples = enforcer.FilterResults(samples)
+	}
+	return dropStaleSamples(samples, namer.MaxSampleAge(), now), windowFor(namer, query), nil
 }
 
 func (p *prometheusProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
+	ctx, cancel := prom.NewRequestContext(p.queryTimeout)
+	defer cancel()
+
+	if podInfo, rollup, isRollup := p.RollupForMetric(info); isRollup {
+		values, err := p.getRollupMetrics(ctx, info, name.Namespace, []string{name.Name}, podInfo, rollup)
+		if err != nil {
+			return nil, err
+		}
+		if len(values.Items) == 0 {
+			return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		}
+		return &values.Items[0], nil
+	}
+
 	// construct a query
-	queryResults, err := p.buildQuery(info, name.Namespace, name.Name)
+	queryResults, window, err := p.buildQuery(ctx, info, name.Namespace, name.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -158,115 +290,148 @@ func (p *prometheusProvider) GetMetricByName(name types.NamespacedName, info pro
 		glog.V(2).Infof("Got more than one result (%v results) when fetching metric %s for %q, using the first one with a matching name...", len(queryResults), info.String(), name)
 	}
 
-	resultValue, nameFound := namedValues[name.Name]
+	resultSample, nameFound := namedValues[name.Name]
 	if !nameFound {
 		glog.Errorf("None of the results returned by when fetching metric %s for %q matched the resource name", info.String(), name)
 		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
 	}
 
 	// return the resulting metric
-	return p.metricFor(resultValue, name, info)
+	return p.metricFor(resultSample, window, name, info)
 }
 
 func (p *prometheusProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo) (*custom_metrics.MetricValueList, error) {
+	ctx, cancel := prom.NewRequestContext(p.queryTimeout)
+	defer cancel()
+
+	// only look up objects for metrics that we actually have, so that
+	// we don't start caching objects for arbitrary resources
+	namer, found := p.NamerForMetric(info)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	podInfo, rollup, isRollup := p.RollupForMetric(info)
+	if namer.JoinsSelectors() && !isRollup {
+		return p.getMetricBySelectorJoin(ctx, namespace, selector, info)
+	}
+
 	// fetch a list of relevant resource names
-	resourceNames, err := helpers.ListObjectNames(p.mapper, p.kubeClient, namespace, selector, info)
+	resourceNames, err := p.objects.ListObjectNames(namespace, selector, info)
 	if err != nil {
 		glog.Errorf("unable to list matching resource names: %v", err)
 		// don't leak implementation details to the user
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
 	}
 
+	if isRollup {
+		return p.getRollupMetrics(ctx, info, namespace, resourceNames, podInfo, rollup)
+	}
+
 	// construct the actual query
-	queryResults, err := p.buildQuery(info, namespace, resourceNames...)
+	queryResults, window, err := p.buildQuery(ctx, info, namespace, resourceNames...)
 	if err != nil {
 		return nil, err
 	}
 
 	// return the resulting metrics
-	return p.metricsFor(queryResults, info, namespace, resourceNames)
+	return p.metricsFor(queryResults, window, info, namespace, resourceNames)
 }
 
-type cachingMetricsLister struct {
-	SeriesRegistry
-
-	promClient     prom.Client
-	updateInterval time.Duration
-	maxAge         time.Duration
-	namers         []MetricNamer
-}
+// getRollupMetrics fetches the given metric for the named owners of pods, by
+// aggregating the values of the corresponding pod metric for each owner's pods.
+// Owners without any pods with values are skipped.
+func (p *prometheusProvider) getRollupMetrics(ctx context.Context, info provider.CustomMetricInfo, namespace string, ownerNames []string, podInfo provider.CustomMetricInfo, rollup *OwnerRollup) (*custom_metrics.MetricValueList, error) {
+	if p.owners == nil {
+		glog.Errorf("unable to fetch metric %s: rolling up pod metrics onto their owners is not enabled", info.String())
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
 
-func (l *cachingMetricsLister) Run() {
-	l.RunUntil(wait.NeverStop)
-}
+	podsByOwner, err := p.owners.PodsForOwners(info.GroupResource, namespace, ownerNames)
+	if err != nil {
+		glog.Errorf("unable to find pods for owners of metric %s: %v", info.String(), err)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
+	}
+	var podNames []string
+	for _, owner := range ownerNames {
+		podNames = append(podNames, podsByOwner[owner]...)
+	}
 
-func (l *cachingMetricsLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
-		if err := l.updateMetrics(); err != nil {
-			utilruntime.HandleError(err)
-		}
-	}, l.updateInterval, stopChan)
-}
+	res := []custom_metrics.MetricValue{}
+	if len(podNames) == 0 {
+		return &custom_metrics.MetricValueList{Items: res}, nil
+	}
 
-type selectorSeries struct {
-	selector prom.Selector
-	series   []prom.Series
-}
+	queryResults, window, err := p.buildQuery(ctx, podInfo, namespace, podNames...)
+	if err != nil {
+		return nil, err
+	}
+	podValues, found := p.MatchValuesToNames(podInfo, queryResults)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
 
-func (l *cachingMetricsLister) updateMetrics() error {
-	startTime := pmodel.Now().Add(-1 * l.maxAge)
-
-	// don't do duplicate queries when it's just the matchers that change
-	seriesCacheByQuery := make(map[prom.Selector][]prom.Series)
-
-	// these can take a while on large clusters, so launch in parallel
-	// and don't duplicate
-	selectors := make(map[prom.Selector]struct{})
-	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
-	errs := make(chan error, len(l.namers))
-	for _, namer := range l.namers {
-		sel := namer.Selector()
-		if _, ok := selectors[sel]; ok {
-			errs <- nil
-			selectorSeriesChan <- selectorSeries{}
+	for _, owner := range ownerNames {
+		var samples []*pmodel.Sample
+		for _, pod := range podsByOwner[owner] {
+			if sample, found := podValues[pod]; found {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) == 0 {
 			continue
 		}
-		selectors[sel] = struct{}{}
-		go func() {
-			series, err := l.promClient.Series(context.TODO(), pmodel.Interval{startTime, 0}, sel)
-			if err != nil {
-				errs <- fmt.Errorf("unable to fetch metrics for query %q: %v", sel, err)
-				return
-			}
-			errs <- nil
-			selectorSeriesChan <- selectorSeries{
-				selector: sel,
-				series:   series,
-			}
-		}()
-	}
 
-	// iterate through, blocking until we've got all results
-	for range l.namers {
-		if err := <-errs; err != nil {
-			return fmt.Errorf("unable to update list of all metrics: %v", err)
-		}
-		if ss := <-selectorSeriesChan; ss.series != nil {
-			seriesCacheByQuery[ss.selector] = ss.series
+		value, err := p.metricFor(aggregateSamples(rollup.Aggregation, samples), window, types.NamespacedName{Namespace: namespace, Name: owner}, info)
+		if err != nil {
+			return nil, err
 		}
+		res = append(res, *value)
 	}
-	close(errs)
 
-	newSeries := make([][]prom.Series, len(l.namers))
-	for i, namer := range l.namers {
-		series, cached := seriesCacheByQuery[namer.Selector()]
-		if !cached {
-			return fmt.Errorf("unable to update list of all metrics: no metrics retrieved for query %q", namer.Selector())
-		}
-		newSeries[i] = namer.FilterSeries(series)
+	return &custom_metrics.MetricValueList{
+		Items: res,
+	}, nil
+}
+
+// getMetricBySelectorJoin fetches the given metric for the objects matching the given
+// selector using a single query, which resolves the selector in Prometheus.
+func (p *prometheusProvider) getMetricBySelectorJoin(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo) (*custom_metrics.MetricValueList, error) {
+	query, found := p.QueryForObjectSelector(info, namespace, selector)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
+	queryResults, window, err := p.runQuery(ctx, info, namespace, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// every object returned by the query matched the selector
+	values, found := p.MatchValuesToNames(info, queryResults)
+	if !found {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	resourceNames := make([]string, 0, len(values))
+	for name := range values {
+		resourceNames = append(resourceNames, name)
+	}
+	sort.Strings(resourceNames)
 
-	glog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
+	return p.metricsFor(queryResults, window, info, namespace, resourceNames)
+}
+
+// CustomMetricsLister is a MetricsLister for custom metrics, which also
+// computes metrics derived from the discovered metrics.
+type CustomMetricsLister interface {
+	MetricsLister
+
+	// SetDerivedMetrics replaces the metrics computed from the discovered
+	// metrics.  The new derived metrics take effect on the next relist.
+	SetDerivedMetrics(derived []*DerivedMetric)
+}
 
-	return l.SetSeries(newSeries, l.namers)
+// cachingMetricsLister is a SeriesRegistry which is periodically
+// populated with the series discovered by its seriesLister.
+type cachingMetricsLister struct {
+	SeriesRegistry
+	*seriesLister
 }
@@ -17,32 +17,60 @@ limitations under the License.
 package provider
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	appsapi "k8s.io/api/apps/v1"
+	coreapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	fakedyn "k8s.io/client-go/dynamic/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
 	config "github.com/directxman12/k8s-prometheus-adapter/cmd/config-gen/utils"
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
 	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	adaptercfg "github.com/directxman12/k8s-prometheus-adapter/pkg/config"
 	pmodel "github.com/prometheus/common/model"
 )
 
 const fakeProviderUpdateInterval = 2 * time.Second
 const fakeProviderStartDuration = 2 * time.Second
 
-func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePrometheusClient) {
-	fakeProm := &fakeprom.FakePrometheusClient{}
-	fakeKubeClient := &fakedyn.FakeDynamicClient{}
-
-	cfg := config.DefaultConfig(1*time.Minute, "")
+// newTestProvider sets up a provider for the metrics described by the given
+// config, backed by the given (fake) Prometheus backends.  Series discovery
+// uses the returned fake clock, and relists at the fake provider interval
+// unless opts say otherwise.
+func newTestProvider(cfg *adaptercfg.MetricsDiscoveryConfig, owners OwnerResolver, promClients prom.Backends, opts ProviderOptions) (*prometheusProvider, *cachingMetricsLister, *clock.FakeClock) {
 	namers, err := NamersFromConfig(cfg, restMapper())
 	Expect(err).NotTo(HaveOccurred())
 
-	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, namers, fakeProviderUpdateInterval, fakeProviderStartDuration)
+	if opts.UpdateInterval == 0 {
+		opts.UpdateInterval = fakeProviderUpdateInterval
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = fakeProviderStartDuration
+	}
+	prov, _ := NewPrometheusProvider(restMapper(), NewDynamicObjectLister(restMapper(), &fakedyn.FakeDynamicClient{}), owners, promClients, namers, opts)
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	lister.clock = fakeClock
+	return prov.(*prometheusProvider), lister, fakeClock
+}
+
+func setupPrometheusProvider() (*prometheusProvider, *cachingMetricsLister, *fakeprom.FakePrometheusClient) {
+	fakeProm := &fakeprom.FakePrometheusClient{}
+	prov, lister, _ := newTestProvider(config.DefaultConfig(1*time.Minute, ""), nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
 
 	containerSel := prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container_name", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod_name", ""))
 	namespacedSel := prom.MatchSeries("", prom.LabelNeq("namespace", ""), prom.NameNotMatches("^container_.*"))
@@ -73,13 +101,13 @@ func setupPrometheusProvider() (provider.CustomMetricsProvider, *fakeprom.FakePr
 		},
 	}
 
-	return prov, fakeProm
+	return prov, lister, fakeProm
 }
 
 var _ = Describe("Custom Metrics Provider", func() {
 	It("should be able to list all metrics", func() {
 		By("setting up the provider")
-		prov, fakeProm := setupPrometheusProvider()
+		prov, lister, fakeProm := setupPrometheusProvider()
 
 		By("ensuring that no metrics are present before we start listing")
 		Expect(prov.ListAllMetrics()).To(BeEmpty())
@@ -90,21 +118,671 @@ var _ = Describe("Custom Metrics Provider", func() {
 
 		By("updating the list of available metrics")
 		// don't call RunUntil to avoid timing issue
-		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
 		Expect(lister.updateMetrics()).To(Succeed())
 
 		By("listing all metrics, and checking that they contain the expected results")
 		Expect(prov.ListAllMetrics()).To(ConsistOf(
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "ingress_hits"},
-			provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "ingresses"}, true, "ingress_hits"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "ingress_hits"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "ingress_hits"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "service_proxy_packets"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "service_proxy_packets"},
-			provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "deployments"}, true, "work_queue_wait"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "work_queue_wait"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "some_usage"},
-			provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "ingress_hits"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "ingresses"}, Namespaced: true, Metric: "ingress_hits"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "ingress_hits"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "ingress_hits"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "service_proxy_packets"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "work_queue_wait"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "work_queue_wait"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "some_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
+		))
+	})
+
+	It("should list and query the series for each rule from that rule's backend", func() {
+		By("setting up a provider with rules for two different backends")
+		defaultProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		appsProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="node_load1"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+				},
+				{
+					SeriesQuery:  `{__name__="http_requests"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					Backend:      "apps",
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: defaultProm, "apps": appsProm}, ProviderOptions{})
+
+		defaultProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="node_load1"}`: {{Name: "node_load1", Labels: pmodel.LabelSet{"node": "somenode"}}},
+		}
+		appsProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests"}`: {{Name: "http_requests", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}}},
+		}
+
+		By("updating the list of available metrics")
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load1"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "http_requests"},
+		))
+
+		By("fetching a metric, and checking that it was queried from the right backend")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+		query, found := lister.QueryForMetric(info, "somens", "somepod")
+		Expect(found).To(BeTrue())
+		vec := pmodel.Vector{{Metric: pmodel.Metric{"pod": "somepod", "namespace": "somens"}, Value: 3}}
+		appsProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			query: {Type: pmodel.ValVector, Vector: &vec},
+		}
+
+		val, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somepod"}, info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(val.Value.MilliValue()).To(Equal(int64(3000)))
+	})
+
+	It("should keep updating the metrics for healthy rules when listing the series for other rules fails", func() {
+		By("setting up a provider with rules for two different backends")
+		defaultProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		appsProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__=~"node_load.*"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+				},
+				{
+					SeriesQuery:  `{__name__="http_requests"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					Backend:      "apps",
+				},
+			},
+		}
+		prov, lister, fakeClock := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: defaultProm, "apps": appsProm}, ProviderOptions{FailureExpiry: 10 * time.Minute})
+		lister.retryDelay = time.Millisecond
+
+		defaultProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__=~"node_load.*"}`: {{Name: "node_load1", Labels: pmodel.LabelSet{"node": "somenode"}}},
+		}
+		appsProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests"}`: {{Name: "http_requests", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}}},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("making one backend fail, and changing the series on the other")
+		appsProm.ErrQueries = map[prom.Selector]error{
+			`{__name__="http_requests"}`: fmt.Errorf("backend unavailable"),
+		}
+		defaultProm.SeriesResults[`{__name__=~"node_load.*"}`] = []prom.Series{
+			{Name: "node_load1", Labels: pmodel.LabelSet{"node": "somenode"}},
+			{Name: "node_load5", Labels: pmodel.LabelSet{"node": "somenode"}},
+		}
+
+		By("checking that the healthy rule was updated, and the failing rule kept its last known metrics")
+		Expect(lister.updateMetrics()).NotTo(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load1"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load5"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "http_requests"},
+		))
+
+		By("checking that the last known metrics are dropped once they expire")
+		fakeClock.Step(11 * time.Minute)
+		Expect(lister.updateMetrics()).NotTo(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load1"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load5"},
+		))
+	})
+
+	It("should relist each rule at its own interval, and expire series individually", func() {
+		By("setting up a provider with a slow rule and a fast rule")
+		fakeProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:    `{__name__=~"node_load.*"}`,
+					Resources:      adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery:   "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					RelistInterval: pmodel.Duration(time.Hour),
+				},
+				{
+					SeriesQuery:    `{__name__=~"node_http_.*"}`,
+					Resources:      adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery:   "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					RelistInterval: pmodel.Duration(time.Minute),
+					MaxAge:         pmodel.Duration(10 * time.Minute),
+				},
+			},
+		}
+		prov, lister, fakeClock := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__=~"node_load.*"}`:  {{Name: "node_load1", Labels: pmodel.LabelSet{"node": "somenode"}}},
+			`{__name__=~"node_http_.*"}`: {{Name: "node_http_requests", Labels: pmodel.LabelSet{"node": "somenode"}}},
+		}
+		Expect(lister.relist(false)).To(Succeed())
+
+		By("changing the series for both rules, and checking that only the fast rule is relisted")
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__=~"node_load.*"}`:  {{Name: "node_load5", Labels: pmodel.LabelSet{"node": "somenode"}}},
+			`{__name__=~"node_http_.*"}`: {{Name: "node_http_errors", Labels: pmodel.LabelSet{"node": "somenode"}}},
+		}
+		fakeClock.Step(2 * time.Minute)
+		Expect(lister.relist(false)).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load1"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_http_requests"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_http_errors"},
+		))
+
+		By("checking that series which haven't been seen for the max age are dropped")
+		fakeClock.Step(11 * time.Minute)
+		Expect(lister.relist(false)).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_load1"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_http_errors"},
+		))
+	})
+
+	It("should list the series for sharded rules one shard at a time", func() {
+		By("setting up a provider with a rule sharded by namespace")
+		fakeProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__=~"container_.*"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					Discovery: &adaptercfg.SeriesDiscovery{
+						TimeSlice:  pmodel.Duration(500 * time.Millisecond),
+						ShardLabel: "namespace",
+					},
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+
+		fakeProm.LabelValuesResults = map[string][]string{"namespace": {"somens", "otherns"}}
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__=~"container_.*",namespace="somens"}`: {
+				{Name: "container_cpu_usage", Labels: pmodel.LabelSet{"namespace": "somens", "pod": "somepod"}},
+			},
+			`{__name__=~"container_.*",namespace="otherns"}`: {
+				{Name: "container_cpu_usage", Labels: pmodel.LabelSet{"namespace": "otherns", "pod": "otherpod"}},
+				{Name: "container_memory_usage", Labels: pmodel.LabelSet{"namespace": "otherns", "pod": "otherpod"}},
+			},
+			`{__name__=~"container_.*",namespace=""}`: {
+				{Name: "container_node_usage", Labels: pmodel.LabelSet{"node": "somenode"}},
+			},
+			// the unsharded query should never be used
+			`{__name__=~"container_.*"}`: {
+				{Name: "container_unsharded", Labels: pmodel.LabelSet{"node": "somenode"}},
+			},
+		}
+
+		By("checking that the series from each shard (and time slice) were merged")
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "container_cpu_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "container_cpu_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "container_memory_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "container_memory_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "container_node_usage"},
+		))
+
+		By("checking that the discovery period is split into slices")
+		start := pmodel.Now()
+		Expect(timeSlices(start, start.Add(1200*time.Millisecond), 500*time.Millisecond)).To(Equal([]pmodel.Interval{
+			{Start: start, End: start.Add(500 * time.Millisecond)},
+			{Start: start.Add(500 * time.Millisecond), End: start.Add(1000 * time.Millisecond)},
+			{Start: start.Add(1000 * time.Millisecond), End: 0},
+		}))
+	})
+
+	It("should discover metrics from label names and values, when asked to", func() {
+		By("setting up a provider with a rule using the labels discovery strategy")
+		fakeProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__=~"container_.*"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					Discovery:    &adaptercfg.SeriesDiscovery{Strategy: "labels"},
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+
+		fakeProm.LabelValuesResults = map[string][]string{"__name__": {"container_cpu_usage", "container_fs_usage"}}
+		fakeProm.LabelNamesResults = map[prom.Selector][]string{
+			`{__name__="container_cpu_usage",__name__=~"container_.*"}`: {"__name__", "namespace", "pod"},
+			`{__name__="container_fs_usage",__name__=~"container_.*"}`:  {"__name__", "node"},
+		}
+		// the series themselves should never be listed
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__=~"container_.*"}`: {{Name: "container_listed", Labels: pmodel.LabelSet{"node": "somenode"}}},
+		}
+
+		By("checking that the metrics and their resources were discovered")
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "container_cpu_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "container_cpu_usage"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "container_fs_usage"},
 		))
+
+		By("checking that series queries with a bare metric name are only queried by that name")
+		cfg.Rules[0].SeriesQuery = `http_requests_total{namespace!=""}`
+		prov, lister, _ = newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		fakeProm.LabelValuesResults = map[string][]string{"__name__": {"http_requests_total"}}
+		fakeProm.LabelNamesResults = map[prom.Selector][]string{
+			`http_requests_total{namespace!=""}`: {"__name__", "namespace", "pod"},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "http_requests_total"},
+		))
+
+		By("checking that unknown strategies are rejected")
+		cfg.Rules[0].Discovery.Strategy = "magic"
+		_, err := NamersFromConfig(cfg, restMapper())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report the sample timestamp and query window, and drop stale samples", func() {
+		By("setting up a provider with a rate rule that limits the age of samples")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="http_requests_total"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+					MaxSampleAge: pmodel.Duration(5 * time.Minute),
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests_total"}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "fresh", "namespace": "somens"}},
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "stale", "namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}
+		freshTime := pmodel.Now().Add(-30 * time.Second)
+		for _, pod := range []string{"fresh", "stale"} {
+			sampleTime := freshTime
+			if pod == "stale" {
+				sampleTime = freshTime.Add(-10 * time.Minute)
+			}
+			query, found := lister.QueryForMetric(info, "somens", pod)
+			Expect(found).To(BeTrue())
+			vec := pmodel.Vector{{Metric: pmodel.Metric{"pod": pmodel.LabelValue(pod), "namespace": "somens"}, Value: 3, Timestamp: sampleTime}}
+			fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+		}
+
+		By("checking that fresh samples carry their own timestamp and the rate window")
+		val, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "fresh"}, info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(val.Timestamp.Time).To(BeTemporally("==", freshTime.Time()))
+		Expect(val.WindowSeconds).NotTo(BeNil())
+		Expect(*val.WindowSeconds).To(Equal(int64(120)))
+
+		By("checking that stale samples are reported as missing")
+		_, err = prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "stale"}, info)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should resolve label selectors in Prometheus for rules with a selector join", func() {
+		By("setting up a provider with a rule that joins against kube-state-metrics")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{__name__="http_requests_total"}`,
+					Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+						"kubernetes_namespace": {Resource: "namespace"},
+						"kubernetes_pod_name":  {Resource: "pod"},
+					}},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					SelectorJoin: &adaptercfg.SelectorJoin{},
+				},
+			},
+		}
+		// the object lister panics if used, since the fake dynamic client has no reactors
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests_total"}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"kubernetes_pod_name": "somepod", "kubernetes_namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}
+		selector, err := labels.Parse("app=web,tier in (frontend),app.kubernetes.io/part-of")
+		Expect(err).NotTo(HaveOccurred())
+		query, found := lister.QueryForObjectSelector(info, "somens", selector)
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`(sum by(kubernetes_pod_name) (http_requests_total{kubernetes_namespace="somens"})) and on(kubernetes_pod_name) ` +
+			`label_replace(kube_pod_labels{namespace="somens",label_app="web",label_app_kubernetes_io_part_of!="",label_tier=~"frontend"}, "kubernetes_pod_name", "$1", "pod", "(.*)")`)))
+		vec := pmodel.Vector{
+			{Metric: pmodel.Metric{"kubernetes_pod_name": "somepod"}, Value: 2},
+			{Metric: pmodel.Metric{"kubernetes_pod_name": "otherpod"}, Value: 4},
+		}
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+
+		By("fetching the metric for the selector, without listing objects")
+		vals, err := prov.GetMetricBySelector("somens", selector, info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vals.Items).To(HaveLen(2))
+		Expect(vals.Items[0].DescribedObject.Name).To(Equal("otherpod"))
+		Expect(vals.Items[0].Value.MilliValue()).To(Equal(int64(4000)))
+		Expect(vals.Items[1].DescribedObject.Name).To(Equal("somepod"))
+		Expect(vals.Items[1].Value.MilliValue()).To(Equal(int64(2000)))
+	})
+
+	It("should roll up pod metrics onto the workloads that own the pods", func() {
+		By("setting up a provider with a rule that rolls pod metrics up onto deployments")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="http_requests"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					OwnerRollup: &adaptercfg.OwnerRollup{
+						Resources:   []adaptercfg.GroupResource{{Group: "extensions", Resource: "deployments"}},
+						Aggregation: "avg",
+					},
+				},
+			},
+		}
+		pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		replicaSets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		isController := true
+		controlledBy := func(apiVersion, kind, name string) []metav1.OwnerReference {
+			return []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name, Controller: &isController}}
+		}
+		Expect(replicaSets.Add(&appsapi.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "somens", Name: "web-abc", OwnerReferences: controlledBy("extensions/v1beta1", "Deployment", "web"),
+		}})).To(Succeed())
+		for _, pod := range []*coreapi.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "somens", Name: "web-abc-2", OwnerReferences: controlledBy("apps/v1", "ReplicaSet", "web-abc")}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "somens", Name: "web-abc-1", OwnerReferences: controlledBy("apps/v1", "ReplicaSet", "web-abc")}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "somens", Name: "db-0", OwnerReferences: controlledBy("apps/v1", "StatefulSet", "db")}},
+		} {
+			Expect(pods.Add(pod)).To(Succeed())
+		}
+		owners := NewOwnerResolver(restMapper(), corelisters.NewPodLister(pods), appslisters.NewReplicaSetLister(replicaSets))
+
+		prov, lister, _ := newTestProvider(cfg, owners, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests"}`: {
+				{Name: "http_requests", Labels: pmodel.LabelSet{"pod": "web-abc-1", "namespace": "somens"}},
+				{Name: "http_requests", Labels: pmodel.LabelSet{"pod": "web-abc-2", "namespace": "somens"}},
+				{Name: "http_requests", Labels: pmodel.LabelSet{"pod": "db-0", "namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("checking that the metric is listed for deployments")
+		deploymentInfo := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "http_requests"}
+		Expect(prov.ListAllMetrics()).To(ContainElement(deploymentInfo))
+
+		By("fetching the metric for a deployment, and checking that its pods were averaged")
+		podInfo := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+		query, found := lister.QueryForMetric(podInfo, "somens", "web-abc-1", "web-abc-2")
+		Expect(found).To(BeTrue())
+		vec := pmodel.Vector{
+			{Metric: pmodel.Metric{"pod": "web-abc-1", "namespace": "somens"}, Value: 2},
+			{Metric: pmodel.Metric{"pod": "web-abc-2", "namespace": "somens"}, Value: 4},
+		}
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+
+		val, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web"}, deploymentInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(val.DescribedObject.Name).To(Equal("web"))
+		Expect(val.Value.MilliValue()).To(Equal(int64(3000)))
+	})
+
+	It("should register static metrics without listing series", func() {
+		By("setting up a provider with a static metric, and a Prometheus which fails series queries")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			ErrQueries:         map[prom.Selector]error{"": fmt.Errorf("static metrics should not be listed")},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			StaticMetrics: []adaptercfg.StaticMetric{
+				{
+					Name:           "http_requests_per_second",
+					SeriesName:     "http_requests_total",
+					GroupResources: []adaptercfg.GroupResource{{Resource: "pods"}, {Group: "extensions", Resource: "deployment"}},
+					Resources:      adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery:   "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("checking that the metric is listed for the declared (normalized) resources only")
+		Expect(prov.ListAllMetrics()).To(ConsistOf(
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_per_second"},
+			provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "http_requests_per_second"},
+		))
+
+		By("fetching the metric, and checking that it's queried like a discovered metric")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_per_second"}
+		query, found := lister.QueryForMetric(info, "somens", "somepod")
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum by(pod) (rate(http_requests_total{namespace="somens",pod="somepod"}[2m]))`)))
+		vec := pmodel.Vector{{Metric: pmodel.Metric{"pod": "somepod", "namespace": "somens"}, Value: 7}}
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+
+		val, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somepod"}, info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(val.Value.MilliValue()).To(Equal(int64(7000)))
+	})
+	It("should split queries for many objects into chunks, and merge the results", func() {
+		By("setting up a provider which queries for at most two objects at once")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="queue_depth"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{MaxNamesPerQuery: 2})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="queue_depth"}`: {
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}
+		names := []string{"pod1", "pod2", "pod3"}
+		for i, chunk := range [][]string{names[:2], names[2:]} {
+			query, found := lister.QueryForMetric(info, "somens", chunk...)
+			Expect(found).To(BeTrue())
+			var vec pmodel.Vector
+			for _, name := range chunk {
+				vec = append(vec, &pmodel.Sample{Metric: pmodel.Metric{"pod": pmodel.LabelValue(name)}, Value: pmodel.SampleValue(i + 1)})
+			}
+			fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+		}
+
+		By("querying for all the objects, and checking that every chunk's results were returned")
+		vec, _, err := prov.buildQuery(context.Background(), info, "somens", names...)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vec).To(ConsistOf(
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "pod1"}, Value: 1},
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "pod2"}, Value: 1},
+			&pmodel.Sample{Metric: pmodel.Metric{"pod": "pod3"}, Value: 2},
+		))
+	})
+	It("should add the global label matchers to every discovery selector and query", func() {
+		By("setting up a provider with global label matchers")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		rule := adaptercfg.DiscoveryRule{
+			SeriesQuery: `{__name__="http_requests_total"}`,
+			Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+				"kubernetes_namespace": {Resource: "namespace"},
+				"kubernetes_pod_name":  {Resource: "pod"},
+			}},
+			MetricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+			SelectorJoin: &adaptercfg.SelectorJoin{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules:               []adaptercfg.DiscoveryRule{rule},
+			ExternalRules:       []adaptercfg.DiscoveryRule{rule},
+			GlobalLabelMatchers: []string{`cluster="prod-eu"`},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests_total",cluster="prod-eu"}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"kubernetes_pod_name": "somepod", "kubernetes_namespace": "somens", "cluster": "prod-eu"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("checking that the metric was discovered using the restricted series query")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}
+		Expect(prov.ListAllMetrics()).To(ContainElement(info))
+
+		By("checking that every selector in the queries is restricted")
+		query, found := lister.QueryForMetric(info, "somens", "somepod")
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum by(kubernetes_pod_name) (rate(http_requests_total{cluster="prod-eu",kubernetes_namespace="somens",kubernetes_pod_name="somepod"}[2m]))`)))
+		selector, err := labels.Parse("app=web")
+		Expect(err).NotTo(HaveOccurred())
+		query, found = lister.QueryForObjectSelector(info, "somens", selector)
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`(sum by(kubernetes_pod_name) (rate(http_requests_total{cluster="prod-eu",kubernetes_namespace="somens"}[2m]))) and on(kubernetes_pod_name) ` +
+			`label_replace(kube_pod_labels{cluster="prod-eu",label_app="web",namespace="somens"}, "kubernetes_pod_name", "$1", "pod", "(.*)")`)))
+
+		externalNamers, err := ExternalNamersFromConfig(cfg, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		query, err = externalNamers[0].QueryForExternalSeries("http_requests_total", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(query).To(Equal(prom.Selector(`sum(rate(http_requests_total{cluster="prod-eu"}[2m]))`)))
+
+		By("rejecting invalid global label matchers")
+		cfg.GlobalLabelMatchers = []string{"cluster"}
+		_, err = NamersFromConfig(cfg, restMapper())
+		Expect(err).To(HaveOccurred())
+	})
+	It("should restrict queries and results to the namespace when enforcing namespace tenancy", func() {
+		By("setting up a provider which enforces namespace tenancy, with a rule whose query reads other series")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:  `{__name__="queue_depth"}`,
+					Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>} or queue_depth_legacy) by (namespace, <<.GroupBy>>)",
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{EnforceNamespaces: true})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="queue_depth"}`: {
+				{Name: "queue_depth", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("checking that every selector in the query is restricted to the namespace")
+		query := prom.Selector(`sum by(namespace, pod) (queue_depth{namespace="somens",pod="somepod"} or queue_depth_legacy{namespace="somens"})`)
+		vec := pmodel.Vector{
+			{Metric: pmodel.Metric{"pod": "somepod", "namespace": "somens"}, Value: 1},
+			{Metric: pmodel.Metric{"pod": "somepod", "namespace": "otherns"}, Value: 2},
+		}
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+
+		By("checking that results from other namespaces are dropped")
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}
+		res, _, err := prov.buildQuery(context.Background(), info, "somens", "somepod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(ConsistOf(&pmodel.Sample{Metric: pmodel.Metric{"pod": "somepod", "namespace": "somens"}, Value: 1}))
+	})
+
+	It("should restrict the series joined against for label selectors to the namespace using their own namespace label", func() {
+		By("setting up a provider which enforces namespace tenancy, with a rule whose namespace label differs from the joined series")
+		fakeProm := &fakeprom.FakePrometheusClient{
+			AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+			QueryResults:       map[prom.Selector]prom.QueryResult{},
+		}
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery: `{__name__="http_requests_total"}`,
+					Resources: adaptercfg.ResourceMapping{Overrides: map[string]adaptercfg.GroupResource{
+						"kubernetes_namespace": {Resource: "namespace"},
+						"kubernetes_pod_name":  {Resource: "pod"},
+					}},
+					MetricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+					SelectorJoin: &adaptercfg.SelectorJoin{},
+				},
+			},
+		}
+		prov, lister, _ := newTestProvider(cfg, nil, prom.Backends{prom.DefaultBackend: fakeProm}, ProviderOptions{EnforceNamespaces: true})
+		fakeProm.SeriesResults = map[prom.Selector][]prom.Series{
+			`{__name__="http_requests_total"}`: {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"kubernetes_pod_name": "somepod", "kubernetes_namespace": "somens"}},
+			},
+		}
+		Expect(lister.updateMetrics()).To(Succeed())
+
+		By("checking that the joined series is restricted using its own namespace label")
+		query := prom.Selector(`(sum by(kubernetes_pod_name) (rate(http_requests_total{kubernetes_namespace="somens"}[2m]))) and on(kubernetes_pod_name) ` +
+			`label_replace(kube_pod_labels{label_app="web",namespace="somens"}, "kubernetes_pod_name", "$1", "pod", "(.*)")`)
+		vec := pmodel.Vector{
+			{Metric: pmodel.Metric{"kubernetes_pod_name": "somepod"}, Value: 1},
+		}
+		fakeProm.QueryResults[query] = prom.QueryResult{Type: pmodel.ValVector, Vector: &vec}
+
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}
+		selector, err := labels.Parse("app=web")
+		Expect(err).NotTo(HaveOccurred())
+		res, err := prov.GetMetricBySelector("somens", selector, info)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Items).To(HaveLen(1))
+		Expect(res.Items[0].DescribedObject.Name).To(Equal("somepod"))
 	})
 })
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+var (
+	// queryCacheRequests counts requests for query results, by whether they were
+	// served from the cache, joined an identical query already in flight, or
+	// were sent to Prometheus.
+	queryCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_query_cache_requests_total",
+			Help: "Number of metrics queries, by whether they were served from the cache (hit), waited for an identical query in flight (coalesced), or were sent to Prometheus (miss).  Broken down by API and result",
+		},
+		[]string{"api", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queryCacheRequests)
+}
+
+// queryCacheKey identifies the results of a single query.
+type queryCacheKey struct {
+	backend string
+	// namespace is part of the key, since it may determine the tenant
+	// that the query is run as.
+	namespace string
+	query     prom.Selector
+	// ttl is how long the results are cached for (zero if they aren't).
+	ttl time.Duration
+	// bucket is the index of the time bucket (of the TTL's length) in which
+	// the query was run.
+	bucket int64
+}
+
+// queryCacheEntry holds the results of a query, once it has completed.
+type queryCacheEntry struct {
+	// done is closed once the query has completed.
+	done chan struct{}
+
+	result prom.QueryResult
+	err    error
+}
+
+// queryCache caches the results of metrics queries for a short time, and
+// coalesces identical queries which are in flight at the same time, so that
+// many identical requests (e.g. from several HPAs targeting the same object)
+// only result in a single query.  Results are cached per time bucket, so all
+// results cached for a TTL are refreshed at the same time.  Results are shared
+// between callers, so they mustn't be modified.
+//
+// Since a query may be shared by several callers, it isn't tied to the context
+// of the caller that happened to start it.  Instead, it's bounded by the query
+// timeout, and each caller only stops waiting for it when its own context is
+// done.
+type queryCache struct {
+	// api names the metrics API that the cache serves, for use in metrics.
+	api string
+	// queryTimeout bounds each query sent to Prometheus (zero for no limit).
+	queryTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[queryCacheKey]*queryCacheEntry
+}
+
+func newQueryCache(api string, queryTimeout time.Duration) *queryCache {
+	return &queryCache{
+		api:          api,
+		queryTimeout: queryTimeout,
+		entries:      make(map[queryCacheKey]*queryCacheEntry),
+	}
+}
+
+// Query runs the given query against the given client for the given namespace,
+// unless its results were cached within the given TTL (zero to skip the cache),
+// or an identical query is already in flight.  Failed queries aren't cached.
+func (c *queryCache) Query(ctx context.Context, promClient prom.Client, backend, namespace string, query prom.Selector, ttl time.Duration) (prom.QueryResult, error) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	key := queryCacheKey{backend: backend, namespace: namespace, query: query, ttl: ttl}
+	now := time.Now()
+	if ttl > 0 {
+		key.bucket = now.UnixNano() / int64(ttl)
+	}
+
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	if !found {
+		c.evictExpired(now)
+		entry = &queryCacheEntry{done: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if found {
+		select {
+		case <-entry.done:
+			queryCacheRequests.WithLabelValues(c.api, "hit").Inc()
+			return entry.result, entry.err
+		default:
+			queryCacheRequests.WithLabelValues(c.api, "coalesced").Inc()
+		}
+	} else {
+		queryCacheRequests.WithLabelValues(c.api, "miss").Inc()
+		go c.fetch(promClient, key, entry)
+	}
+
+	select {
+	case <-entry.done:
+		return entry.result, entry.err
+	case <-ctx.Done():
+		return prom.QueryResult{}, ctx.Err()
+	}
+}
+
+// fetch runs the query for the given entry, and completes the entry with the
+// results.  The query is bounded by the query timeout rather than the context
+// of any of the callers waiting for it, so that it completes for the other
+// callers if the one which started it gives up.
+func (c *queryCache) fetch(promClient prom.Client, key queryCacheKey, entry *queryCacheEntry) {
+	ctx, cancel := prom.WithQueryTimeout(context.Background(), c.queryTimeout)
+	defer cancel()
+
+	entry.result, entry.err = promClient.Query(prom.WithNamespace(ctx, key.namespace), pmodel.Now(), key.query)
+
+	// uncached and failed queries only need to be kept while they're in flight.
+	// They're removed before waking the callers, so that a caller that retries
+	// straight away doesn't get the same results.
+	if key.ttl == 0 || entry.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	close(entry.done)
+}
+
+// evictExpired removes the completed entries for time buckets which have
+// passed.  It must be called with the lock held.
+func (c *queryCache) evictExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if key.ttl == 0 || now.UnixNano()/int64(key.ttl) == key.bucket {
+			continue
+		}
+		select {
+		case <-entry.done:
+			delete(c.entries, key)
+		default:
+			// still in flight
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+)
+
+// countingPromClient is a Prometheus client which counts the queries it receives,
+// and doesn't answer them until it's unblocked (or the query's context is done).
+type countingPromClient struct {
+	fakeprom.FakePrometheusClient
+
+	mu      sync.Mutex
+	queries int
+	blocked chan struct{}
+}
+
+func (c *countingPromClient) Query(ctx context.Context, t pmodel.Time, query prom.Selector) (prom.QueryResult, error) {
+	c.mu.Lock()
+	c.queries++
+	c.mu.Unlock()
+
+	select {
+	case <-c.blocked:
+	case <-ctx.Done():
+		return prom.QueryResult{}, ctx.Err()
+	}
+	return c.FakePrometheusClient.Query(ctx, t, query)
+}
+
+func (c *countingPromClient) queryCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queries
+}
+
+var _ = Describe("Query Cache", func() {
+	var (
+		client *countingPromClient
+		cache  *queryCache
+	)
+
+	BeforeEach(func() {
+		vec := pmodel.Vector{{Metric: pmodel.Metric{"pod": "somepod"}, Value: 1}}
+		client = &countingPromClient{
+			FakePrometheusClient: fakeprom.FakePrometheusClient{
+				AcceptableInterval: pmodel.Interval{End: pmodel.Latest},
+				QueryResults: map[prom.Selector]prom.QueryResult{
+					"some_query": {Type: pmodel.ValVector, Vector: &vec},
+				},
+				ErrQueries: map[prom.Selector]error{
+					"bad_query": fmt.Errorf("bad query"),
+				},
+			},
+			blocked: make(chan struct{}),
+		}
+		cache = newQueryCache("custom", time.Minute)
+	})
+
+	It("should coalesce identical queries which are in flight at the same time", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				res, err := cache.Query(context.Background(), client, "", "somens", "some_query", 0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*res.Vector).To(HaveLen(1))
+			}()
+		}
+
+		Eventually(client.queryCount).Should(Equal(1))
+		close(client.blocked)
+		wg.Wait()
+		Expect(client.queryCount()).To(Equal(1))
+
+		By("checking that the results aren't cached without a TTL")
+		_, err := cache.Query(context.Background(), client, "", "somens", "some_query", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(2))
+	})
+
+	It("should finish a coalesced query for the other callers when the caller that started it gives up", func() {
+		By("starting a query from a caller that gives up before it completes")
+		firstCtx, cancelFirst := context.WithCancel(context.Background())
+		firstErr := make(chan error)
+		go func() {
+			_, err := cache.Query(firstCtx, client, "", "somens", "some_query", 0)
+			firstErr <- err
+		}()
+		Eventually(client.queryCount).Should(Equal(1))
+
+		By("joining the query from a second caller")
+		secondRes := make(chan prom.QueryResult)
+		go func() {
+			defer GinkgoRecover()
+			res, err := cache.Query(context.Background(), client, "", "somens", "some_query", 0)
+			Expect(err).NotTo(HaveOccurred())
+			secondRes <- res
+		}()
+
+		By("checking that only the first caller stops waiting when it gives up")
+		cancelFirst()
+		Eventually(firstErr).Should(Receive(Equal(context.Canceled)))
+		Consistently(secondRes, 50*time.Millisecond).ShouldNot(Receive())
+
+		By("checking that the second caller still gets the results of the original query")
+		close(client.blocked)
+		var res prom.QueryResult
+		Eventually(secondRes).Should(Receive(&res))
+		Expect(*res.Vector).To(HaveLen(1))
+		Expect(client.queryCount()).To(Equal(1))
+	})
+
+	It("should bound queries by the query timeout", func() {
+		cache = newQueryCache("custom", 50*time.Millisecond)
+
+		_, err := cache.Query(context.Background(), client, "", "somens", "some_query", time.Hour)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+
+		By("checking that the timed out query wasn't cached")
+		close(client.blocked)
+		_, err = cache.Query(context.Background(), client, "", "somens", "some_query", time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(2))
+	})
+
+	It("should cache results for the TTL, per namespace", func() {
+		close(client.blocked)
+
+		_, err := cache.Query(context.Background(), client, "", "somens", "some_query", time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cache.Query(context.Background(), client, "", "somens", "some_query", time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(1))
+
+		By("checking that other namespaces don't share the results")
+		_, err = cache.Query(context.Background(), client, "", "otherns", "some_query", time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(2))
+
+		By("checking that failed queries aren't cached")
+		_, err = cache.Query(context.Background(), client, "", "somens", "bad_query", time.Hour)
+		Expect(err).To(HaveOccurred())
+		_, err = cache.Query(context.Background(), client, "", "somens", "bad_query", time.Hour)
+		Expect(err).To(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(4))
+	})
+
+	It("should refresh results once their time bucket has passed", func() {
+		close(client.blocked)
+		ttl := 50 * time.Millisecond
+
+		_, err := cache.Query(context.Background(), client, "", "somens", "some_query", ttl)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(2 * ttl)
+		_, err = cache.Query(context.Background(), client, "", "somens", "some_query", ttl)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.queryCount()).To(Equal(2))
+
+		By("checking that expired results are evicted")
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		Expect(cache.entries).To(HaveLen(1))
+	})
+})
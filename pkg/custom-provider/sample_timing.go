@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+// windowFor determines the window (in seconds) to report with the results of the
+// given query for one of the given namer's metrics.  Unless the namer specifies a
+// window, it's the largest range used in the query.  Nil is returned for queries
+// over instantaneous values.
+func windowFor(namer MetricNamer, query prom.Selector) *int64 {
+	window := namer.Window()
+	if window == 0 {
+		expr, err := parser.ParseExpr(string(query))
+		if err != nil {
+			glog.V(4).Infof("unable to parse query %q to determine its window: %v", query, err)
+			return nil
+		}
+		window = promql.MaxRange(expr)
+	}
+	if window <= 0 {
+		return nil
+	}
+
+	seconds := int64(window / time.Second)
+	return &seconds
+}
+
+// cacheTTLFor returns how long to cache the results of queries for the given namer's
+// metrics, given the default TTL.
+func cacheTTLFor(namer MetricNamer, defaultTTL time.Duration) time.Duration {
+	ttl := namer.CacheTTL()
+	if ttl == 0 {
+		return defaultTTL
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// dropStaleSamples removes any samples older than the given maximum age (if non-zero)
+// from the given query results.
+func dropStaleSamples(values pmodel.Vector, maxAge time.Duration, now pmodel.Time) pmodel.Vector {
+	if maxAge == 0 {
+		return values
+	}
+
+	cutoff := now.Add(-maxAge)
+	fresh := make(pmodel.Vector, 0, len(values))
+	for _, sample := range values {
+		if sample == nil {
+			continue
+		}
+		if sample.Timestamp.Before(cutoff) {
+			glog.V(4).Infof("ignoring stale sample for %s from %s (older than %s)", sample.Metric, sample.Timestamp.Time(), maxAge)
+			continue
+		}
+		fresh = append(fresh, sample)
+	}
+	return fresh
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+// DiscoveryOptions describes how to split up listing the series for a series
+// query, so that Prometheus doesn't have to return them all at once.  The zero
+// value lists all the series in a single request.
+type DiscoveryOptions struct {
+	// TimeSlice is the maximum length of the period listed in a single request
+	// (zero for no limit).
+	TimeSlice time.Duration
+	// ShardLabel is the label whose values the series are listed separately
+	// for (empty to list them together).
+	ShardLabel pmodel.LabelName
+	// LabelsOnly causes the names of the metrics matching the series query and
+	// the names of their labels to be listed, instead of the series themselves.
+	// A single series is produced for each metric, carrying each label name (with
+	// an empty value).
+	LabelsOnly bool
+}
+
+// discoveryOptionsFromConfig checks and converts the given discovery configuration
+// for the given series query.
+func discoveryOptionsFromConfig(cfg config.SeriesDiscovery, seriesQuery prom.Selector) (DiscoveryOptions, error) {
+	opts := DiscoveryOptions{
+		TimeSlice:  time.Duration(cfg.TimeSlice),
+		ShardLabel: pmodel.LabelName(cfg.ShardLabel),
+	}
+	if opts.TimeSlice < 0 {
+		return DiscoveryOptions{}, fmt.Errorf("time slice may not be negative")
+	}
+	switch cfg.Strategy {
+	case "", "series":
+	case "labels":
+		opts.LabelsOnly = true
+	default:
+		return DiscoveryOptions{}, fmt.Errorf("unknown discovery strategy %q (must be series or labels)", cfg.Strategy)
+	}
+	if opts.ShardLabel != "" && (!opts.ShardLabel.IsValid() || opts.ShardLabel == pmodel.MetricNameLabel) {
+		return DiscoveryOptions{}, fmt.Errorf("invalid shard label %q", cfg.ShardLabel)
+	}
+	if opts.ShardLabel != "" || opts.LabelsOnly {
+		// we need to be able to add matchers to the series query for each shard
+		// (or metric name)
+		if _, err := promql.ParseSelector(string(seriesQuery)); err != nil {
+			return DiscoveryOptions{}, fmt.Errorf("unable to parse series query to add matchers to it: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// listQuerySeries lists the series for the given series query since the given
+// start time, split up into time slices and shards (and using the strategy) as
+// per the query's discovery options.  The slices and shards are listed one after another (to limit the load
+// on Prometheus), and the results are merged.
+func listQuerySeries(ctx context.Context, promClient prom.Client, start pmodel.Time, query seriesQuery, retryDelay time.Duration) ([]prom.Series, error) {
+	opts := query.discovery
+	list := listSeriesWithRetries
+	if opts.LabelsOnly {
+		list = listSeriesFromLabels
+	}
+
+	intervals := timeSlices(start, pmodel.Now(), opts.TimeSlice)
+	if len(intervals) == 1 && opts.ShardLabel == "" {
+		return list(ctx, promClient, intervals[0], query.selector, retryDelay)
+	}
+
+	var res []prom.Series
+	seen := make(map[pmodel.Fingerprint]struct{})
+	for _, interval := range intervals {
+		selectors := []prom.Selector{query.selector}
+		if opts.ShardLabel != "" {
+			var err error
+			selectors, err = shardSelectors(ctx, promClient, interval, query.selector, opts.ShardLabel, retryDelay)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, selector := range selectors {
+			series, err := list(ctx, promClient, interval, selector, retryDelay)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range series {
+				fingerprint := seriesFingerprint(s)
+				if _, alreadySeen := seen[fingerprint]; alreadySeen {
+					continue
+				}
+				seen[fingerprint] = struct{}{}
+				res = append(res, s)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// timeSlices splits the period from start until end into intervals of at most
+// the given length (or a single interval, if the length is zero).  The last
+// interval is open-ended, so that it runs up until the time of the request.
+func timeSlices(start, end pmodel.Time, length time.Duration) []pmodel.Interval {
+	if length == 0 || start == 0 {
+		return []pmodel.Interval{{Start: start, End: 0}}
+	}
+
+	var intervals []pmodel.Interval
+	for sliceStart := start; ; sliceStart = sliceStart.Add(length) {
+		sliceEnd := sliceStart.Add(length)
+		if !sliceEnd.Before(end) {
+			return append(intervals, pmodel.Interval{Start: sliceStart, End: 0})
+		}
+		intervals = append(intervals, pmodel.Interval{Start: sliceStart, End: sliceEnd})
+	}
+}
+
+// shardSelectors splits the given series selector into one selector for each value
+// of the given label over the given interval, plus one for series without the label.
+func shardSelectors(ctx context.Context, promClient prom.Client, interval pmodel.Interval, selector prom.Selector, label pmodel.LabelName, retryDelay time.Duration) ([]prom.Selector, error) {
+	var values []string
+	err := withRetries(ctx, retryDelay, fmt.Sprintf("values of label %q for query %q", label, selector), func() error {
+		var err error
+		values, err = promClient.LabelValues(ctx, interval, string(label), selector)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list values of shard label %q: %v", label, err)
+	}
+
+	// series without the label at all match an empty value
+	values = append(values, "")
+	selectors := make([]prom.Selector, len(values))
+	for i, value := range values {
+		selectors[i], err = withLabelEq(selector, label, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selectors, nil
+}
+
+// listSeriesFromLabels lists the names of the metrics matching the given selector
+// over the given interval, and the names of the labels on each metric, producing
+// a single series for each metric, carrying each of its label names with an empty
+// value.
+func listSeriesFromLabels(ctx context.Context, promClient prom.Client, interval pmodel.Interval, selector prom.Selector, retryDelay time.Duration) ([]prom.Series, error) {
+	var names []string
+	err := withRetries(ctx, retryDelay, fmt.Sprintf("metric names for query %q", selector), func() error {
+		var err error
+		names, err = promClient.LabelValues(ctx, interval, pmodel.MetricNameLabel, selector)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list metric names: %v", err)
+	}
+
+	res := make([]prom.Series, 0, len(names))
+	for _, name := range names {
+		metricSelector, err := withLabelEq(selector, pmodel.MetricNameLabel, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var labelNames []string
+		err = withRetries(ctx, retryDelay, fmt.Sprintf("label names for query %q", metricSelector), func() error {
+			var err error
+			labelNames, err = promClient.LabelNames(ctx, interval, metricSelector)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list label names for metric %q: %v", name, err)
+		}
+
+		lbls := make(pmodel.LabelSet, len(labelNames))
+		for _, labelName := range labelNames {
+			if labelName != pmodel.MetricNameLabel {
+				lbls[pmodel.LabelName(labelName)] = ""
+			}
+		}
+		res = append(res, prom.Series{Name: name, Labels: lbls})
+	}
+	return res, nil
+}
+
+// withLabelEq adds a matcher requiring the given label to have the given value
+// to the given series selector.  Selectors which already name their metric outside
+// of the braces (e.g. `foo{bar="baz"}`) can't carry a metric name matcher as well,
+// so they're left as-is when restricted to the metric they already name.
+func withLabelEq(selector prom.Selector, label pmodel.LabelName, value string) (prom.Selector, error) {
+	sel, err := promql.ParseSelector(string(selector))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse series query to add matchers to it: %v", err)
+	}
+	if label == pmodel.MetricNameLabel && sel.Name != "" {
+		if sel.Name != value {
+			return "", fmt.Errorf("series query %q can't be restricted to metric %q", selector, value)
+		}
+		return selector, nil
+	}
+	sel.LabelMatchers = append(sel.LabelMatchers, plabels.MustNewMatcher(plabels.MatchEqual, string(label), value))
+	return prom.Selector(sel.String()), nil
+}
@@ -0,0 +1,539 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+const (
+	// discoveryAttempts is the number of times that listing the series for a
+	// single series query is attempted during each relist.
+	discoveryAttempts = 3
+	// defaultDiscoveryRetryDelay is the delay before the first retry of a failed
+	// series query.  The delay doubles with each subsequent retry.
+	defaultDiscoveryRetryDelay = 1 * time.Second
+)
+
+var (
+	// discoveryLastSuccess tracks the last time that listing the series for each
+	// series query succeeded.
+	discoveryLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cmgateway_discovery_last_success_timestamp_seconds",
+			Help: "Time at which the series for each series query were last listed successfully.  Broken down by API, backend name, and series query",
+		},
+		[]string{"api", "backend", "series_query"},
+	)
+
+	// discoveryFailing tracks whether the last attempt to list the series for
+	// each series query failed.
+	discoveryFailing = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cmgateway_discovery_failing",
+			Help: "Whether (1) or not (0) the last attempt to list the series for each series query failed.  Broken down by API, backend name, and series query",
+		},
+		[]string{"api", "backend", "series_query"},
+	)
+
+	// discoveryFailures counts failed attempts to list the series for each series query.
+	discoveryFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_discovery_failures_total",
+			Help: "Number of relists in which listing the series for each series query failed (after retries).  Broken down by API, backend name, and series query",
+		},
+		[]string{"api", "backend", "series_query"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(discoveryLastSuccess, discoveryFailing, discoveryFailures)
+}
+
+// Runnable represents something that can be run until told to stop.
+type Runnable interface {
+	// Run runs the runnable forever.
+	Run()
+	// RunUntil runs the runnable until the given channel is closed.
+	RunUntil(stopChan <-chan struct{})
+}
+
+// MetricsLister periodically lists the metrics available for a set of MetricNamers.
+type MetricsLister interface {
+	Runnable
+
+	// UpdateNamers replaces the namers used to discover metrics,
+	// and triggers an immediate relist.
+	UpdateNamers(namers []MetricNamer)
+}
+
+// seriesSetter knows how to store the results of listing series.
+type seriesSetter interface {
+	// SetSeries replaces the known series.
+	// Each slice in series should correspond to a MetricNamer in namers.
+	SetSeries(series [][]prom.Series, namers []MetricNamer) error
+}
+
+// seriesLister periodically lists the series matching each of its namers,
+// and stores the results in a registry.  Each series query is relisted at its
+// own interval, and only for the period since it was last listed, with each
+// series expiring individually once it hasn't been seen for the query's max age.
+// If listing the series for some of its namers fails, the last known series
+// for those namers are kept until they expire, and the other namers are
+// updated as normal.
+type seriesLister struct {
+	// api names the metrics API that the series are listed for, for use in metrics.
+	api         string
+	promClients prom.Backends
+	// updateInterval and maxAge are the relist interval and max age for series
+	// queries whose namers don't specify their own.
+	updateInterval time.Duration
+	maxAge         time.Duration
+	// failureExpiry is the amount of time for which the last known series for
+	// a series query are kept while listing its series fails (zero for no limit).
+	failureExpiry time.Duration
+	// retryDelay is the delay before the first retry of a failed series query.
+	retryDelay time.Duration
+	registry   seriesSetter
+	// clock is used to schedule relists, and to track when series were seen.
+	clock clock.Clock
+
+	namersMu sync.RWMutex
+	namers   []MetricNamer
+	// namersGeneration is incremented each time the namers change.
+	namersGeneration uint64
+	// namersChanged is notified when the namers change, so that the relist
+	// schedule can be recomputed.
+	namersChanged chan struct{}
+
+	// updateMu guards the state of the series queries.  It isn't held while
+	// listing series, so relists may overlap.
+	updateMu sync.Mutex
+	// queryStates holds the last known results of each series query.  It's
+	// only accessed with updateMu held.
+	queryStates map[seriesQuery]*queryState
+	// appliedGeneration is the generation of the namers last passed to the
+	// registry, so that an update with an older set of namers never overwrites
+	// the results of an update with a newer set.  It's only accessed with
+	// updateMu held.
+	appliedGeneration uint64
+}
+
+// queryState holds the last known results of a single series query.
+type queryState struct {
+	// series are the series seen by listings of the query, by fingerprint.
+	series map[pmodel.Fingerprint]seenSeries
+	// relistInterval and maxAge are the effective relist interval and max age
+	// for the query, as of the last update.
+	relistInterval time.Duration
+	maxAge         time.Duration
+	// lastAttempt is the time of the last attempt to list the query's series.
+	lastAttempt time.Time
+	// lastSuccess is the time of the last successful listing (zero if never).
+	lastSuccess time.Time
+}
+
+// seenSeries is a series, plus the last time at which it was seen.
+type seenSeries struct {
+	series   prom.Series
+	lastSeen time.Time
+}
+
+func newSeriesLister(api string, promClients prom.Backends, namers []MetricNamer, updateInterval, maxAge, failureExpiry time.Duration, registry seriesSetter) *seriesLister {
+	return &seriesLister{
+		api:            api,
+		promClients:    promClients,
+		updateInterval: updateInterval,
+		maxAge:         maxAge,
+		failureExpiry:  failureExpiry,
+		retryDelay:     defaultDiscoveryRetryDelay,
+		registry:       registry,
+		clock:          clock.RealClock{},
+		namers:         namers,
+		namersChanged:  make(chan struct{}, 1),
+		queryStates:    make(map[seriesQuery]*queryState),
+	}
+}
+
+func (l *seriesLister) Run() {
+	l.RunUntil(wait.NeverStop)
+}
+
+func (l *seriesLister) RunUntil(stopChan <-chan struct{}) {
+	go func() {
+		defer utilruntime.HandleCrash()
+		for {
+			if err := l.relist(false); err != nil {
+				utilruntime.HandleError(err)
+			}
+
+			select {
+			case <-stopChan:
+				return
+			case <-l.namersChanged:
+			case <-l.clock.After(l.nextRelistIn()):
+			}
+		}
+	}()
+}
+
+func (l *seriesLister) UpdateNamers(namers []MetricNamer) {
+	l.namersMu.Lock()
+	l.namers = namers
+	l.namersGeneration++
+	l.namersMu.Unlock()
+
+	// wake up the relist loop (if it's running), so that new queries are
+	// listed straight away, and relisted at the right interval
+	select {
+	case l.namersChanged <- struct{}{}:
+	default:
+	}
+}
+
+// currentNamers returns the namers currently in use, and their generation.
+func (l *seriesLister) currentNamers() ([]MetricNamer, uint64) {
+	l.namersMu.RLock()
+	defer l.namersMu.RUnlock()
+	return l.namers, l.namersGeneration
+}
+
+// updateMetrics relists the series for every series query.
+func (l *seriesLister) updateMetrics() error {
+	return l.relist(true)
+}
+
+// nextRelistIn returns the amount of time until the next series query is due
+// to be relisted.
+func (l *seriesLister) nextRelistIn() time.Duration {
+	l.updateMu.Lock()
+	defer l.updateMu.Unlock()
+
+	next := l.updateInterval
+	now := l.clock.Now()
+	for _, state := range l.queryStates {
+		if dueIn := state.lastAttempt.Add(state.relistInterval).Sub(now); dueIn < next {
+			next = dueIn
+		}
+	}
+	if next < 0 {
+		return 0
+	}
+	return next
+}
+
+// relist lists the series for the series queries which are due to be
+// relisted (or all series queries, if all is true), and updates the registry.
+// Each series query is listed with a timeout of its own relist interval, so
+// that a stuck Prometheus doesn't hold up the next relist.
+func (l *seriesLister) relist(all bool) error {
+	namers, generation := l.currentNamers()
+
+	l.updateMu.Lock()
+	queryStates, toList := l.planRelist(namers, all, l.clock.Now())
+	l.updateMu.Unlock()
+
+	results := listSeries(l.promClients, toList, l.retryDelay)
+
+	l.updateMu.Lock()
+	defer l.updateMu.Unlock()
+
+	now := l.clock.Now()
+	var errs []error
+	for query, result := range results {
+		state := queryStates[query]
+		if current, stillUsed := l.queryStates[query]; !stillUsed || current != state {
+			// a later relist with different namers has forgotten about this query
+			continue
+		}
+		metricLabels := prometheus.Labels{"api": l.api, "backend": query.backend, "series_query": string(query.selector)}
+
+		if result.err != nil {
+			errs = append(errs, result.err)
+			discoveryFailing.With(metricLabels).Set(1)
+			discoveryFailures.With(metricLabels).Inc()
+			continue
+		}
+
+		for _, series := range result.series {
+			state.series[seriesFingerprint(series)] = seenSeries{series: series, lastSeen: now}
+		}
+		// we only know that series are gone if the listing succeeded
+		for fingerprint, seen := range state.series {
+			if now.Sub(seen.lastSeen) > state.maxAge {
+				delete(state.series, fingerprint)
+			}
+		}
+		state.lastSuccess = now
+		discoveryFailing.With(metricLabels).Set(0)
+		discoveryLastSuccess.With(metricLabels).Set(float64(now.Unix()))
+	}
+
+	// a relist for a newer set of namers may have finished first
+	if generation >= l.appliedGeneration {
+		l.appliedGeneration = generation
+		if err := l.registry.SetSeries(l.seriesFor(namers, queryStates, now), namers); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to update the series for some rules (keeping the last known series until they expire): %v", utilerrors.NewAggregate(errs))
+	}
+	return nil
+}
+
+// planRelist computes the state of each series query used by the given namers,
+// and figures out which queries need to be listed (all of them, if all is
+// true), and how.  It must be called with updateMu held.
+func (l *seriesLister) planRelist(namers []MetricNamer, all bool, now time.Time) (map[seriesQuery]*queryState, map[seriesQuery]listRequest) {
+	queryStates := make(map[seriesQuery]*queryState)
+	for _, namer := range namers {
+		// declared series don't need to be listed at all
+		if namer.StaticSeries() != nil {
+			continue
+		}
+		query := seriesQueryFor(namer)
+		relistInterval, maxAge := l.relistSettingsFor(namer)
+
+		state, known := queryStates[query]
+		if !known {
+			state, known = l.queryStates[query]
+			if !known {
+				state = &queryState{series: make(map[pmodel.Fingerprint]seenSeries)}
+			}
+			// the settings are recomputed from the current namers, since
+			// they may have changed since the last update
+			state.relistInterval = relistInterval
+			state.maxAge = maxAge
+			queryStates[query] = state
+		}
+		// several namers may share a query, so use the most demanding settings
+		if relistInterval < state.relistInterval {
+			state.relistInterval = relistInterval
+		}
+		if maxAge > state.maxAge {
+			state.maxAge = maxAge
+		}
+	}
+
+	toList := make(map[seriesQuery]listRequest)
+	for query, state := range queryStates {
+		if !all && now.Sub(state.lastAttempt) < state.relistInterval {
+			continue
+		}
+		// only list the series since the last successful listing, if that's recent enough
+		start := now.Add(-state.maxAge)
+		if state.lastSuccess.After(start) {
+			start = state.lastSuccess
+		}
+		toList[query] = listRequest{
+			start:   pmodel.TimeFromUnixNano(start.UnixNano()),
+			timeout: state.relistInterval,
+		}
+		// mark the attempt now, so that overlapping relists don't list the
+		// query again while this one is in progress
+		state.lastAttempt = now
+	}
+
+	// forget about queries that are no longer used (e.g. after a config reload)
+	for query := range l.queryStates {
+		if _, stillUsed := queryStates[query]; !stillUsed {
+			metricLabels := prometheus.Labels{"api": l.api, "backend": query.backend, "series_query": string(query.selector)}
+			discoveryLastSuccess.Delete(metricLabels)
+			discoveryFailing.Delete(metricLabels)
+			discoveryFailures.Delete(metricLabels)
+		}
+	}
+	l.queryStates = queryStates
+
+	return queryStates, toList
+}
+
+// seriesFor collects the current series for each of the given namers from the
+// given query states.  It must be called with updateMu held.
+func (l *seriesLister) seriesFor(namers []MetricNamer, queryStates map[seriesQuery]*queryState, now time.Time) [][]prom.Series {
+	newSeries := make([][]prom.Series, len(namers))
+	for i, namer := range namers {
+		if static := namer.StaticSeries(); static != nil {
+			newSeries[i] = static
+			continue
+		}
+		query := seriesQueryFor(namer)
+		state := queryStates[query]
+		if state.lastSuccess.IsZero() {
+			continue
+		}
+		if l.failureExpiry != 0 && now.Sub(state.lastSuccess) > l.failureExpiry {
+			glog.Warningf("series for query %q were last listed successfully at %s, dropping metrics for them until listing succeeds again", query.selector, state.lastSuccess)
+			continue
+		}
+		newSeries[i] = namer.FilterSeries(state.currentSeries())
+	}
+
+	glog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
+	return newSeries
+}
+
+// relistSettingsFor returns the relist interval and max age for the given
+// namer's series query, falling back to the lister's defaults.  The max age is
+// never less than the relist interval, so that series don't disappear between
+// relists.
+func (l *seriesLister) relistSettingsFor(namer MetricNamer) (relistInterval, maxAge time.Duration) {
+	relistInterval, maxAge = namer.RelistInterval(), namer.SeriesMaxAge()
+	if relistInterval == 0 {
+		relistInterval = l.updateInterval
+	}
+	if maxAge == 0 {
+		maxAge = l.maxAge
+	}
+	if maxAge < relistInterval {
+		maxAge = relistInterval
+	}
+	return relistInterval, maxAge
+}
+
+// currentSeries returns the series currently known for the query.
+func (s *queryState) currentSeries() []prom.Series {
+	series := make([]prom.Series, 0, len(s.series))
+	for _, seen := range s.series {
+		series = append(series, seen.series)
+	}
+	return series
+}
+
+// seriesFingerprint identifies a series by its name and labels.
+func seriesFingerprint(series prom.Series) pmodel.Fingerprint {
+	lbls := make(pmodel.LabelSet, len(series.Labels)+1)
+	for name, value := range series.Labels {
+		lbls[name] = value
+	}
+	lbls[pmodel.MetricNameLabel] = pmodel.LabelValue(series.Name)
+	return lbls.Fingerprint()
+}
+
+// seriesQuery identifies a single series query against a particular backend,
+// listed in a particular way.
+type seriesQuery struct {
+	backend   string
+	selector  prom.Selector
+	discovery DiscoveryOptions
+}
+
+// seriesQueryFor returns the series query for the given namer.
+func seriesQueryFor(namer MetricNamer) seriesQuery {
+	return seriesQuery{
+		backend:   namer.Backend(),
+		selector:  namer.Selector(),
+		discovery: namer.DiscoveryOptions(),
+	}
+}
+
+// listRequest describes how to list the series for a single series query.
+type listRequest struct {
+	// start is the beginning of the period to list the series for.
+	start pmodel.Time
+	// timeout limits the time taken to list the series (zero for no limit).
+	timeout time.Duration
+}
+
+// seriesResult is the result of listing the series for a single series query.
+type seriesResult struct {
+	series []prom.Series
+	err    error
+}
+
+// listSeries fetches the series available for each of the given series queries
+// since the corresponding start time, within the corresponding timeout.  Each
+// query's series are fetched from its own backend.  Failed queries are retried
+// a few times, starting after the given retry delay.
+func listSeries(promClients prom.Backends, queries map[seriesQuery]listRequest, retryDelay time.Duration) map[seriesQuery]seriesResult {
+	// these can take a while on large clusters, so launch in parallel
+	var resultsMu sync.Mutex
+	results := make(map[seriesQuery]seriesResult, len(queries))
+	var wg sync.WaitGroup
+	for query, req := range queries {
+		promClient, err := promClients.For(query.backend)
+		if err != nil {
+			results[query] = seriesResult{err: fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)}
+			continue
+		}
+
+		wg.Add(1)
+		go func(query seriesQuery, req listRequest) {
+			defer wg.Done()
+			ctx, cancel := prom.WithQueryTimeout(context.Background(), req.timeout)
+			defer cancel()
+			series, err := listQuerySeries(ctx, promClient, req.start, query, retryDelay)
+			if err != nil {
+				err = fmt.Errorf("unable to fetch metrics for query %q: %v", query.selector, err)
+			}
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			results[query] = seriesResult{series: series, err: err}
+		}(query, req)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// listSeriesWithRetries lists the series matching the given selector, retrying
+// with exponential backoff (starting at the given delay) if that fails.
+func listSeriesWithRetries(ctx context.Context, promClient prom.Client, interval pmodel.Interval, selector prom.Selector, retryDelay time.Duration) ([]prom.Series, error) {
+	var series []prom.Series
+	err := withRetries(ctx, retryDelay, fmt.Sprintf("series for query %q", selector), func() error {
+		var err error
+		series, err = promClient.Series(ctx, interval, selector)
+		return err
+	})
+	return series, err
+}
+
+// withRetries calls list, retrying with exponential backoff (starting at the
+// given delay) if it fails.  what describes what's being listed, for logging.
+func withRetries(ctx context.Context, retryDelay time.Duration, what string, list func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := list()
+		if err == nil || attempt == discoveryAttempts {
+			return err
+		}
+		glog.V(4).Infof("unable to list %s (attempt %d of %d), retrying in %s: %v", what, attempt, discoveryAttempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
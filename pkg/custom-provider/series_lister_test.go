@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	adaptercfg "github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+// blockingPrometheusClient is a fake Prometheus client whose series requests
+// block until they're released (or their context is done).
+type blockingPrometheusClient struct {
+	fakeprom.FakePrometheusClient
+
+	// deadlines receives the time remaining before the deadline of each
+	// series request, when the request is made.
+	deadlines chan time.Duration
+	// release unblocks the series requests.
+	release chan struct{}
+}
+
+func (c *blockingPrometheusClient) Series(ctx context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
+	var remaining time.Duration
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		remaining = time.Until(deadline)
+	}
+	c.deadlines <- remaining
+
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.FakePrometheusClient.Series(ctx, interval, selectors...)
+}
+
+var _ = Describe("Series Lister", func() {
+	It("should list each series query with its own timeout, without blocking other operations", func() {
+		By("setting up a lister with a slow rule and a fast rule, on different backends")
+		newClient := func() *blockingPrometheusClient {
+			return &blockingPrometheusClient{
+				FakePrometheusClient: fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}},
+				deadlines:            make(chan time.Duration, 1),
+				release:              make(chan struct{}),
+			}
+		}
+		slowProm, fastProm := newClient(), newClient()
+		cfg := &adaptercfg.MetricsDiscoveryConfig{
+			Rules: []adaptercfg.DiscoveryRule{
+				{
+					SeriesQuery:    `{__name__=~"node_load.*"}`,
+					Resources:      adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery:   "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					RelistInterval: pmodel.Duration(time.Hour),
+					Backend:        "slow",
+				},
+				{
+					SeriesQuery:    `{__name__=~"node_http_.*"}`,
+					Resources:      adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+					MetricsQuery:   "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+					RelistInterval: pmodel.Duration(time.Minute),
+					Backend:        "fast",
+				},
+			},
+		}
+		namers, err := NamersFromConfig(cfg, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		lister := newSeriesLister("custom", prom.Backends{"slow": slowProm, "fast": fastProm}, namers, 10*time.Minute, 10*time.Minute, 0, NewBasicSeriesRegistry(restMapper()))
+
+		relistErr := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			relistErr <- lister.relist(true)
+		}()
+
+		By("checking that each query's timeout comes from its own relist interval")
+		var slowTimeout, fastTimeout time.Duration
+		Eventually(slowProm.deadlines).Should(Receive(&slowTimeout))
+		Eventually(fastProm.deadlines).Should(Receive(&fastTimeout))
+		Expect(slowTimeout).To(BeNumerically("~", time.Hour, time.Minute))
+		Expect(fastTimeout).To(BeNumerically("~", time.Minute, 10*time.Second))
+
+		By("checking that the lister's state can be read while the queries are in progress")
+		nextRelist := make(chan time.Duration, 1)
+		go func() {
+			nextRelist <- lister.nextRelistIn()
+		}()
+		Eventually(nextRelist).Should(Receive(BeNumerically("~", time.Minute, 10*time.Second)))
+
+		By("releasing the queries, and checking that the relist completes")
+		close(slowProm.release)
+		close(fastProm.release)
+		Eventually(relistErr).Should(Receive(BeNil()))
+	})
+})
@@ -22,6 +22,8 @@ import (
 
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
 	"github.com/golang/glog"
@@ -46,13 +48,26 @@ type SeriesRegistry interface {
 	// SetSeries replaces the known series in this registry.
 	// Each slice in series should correspond to a MetricNamer in namers.
 	SetSeries(series [][]prom.Series, namers []MetricNamer) error
+	// SetDerivedMetrics replaces the metrics computed from other metrics in this registry.
+	// The new derived metrics take effect the next time SetSeries is called.
+	SetDerivedMetrics(derived []*DerivedMetric)
 	// ListAllMetrics lists all metrics known to this registry
 	ListAllMetrics() []provider.CustomMetricInfo
 	// SeriesForMetric looks up the minimum required series information to make a query for the given metric
 	// against the given resource (namespace may be empty for non-namespaced resources)
 	QueryForMetric(info provider.CustomMetricInfo, namespace string, resourceNames ...string) (query prom.Selector, found bool)
-	// MatchValuesToNames matches result values to resource names for the given metric and value set
-	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool)
+	// QueryForObjectSelector produces a query for the given metric against all objects in the
+	// given namespace matching the given object selector, for metrics whose namer resolves
+	// label selectors in Prometheus (see MetricNamer#JoinsSelectors).
+	QueryForObjectSelector(info provider.CustomMetricInfo, namespace string, objectSelector labels.Selector) (query prom.Selector, found bool)
+	// RollupForMetric checks whether the given metric is produced by rolling up a pod metric onto
+	// the owners of the pods, returning the pod metric and the rollup if so.
+	RollupForMetric(metricInfo provider.CustomMetricInfo) (podInfo provider.CustomMetricInfo, rollup *OwnerRollup, found bool)
+	// MatchValuesToNames matches result samples to resource names for the given metric and value set
+	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]*pmodel.Sample, found bool)
+	// NamerForMetric returns the namer responsible for the given metric, which determines (amongst other
+	// things) the Prometheus backend that should be queried for it.
+	NamerForMetric(metricInfo provider.CustomMetricInfo) (namer MetricNamer, found bool)
 }
 
 type seriesInfo struct {
@@ -61,6 +76,14 @@ type seriesInfo struct {
 
 	// namer is the MetricNamer used to name this series
 	namer MetricNamer
+
+	// rollup indicates that the metric is produced by rolling up the
+	// corresponding pod metric onto the owners of the pods
+	rollup bool
+
+	// derived is set if the metric is computed from other metrics of the
+	// same object, in which case namer is the namer of the first of those
+	derived *DerivedMetric
 }
 
 // overridableSeriesRegistry is a basic SeriesRegistry
@@ -71,15 +94,36 @@ type basicSeriesRegistry struct {
 	info map[provider.CustomMetricInfo]seriesInfo
 	// metrics is the list of all known metrics
 	metrics []provider.CustomMetricInfo
+	// derived are the metrics computed from other metrics
+	derived []*DerivedMetric
 
 	mapper apimeta.RESTMapper
 }
 
+// NewBasicSeriesRegistry constructs a SeriesRegistry which knows about no
+// series until SetSeries is called.
+func NewBasicSeriesRegistry(mapper apimeta.RESTMapper) SeriesRegistry {
+	return &basicSeriesRegistry{
+		mapper: mapper,
+	}
+}
+
+func (r *basicSeriesRegistry) SetDerivedMetrics(derived []*DerivedMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.derived = derived
+}
+
 func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers []MetricNamer) error {
 	if len(newSeriesSlices) != len(namers) {
 		return fmt.Errorf("need one set of series per namer")
 	}
 
+	r.mu.RLock()
+	derivedMetrics := r.derived
+	r.mu.RUnlock()
+
 	newInfo := make(map[provider.CustomMetricInfo]seriesInfo)
 	for i, newSeries := range newSeriesSlices {
 		namer := namers[i]
@@ -109,9 +153,33 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 					namer:      namer,
 				}
 			}
+
+			// roll pod metrics up onto the owners of the pods, unless
+			// the owners have metrics of their own
+			rollup := namer.OwnerRollup()
+			if rollup == nil || !hasResource(resources, podGroupResource) {
+				continue
+			}
+			for _, owner := range rollup.Owners {
+				info := provider.CustomMetricInfo{
+					GroupResource: owner,
+					Namespaced:    true,
+					Metric:        name,
+				}
+				if existing, exists := newInfo[info]; exists && !existing.rollup {
+					continue
+				}
+				newInfo[info] = seriesInfo{
+					seriesName: series.Name,
+					namer:      namer,
+					rollup:     true,
+				}
+			}
 		}
 	}
 
+	addDerivedMetrics(newInfo, derivedMetrics)
+
 	// regenerate metrics
 	newMetrics := make([]provider.CustomMetricInfo, 0, len(newInfo))
 	for info := range newInfo {
@@ -127,6 +195,81 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 	return nil
 }
 
+// addDerivedMetrics registers each of the given derived metrics for every resource
+// which has all of the metrics that it refers to, unless the resource already has
+// a discovered metric of the same name.
+func addDerivedMetrics(infos map[provider.CustomMetricInfo]seriesInfo, derivedMetrics []*DerivedMetric) {
+	for _, derived := range derivedMetrics {
+		var candidates []provider.CustomMetricInfo
+		for info := range infos {
+			if info.Metric == derived.Metrics[0] {
+				candidates = append(candidates, info)
+			}
+		}
+
+		for _, candidate := range candidates {
+			derivedInfo := candidate
+			derivedInfo.Metric = derived.Name
+			if _, exists := infos[derivedInfo]; exists {
+				continue
+			}
+			if info, ok := derivedSeriesInfo(infos, derived, candidate); ok {
+				infos[derivedInfo] = info
+			}
+		}
+	}
+}
+
+// derivedSeriesInfo produces the series information for the given derived metric on the
+// resource of the given metric info, returning false if the metrics it refers to aren't
+// all available for that resource, or can't be combined into a single query.
+func derivedSeriesInfo(infos map[provider.CustomMetricInfo]seriesInfo, derived *DerivedMetric, resourceInfo provider.CustomMetricInfo) (seriesInfo, bool) {
+	var first seriesInfo
+	var resourceLbl pmodel.LabelName
+	for i, metric := range derived.Metrics {
+		baseInfo := resourceInfo
+		baseInfo.Metric = metric
+		base, found := infos[baseInfo]
+		if !found {
+			return seriesInfo{}, false
+		}
+		if base.rollup || base.derived != nil {
+			glog.V(4).Infof("not computing derived metric %q for %s: metric %q is not discovered directly", derived.Name, resourceInfo.GroupResource.String(), metric)
+			return seriesInfo{}, false
+		}
+		lbl, err := base.namer.LabelForResource(resourceInfo.GroupResource)
+		if err != nil {
+			glog.V(4).Infof("not computing derived metric %q for %s: %v", derived.Name, resourceInfo.GroupResource.String(), err)
+			return seriesInfo{}, false
+		}
+
+		if i == 0 {
+			first = base
+			resourceLbl = lbl
+			continue
+		}
+		if base.namer.Backend() != first.namer.Backend() || base.namer.JoinsSelectors() != first.namer.JoinsSelectors() || lbl != resourceLbl {
+			glog.V(4).Infof("not computing derived metric %q for %s: metrics %q and %q are queried differently", derived.Name, resourceInfo.GroupResource.String(), derived.Metrics[0], metric)
+			return seriesInfo{}, false
+		}
+	}
+
+	return seriesInfo{
+		namer:   first.namer,
+		derived: derived,
+	}, true
+}
+
+// hasResource checks if the given group-resource is in the given list.
+func hasResource(resources []schema.GroupResource, resource schema.GroupResource) bool {
+	for _, res := range resources {
+		if res == resource {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *basicSeriesRegistry) ListAllMetrics() []provider.CustomMetricInfo {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -155,7 +298,61 @@ func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInf
 		return "", false
 	}
 
-	query, err := info.namer.QueryForSeries(info.seriesName, metricInfo.GroupResource, namespace, resourceNames...)
+	query, err := r.queryFor(metricInfo, info, func(info seriesInfo) (prom.Selector, error) {
+		return info.namer.QueryForSeries(info.seriesName, metricInfo.GroupResource, namespace, resourceNames...)
+	})
+	if err != nil {
+		glog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
+		return "", false
+	}
+
+	return query, true
+}
+
+// queryFor produces the query for the given (normalized) metric using the given function,
+// which produces the query for a single discovered metric.  For derived metrics, the
+// queries for each of the metrics that they refer to are combined.
+func (r *basicSeriesRegistry) queryFor(metricInfo provider.CustomMetricInfo, info seriesInfo, queryForSeries func(seriesInfo) (prom.Selector, error)) (prom.Selector, error) {
+	if info.derived == nil {
+		return queryForSeries(info)
+	}
+
+	metricQueries := make(map[string]prom.Selector, len(info.derived.Metrics))
+	for _, metric := range info.derived.Metrics {
+		baseInfo := metricInfo
+		baseInfo.Metric = metric
+		base, found := r.info[baseInfo]
+		if !found {
+			return "", fmt.Errorf("metric %s is not registered", baseInfo.String())
+		}
+		query, err := queryForSeries(base)
+		if err != nil {
+			return "", err
+		}
+		metricQueries[metric] = query
+	}
+	return info.derived.Query(metricQueries)
+}
+
+func (r *basicSeriesRegistry) QueryForObjectSelector(metricInfo provider.CustomMetricInfo, namespace string, objectSelector labels.Selector) (prom.Selector, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		glog.Errorf("unable to normalize group resource while producing a query: %v", err)
+		return "", false
+	}
+
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		glog.V(10).Infof("metric %v not registered", metricInfo)
+		return "", false
+	}
+
+	query, err := r.queryFor(metricInfo, info, func(info seriesInfo) (prom.Selector, error) {
+		return info.namer.QueryForObjectSelector(info.seriesName, metricInfo.GroupResource, namespace, objectSelector)
+	})
 	if err != nil {
 		glog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
 		return "", false
@@ -164,7 +361,46 @@ func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInf
 	return query, true
 }
 
-func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool) {
+func (r *basicSeriesRegistry) RollupForMetric(metricInfo provider.CustomMetricInfo) (provider.CustomMetricInfo, *OwnerRollup, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		glog.Errorf("unable to normalize group resource while looking up rollup: %v", err)
+		return provider.CustomMetricInfo{}, nil, false
+	}
+
+	info, infoFound := r.info[metricInfo]
+	if !infoFound || !info.rollup {
+		return provider.CustomMetricInfo{}, nil, false
+	}
+	podInfo := provider.CustomMetricInfo{
+		GroupResource: podGroupResource,
+		Namespaced:    true,
+		Metric:        metricInfo.Metric,
+	}
+	return podInfo, info.namer.OwnerRollup(), true
+}
+
+func (r *basicSeriesRegistry) NamerForMetric(metricInfo provider.CustomMetricInfo) (MetricNamer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		glog.Errorf("unable to normalize group resource while looking up namer: %v", err)
+		return nil, false
+	}
+
+	info, infoFound := r.info[metricInfo]
+	if !infoFound {
+		return nil, false
+	}
+	return info.namer, true
+}
+
+func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]*pmodel.Sample, found bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -185,13 +421,13 @@ func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetri
 		return nil, false
 	}
 
-	res := make(map[string]pmodel.SampleValue, len(values))
+	res := make(map[string]*pmodel.Sample, len(values))
 	for _, val := range values {
 		if val == nil {
 			// skip empty values
 			continue
 		}
-		res[string(val.Metric[resourceLbl])] = val.Value
+		res[string(val.Metric[resourceLbl])] = val
 	}
 
 	return res, true
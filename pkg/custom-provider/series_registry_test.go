@@ -24,6 +24,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	pmodel "github.com/prometheus/common/model"
+	appsapi "k8s.io/api/apps/v1"
 	coreapi "k8s.io/api/core/v1"
 	extapi "k8s.io/api/extensions/v1beta1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
@@ -31,6 +32,7 @@ import (
 
 	config "github.com/directxman12/k8s-prometheus-adapter/cmd/config-gen/utils"
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	adaptercfg "github.com/directxman12/k8s-prometheus-adapter/pkg/config"
 )
 
 // restMapper creates a RESTMapper with just the types we need for
@@ -42,6 +44,8 @@ func restMapper() apimeta.RESTMapper {
 	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Service"), apimeta.RESTScopeNamespace)
 	mapper.Add(extapi.SchemeGroupVersion.WithKind("Ingress"), apimeta.RESTScopeNamespace)
 	mapper.Add(extapi.SchemeGroupVersion.WithKind("Deployment"), apimeta.RESTScopeNamespace)
+	mapper.Add(appsapi.SchemeGroupVersion.WithKind("ReplicaSet"), apimeta.RESTScopeNamespace)
+	mapper.Add(appsapi.SchemeGroupVersion.WithKind("StatefulSet"), apimeta.RESTScopeNamespace)
 
 	mapper.Add(coreapi.SchemeGroupVersion.WithKind("Node"), apimeta.RESTScopeRoot)
 	mapper.Add(coreapi.SchemeGroupVersion.WithKind("PersistentVolume"), apimeta.RESTScopeRoot)
@@ -144,90 +148,97 @@ var _ = Describe("Series Registry", func() {
 			// container metrics
 			{
 				title:         "container metrics gauge / multiple resource names",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_usage"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
 				namespace:     "somens",
 				resourceNames: []string{"somepod1", "somepod2"},
 
-				expectedQuery: "sum(container_some_usage{namespace=\"somens\",pod_name=~\"somepod1|somepod2\",container_name!=\"POD\"}) by (pod_name)",
+				expectedQuery: "sum by(pod_name) (container_some_usage{container_name!=\"POD\",namespace=\"somens\",pod_name=~\"somepod1|somepod2\"})",
 			},
 			{
 				title:         "container metrics counter",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_count"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_count"},
 				namespace:     "somens",
 				resourceNames: []string{"somepod1", "somepod2"},
 
-				expectedQuery: "sum(rate(container_some_count_total{namespace=\"somens\",pod_name=~\"somepod1|somepod2\",container_name!=\"POD\"}[1m])) by (pod_name)",
+				expectedQuery: "sum by(pod_name) (rate(container_some_count_total{container_name!=\"POD\",namespace=\"somens\",pod_name=~\"somepod1|somepod2\"}[1m]))",
 			},
 			{
 				title:         "container metrics seconds counter",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_time"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_time"},
 				namespace:     "somens",
 				resourceNames: []string{"somepod1", "somepod2"},
 
-				expectedQuery: "sum(rate(container_some_time_seconds_total{namespace=\"somens\",pod_name=~\"somepod1|somepod2\",container_name!=\"POD\"}[1m])) by (pod_name)",
+				expectedQuery: "sum by(pod_name) (rate(container_some_time_seconds_total{container_name!=\"POD\",namespace=\"somens\",pod_name=~\"somepod1|somepod2\"}[1m]))",
 			},
 			// namespaced metrics
 			{
 				title:         "namespaced metrics counter / multidimensional (service)",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "service"}, true, "ingress_hits"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "service"}, Namespaced: true, Metric: "ingress_hits"},
 				namespace:     "somens",
 				resourceNames: []string{"somesvc"},
 
-				expectedQuery: "sum(rate(ingress_hits_total{kube_namespace=\"somens\",kube_service=\"somesvc\"}[1m])) by (kube_service)",
+				expectedQuery: "sum by(kube_service) (rate(ingress_hits_total{kube_namespace=\"somens\",kube_service=\"somesvc\"}[1m]))",
 			},
 			{
 				title:         "namespaced metrics counter / multidimensional (ingress)",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "ingress"}, true, "ingress_hits"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "ingress"}, Namespaced: true, Metric: "ingress_hits"},
 				namespace:     "somens",
 				resourceNames: []string{"someingress"},
 
-				expectedQuery: "sum(rate(ingress_hits_total{kube_namespace=\"somens\",kube_ingress=\"someingress\"}[1m])) by (kube_ingress)",
+				expectedQuery: "sum by(kube_ingress) (rate(ingress_hits_total{kube_ingress=\"someingress\",kube_namespace=\"somens\"}[1m]))",
 			},
 			{
 				title:         "namespaced metrics counter / multidimensional (pod)",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "pod"}, true, "ingress_hits"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pod"}, Namespaced: true, Metric: "ingress_hits"},
 				namespace:     "somens",
 				resourceNames: []string{"somepod"},
 
-				expectedQuery: "sum(rate(ingress_hits_total{kube_namespace=\"somens\",kube_pod=\"somepod\"}[1m])) by (kube_pod)",
+				expectedQuery: "sum by(kube_pod) (rate(ingress_hits_total{kube_namespace=\"somens\",kube_pod=\"somepod\"}[1m]))",
 			},
 			{
 				title:         "namespaced metrics gauge",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "service"}, true, "service_proxy_packets"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "service"}, Namespaced: true, Metric: "service_proxy_packets"},
 				namespace:     "somens",
 				resourceNames: []string{"somesvc"},
 
-				expectedQuery: "sum(service_proxy_packets{kube_namespace=\"somens\",kube_service=\"somesvc\"}) by (kube_service)",
+				expectedQuery: "sum by(kube_service) (service_proxy_packets{kube_namespace=\"somens\",kube_service=\"somesvc\"})",
 			},
 			{
 				title:         "namespaced metrics seconds counter",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "deployment"}, true, "work_queue_wait"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployment"}, Namespaced: true, Metric: "work_queue_wait"},
 				namespace:     "somens",
 				resourceNames: []string{"somedep"},
 
-				expectedQuery: "sum(rate(work_queue_wait_seconds_total{kube_namespace=\"somens\",kube_deployment=\"somedep\"}[1m])) by (kube_deployment)",
+				expectedQuery: "sum by(kube_deployment) (rate(work_queue_wait_seconds_total{kube_deployment=\"somedep\",kube_namespace=\"somens\"}[1m]))",
 			},
 			// non-namespaced series
 			{
 				title:         "root scoped metrics gauge",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "node"}, false, "node_gigawatts"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "node"}, Namespaced: false, Metric: "node_gigawatts"},
 				resourceNames: []string{"somenode"},
 
-				expectedQuery: "sum(node_gigawatts{kube_node=\"somenode\"}) by (kube_node)",
+				expectedQuery: "sum by(kube_node) (node_gigawatts{kube_node=\"somenode\"})",
+			},
+			{
+				title:         "root scoped metrics gauge / resource names with regex characters",
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "node"}, Namespaced: false, Metric: "node_gigawatts"},
+				resourceNames: []string{"node1.example.com", "node2"},
+
+				expectedQuery: "sum by(kube_node) (node_gigawatts{kube_node=~\"node1\\\\.example\\\\.com|node2\"})",
 			},
 			{
 				title:         "root scoped metrics counter",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "persistentvolume"}, false, "volume_claims"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "persistentvolume"}, Namespaced: false, Metric: "volume_claims"},
 				resourceNames: []string{"somepv"},
 
-				expectedQuery: "sum(rate(volume_claims_total{kube_persistentvolume=\"somepv\"}[1m])) by (kube_persistentvolume)",
+				expectedQuery: "sum by(kube_persistentvolume) (rate(volume_claims_total{kube_persistentvolume=\"somepv\"}[1m]))",
 			},
 			{
 				title:         "root scoped metrics seconds counter",
-				info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "node"}, false, "node_fan"},
+				info:          provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "node"}, Namespaced: false, Metric: "node_fan"},
 				resourceNames: []string{"somenode"},
 
-				expectedQuery: "sum(rate(node_fan_seconds_total{kube_node=\"somenode\"}[1m])) by (kube_node)",
+				expectedQuery: "sum by(kube_node) (rate(node_fan_seconds_total{kube_node=\"somenode\"}[1m]))",
 			},
 		}
 
@@ -245,24 +256,132 @@ var _ = Describe("Series Registry", func() {
 
 		It("should list all metrics", func() {
 			Expect(registry.ListAllMetrics()).To(ConsistOf(
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_count"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "some_count"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_time"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "some_time"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "some_usage"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "some_usage"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "ingress_hits"},
-				provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "ingresses"}, true, "ingress_hits"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "ingress_hits"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "ingress_hits"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "service_proxy_packets"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "service_proxy_packets"},
-				provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "deployments"}, true, "work_queue_wait"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "namespaces"}, false, "work_queue_wait"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "nodes"}, false, "node_gigawatts"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "persistentvolumes"}, false, "volume_claims"},
-				provider.CustomMetricInfo{schema.GroupResource{Resource: "nodes"}, false, "node_fan"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_count"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "some_count"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_time"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "some_time"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "some_usage"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "some_usage"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "ingress_hits"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "ingresses"}, Namespaced: true, Metric: "ingress_hits"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "ingress_hits"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "ingress_hits"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "service_proxy_packets"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "work_queue_wait"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "work_queue_wait"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_gigawatts"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "persistentvolumes"}, Namespaced: false, Metric: "volume_claims"},
+				provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Namespaced: false, Metric: "node_fan"},
 			))
 		})
 	})
+
+	Context("with derived metrics", func() {
+		BeforeEach(func() {
+			derived, err := DerivedMetricsFromConfig(&adaptercfg.MetricsDiscoveryConfig{
+				DerivedMetrics: []adaptercfg.DerivedMetric{
+					{Name: "hits_per_packet", Expression: "ingress_hits / service_proxy_packets"},
+					{Name: "work_queue_wait", Expression: "ingress_hits * 2"},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			registry.SetDerivedMetrics(derived)
+			Expect(registry.SetSeries(seriesRegistryTestSeries, setupMetricNamer())).To(Succeed())
+		})
+
+		It("should list derived metrics for resources with all of the metrics they refer to", func() {
+			metrics := registry.ListAllMetrics()
+			Expect(metrics).To(ContainElement(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "hits_per_packet"}))
+			Expect(metrics).To(ContainElement(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "hits_per_packet"}))
+			Expect(metrics).NotTo(ContainElement(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "hits_per_packet"}))
+		})
+
+		It("should compose the queries for the metrics referred to", func() {
+			info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "hits_per_packet"}
+			query, found := registry.QueryForMetric(info, "somens", "somesvc")
+			Expect(found).To(BeTrue())
+			Expect(query).To(Equal(prom.Selector(`(sum by(kube_service) (rate(ingress_hits_total{kube_namespace="somens",kube_service="somesvc"}[1m]))) / ` +
+				`(sum by(kube_service) (service_proxy_packets{kube_namespace="somens",kube_service="somesvc"}))`)))
+		})
+
+		It("should prefer discovered metrics over derived metrics of the same name", func() {
+			query, found := registry.QueryForMetric(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Namespaced: false, Metric: "work_queue_wait"}, "", "somens")
+			Expect(found).To(BeTrue())
+			Expect(query).To(Equal(prom.Selector(`sum by(kube_namespace) (rate(work_queue_wait_seconds_total{kube_namespace="somens"}[1m]))`)))
+
+			query, found = registry.QueryForMetric(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "work_queue_wait"}, "somens", "somepod")
+			Expect(found).To(BeTrue())
+			Expect(query).To(Equal(prom.Selector(`(sum by(kube_pod) (rate(ingress_hits_total{kube_namespace="somens",kube_pod="somepod"}[1m]))) * 2`)))
+		})
+	})
+
+	It("should reject invalid derived metrics", func() {
+		for _, derived := range []adaptercfg.DerivedMetric{
+			{Name: "", Expression: "foo"},
+			{Name: "bar", Expression: "foo{"},
+			{Name: "bar", Expression: `foo{pod="somepod"}`},
+			{Name: "bar", Expression: "rate(foo[5m])"},
+			{Name: "bar", Expression: "1 + 2"},
+			{Name: "bar", Expression: "bar / foo"},
+		} {
+			_, err := DerivedMetricFromConfig(derived)
+			Expect(err).To(HaveOccurred(), "for derived metric %q", derived.Expression)
+		}
+
+		_, err := DerivedMetricsFromConfig(&adaptercfg.MetricsDiscoveryConfig{
+			DerivedMetrics: []adaptercfg.DerivedMetric{
+				{Name: "foo_ratio", Expression: "foo / bar"},
+				{Name: "foo_ratio_doubled", Expression: "foo_ratio * 2"},
+			},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+	It("should restrict queries to the requested objects, even if the template doesn't use the label matchers", func() {
+		namer, err := NamerFromRule(adaptercfg.DiscoveryRule{
+			SeriesQuery:  `{__name__="queue_depth"}`,
+			Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: `sum(<<.Series>>{queue!=""}) by (<<.GroupBy>>) / sum(<<.Series>>) by (<<.GroupBy>>)`,
+		}, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.SetSeries([][]prom.Series{{
+			{Name: "queue_depth", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+		}}, []MetricNamer{namer})).To(Succeed())
+
+		query, found := registry.QueryForMetric(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}, "somens", "somepod")
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum by(pod) (queue_depth{namespace="somens",pod="somepod",queue!=""}) / sum by(pod) (queue_depth{namespace="somens",pod="somepod"})`)))
+	})
+
+	It("should build queries which use functions from newer versions of Prometheus", func() {
+		namer, err := NamerFromRule(adaptercfg.DiscoveryRule{
+			SeriesQuery:  `{__name__="queue_depth"}`,
+			Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: `sum(sgn(<<.Series>>{<<.LabelMatchers>>})) by (<<.GroupBy>>)`,
+		}, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.SetSeries([][]prom.Series{{
+			{Name: "queue_depth", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+		}}, []MetricNamer{namer})).To(Succeed())
+
+		query, found := registry.QueryForMetric(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}, "somens", "somepod")
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum by(pod) (sgn(queue_depth{namespace="somens",pod="somepod"}))`)))
+	})
+
+	It("should build queries from the parsed template, substituting the series, matchers, and group-by labels", func() {
+		namer, err := NamerFromRule(adaptercfg.DiscoveryRule{
+			SeriesQuery:  `{__name__="queue_depth"}`,
+			Resources:    adaptercfg.ResourceMapping{Template: "<<.Resource>>"},
+			MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>,queue!=""} @ end() offset 5m) by (<<.GroupBy>>) > on(<<.GroupBy>>) group_left() max(rate(<<.Series>>{<<.LabelMatchers>>}[1h30m])) by (<<.GroupBy>>)`,
+		}, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.SetSeries([][]prom.Series{{
+			{Name: "queue_depth", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+		}}, []MetricNamer{namer})).To(Succeed())
+
+		query, found := registry.QueryForMetric(provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_depth"}, "somens", "somepod1", "somepod2")
+		Expect(found).To(BeTrue())
+		Expect(query).To(Equal(prom.Selector(`sum by(pod) (queue_depth{namespace="somens",pod=~"somepod1|somepod2",queue!=""} @ end() offset 5m) > on(pod) group_left() max by(pod) (rate(queue_depth{namespace="somens",pod=~"somepod1|somepod2"}[1h30m]))`)))
+	})
 })
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+// staticMetricNamer is a MetricNamer for a metric which is declared directly,
+// instead of being discovered.  It declares a single series, with a label for
+// each of the metric's resources, so that the metric is registered (and its
+// resources converted) just like a discovered metric.
+type staticMetricNamer struct {
+	MetricNamer
+
+	name      string
+	series    []prom.Series
+	resources []schema.GroupResource
+}
+
+func (n *staticMetricNamer) StaticSeries() []prom.Series {
+	return n.series
+}
+
+func (n *staticMetricNamer) FilterSeries(series []prom.Series) []prom.Series {
+	return series
+}
+
+func (n *staticMetricNamer) MetricNameForSeries(series prom.Series) (string, error) {
+	return n.name, nil
+}
+
+// ResourcesForSeries only returns the declared resources, so that namespaces only
+// have the metric if they're declared explicitly.
+func (n *staticMetricNamer) ResourcesForSeries(series prom.Series) ([]schema.GroupResource, bool) {
+	_, namespaced := n.MetricNamer.ResourcesForSeries(series)
+	return n.resources, namespaced
+}
+
+// NamerFromStaticMetric produces a MetricNamer for a single static metric.
+func NamerFromStaticMetric(metric config.StaticMetric, mapper apimeta.RESTMapper) (MetricNamer, error) {
+	if metric.Name == "" {
+		return nil, fmt.Errorf("static metric name must be specified")
+	}
+	if len(metric.GroupResources) == 0 {
+		return nil, fmt.Errorf("static metric %q must list at least one resource", metric.Name)
+	}
+	seriesName := metric.SeriesName
+	if seriesName == "" {
+		seriesName = metric.Name
+	}
+
+	namer, err := NamerFromRule(config.DiscoveryRule{
+		Resources:    metric.Resources,
+		MetricsQuery: metric.MetricsQuery,
+		Backend:      metric.Backend,
+		MaxSampleAge: metric.MaxSampleAge,
+		Window:       metric.Window,
+	}, mapper)
+	if err != nil {
+		return nil, fmt.Errorf("invalid static metric %q: %v", metric.Name, err)
+	}
+
+	seriesLabels := pmodel.LabelSet{}
+	resources := make([]schema.GroupResource, 0, len(metric.GroupResources))
+	anyNamespaced := false
+	for _, groupRes := range metric.GroupResources {
+		info, _, err := provider.CustomMetricInfo{
+			GroupResource: schema.GroupResource{Group: groupRes.Group, Resource: groupRes.Resource},
+		}.Normalized(mapper)
+		if err != nil {
+			return nil, fmt.Errorf("unable to normalize group-resource %v for static metric %q: %v", groupRes, metric.Name, err)
+		}
+		lbl, err := namer.LabelForResource(info.GroupResource)
+		if err != nil {
+			return nil, fmt.Errorf("static metric %q doesn't map resource %s to a label: %v", metric.Name, info.GroupResource.String(), err)
+		}
+		namespaced, err := isNamespaced(mapper, info.GroupResource)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the scope of resource %s for static metric %q: %v", info.GroupResource.String(), metric.Name, err)
+		}
+		anyNamespaced = anyNamespaced || namespaced
+
+		seriesLabels[lbl] = ""
+		resources = append(resources, info.GroupResource)
+	}
+
+	if anyNamespaced {
+		lbl, err := namer.LabelForResource(nsGroupResource)
+		if err != nil {
+			return nil, fmt.Errorf("static metric %q has namespaced resources, but doesn't map namespaces to a label: %v", metric.Name, err)
+		}
+		seriesLabels[lbl] = ""
+	}
+
+	return &staticMetricNamer{
+		MetricNamer: namer,
+		name:        metric.Name,
+		series:      []prom.Series{{Name: seriesName, Labels: seriesLabels}},
+		resources:   resources,
+	}, nil
+}
+
+// isNamespaced checks whether the given (normalized) group-resource is namespace-scoped.
+func isNamespaced(mapper apimeta.RESTMapper, groupRes schema.GroupResource) (bool, error) {
+	kind, err := mapper.KindFor(groupRes.WithVersion(""))
+	if err != nil {
+		return false, err
+	}
+	mapping, err := mapper.RESTMapping(kind.GroupKind(), kind.Version)
+	if err != nil {
+		return false, err
+	}
+	return mapping.Scope.Name() == apimeta.RESTScopeNameNamespace, nil
+}
@@ -0,0 +1,33 @@
+package mapper
+
+import (
+	"fmt"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewForKubeconfig constructs a RESTMapper using the resources available in the
+// cluster pointed to by the given kubeconfig file.  If kubeconfig is empty,
+// a mapper for the built-in Kubernetes resources is returned instead.
+func NewForKubeconfig(kubeconfig string) (apimeta.RESTMapper, error) {
+	if kubeconfig == "" {
+		return NewStatic(), nil
+	}
+
+	clientConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig: %v", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct discovery client: %v", err)
+	}
+	groupResources, err := restmapper.GetAPIGroupResources(discoveryClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover cluster resources: %v", err)
+	}
+	return restmapper.NewDiscoveryRESTMapper(groupResources), nil
+}
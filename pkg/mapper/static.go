@@ -0,0 +1,64 @@
+// Package mapper provides RESTMappers for tools that run outside of the adapter
+// (and thus may not have access to a cluster).
+package mapper
+
+import (
+	"sort"
+	"strings"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// clusterScopedKinds are the built-in kinds which aren't namespaced.
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CertificateSigningRequest":      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"ComponentStatus":                true,
+	"CustomResourceDefinition":       true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PodSecurityPolicy":              true,
+	"PriorityClass":                  true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+	"VolumeAttachment":               true,
+	"InitializerConfiguration":       true,
+}
+
+// NewStatic constructs a RESTMapper that knows about the built-in
+// Kubernetes types, without contacting a cluster.  When a resource exists in
+// multiple groups, the legacy (core) group is preferred, followed by the other
+// groups in alphabetical order.  Only the preferred version of each group is used.
+func NewStatic() apimeta.RESTMapper {
+	preferredVersions := scheme.Scheme.PreferredVersionAllGroups()
+	sort.Slice(preferredVersions, func(i, j int) bool {
+		return preferredVersions[i].Group < preferredVersions[j].Group
+	})
+
+	mapper := apimeta.NewDefaultRESTMapper(preferredVersions)
+	priority := make([]schema.GroupVersionResource, 0, len(preferredVersions))
+	for _, gv := range preferredVersions {
+		for kind := range scheme.Scheme.KnownTypes(gv) {
+			if strings.HasSuffix(kind, "List") || strings.HasSuffix(kind, "Options") || kind == "WatchEvent" {
+				continue
+			}
+			scope := apimeta.RESTScopeNamespace
+			if clusterScopedKinds[kind] {
+				scope = apimeta.RESTScopeRoot
+			}
+			mapper.Add(gv.WithKind(kind), scope)
+		}
+		priority = append(priority, schema.GroupVersionResource{Group: gv.Group, Version: gv.Version, Resource: apimeta.AnyResource})
+	}
+
+	return apimeta.PriorityRESTMapper{
+		Delegate:         mapper,
+		ResourcePriority: priority,
+	}
+}
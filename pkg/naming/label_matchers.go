@@ -0,0 +1,66 @@
+package naming
+
+import (
+	"fmt"
+
+	plabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+// ParseLabelMatchers parses the given PromQL label matchers (e.g. `cluster="prod-eu"`).
+func ParseLabelMatchers(matchers []string) ([]*plabels.Matcher, error) {
+	res := make([]*plabels.Matcher, 0, len(matchers))
+	for _, raw := range matchers {
+		parsed, err := parser.ParseMetricSelector("{" + raw + "}")
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matcher %q: %v", raw, err)
+		}
+		if len(parsed) != 1 {
+			return nil, fmt.Errorf("invalid label matcher %q: expected a single matcher", raw)
+		}
+		res = append(res, parsed[0])
+	}
+	return res, nil
+}
+
+// EnforceLabelMatchers adds the given label matchers to every selector in the
+// given PromQL expression which doesn't already have them.
+func EnforceLabelMatchers(query prom.Selector, matchers []*plabels.Matcher) (prom.Selector, error) {
+	return EnforceLabelMatchersBySeries(query, matchers, nil)
+}
+
+// EnforceLabelMatchersBySeries is like EnforceLabelMatchers, except that selectors
+// for the series in seriesMatchers get the matchers given for that series instead.
+func EnforceLabelMatchersBySeries(query prom.Selector, matchers []*plabels.Matcher, seriesMatchers map[string][]*plabels.Matcher) (prom.Selector, error) {
+	if len(matchers) == 0 && len(seriesMatchers) == 0 {
+		return query, nil
+	}
+	expr, err := parser.ParseExpr(string(query))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse query %q: %v", query, err)
+	}
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		sel, isSel := node.(*parser.VectorSelector)
+		if !isSel {
+			return nil
+		}
+		selMatchers := matchers
+		for series, override := range seriesMatchers {
+			if selectsSeries(sel, series) {
+				selMatchers = override
+				break
+			}
+		}
+		for _, matcher := range selMatchers {
+			if !hasMatchers(sel, []*plabels.Matcher{matcher}) {
+				sel.LabelMatchers = append(sel.LabelMatchers, matcher)
+			}
+		}
+		return nil
+	})
+
+	return prom.Selector(expr.String()), nil
+}
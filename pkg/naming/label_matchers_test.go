@@ -0,0 +1,91 @@
+package naming
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	plabels "github.com/prometheus/prometheus/model/labels"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+var _ = Describe("Label Matchers", func() {
+	It("should parse single label matchers, and refuse anything else", func() {
+		matchers, err := ParseLabelMatchers([]string{`cluster="prod-eu"`, `region=~"eu-.*"`, `env!=""`})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matchers).To(Equal([]*plabels.Matcher{
+			plabels.MustNewMatcher(plabels.MatchEqual, "cluster", "prod-eu"),
+			plabels.MustNewMatcher(plabels.MatchRegexp, "region", "eu-.*"),
+			plabels.MustNewMatcher(plabels.MatchNotEqual, "env", ""),
+		}))
+
+		for _, raw := range []string{`cluster`, `cluster="a",region="b"`, `cluster=~"("`} {
+			_, err := ParseLabelMatchers([]string{raw})
+			Expect(err).To(HaveOccurred(), "matcher %q should have been refused", raw)
+		}
+	})
+
+	It("should add the label matchers to every selector in the query", func() {
+		matchers := []*plabels.Matcher{plabels.MustNewMatcher(plabels.MatchEqual, "cluster", "prod-eu")}
+		testCases := []struct {
+			name     string
+			query    prom.Selector
+			expected prom.Selector
+		}{
+			{
+				name:     "a plain selector",
+				query:    `foo`,
+				expected: `foo{cluster="prod-eu"}`,
+			},
+			{
+				name:     "a selector which already has the matcher",
+				query:    `foo{cluster="prod-eu",pod="a"}`,
+				expected: `foo{cluster="prod-eu",pod="a"}`,
+			},
+			{
+				name:     "a selector for another value of the label",
+				query:    `foo{cluster="prod-us"}`,
+				expected: `foo{cluster="prod-eu",cluster="prod-us"}`,
+			},
+			{
+				name:     "binary operations and aggregations",
+				query:    `sum(rate(foo[2m])) by (pod) / on(pod) group_left sum(bar) by (pod)`,
+				expected: `sum by(pod) (rate(foo{cluster="prod-eu"}[2m])) / on(pod) group_left() sum by(pod) (bar{cluster="prod-eu"})`,
+			},
+			{
+				name:     "functions from newer versions of Prometheus",
+				query:    `last_over_time(foo[5m]) + present_over_time(bar[5m])`,
+				expected: `last_over_time(foo{cluster="prod-eu"}[5m]) + present_over_time(bar{cluster="prod-eu"}[5m])`,
+			},
+			{
+				name:     "subqueries, offsets and the @ modifier",
+				query:    `max_over_time(rate(foo[1m])[10m:1m] offset 5m) - bar @ end()`,
+				expected: `max_over_time(rate(foo{cluster="prod-eu"}[1m])[10m:1m] offset 5m) - bar{cluster="prod-eu"} @ end()`,
+			},
+		}
+
+		for _, tc := range testCases {
+			By(fmt.Sprintf("checking %s", tc.name))
+			res, err := EnforceLabelMatchers(tc.query, matchers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(tc.expected))
+		}
+	})
+
+	It("should add the matchers given for a series to its selectors instead", func() {
+		matchers := []*plabels.Matcher{plabels.MustNewMatcher(plabels.MatchEqual, "kubernetes_namespace", "somens")}
+		seriesMatchers := map[string][]*plabels.Matcher{
+			"kube_pod_labels": {plabels.MustNewMatcher(plabels.MatchEqual, "namespace", "somens")},
+		}
+		res, err := EnforceLabelMatchersBySeries(`sum(foo) by (pod) and on(pod) kube_pod_labels{label_app="web"}`, matchers, seriesMatchers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(prom.Selector(`sum by(pod) (foo{kubernetes_namespace="somens"}) and on(pod) kube_pod_labels{label_app="web",namespace="somens"}`)))
+	})
+
+	It("should refuse queries which can't be parsed, instead of running them unrestricted", func() {
+		matchers := []*plabels.Matcher{plabels.MustNewMatcher(plabels.MatchEqual, "cluster", "prod-eu")}
+		_, err := EnforceLabelMatchers(`sum(foo) by (`, matchers)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -26,7 +26,7 @@ type labelGroupResExtractor struct {
 // so anything in the template which limits resource or group name length will cause issues.
 func newLabelGroupResExtractor(labelTemplate *template.Template) (*labelGroupResExtractor, error) {
 	labelRegexBuff := new(bytes.Buffer)
-	if err := labelTemplate.Execute(labelRegexBuff, schema.GroupResource{"(?P<group>.+?)", "(?P<resource>.+?)"}); err != nil {
+	if err := labelTemplate.Execute(labelRegexBuff, schema.GroupResource{Group: "(?P<group>.+?)", Resource: "(?P<resource>.+?)"}); err != nil {
 		return nil, fmt.Errorf("unable to convert label template to matcher: %v", err)
 	}
 	if labelRegexBuff.Len() == 0 {
@@ -3,12 +3,20 @@ package naming
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
 )
 
 // MetricsQuery represents a compiled metrics query for some set of
@@ -19,8 +27,15 @@ type MetricsQuery interface {
 	// over the given group-resource.  If namespace is empty, the resource
 	// is considered to be root-scoped.  extraGroupBy may be used for cases
 	// where we need to scope down more specifically than just the group-resource
-	// (e.g. container metrics).
+	// (e.g. container metrics).  If no resource names are given, the query
+	// covers every object of the group-resource.
 	Build(series string, groupRes schema.GroupResource, namespace string, extraGroupBy []string, resourceNames ...string) (prom.Selector, error)
+
+	// BuildExternal constructs Prometheus expressions to represent this query
+	// for an external metric.  If namespace is empty, no namespace matcher is
+	// added.  Each requirement in metricSelector is converted into an equivalent
+	// Prometheus label matcher.
+	BuildExternal(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error)
 }
 
 // NewMetricsQuery constructs a new MetricsQuery by compiling the given Go template.
@@ -30,16 +45,35 @@ type MetricsQuery interface {
 // - LabelMatchersByName: the raw map-form of the above matchers
 // - GroupBy: the group-by clause to use for the resources in the query (stringified)
 // - GroupBySlice: the raw slice form of the above group-by clause
+// Templates which only use Series, LabelMatchers, and GroupBy are parsed once,
+// and each query is built from the parsed expression.  Other templates are
+// rendered and parsed for each query.  The template is checked by rendering it
+// with example arguments, and an error is returned if the result isn't valid PromQL.
 func NewMetricsQuery(queryTemplate string, resourceConverter ResourceConverter) (MetricsQuery, error) {
 	templ, err := template.New("metrics-query").Delims("<<", ">>").Parse(queryTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse metrics query template %q: %v", queryTemplate, err)
 	}
 
-	return &metricsQuery{
+	q := &metricsQuery{
 		resConverter: resourceConverter,
 		template:     templ,
-	}, nil
+	}
+
+	example, err := q.render(exampleTemplateArgs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render metrics query template %q: %v", queryTemplate, err)
+	}
+	exampleExpr, err := parser.ParseExpr(example)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse metrics query template %q (rendered as %q): %v", queryTemplate, example, err)
+	}
+
+	if usesOnlyPlaceholderFields(templ) {
+		q.skeleton = q.parseSkeleton(exampleExpr)
+	}
+
+	return q, nil
 }
 
 // metricsQuery is a MetricsQuery based on a compiled Go text template.
@@ -48,6 +82,12 @@ func NewMetricsQuery(queryTemplate string, resourceConverter ResourceConverter)
 type metricsQuery struct {
 	resConverter ResourceConverter
 	template     *template.Template
+
+	// skeleton is the template rendered with placeholder arguments and parsed,
+	// if the template only uses fields that can be substituted into the parsed
+	// expression.  Queries are built from copies of it, instead of rendering
+	// and parsing the template each time.
+	skeleton parser.Expr
 }
 
 // queryTemplateArgs contains the arguments for the template used in metricsQuery.
@@ -59,8 +99,149 @@ type queryTemplateArgs struct {
 	GroupBySlice      []string
 }
 
+// exampleTemplateArgs stand in for the arguments of a real query when checking
+// that a query template produces valid PromQL.
+var exampleTemplateArgs = queryTemplateArgs{
+	Series:            "series",
+	LabelMatchers:     `resource="name"`,
+	LabelValuesByName: map[string][]string{"resource": {"name"}},
+	GroupBy:           "resource",
+	GroupBySlice:      []string{"resource"},
+}
+
+const (
+	// placeholderSeries, placeholderMatchersLabel, and placeholderGroupBy
+	// mark where the series, label matchers, and group-by labels go in the
+	// skeleton of a query.
+	placeholderSeries        = "__adapter_series__"
+	placeholderMatchersLabel = "__adapter_label_matchers__"
+	placeholderGroupBy       = "__adapter_group_by__"
+)
+
+// placeholderTemplateArgs are used to render the skeleton of a query.
+var placeholderTemplateArgs = queryTemplateArgs{
+	Series:        placeholderSeries,
+	LabelMatchers: placeholderMatchersLabel + `=""`,
+	GroupBy:       placeholderGroupBy,
+}
+
+// usesOnlyPlaceholderFields checks whether the given template consists only of
+// text and plain references to the fields that have placeholders (Series,
+// LabelMatchers, and GroupBy).
+func usesOnlyPlaceholderFields(templ *template.Template) bool {
+	for _, node := range templ.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			continue
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) != 0 || len(n.Pipe.Cmds) != 1 || len(n.Pipe.Cmds[0].Args) != 1 {
+				return false
+			}
+			field, isField := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+			if !isField || len(field.Ident) != 1 {
+				return false
+			}
+			switch field.Ident[0] {
+			case "Series", "LabelMatchers", "GroupBy":
+				continue
+			}
+			return false
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseSkeleton renders and parses the skeleton of the query.  It returns nil
+// if the placeholders can't all be substituted in the parsed expression (e.g.
+// because a placeholder was used as part of a label value), or if substituting
+// the example arguments doesn't produce the same query as rendering them,
+// in which case queries are rendered and parsed each time instead.
+func (q *metricsQuery) parseSkeleton(exampleExpr parser.Expr) parser.Expr {
+	rendered, err := q.render(placeholderTemplateArgs)
+	if err != nil {
+		return nil
+	}
+	skeleton, err := parser.ParseExpr(rendered)
+	if err != nil {
+		return nil
+	}
+
+	matchers := []*plabels.Matcher{plabels.MustNewMatcher(plabels.MatchEqual, "resource", "name")}
+	substituted := fillSkeleton(skeleton, exampleTemplateArgs.Series, matchers, exampleTemplateArgs.GroupBySlice).String()
+	if substituted != exampleExpr.String() {
+		return nil
+	}
+	for _, placeholder := range []string{placeholderSeries, placeholderMatchersLabel, placeholderGroupBy} {
+		if strings.Contains(substituted, placeholder) {
+			return nil
+		}
+	}
+	return skeleton
+}
+
+// fillSkeleton produces a copy of the given skeleton with the placeholders
+// replaced by the given series, label matchers, and group-by labels.
+func fillSkeleton(skeleton parser.Expr, series string, matchers []*plabels.Matcher, groupBy []string) parser.Expr {
+	fillSelector := func(sel *parser.VectorSelector) {
+		if sel.Name == placeholderSeries {
+			sel.Name = series
+		}
+		filled := make([]*plabels.Matcher, 0, len(sel.LabelMatchers)+len(matchers))
+		for _, matcher := range sel.LabelMatchers {
+			switch {
+			case matcher.Name == placeholderMatchersLabel:
+				filled = append(filled, matchers...)
+			case matcher.Value == placeholderSeries:
+				// matchers are shared with the skeleton, so replace this one
+				// instead of modifying it
+				filled = append(filled, plabels.MustNewMatcher(matcher.Type, matcher.Name, series))
+			default:
+				filled = append(filled, matcher)
+			}
+		}
+		sel.LabelMatchers = filled
+	}
+
+	expr := promql.Clone(skeleton)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			fillSelector(e)
+		case *parser.StringLiteral:
+			if e.Val == placeholderSeries {
+				e.Val = series
+			}
+		case *parser.BinaryExpr:
+			if e.VectorMatching != nil {
+				e.VectorMatching.MatchingLabels = fillGroupBy(e.VectorMatching.MatchingLabels, groupBy)
+				e.VectorMatching.Include = fillGroupBy(e.VectorMatching.Include, groupBy)
+			}
+		case *parser.AggregateExpr:
+			e.Grouping = fillGroupBy(e.Grouping, groupBy)
+		}
+		return nil
+	})
+	return expr
+}
+
+// fillGroupBy replaces the group-by placeholder in the given list of labels
+// with the given group-by labels.
+func fillGroupBy(lbls []string, groupBy []string) []string {
+	var filled []string
+	for _, lbl := range lbls {
+		if lbl == placeholderGroupBy {
+			filled = append(filled, groupBy...)
+		} else {
+			filled = append(filled, lbl)
+		}
+	}
+	return filled
+}
+
 func (q *metricsQuery) Build(series string, resource schema.GroupResource, namespace string, extraGroupBy []string, names ...string) (prom.Selector, error) {
-	var exprs []string
+	var matchers []*plabels.Matcher
 	valuesByName := map[string][]string{}
 
 	if namespace != "" {
@@ -68,7 +249,7 @@ func (q *metricsQuery) Build(series string, resource schema.GroupResource, names
 		if err != nil {
 			return "", err
 		}
-		exprs = append(exprs, prom.LabelEq(string(namespaceLbl), namespace))
+		matchers = append(matchers, plabels.MustNewMatcher(plabels.MatchEqual, string(namespaceLbl), namespace))
 		valuesByName[string(namespaceLbl)] = []string{namespace}
 	}
 
@@ -76,26 +257,121 @@ func (q *metricsQuery) Build(series string, resource schema.GroupResource, names
 	if err != nil {
 		return "", err
 	}
-	matcher := prom.LabelEq
-	targetValue := names[0]
-	if len(names) > 1 {
-		matcher = prom.LabelMatches
-		targetValue = strings.Join(names, "|")
+	if len(names) > 0 {
+		matcher := plabels.MustNewMatcher(plabels.MatchEqual, string(resourceLbl), names[0])
+		if len(names) > 1 {
+			matcher = plabels.MustNewMatcher(plabels.MatchRegexp, string(resourceLbl), regexAlternation(names))
+		}
+		matchers = append(matchers, matcher)
+		valuesByName[string(resourceLbl)] = names
 	}
-	exprs = append(exprs, matcher(string(resourceLbl), targetValue))
-	valuesByName[string(resourceLbl)] = names
 
 	groupBy := make([]string, 0, len(extraGroupBy)+1)
 	groupBy = append(groupBy, string(resourceLbl))
 	groupBy = append(groupBy, extraGroupBy...)
 
-	args := queryTemplateArgs{
+	return q.execute(series, matchers, queryTemplateArgs{
 		Series:            series,
-		LabelMatchers:     strings.Join(exprs, ","),
+		LabelMatchers:     strings.Join(matcherStrings(matchers), ","),
 		LabelValuesByName: valuesByName,
 		GroupBy:           strings.Join(groupBy, ","),
 		GroupBySlice:      groupBy,
+	})
+}
+
+func (q *metricsQuery) BuildExternal(series string, namespace string, metricSelector labels.Selector) (prom.Selector, error) {
+	var matchers []*plabels.Matcher
+	valuesByName := map[string][]string{}
+
+	if namespace != "" {
+		namespaceLbl, err := q.resConverter.LabelForResource(nsGroupResource)
+		if err != nil {
+			return "", err
+		}
+		matchers = append(matchers, plabels.MustNewMatcher(plabels.MatchEqual, string(namespaceLbl), namespace))
+		valuesByName[string(namespaceLbl)] = []string{namespace}
+	}
+
+	selectorMatchers, err := matchersForSelector(metricSelector)
+	if err != nil {
+		return "", err
+	}
+	matchers = append(matchers, selectorMatchers...)
+
+	// external metrics aren't associated with any particular object,
+	// so there's nothing to group by
+	return q.execute(series, matchers, queryTemplateArgs{
+		Series:            series,
+		LabelMatchers:     strings.Join(matcherStrings(matchers), ","),
+		LabelValuesByName: valuesByName,
+	})
+}
+
+// execute builds the query from the skeleton if there is one, and otherwise
+// renders the query template with the given arguments and parses the result.
+// If the query doesn't apply the given matchers to any selector for the given
+// series (e.g. because the template only uses LabelValuesByName), they're added
+// to every selector for the series, so that queries are always restricted to
+// the requested objects.
+func (q *metricsQuery) execute(series string, matchers []*plabels.Matcher, args queryTemplateArgs) (prom.Selector, error) {
+	if q.skeleton != nil {
+		expr := fillSkeleton(q.skeleton, args.Series, matchers, args.GroupBySlice)
+		restrictSeries(expr, series, matchers)
+		return prom.Selector(expr.String()), nil
+	}
+
+	rendered, err := q.render(args)
+	if err != nil {
+		return "", err
+	}
+	expr, err := parser.ParseExpr(rendered)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse metrics query %q: %v", rendered, err)
+	}
+
+	if !restrictSeries(expr, series, matchers) {
+		// keep the query as written
+		return prom.Selector(rendered), nil
+	}
+	return prom.Selector(expr.String()), nil
+}
+
+// restrictSeries adds the given matchers to every selector for the given series
+// in the expression, unless one of them already has all of the matchers.  It
+// returns whether or not the expression was modified.
+func restrictSeries(expr parser.Expr, series string, matchers []*plabels.Matcher) bool {
+	if series == "" || len(matchers) == 0 {
+		return false
+	}
+	var seriesSels []*parser.VectorSelector
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if sel, isSel := node.(*parser.VectorSelector); isSel && selectsSeries(sel, series) {
+			seriesSels = append(seriesSels, sel)
+		}
+		return nil
+	})
+	if len(seriesSels) == 0 {
+		return false
+	}
+	for _, sel := range seriesSels {
+		if hasMatchers(sel, matchers) {
+			// the query applies the matchers itself
+			return false
+		}
+	}
+
+	for _, sel := range seriesSels {
+		for _, matcher := range matchers {
+			if !hasMatchers(sel, []*plabels.Matcher{matcher}) {
+				sel.LabelMatchers = append(sel.LabelMatchers, matcher)
+			}
+		}
 	}
+	return true
+}
+
+// render renders the query template with the given arguments.
+func (q *metricsQuery) render(args queryTemplateArgs) (string, error) {
 	queryBuff := new(bytes.Buffer)
 	if err := q.template.Execute(queryBuff, args); err != nil {
 		return "", err
@@ -105,5 +381,113 @@ func (q *metricsQuery) Build(series string, resource schema.GroupResource, names
 		return "", fmt.Errorf("empty query produced by metrics query template")
 	}
 
-	return prom.Selector(queryBuff.String()), nil
+	return queryBuff.String(), nil
+}
+
+// selectsSeries checks whether the given selector selects the given series by name.
+func selectsSeries(sel *parser.VectorSelector, series string) bool {
+	if sel.Name != "" {
+		return sel.Name == series
+	}
+	for _, matcher := range sel.LabelMatchers {
+		if matcher.Name == pmodel.MetricNameLabel && matcher.Type == plabels.MatchEqual {
+			return matcher.Value == series
+		}
+	}
+	return false
+}
+
+// hasMatchers checks whether the given selector already contains all of the given matchers.
+func hasMatchers(sel *parser.VectorSelector, matchers []*plabels.Matcher) bool {
+	for _, matcher := range matchers {
+		found := false
+		for _, existing := range sel.LabelMatchers {
+			if existing.Name == matcher.Name && existing.Type == matcher.Type && existing.Value == matcher.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matcherStrings converts the given label matchers into their PromQL form.
+func matcherStrings(matchers []*plabels.Matcher) []string {
+	strs := make([]string, len(matchers))
+	for i, matcher := range matchers {
+		strs[i] = matcher.String()
+	}
+	return strs
+}
+
+// matchersForSelector converts a Kubernetes label selector into the equivalent
+// set of Prometheus label matchers.  Set-based requirements are converted into
+// regular expression matchers, with each value escaped.
+func matchersForSelector(selector labels.Selector) ([]*plabels.Matcher, error) {
+	return matchersForSelectorWithLabels(selector, func(key string) string { return key })
+}
+
+// matchersForSelectorWithLabels is like matchersForSelector, except that the
+// Prometheus label for each key in the selector is produced by labelFor.
+func matchersForSelectorWithLabels(selector labels.Selector, labelFor func(key string) string) ([]*plabels.Matcher, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	reqs, selectable := selector.Requirements()
+	if !selectable {
+		return nil, fmt.Errorf("label selector %q cannot be converted into Prometheus label matchers", selector.String())
+	}
+
+	matchers := make([]*plabels.Matcher, 0, len(reqs))
+	for _, req := range reqs {
+		values := req.Values().List()
+		var matchType plabels.MatchType
+		var value string
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			matchType, value = plabels.MatchEqual, values[0]
+		case selection.NotEquals:
+			matchType, value = plabels.MatchNotEqual, values[0]
+		case selection.In:
+			matchType, value = plabels.MatchRegexp, regexAlternation(values)
+		case selection.NotIn:
+			matchType, value = plabels.MatchNotRegexp, regexAlternation(values)
+		case selection.Exists:
+			matchType = plabels.MatchNotEqual
+		case selection.DoesNotExist:
+			matchType = plabels.MatchEqual
+		default:
+			return nil, fmt.Errorf("label selector operator %q is not supported for Prometheus label matchers", req.Operator())
+		}
+		matchers = append(matchers, plabels.MustNewMatcher(matchType, labelFor(req.Key()), value))
+	}
+	return matchers, nil
+}
+
+// regexAlternation produces a regular expression which matches exactly
+// any of the given values.
+func regexAlternation(values []string) string {
+	quoted := make([]string, len(values))
+	for i, val := range values {
+		quoted[i] = regexp.QuoteMeta(val)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// ChunkNames splits the given object names into chunks of at most maxNames names
+// each, so that queries for large numbers of objects can be split into several
+// smaller queries.  If maxNames isn't positive, all the names are in a single chunk.
+func ChunkNames(names []string, maxNames int) [][]string {
+	if maxNames <= 0 || len(names) <= maxNames {
+		return [][]string{names}
+	}
+	chunks := make([][]string, 0, (len(names)+maxNames-1)/maxNames)
+	for len(names) > maxNames {
+		chunks = append(chunks, names[:maxNames])
+		names = names[maxNames:]
+	}
+	return append(chunks, names)
 }
@@ -0,0 +1,200 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+)
+
+// fixedConverter is a ResourceConverter with a fixed set of labels for resources.
+type fixedConverter map[schema.GroupResource]pmodel.LabelName
+
+func (c fixedConverter) ResourcesForSeries(series prom.Series) ([]schema.GroupResource, bool) {
+	return nil, false
+}
+
+func (c fixedConverter) LabelForResource(resource schema.GroupResource) (pmodel.LabelName, error) {
+	lbl, ok := c[resource]
+	if !ok {
+		return "", fmt.Errorf("no label for resource %s", resource.String())
+	}
+	return lbl, nil
+}
+
+var testConverter = fixedConverter{
+	nsGroupResource:                          "namespace",
+	{Resource: "pods"}:                       "pod",
+	{Resource: "nodes"}:                      "node",
+	{Group: "apps", Resource: "deployments"}: "deployment",
+}
+
+var _ = Describe("Metrics Query", func() {
+	It("should build queries for objects", func() {
+		testCases := []struct {
+			name         string
+			template     string
+			resource     schema.GroupResource
+			namespace    string
+			extraGroupBy []string
+			names        []string
+			expected     prom.Selector
+		}{
+			{
+				name:      "a single namespaced object",
+				template:  `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				names:     []string{"somepod"},
+				expected:  `sum by(pod) (foo{namespace="somens",pod="somepod"})`,
+			},
+			{
+				name:      "several objects, with escaped names",
+				template:  `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				names:     []string{"pod-a", "pod.b"},
+				expected:  `sum by(pod) (foo{namespace="somens",pod=~"pod-a|pod\\.b"})`,
+			},
+			{
+				name:     "every object of a root-scoped resource",
+				template: `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				resource: schema.GroupResource{Resource: "nodes"},
+				expected: `sum by(node) (foo)`,
+			},
+			{
+				name:         "extra group-by labels",
+				template:     `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)`,
+				resource:     schema.GroupResource{Resource: "pods"},
+				namespace:    "somens",
+				extraGroupBy: []string{"container"},
+				names:        []string{"somepod"},
+				expected:     `sum by(pod, container) (foo{namespace="somens",pod="somepod"})`,
+			},
+			{
+				name:      "placeholders in several places",
+				template:  `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>) / on(<<.GroupBy>>) group_left sum(limit{<<.LabelMatchers>>,series="<<.Series>>"}) by (<<.GroupBy>>)`,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				names:     []string{"somepod"},
+				expected:  `sum by(pod) (rate(foo{namespace="somens",pod="somepod"}[2m])) / on(pod) group_left() sum by(pod) (limit{namespace="somens",pod="somepod",series="foo"})`,
+			},
+			{
+				name:      "a template which doesn't apply the label matchers itself",
+				template:  `max(<<.Series>>) by (<<index .GroupBySlice 0>>)`,
+				resource:  schema.GroupResource{Group: "apps", Resource: "deployments"},
+				namespace: "somens",
+				names:     []string{"somedep"},
+				expected:  `max by(deployment) (foo{deployment="somedep",namespace="somens"})`,
+			},
+			{
+				name:      "a template which only builds some of the matchers itself",
+				template:  `sum(<<.Series>>{pod=~"<<range $i, $name := index .LabelValuesByName "pod">><<if $i>>|<<end>><<$name>><<end>>"}) by (<<.GroupBy>>)`,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				names:     []string{"pod-a", "pod-b"},
+				expected:  `sum by(pod) (foo{namespace="somens",pod=~"pod-a|pod-b"})`,
+			},
+		}
+
+		for _, tc := range testCases {
+			By(fmt.Sprintf("checking %s", tc.name))
+			query, err := NewMetricsQuery(tc.template, testConverter)
+			Expect(err).NotTo(HaveOccurred())
+			res, err := query.Build("foo", tc.resource, tc.namespace, tc.extraGroupBy, tc.names...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(tc.expected))
+		}
+	})
+
+	It("should build queries for external metrics", func() {
+		query, err := NewMetricsQuery(`sum(<<.Series>>{<<.LabelMatchers>>})`, testConverter)
+		Expect(err).NotTo(HaveOccurred())
+
+		selector, err := labels.Parse("queue in (a.b,c),env!=prod,!legacy")
+		Expect(err).NotTo(HaveOccurred())
+		res, err := query.BuildExternal("foo", "somens", selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(prom.Selector(`sum(foo{env!="prod",legacy="",namespace="somens",queue=~"a\\.b|c"})`)))
+
+		res, err = query.BuildExternal("foo", "", labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(prom.Selector(`sum(foo)`)))
+	})
+
+	It("should refuse templates which don't render to valid PromQL", func() {
+		testCases := []struct {
+			name     string
+			template string
+			err      string
+		}{
+			{
+				name:     "a misplaced grouping clause",
+				template: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m]) by (<<.GroupBy>>)`,
+				err:      `unable to parse metrics query template "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m]) by (<<.GroupBy>>)" (rendered as "sum(rate(series{resource=\"name\"}[2m]) by (resource)"): 1:39: parse error: unexpected <by> in aggregation`,
+			},
+			{
+				name:     "an unknown function",
+				template: `sum(not_a_function(<<.Series>>{<<.LabelMatchers>>})) by (<<.GroupBy>>)`,
+				err:      `parse error: unknown function with name "not_a_function"`,
+			},
+			{
+				name:     "a quoted label matcher",
+				template: `sum(<<.Series>>{"<<.LabelMatchers>>"}) by (<<.GroupBy>>)`,
+				err:      "parse error",
+			},
+		}
+
+		for _, tc := range testCases {
+			By(fmt.Sprintf("checking %s", tc.name))
+			_, err := NewMetricsQuery(tc.template, testConverter)
+			Expect(err).To(MatchError(ContainSubstring(tc.err)))
+		}
+	})
+})
+
+var _ = Describe("Regex Alternation", func() {
+	It("should produce a regular expression matching exactly the given values", func() {
+		testCases := []struct {
+			values     []string
+			expected   string
+			nonMatches []string
+		}{
+			{
+				values:     []string{"somepod"},
+				expected:   `somepod`,
+				nonMatches: []string{"somepod2", "some"},
+			},
+			{
+				values:     []string{"pod-a", "pod-b"},
+				expected:   `pod-a|pod-b`,
+				nonMatches: []string{"pod-a|pod-b", "pod-c"},
+			},
+			{
+				values:     []string{"node1.example.com", "a+b", "(x)"},
+				expected:   `node1\.example\.com|a\+b|\(x\)`,
+				nonMatches: []string{"node1xexample.com", "aab", "x"},
+			},
+		}
+
+		for _, tc := range testCases {
+			res := regexAlternation(tc.values)
+			Expect(res).To(Equal(tc.expected))
+
+			// Prometheus anchors regular expressions in label matchers
+			anchored := regexp.MustCompile("^(?:" + res + ")$")
+			for _, val := range tc.values {
+				Expect(anchored.MatchString(val)).To(BeTrue(), "%q should match %q", res, val)
+			}
+			for _, val := range tc.nonMatches {
+				Expect(anchored.MatchString(val)).To(BeFalse(), "%q shouldn't match %q", res, val)
+			}
+		}
+	})
+})
@@ -0,0 +1,13 @@
+package naming
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestNaming(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Naming Suite")
+}
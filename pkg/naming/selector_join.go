@@ -0,0 +1,164 @@
+package naming
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+)
+
+const (
+	defaultSelectorJoinSeries         = "kube_<<.Resource>>_labels"
+	defaultSelectorJoinObjectLabel    = "<<.Resource>>"
+	defaultSelectorJoinNamespaceLabel = "namespace"
+	defaultSelectorJoinLabelPrefix    = "label_"
+)
+
+// invalidLabelChars matches the characters which may appear in Kubernetes
+// label names, but not in Prometheus label names.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// SelectorJoin resolves Kubernetes label selectors in Prometheus, by joining
+// queries against series which carry the labels of each object.
+type SelectorJoin interface {
+	// Join restricts the results of the given query (which must be grouped by
+	// the label for the given group-resource) to the objects in the given
+	// namespace (empty for root-scoped resources) which match the given selector.
+	Join(query prom.Selector, groupRes schema.GroupResource, namespace string, selector labels.Selector) (prom.Selector, error)
+	// JoinedSeries returns the name of the series which queries for the given
+	// group-resource are joined against, and the label carrying the namespace
+	// of each object on that series.
+	JoinedSeries(groupRes schema.GroupResource) (series string, namespaceLabel string, err error)
+}
+
+// NewSelectorJoin constructs a SelectorJoin for the given configuration.  The
+// given ResourceConverter determines the labels used by the queries being joined.
+func NewSelectorJoin(cfg config.SelectorJoin, resConverter ResourceConverter, mapper apimeta.RESTMapper) (SelectorJoin, error) {
+	if cfg.Series == "" {
+		cfg.Series = defaultSelectorJoinSeries
+	}
+	if cfg.ObjectLabel == "" {
+		cfg.ObjectLabel = defaultSelectorJoinObjectLabel
+	}
+	if cfg.NamespaceLabel == "" {
+		cfg.NamespaceLabel = defaultSelectorJoinNamespaceLabel
+	}
+	if cfg.LabelPrefix == "" {
+		cfg.LabelPrefix = defaultSelectorJoinLabelPrefix
+	}
+
+	seriesTemplate, err := template.New("selector-join-series").Delims("<<", ">>").Parse(cfg.Series)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse selector join series template %q: %v", cfg.Series, err)
+	}
+	objectLabelTemplate, err := template.New("selector-join-object-label").Delims("<<", ">>").Parse(cfg.ObjectLabel)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse selector join object label template %q: %v", cfg.ObjectLabel, err)
+	}
+
+	return &selectorJoin{
+		resConverter:        resConverter,
+		mapper:              mapper,
+		seriesTemplate:      seriesTemplate,
+		objectLabelTemplate: objectLabelTemplate,
+		namespaceLabel:      cfg.NamespaceLabel,
+		labelPrefix:         cfg.LabelPrefix,
+	}, nil
+}
+
+// selectorJoin is a SelectorJoin based on compiled Go text templates.
+type selectorJoin struct {
+	resConverter        ResourceConverter
+	mapper              apimeta.RESTMapper
+	seriesTemplate      *template.Template
+	objectLabelTemplate *template.Template
+	namespaceLabel      string
+	labelPrefix         string
+}
+
+func (j *selectorJoin) Join(query prom.Selector, groupRes schema.GroupResource, namespace string, selector labels.Selector) (prom.Selector, error) {
+	templateArgs, err := j.templateArgs(groupRes)
+	if err != nil {
+		return "", err
+	}
+	series, err := executeNameTemplate(j.seriesTemplate, templateArgs)
+	if err != nil {
+		return "", fmt.Errorf("unable to produce selector join series name: %v", err)
+	}
+	objectLbl, err := executeNameTemplate(j.objectLabelTemplate, templateArgs)
+	if err != nil {
+		return "", fmt.Errorf("unable to produce selector join object label: %v", err)
+	}
+
+	resourceLbl, err := j.resConverter.LabelForResource(groupRes)
+	if err != nil {
+		return "", err
+	}
+
+	var exprs []string
+	if namespace != "" {
+		exprs = append(exprs, prom.LabelEq(j.namespaceLabel, namespace))
+	}
+	selectorMatchers, err := matchersForSelectorWithLabels(selector, j.labelFor)
+	if err != nil {
+		return "", err
+	}
+	exprs = append(exprs, matcherStrings(selectorMatchers)...)
+
+	objects := fmt.Sprintf("%s{%s}", series, strings.Join(exprs, ","))
+	if objectLbl != string(resourceLbl) {
+		objects = fmt.Sprintf("label_replace(%s, %q, \"$1\", %q, \"(.*)\")", objects, resourceLbl, objectLbl)
+	}
+
+	return prom.Selector(fmt.Sprintf("(%s) and on(%s) %s", query, resourceLbl, objects)), nil
+}
+
+func (j *selectorJoin) JoinedSeries(groupRes schema.GroupResource) (string, string, error) {
+	templateArgs, err := j.templateArgs(groupRes)
+	if err != nil {
+		return "", "", err
+	}
+	series, err := executeNameTemplate(j.seriesTemplate, templateArgs)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to produce selector join series name: %v", err)
+	}
+	return series, j.namespaceLabel, nil
+}
+
+// templateArgs produces the arguments for the series and object label templates
+// for the given group-resource.
+func (j *selectorJoin) templateArgs(groupRes schema.GroupResource) (schema.GroupResource, error) {
+	singularRes, err := j.mapper.ResourceSingularizer(groupRes.Resource)
+	if err != nil {
+		return schema.GroupResource{}, fmt.Errorf("unable to singularize resource %s: %v", groupRes.String(), err)
+	}
+	return schema.GroupResource{
+		Group:    groupNameSanitizer.Replace(groupRes.Group),
+		Resource: singularRes,
+	}, nil
+}
+
+// labelFor returns the label carrying the value of the given Kubernetes label.
+func (j *selectorJoin) labelFor(key string) string {
+	return j.labelPrefix + invalidLabelChars.ReplaceAllString(key, "_")
+}
+
+// executeNameTemplate renders a template which produces a series or label name.
+func executeNameTemplate(templ *template.Template, args schema.GroupResource) (string, error) {
+	buff := new(bytes.Buffer)
+	if err := templ.Execute(buff, args); err != nil {
+		return "", err
+	}
+	if buff.Len() == 0 {
+		return "", fmt.Errorf("empty name produced by template")
+	}
+	return buff.String(), nil
+}
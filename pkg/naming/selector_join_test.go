@@ -0,0 +1,110 @@
+package naming
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+)
+
+var _ = Describe("Selector Join", func() {
+	It("should join queries against the series carrying the labels of each object", func() {
+		prefixedConverter := fixedConverter{
+			nsGroupResource:    "kubernetes_namespace",
+			{Resource: "pods"}: "kubernetes_pod_name",
+		}
+
+		testCases := []struct {
+			name      string
+			cfg       config.SelectorJoin
+			converter ResourceConverter
+			resource  schema.GroupResource
+			namespace string
+			selector  string
+			expected  prom.Selector
+		}{
+			{
+				name:      "the defaults",
+				converter: testConverter,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				selector:  "app=web",
+				expected:  `(sum by(pod) (foo)) and on(pod) kube_pod_labels{namespace="somens",label_app="web"}`,
+			},
+			{
+				name:      "a query whose object label differs from the joined series",
+				converter: prefixedConverter,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				selector:  "app=web",
+				expected: `(sum by(pod) (foo)) and on(kubernetes_pod_name) ` +
+					`label_replace(kube_pod_labels{namespace="somens",label_app="web"}, "kubernetes_pod_name", "$1", "pod", "(.*)")`,
+			},
+			{
+				name: "custom series and labels",
+				cfg: config.SelectorJoin{
+					Series:         "kube_<<.Resource>>_info",
+					ObjectLabel:    "exported_<<.Resource>>",
+					NamespaceLabel: "exported_namespace",
+					LabelPrefix:    "k8s_label_",
+				},
+				converter: testConverter,
+				resource:  schema.GroupResource{Resource: "pods"},
+				namespace: "somens",
+				selector:  "app.kubernetes.io/name in (a,b),tier!=db",
+				expected: `(sum by(pod) (foo)) and on(pod) ` +
+					`label_replace(kube_pod_info{exported_namespace="somens",k8s_label_app_kubernetes_io_name=~"a|b",k8s_label_tier!="db"}, "pod", "$1", "exported_pod", "(.*)")`,
+			},
+			{
+				name:      "a root-scoped resource",
+				converter: testConverter,
+				resource:  schema.GroupResource{Resource: "nodes"},
+				selector:  "role=infra",
+				expected:  `(sum by(pod) (foo)) and on(node) kube_node_labels{label_role="infra"}`,
+			},
+			{
+				name:      "a resource in a named group",
+				converter: testConverter,
+				resource:  schema.GroupResource{Group: "apps", Resource: "deployments"},
+				namespace: "somens",
+				selector:  "app",
+				expected:  `(sum by(pod) (foo)) and on(deployment) kube_deployment_labels{namespace="somens",label_app!=""}`,
+			},
+		}
+
+		for _, tc := range testCases {
+			By(fmt.Sprintf("checking %s", tc.name))
+			join, err := NewSelectorJoin(tc.cfg, tc.converter, mapper.NewStatic())
+			Expect(err).NotTo(HaveOccurred())
+			selector, err := labels.Parse(tc.selector)
+			Expect(err).NotTo(HaveOccurred())
+			res, err := join.Join(`sum by(pod) (foo)`, tc.resource, tc.namespace, selector)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(tc.expected))
+		}
+	})
+
+	It("should report the joined series and its namespace label", func() {
+		join, err := NewSelectorJoin(config.SelectorJoin{NamespaceLabel: "exported_namespace"}, testConverter, mapper.NewStatic())
+		Expect(err).NotTo(HaveOccurred())
+		series, namespaceLabel, err := join.JoinedSeries(schema.GroupResource{Group: "apps", Resource: "deployments"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(series).To(Equal("kube_deployment_labels"))
+		Expect(namespaceLabel).To(Equal("exported_namespace"))
+	})
+
+	It("should refuse selectors which can't be converted into label matchers", func() {
+		join, err := NewSelectorJoin(config.SelectorJoin{}, testConverter, mapper.NewStatic())
+		Expect(err).NotTo(HaveOccurred())
+		selector, err := labels.Parse("replicas>2")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = join.Join(`sum by(pod) (foo)`, schema.GroupResource{Resource: "pods"}, "somens", selector)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Rewrite replaces nodes of the given expression in depth-first order.  For each
+// node, f is called first: if it returns a non-nil expression, that expression
+// replaces the node, and the children of the node are not traversed.  Otherwise,
+// the node's children are rewritten in place.  The selector inside a matrix
+// selector is never replaced, since it must remain a vector selector.  The
+// (possibly replaced) root of the expression is returned.
+func Rewrite(expr parser.Expr, f func(parser.Expr) parser.Expr) parser.Expr {
+	if expr == nil {
+		return nil
+	}
+	if replacement := f(expr); replacement != nil {
+		return replacement
+	}
+
+	switch e := expr.(type) {
+	case *parser.SubqueryExpr:
+		e.Expr = Rewrite(e.Expr, f)
+	case *parser.ParenExpr:
+		e.Expr = Rewrite(e.Expr, f)
+	case *parser.UnaryExpr:
+		e.Expr = Rewrite(e.Expr, f)
+	case *parser.StepInvariantExpr:
+		e.Expr = Rewrite(e.Expr, f)
+	case *parser.BinaryExpr:
+		e.LHS = Rewrite(e.LHS, f)
+		e.RHS = Rewrite(e.RHS, f)
+	case *parser.Call:
+		for i, arg := range e.Args {
+			e.Args[i] = Rewrite(arg, f)
+		}
+	case *parser.AggregateExpr:
+		e.Param = Rewrite(e.Param, f)
+		e.Expr = Rewrite(e.Expr, f)
+	}
+	return expr
+}
+
+// Clone returns a deep copy of the given expression, which may be modified
+// (e.g. via Rewrite) without affecting the original.  Label matchers are
+// shared between the copies, since they can't be modified in place.
+func Clone(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+	case *parser.NumberLiteral:
+		res := *e
+		return &res
+	case *parser.StringLiteral:
+		res := *e
+		return &res
+	case *parser.VectorSelector:
+		return cloneSelector(e)
+	case *parser.MatrixSelector:
+		res := *e
+		res.VectorSelector = Clone(e.VectorSelector)
+		return &res
+	case *parser.SubqueryExpr:
+		res := *e
+		res.Expr = Clone(e.Expr)
+		res.Timestamp = cloneTimestamp(e.Timestamp)
+		return &res
+	case *parser.ParenExpr:
+		res := *e
+		res.Expr = Clone(e.Expr)
+		return &res
+	case *parser.UnaryExpr:
+		res := *e
+		res.Expr = Clone(e.Expr)
+		return &res
+	case *parser.StepInvariantExpr:
+		return &parser.StepInvariantExpr{Expr: Clone(e.Expr)}
+	case *parser.BinaryExpr:
+		res := *e
+		res.LHS, res.RHS = Clone(e.LHS), Clone(e.RHS)
+		if e.VectorMatching != nil {
+			matching := *e.VectorMatching
+			matching.MatchingLabels = cloneStrings(e.VectorMatching.MatchingLabels)
+			matching.Include = cloneStrings(e.VectorMatching.Include)
+			res.VectorMatching = &matching
+		}
+		return &res
+	case *parser.Call:
+		res := *e
+		res.Args = make(parser.Expressions, len(e.Args))
+		for i, arg := range e.Args {
+			res.Args[i] = Clone(arg)
+		}
+		return &res
+	case *parser.AggregateExpr:
+		res := *e
+		res.Expr, res.Param = Clone(e.Expr), Clone(e.Param)
+		res.Grouping = cloneStrings(e.Grouping)
+		return &res
+	}
+	panic(fmt.Sprintf("unable to clone expression of type %T", expr))
+}
+
+func cloneSelector(sel *parser.VectorSelector) *parser.VectorSelector {
+	res := *sel
+	res.LabelMatchers = append([]*labels.Matcher(nil), sel.LabelMatchers...)
+	res.Timestamp = cloneTimestamp(sel.Timestamp)
+	res.UnexpandedSeriesSet, res.Series = nil, nil
+	return &res
+}
+
+func cloneTimestamp(ts *int64) *int64 {
+	if ts == nil {
+		return nil
+	}
+	res := *ts
+	return &res
+}
+
+func cloneStrings(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	return append([]string(nil), strs...)
+}
+
+// MaxRange returns the largest span of time looked at by any range in the
+// given expression (e.g. 5m for `rate(foo[5m])`).  The range of a subquery
+// includes the ranges used within it.  Zero is returned if the expression
+// doesn't use any ranges.
+func MaxRange(expr parser.Expr) time.Duration {
+	switch e := expr.(type) {
+	case *parser.MatrixSelector:
+		return e.Range
+	case *parser.SubqueryExpr:
+		return e.Range + MaxRange(e.Expr)
+	}
+
+	var res time.Duration
+	for _, child := range parser.Children(expr) {
+		if childExpr, isExpr := child.(parser.Expr); isExpr {
+			if childRange := MaxRange(childExpr); childRange > res {
+				res = childRange
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package promql contains helpers for working with PromQL expressions, and a
+// small evaluation engine.
+//
+// Expressions are parsed by the upstream Prometheus parser
+// (github.com/prometheus/prometheus/promql/parser), so the adapter accepts
+// exactly the grammar that Prometheus does.  This package adds what the
+// adapter needs on top of that: parsing series queries as single selectors,
+// matching series against selectors, and copying and rewriting expressions.
+//
+// The engine evaluates expressions against fixed data in tests and tooling.
+// It's neither fast nor complete: it follows the semantics of the Prometheus
+// query engine for the functions and operators that the adapter's queries
+// commonly use, and returns an error for functions it doesn't implement.  It
+// does not implement staleness markers or native histograms.
+package promql
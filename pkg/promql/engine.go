@@ -0,0 +1,353 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// DefaultLookbackDelta is the default amount of time that instant vector
+	// selectors look back for the most recent sample, as in Prometheus.
+	DefaultLookbackDelta = 5 * time.Minute
+	// DefaultSubqueryStep is the default resolution of subqueries that
+	// don't specify one.
+	DefaultSubqueryStep = 1 * time.Minute
+)
+
+// Storage provides the series data that expressions are evaluated against.
+type Storage interface {
+	// Select returns the samples between start and end (inclusive) of all
+	// series matching the given selector.  The offset of the selector should
+	// be ignored, since it's already accounted for in start and end.
+	Select(sel *parser.VectorSelector, start, end pmodel.Time) pmodel.Matrix
+}
+
+// Engine evaluates PromQL expressions against some Storage.  It's intended
+// for testing and tooling -- it's neither fast nor particularly memory-efficient,
+// but it follows the semantics of the Prometheus query engine closely.
+type Engine struct {
+	Storage Storage
+	// LookbackDelta is how far back instant vector selectors look
+	// for samples.  If zero, DefaultLookbackDelta is used.
+	LookbackDelta time.Duration
+	// SubqueryStep is the resolution of subqueries that don't specify
+	// one.  If zero, DefaultSubqueryStep is used.
+	SubqueryStep time.Duration
+}
+
+// Eval evaluates the given expression at the given time, returning a *model.Scalar,
+// *model.String, model.Vector, or model.Matrix, depending on the type of the expression.
+func (e *Engine) Eval(expr parser.Expr, ts pmodel.Time) (pmodel.Value, error) {
+	res, err := e.eval(resolveStartAndEnd(expr, ts, ts), ts)
+	if err != nil {
+		return nil, err
+	}
+
+	// instant query results are reported at the evaluation time
+	if vec, isVec := res.(pmodel.Vector); isVec {
+		for _, sample := range vec {
+			sample.Timestamp = ts
+		}
+	}
+	return res, nil
+}
+
+// EvalRange evaluates the given expression at each step in the given range,
+// combining the results into a single matrix.
+func (e *Engine) EvalRange(expr parser.Expr, start, end pmodel.Time, step time.Duration) (pmodel.Matrix, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	if typ := expr.Type(); typ != parser.ValueTypeScalar && typ != parser.ValueTypeVector {
+		return nil, fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", parser.DocumentedType(typ))
+	}
+
+	expr = resolveStartAndEnd(expr, start, end)
+	var res pmodel.Matrix
+	streams := make(map[pmodel.Fingerprint]*pmodel.SampleStream)
+	for ts := start; ts <= end; ts = ts.Add(step) {
+		vec, err := e.evalVectorOrScalar(expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range vec {
+			fp := sample.Metric.Fingerprint()
+			stream, exists := streams[fp]
+			if !exists {
+				stream = &pmodel.SampleStream{Metric: sample.Metric}
+				streams[fp] = stream
+				res = append(res, stream)
+			}
+			stream.Values = append(stream.Values, pmodel.SamplePair{Timestamp: ts, Value: sample.Value})
+		}
+	}
+	return res, nil
+}
+
+// resolveStartAndEnd replaces `@ start()` and `@ end()` modifiers in the
+// given expression with the start and end of the query.  The expression is
+// copied first if it needs to be changed.
+func resolveStartAndEnd(expr parser.Expr, start, end pmodel.Time) parser.Expr {
+	needsResolving := false
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			needsResolving = needsResolving || e.StartOrEnd != 0
+		case *parser.SubqueryExpr:
+			needsResolving = needsResolving || e.StartOrEnd != 0
+		}
+		return nil
+	})
+	if !needsResolving {
+		return expr
+	}
+
+	resolve := func(startOrEnd parser.ItemType) *int64 {
+		res := int64(start)
+		if startOrEnd == parser.END {
+			res = int64(end)
+		}
+		return &res
+	}
+	res := Clone(expr)
+	parser.Inspect(res, func(node parser.Node, _ []parser.Node) error {
+		switch e := node.(type) {
+		case *parser.VectorSelector:
+			if e.StartOrEnd != 0 {
+				e.Timestamp, e.StartOrEnd = resolve(e.StartOrEnd), 0
+			}
+		case *parser.SubqueryExpr:
+			if e.StartOrEnd != 0 {
+				e.Timestamp, e.StartOrEnd = resolve(e.StartOrEnd), 0
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// modifiedTime returns the time at which a selector or subquery evaluated at
+// the given time actually looks, taking into account its @ and offset modifiers.
+func modifiedTime(ts pmodel.Time, timestamp *int64, offset time.Duration) pmodel.Time {
+	if timestamp != nil {
+		ts = pmodel.Time(*timestamp)
+	}
+	return ts.Add(-offset)
+}
+
+// evalVectorOrScalar evaluates the expression, converting scalar results into
+// a vector with a single, label-less sample.
+func (e *Engine) evalVectorOrScalar(expr parser.Expr, ts pmodel.Time) (pmodel.Vector, error) {
+	res, err := e.eval(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	switch val := res.(type) {
+	case pmodel.Vector:
+		return val, nil
+	case *pmodel.Scalar:
+		return pmodel.Vector{{Metric: pmodel.Metric{}, Value: val.Value, Timestamp: ts}}, nil
+	}
+	return nil, fmt.Errorf("unexpected result of type %s", res.Type())
+}
+
+func (e *Engine) lookbackDelta() time.Duration {
+	if e.LookbackDelta == 0 {
+		return DefaultLookbackDelta
+	}
+	return e.LookbackDelta
+}
+
+func (e *Engine) subqueryStep() time.Duration {
+	if e.SubqueryStep == 0 {
+		return DefaultSubqueryStep
+	}
+	return e.SubqueryStep
+}
+
+func (e *Engine) eval(expr parser.Expr, ts pmodel.Time) (pmodel.Value, error) {
+	switch ex := expr.(type) {
+	case *parser.NumberLiteral:
+		return &pmodel.Scalar{Value: pmodel.SampleValue(ex.Val), Timestamp: ts}, nil
+	case *parser.StringLiteral:
+		return &pmodel.String{Value: ex.Val, Timestamp: ts}, nil
+	case *parser.ParenExpr:
+		return e.eval(ex.Expr, ts)
+	case *parser.StepInvariantExpr:
+		return e.eval(ex.Expr, ts)
+	case *parser.VectorSelector:
+		return e.evalVectorSelector(ex, ts), nil
+	case *parser.MatrixSelector:
+		return e.evalMatrixSelector(ex, ts), nil
+	case *parser.SubqueryExpr:
+		return e.evalSubquery(ex, ts)
+	case *parser.UnaryExpr:
+		return e.evalUnary(ex, ts)
+	case *parser.BinaryExpr:
+		return e.evalBinary(ex, ts)
+	case *parser.AggregateExpr:
+		return e.evalAggregate(ex, ts)
+	case *parser.Call:
+		return e.evalCall(ex, ts)
+	}
+	return nil, fmt.Errorf("unable to evaluate expression of type %T", expr)
+}
+
+func (e *Engine) evalVectorSelector(sel *parser.VectorSelector, ts pmodel.Time) pmodel.Vector {
+	refTime := modifiedTime(ts, sel.Timestamp, sel.OriginalOffset)
+	start := refTime.Add(-e.lookbackDelta())
+
+	res := pmodel.Vector{}
+	for _, stream := range e.Storage.Select(sel, start, refTime) {
+		var latest *pmodel.SamplePair
+		for i := range stream.Values {
+			sample := &stream.Values[i]
+			if sample.Timestamp <= start || sample.Timestamp > refTime {
+				continue
+			}
+			if latest == nil || sample.Timestamp > latest.Timestamp {
+				latest = sample
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		res = append(res, &pmodel.Sample{
+			Metric:    stream.Metric.Clone(),
+			Value:     latest.Value,
+			Timestamp: latest.Timestamp,
+		})
+	}
+	return res
+}
+
+func (e *Engine) evalMatrixSelector(sel *parser.MatrixSelector, ts pmodel.Time) pmodel.Matrix {
+	vecSel := sel.VectorSelector.(*parser.VectorSelector)
+	refTime := modifiedTime(ts, vecSel.Timestamp, vecSel.OriginalOffset)
+	start := refTime.Add(-sel.Range)
+
+	res := pmodel.Matrix{}
+	for _, stream := range e.Storage.Select(vecSel, start, refTime) {
+		var values []pmodel.SamplePair
+		for _, sample := range stream.Values {
+			if sample.Timestamp >= start && sample.Timestamp <= refTime {
+				values = append(values, sample)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i].Timestamp < values[j].Timestamp })
+		res = append(res, &pmodel.SampleStream{Metric: stream.Metric.Clone(), Values: values})
+	}
+	return res
+}
+
+func (e *Engine) evalSubquery(sub *parser.SubqueryExpr, ts pmodel.Time) (pmodel.Value, error) {
+	step := sub.Step
+	if step == 0 {
+		step = e.subqueryStep()
+	}
+	refTime := modifiedTime(ts, sub.Timestamp, sub.OriginalOffset)
+	start := refTime.Add(-sub.Range)
+
+	// subquery steps are aligned to multiples of the step, as in Prometheus
+	stepMillis := int64(step / time.Millisecond)
+	first := pmodel.Time(int64(start) / stepMillis * stepMillis)
+	if first < start {
+		first = first.Add(step)
+	}
+
+	res := pmodel.Matrix{}
+	streams := make(map[pmodel.Fingerprint]*pmodel.SampleStream)
+	for stepTime := first; stepTime <= refTime; stepTime = stepTime.Add(step) {
+		vec, err := e.evalVectorOrScalar(sub.Expr, stepTime)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range vec {
+			fp := sample.Metric.Fingerprint()
+			stream, exists := streams[fp]
+			if !exists {
+				stream = &pmodel.SampleStream{Metric: sample.Metric}
+				streams[fp] = stream
+				res = append(res, stream)
+			}
+			stream.Values = append(stream.Values, pmodel.SamplePair{Timestamp: stepTime, Value: sample.Value})
+		}
+	}
+	return res, nil
+}
+
+func (e *Engine) evalUnary(ex *parser.UnaryExpr, ts pmodel.Time) (pmodel.Value, error) {
+	val, err := e.eval(ex.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	if ex.Op == parser.ADD {
+		return val, nil
+	}
+
+	switch v := val.(type) {
+	case *pmodel.Scalar:
+		return &pmodel.Scalar{Value: -v.Value, Timestamp: ts}, nil
+	case pmodel.Vector:
+		res := make(pmodel.Vector, len(v))
+		for i, sample := range v {
+			res[i] = &pmodel.Sample{Metric: dropMetricName(sample.Metric), Value: -sample.Value, Timestamp: ts}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unary expression only allowed on expressions of type scalar or instant vector")
+}
+
+// dropMetricName returns a copy of the given metric without its name.
+func dropMetricName(metric pmodel.Metric) pmodel.Metric {
+	res := metric.Clone()
+	delete(res, pmodel.MetricNameLabel)
+	return res
+}
+
+// quantile calculates the given quantile of the values, using linear
+// interpolation between the closest ranks, as in Prometheus.
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := float64(len(sorted))
+	rank := q * (n - 1)
+	lowerIndex := math.Max(0, math.Floor(rank))
+	upperIndex := math.Min(n-1, lowerIndex+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lowerIndex)]*(1-weight) + sorted[int(upperIndex)]*weight
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// aggregationGroup holds the samples belonging to a single output series of an aggregation.
+type aggregationGroup struct {
+	metric  pmodel.Metric
+	samples pmodel.Vector
+}
+
+func (e *Engine) evalAggregate(ex *parser.AggregateExpr, ts pmodel.Time) (pmodel.Value, error) {
+	val, err := e.eval(ex.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	vec := val.(pmodel.Vector)
+
+	var param pmodel.Value
+	if ex.Param != nil {
+		if param, err = e.eval(ex.Param, ts); err != nil {
+			return nil, err
+		}
+	}
+
+	var valueLabel pmodel.LabelName
+	if ex.Op == parser.COUNT_VALUES {
+		valueLabel = pmodel.LabelName(param.(*pmodel.String).Value)
+		if !valueLabel.IsValid() {
+			return nil, fmt.Errorf("invalid label name %q", valueLabel)
+		}
+	}
+
+	// group the samples, preserving the order in which groups are first seen
+	var groups []*aggregationGroup
+	groupsBySig := make(map[pmodel.Fingerprint]*aggregationGroup)
+	for _, sample := range vec {
+		metric := e.groupingMetric(sample.Metric, ex)
+		if ex.Op == parser.COUNT_VALUES {
+			metric[valueLabel] = pmodel.LabelValue(strconv.FormatFloat(float64(sample.Value), 'f', -1, 64))
+		}
+		fp := metric.Fingerprint()
+		group, exists := groupsBySig[fp]
+		if !exists {
+			group = &aggregationGroup{metric: metric}
+			groupsBySig[fp] = group
+			groups = append(groups, group)
+		}
+		group.samples = append(group.samples, sample)
+	}
+
+	res := pmodel.Vector{}
+	for _, group := range groups {
+		switch ex.Op.String() {
+		case "topk", "bottomk":
+			k := int(param.(*pmodel.Scalar).Value)
+			samples := append(pmodel.Vector(nil), group.samples...)
+			sort.SliceStable(samples, func(i, j int) bool {
+				if ex.Op == parser.TOPK {
+					return samples[i].Value > samples[j].Value
+				}
+				return samples[i].Value < samples[j].Value
+			})
+			if k < len(samples) {
+				if k < 0 {
+					k = 0
+				}
+				samples = samples[:k]
+			}
+			res = append(res, samples...)
+			continue
+		}
+
+		values := make([]float64, len(group.samples))
+		for i, sample := range group.samples {
+			values[i] = float64(sample.Value)
+		}
+
+		var result float64
+		switch ex.Op.String() {
+		case "sum":
+			result = sumOf(values)
+		case "avg":
+			result = sumOf(values) / float64(len(values))
+		case "count", "count_values":
+			result = float64(len(values))
+		case "group":
+			result = 1
+		case "min":
+			result = values[0]
+			for _, v := range values[1:] {
+				if v < result || math.IsNaN(result) {
+					result = v
+				}
+			}
+		case "max":
+			result = values[0]
+			for _, v := range values[1:] {
+				if v > result || math.IsNaN(result) {
+					result = v
+				}
+			}
+		case "stddev":
+			result = math.Sqrt(variance(values))
+		case "stdvar":
+			result = variance(values)
+		case "quantile":
+			result = quantile(float64(param.(*pmodel.Scalar).Value), values)
+		default:
+			return nil, fmt.Errorf("unknown aggregation operator %q", ex.Op.String())
+		}
+
+		res = append(res, &pmodel.Sample{Metric: group.metric, Value: pmodel.SampleValue(result), Timestamp: ts})
+	}
+
+	return res, nil
+}
+
+// groupingMetric computes the labels of the output series of an aggregation
+// that the given input series belongs to.
+func (e *Engine) groupingMetric(metric pmodel.Metric, ex *parser.AggregateExpr) pmodel.Metric {
+	if ex.Without {
+		res := dropMetricName(metric)
+		for _, name := range ex.Grouping {
+			delete(res, pmodel.LabelName(name))
+		}
+		return res
+	}
+
+	res := make(pmodel.Metric, len(ex.Grouping))
+	for _, name := range ex.Grouping {
+		if val, present := metric[pmodel.LabelName(name)]; present {
+			res[pmodel.LabelName(name)] = val
+		}
+	}
+	return res
+}
+
+func sumOf(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// variance calculates the population variance of the given values.
+func variance(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	mean := sumOf(values) / float64(len(values))
+	squares := 0.0
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return squares / float64(len(values))
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func (e *Engine) evalBinary(ex *parser.BinaryExpr, ts pmodel.Time) (pmodel.Value, error) {
+	lhs, err := e.eval(ex.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := e.eval(ex.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	lhsScalar, lhsIsScalar := lhs.(*pmodel.Scalar)
+	rhsScalar, rhsIsScalar := rhs.(*pmodel.Scalar)
+
+	switch {
+	case lhsIsScalar && rhsIsScalar:
+		val, keep := binaryOp(ex.Op, float64(lhsScalar.Value), float64(rhsScalar.Value))
+		if ex.Op.IsComparisonOperator() {
+			val = boolValue(keep)
+		}
+		return &pmodel.Scalar{Value: pmodel.SampleValue(val), Timestamp: ts}, nil
+	case lhsIsScalar:
+		return vectorScalarBinary(ex, rhs.(pmodel.Vector), float64(lhsScalar.Value), true, ts), nil
+	case rhsIsScalar:
+		return vectorScalarBinary(ex, lhs.(pmodel.Vector), float64(rhsScalar.Value), false, ts), nil
+	}
+
+	lhsVec, rhsVec := lhs.(pmodel.Vector), rhs.(pmodel.Vector)
+	matching := ex.VectorMatching
+	if matching == nil {
+		matching = &parser.VectorMatching{Card: parser.CardOneToOne}
+	}
+
+	switch ex.Op {
+	case parser.LAND:
+		return vectorAnd(lhsVec, rhsVec, matching, ts), nil
+	case parser.LOR:
+		return vectorOr(lhsVec, rhsVec, matching, ts), nil
+	case parser.LUNLESS:
+		return vectorUnless(lhsVec, rhsVec, matching, ts), nil
+	}
+	return vectorBinary(ex, lhsVec, rhsVec, matching, ts)
+}
+
+// binaryOp applies an arithmetic or comparison operator.  For comparisons,
+// the returned value is the left-hand side, and keep indicates whether the
+// comparison was true.
+func binaryOp(op parser.ItemType, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case parser.ADD:
+		return lhs + rhs, true
+	case parser.SUB:
+		return lhs - rhs, true
+	case parser.MUL:
+		return lhs * rhs, true
+	case parser.DIV:
+		return lhs / rhs, true
+	case parser.MOD:
+		return math.Mod(lhs, rhs), true
+	case parser.POW:
+		return math.Pow(lhs, rhs), true
+	case parser.ATAN2:
+		return math.Atan2(lhs, rhs), true
+	case parser.EQLC:
+		return lhs, lhs == rhs
+	case parser.NEQ:
+		return lhs, lhs != rhs
+	case parser.GTR:
+		return lhs, lhs > rhs
+	case parser.LSS:
+		return lhs, lhs < rhs
+	case parser.GTE:
+		return lhs, lhs >= rhs
+	case parser.LTE:
+		return lhs, lhs <= rhs
+	}
+	panic(fmt.Sprintf("unknown binary operator %q", op))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// shouldDropMetricName checks if the result of the given binary expression
+// should lose the metric name of its inputs.
+func shouldDropMetricName(ex *parser.BinaryExpr) bool {
+	return !ex.Op.IsComparisonOperator() || ex.ReturnBool
+}
+
+func vectorScalarBinary(ex *parser.BinaryExpr, vec pmodel.Vector, scalar float64, scalarOnLeft bool, ts pmodel.Time) pmodel.Vector {
+	res := pmodel.Vector{}
+	for _, sample := range vec {
+		lhs, rhs := float64(sample.Value), scalar
+		if scalarOnLeft {
+			lhs, rhs = rhs, lhs
+		}
+		val, keep := binaryOp(ex.Op, lhs, rhs)
+		if ex.Op.IsComparisonOperator() {
+			// comparisons filter (or produce a bool for) the vector, keeping its value
+			val = float64(sample.Value)
+			if ex.ReturnBool {
+				val, keep = boolValue(keep), true
+			}
+		}
+		if !keep {
+			continue
+		}
+
+		metric := sample.Metric
+		if shouldDropMetricName(ex) {
+			metric = dropMetricName(metric)
+		}
+		res = append(res, &pmodel.Sample{Metric: metric, Value: pmodel.SampleValue(val), Timestamp: ts})
+	}
+	return res
+}
+
+// matchingSignature produces the signature of the given metric used to match
+// it against the other side of a binary operation.
+func matchingSignature(metric pmodel.Metric, matching *parser.VectorMatching) string {
+	var names []string
+	if matching.On {
+		names = append(names, matching.MatchingLabels...)
+	} else {
+		ignored := make(map[string]bool, len(matching.MatchingLabels))
+		for _, name := range matching.MatchingLabels {
+			ignored[name] = true
+		}
+		for name := range metric {
+			if name != pmodel.MetricNameLabel && !ignored[string(name)] {
+				names = append(names, string(name))
+			}
+		}
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%q", name, metric[pmodel.LabelName(name)])
+	}
+	return strings.Join(parts, ",")
+}
+
+func vectorAnd(lhs, rhs pmodel.Vector, matching *parser.VectorMatching, ts pmodel.Time) pmodel.Vector {
+	rhsSigs := make(map[string]bool, len(rhs))
+	for _, sample := range rhs {
+		rhsSigs[matchingSignature(sample.Metric, matching)] = true
+	}
+
+	res := pmodel.Vector{}
+	for _, sample := range lhs {
+		if rhsSigs[matchingSignature(sample.Metric, matching)] {
+			res = append(res, sample)
+		}
+	}
+	return res
+}
+
+func vectorOr(lhs, rhs pmodel.Vector, matching *parser.VectorMatching, ts pmodel.Time) pmodel.Vector {
+	lhsSigs := make(map[string]bool, len(lhs))
+	res := pmodel.Vector{}
+	for _, sample := range lhs {
+		lhsSigs[matchingSignature(sample.Metric, matching)] = true
+		res = append(res, sample)
+	}
+	for _, sample := range rhs {
+		if !lhsSigs[matchingSignature(sample.Metric, matching)] {
+			res = append(res, sample)
+		}
+	}
+	return res
+}
+
+func vectorUnless(lhs, rhs pmodel.Vector, matching *parser.VectorMatching, ts pmodel.Time) pmodel.Vector {
+	rhsSigs := make(map[string]bool, len(rhs))
+	for _, sample := range rhs {
+		rhsSigs[matchingSignature(sample.Metric, matching)] = true
+	}
+
+	res := pmodel.Vector{}
+	for _, sample := range lhs {
+		if !rhsSigs[matchingSignature(sample.Metric, matching)] {
+			res = append(res, sample)
+		}
+	}
+	return res
+}
+
+// vectorBinary applies an arithmetic or comparison operator between two vectors.
+func vectorBinary(ex *parser.BinaryExpr, lhs, rhs pmodel.Vector, matching *parser.VectorMatching, ts pmodel.Time) (pmodel.Vector, error) {
+	// the "many" side (or the left-hand side, for one-to-one matching) drives the
+	// matching, and its labels form the basis for the result.
+	manySide, oneSide := lhs, rhs
+	if matching.Card == parser.CardOneToMany {
+		manySide, oneSide = rhs, lhs
+	}
+
+	oneSideBySig := make(map[string]*pmodel.Sample, len(oneSide))
+	for _, sample := range oneSide {
+		sig := matchingSignature(sample.Metric, matching)
+		if _, duplicate := oneSideBySig[sig]; duplicate {
+			side := "right"
+			if matching.Card == parser.CardOneToMany {
+				side = "left"
+			}
+			return nil, fmt.Errorf("found duplicate series for the match group {%s} on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig, side)
+		}
+		oneSideBySig[sig] = sample
+	}
+
+	res := pmodel.Vector{}
+	matchedSigs := make(map[string]bool)
+	resultFingerprints := make(map[pmodel.Fingerprint]bool)
+	for _, manySample := range manySide {
+		sig := matchingSignature(manySample.Metric, matching)
+		oneSample, found := oneSideBySig[sig]
+		if !found {
+			continue
+		}
+
+		if matching.Card == parser.CardOneToOne {
+			if matchedSigs[sig] {
+				return nil, fmt.Errorf("multiple matches for labels {%s}: many-to-one matching must be explicit (group_left/group_right)", sig)
+			}
+			matchedSigs[sig] = true
+		}
+
+		lhsVal, rhsVal := float64(manySample.Value), float64(oneSample.Value)
+		if matching.Card == parser.CardOneToMany {
+			lhsVal, rhsVal = rhsVal, lhsVal
+		}
+		val, keep := binaryOp(ex.Op, lhsVal, rhsVal)
+		if ex.ReturnBool {
+			val, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+
+		metric := resultMetric(manySample.Metric, oneSample.Metric, ex, matching)
+		fp := metric.Fingerprint()
+		if resultFingerprints[fp] {
+			return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+		}
+		resultFingerprints[fp] = true
+
+		res = append(res, &pmodel.Sample{Metric: metric, Value: pmodel.SampleValue(val), Timestamp: ts})
+	}
+
+	return res, nil
+}
+
+// resultMetric computes the labels of the result of a binary operation between
+// two vector samples.
+func resultMetric(many, one pmodel.Metric, ex *parser.BinaryExpr, matching *parser.VectorMatching) pmodel.Metric {
+	res := many.Clone()
+	if shouldDropMetricName(ex) {
+		delete(res, pmodel.MetricNameLabel)
+	}
+
+	if matching.Card == parser.CardOneToOne {
+		if matching.On {
+			kept := make(pmodel.Metric, len(matching.MatchingLabels))
+			for _, name := range matching.MatchingLabels {
+				if val, present := res[pmodel.LabelName(name)]; present {
+					kept[pmodel.LabelName(name)] = val
+				}
+			}
+			res = kept
+		} else {
+			for _, name := range matching.MatchingLabels {
+				delete(res, pmodel.LabelName(name))
+			}
+		}
+	}
+
+	for _, name := range matching.Include {
+		if val, present := one[pmodel.LabelName(name)]; present && val != "" {
+			res[pmodel.LabelName(name)] = val
+		} else {
+			delete(res, pmodel.LabelName(name))
+		}
+	}
+
+	return res
+}
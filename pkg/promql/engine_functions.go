@@ -0,0 +1,633 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// mathFunctions are the functions that apply a simple operation to each sample of a vector.
+var mathFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"exp":   math.Exp,
+	"floor": math.Floor,
+	"ln":    math.Log,
+	"log10": math.Log10,
+	"log2":  math.Log2,
+	"sqrt":  math.Sqrt,
+	"acos":  math.Acos,
+	"acosh": math.Acosh,
+	"asin":  math.Asin,
+	"asinh": math.Asinh,
+	"atan":  math.Atan,
+	"atanh": math.Atanh,
+	"cos":   math.Cos,
+	"cosh":  math.Cosh,
+	"sin":   math.Sin,
+	"sinh":  math.Sinh,
+	"tan":   math.Tan,
+	"tanh":  math.Tanh,
+	"deg":   func(v float64) float64 { return v * 180 / math.Pi },
+	"rad":   func(v float64) float64 { return v * math.Pi / 180 },
+	"sgn": func(v float64) float64 {
+		switch {
+		case v < 0:
+			return -1
+		case v > 0:
+			return 1
+		}
+		return v
+	},
+}
+
+// overTimeFunctions are the functions that reduce the samples of each series
+// in a range vector to a single value.
+var overTimeFunctions = map[string]func(values []float64) float64{
+	"avg_over_time":     func(values []float64) float64 { return sumOf(values) / float64(len(values)) },
+	"count_over_time":   func(values []float64) float64 { return float64(len(values)) },
+	"sum_over_time":     sumOf,
+	"present_over_time": func(values []float64) float64 { return 1 },
+	"stdvar_over_time":  variance,
+	"stddev_over_time":  func(values []float64) float64 { return math.Sqrt(variance(values)) },
+	"max_over_time": func(values []float64) float64 {
+		res := values[0]
+		for _, v := range values[1:] {
+			if v > res || math.IsNaN(res) {
+				res = v
+			}
+		}
+		return res
+	},
+	"min_over_time": func(values []float64) float64 {
+		res := values[0]
+		for _, v := range values[1:] {
+			if v < res || math.IsNaN(res) {
+				res = v
+			}
+		}
+		return res
+	},
+}
+
+// dateFunctions are the functions that extract part of a date from a timestamp.
+var dateFunctions = map[string]func(time.Time) float64{
+	"day_of_month": func(t time.Time) float64 { return float64(t.Day()) },
+	"day_of_week":  func(t time.Time) float64 { return float64(t.Weekday()) },
+	"days_in_month": func(t time.Time) float64 {
+		return float64(32 - time.Date(t.Year(), t.Month(), 32, 0, 0, 0, 0, time.UTC).Day())
+	},
+	"hour":   func(t time.Time) float64 { return float64(t.Hour()) },
+	"minute": func(t time.Time) float64 { return float64(t.Minute()) },
+	"month":  func(t time.Time) float64 { return float64(t.Month()) },
+	"year":   func(t time.Time) float64 { return float64(t.Year()) },
+}
+
+func (e *Engine) evalCall(ex *parser.Call, ts pmodel.Time) (pmodel.Value, error) {
+	args := make([]pmodel.Value, len(ex.Args))
+	for i, arg := range ex.Args {
+		val, err := e.eval(arg, ts)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+
+	if fn, isMath := mathFunctions[ex.Func.Name]; isMath {
+		return mapVector(args[0].(pmodel.Vector), ts, fn), nil
+	}
+	if fn, isOverTime := overTimeFunctions[ex.Func.Name]; isOverTime {
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			return fn(sampleValues(values)), true
+		}), nil
+	}
+	if fn, isDate := dateFunctions[ex.Func.Name]; isDate {
+		vec := pmodel.Vector{{Metric: pmodel.Metric{}, Value: pmodel.SampleValue(float64(ts) / 1000), Timestamp: ts}}
+		if len(args) > 0 {
+			vec = args[0].(pmodel.Vector)
+		}
+		return mapVector(vec, ts, func(v float64) float64 {
+			return fn(time.Unix(int64(v), 0).UTC())
+		}), nil
+	}
+
+	switch ex.Func.Name {
+	case "rate":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, extrapolatedRate(ex.Args[0], ts, true, true)), nil
+	case "increase":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, extrapolatedRate(ex.Args[0], ts, true, false)), nil
+	case "delta":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, extrapolatedRate(ex.Args[0], ts, false, false)), nil
+	case "irate":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, instantValue(true)), nil
+	case "idelta":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, instantValue(false)), nil
+	case "deriv":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			if len(values) < 2 {
+				return 0, false
+			}
+			slope, _ := linearRegression(values, values[0].Timestamp)
+			return slope, true
+		}), nil
+	case "predict_linear":
+		duration := float64(args[1].(*pmodel.Scalar).Value)
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			if len(values) < 2 {
+				return 0, false
+			}
+			slope, intercept := linearRegression(values, ts)
+			return slope*duration + intercept, true
+		}), nil
+	case "quantile_over_time":
+		q := float64(args[0].(*pmodel.Scalar).Value)
+		return reduceMatrix(args[1].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			return quantile(q, sampleValues(values)), true
+		}), nil
+	case "changes", "resets":
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			count := 0
+			for i := 1; i < len(values); i++ {
+				prev, cur := values[i-1].Value, values[i].Value
+				if (ex.Func.Name == "resets" && cur < prev) || (ex.Func.Name == "changes" && cur != prev && !(math.IsNaN(float64(cur)) && math.IsNaN(float64(prev)))) {
+					count++
+				}
+			}
+			return float64(count), true
+		}), nil
+	case "holt_winters":
+		sf, tf := float64(args[1].(*pmodel.Scalar).Value), float64(args[2].(*pmodel.Scalar).Value)
+		if sf <= 0 || sf >= 1 {
+			return nil, fmt.Errorf("invalid smoothing factor. Expected: 0 < sf < 1, got: %v", sf)
+		}
+		if tf <= 0 || tf >= 1 {
+			return nil, fmt.Errorf("invalid trend factor. Expected: 0 < tf < 1, got: %v", tf)
+		}
+		return reduceMatrix(args[0].(pmodel.Matrix), ts, func(values []pmodel.SamplePair) (float64, bool) {
+			if len(values) < 2 {
+				return 0, false
+			}
+			return holtWinters(sampleValues(values), sf, tf), true
+		}), nil
+	case "absent":
+		if len(args[0].(pmodel.Vector)) > 0 {
+			return pmodel.Vector{}, nil
+		}
+		return pmodel.Vector{{Metric: absentMetric(ex.Args[0]), Value: 1, Timestamp: ts}}, nil
+	case "absent_over_time":
+		if len(args[0].(pmodel.Matrix)) > 0 {
+			return pmodel.Vector{}, nil
+		}
+		return pmodel.Vector{{Metric: absentMetric(ex.Args[0]), Value: 1, Timestamp: ts}}, nil
+	case "last_over_time":
+		// unlike the other functions, last_over_time keeps the metric name
+		res := pmodel.Vector{}
+		for _, stream := range args[0].(pmodel.Matrix) {
+			if len(stream.Values) == 0 {
+				continue
+			}
+			res = append(res, &pmodel.Sample{Metric: stream.Metric.Clone(), Value: stream.Values[len(stream.Values)-1].Value, Timestamp: ts})
+		}
+		return res, nil
+	case "clamp":
+		min, max := float64(args[1].(*pmodel.Scalar).Value), float64(args[2].(*pmodel.Scalar).Value)
+		if max < min {
+			return pmodel.Vector{}, nil
+		}
+		return mapVector(args[0].(pmodel.Vector), ts, func(v float64) float64 { return math.Max(min, math.Min(max, v)) }), nil
+	case "clamp_max":
+		max := float64(args[1].(*pmodel.Scalar).Value)
+		return mapVector(args[0].(pmodel.Vector), ts, func(v float64) float64 { return math.Min(max, v) }), nil
+	case "clamp_min":
+		min := float64(args[1].(*pmodel.Scalar).Value)
+		return mapVector(args[0].(pmodel.Vector), ts, func(v float64) float64 { return math.Max(min, v) }), nil
+	case "round":
+		toNearest := 1.0
+		if len(args) > 1 {
+			toNearest = float64(args[1].(*pmodel.Scalar).Value)
+		}
+		// round half up, as in Prometheus
+		toNearestInverse := 1.0 / toNearest
+		return mapVector(args[0].(pmodel.Vector), ts, func(v float64) float64 {
+			return math.Floor(v*toNearestInverse+0.5) / toNearestInverse
+		}), nil
+	case "scalar":
+		vec := args[0].(pmodel.Vector)
+		if len(vec) != 1 {
+			return &pmodel.Scalar{Value: pmodel.SampleValue(math.NaN()), Timestamp: ts}, nil
+		}
+		return &pmodel.Scalar{Value: vec[0].Value, Timestamp: ts}, nil
+	case "vector":
+		return pmodel.Vector{{Metric: pmodel.Metric{}, Value: args[0].(*pmodel.Scalar).Value, Timestamp: ts}}, nil
+	case "time":
+		return &pmodel.Scalar{Value: pmodel.SampleValue(float64(ts) / 1000), Timestamp: ts}, nil
+	case "timestamp":
+		vec := args[0].(pmodel.Vector)
+		res := make(pmodel.Vector, len(vec))
+		for i, sample := range vec {
+			res[i] = &pmodel.Sample{Metric: dropMetricName(sample.Metric), Value: pmodel.SampleValue(float64(sample.Timestamp) / 1000), Timestamp: ts}
+		}
+		return res, nil
+	case "sort", "sort_desc":
+		res := append(pmodel.Vector(nil), args[0].(pmodel.Vector)...)
+		sort.SliceStable(res, func(i, j int) bool {
+			if ex.Func.Name == "sort" {
+				return res[i].Value < res[j].Value
+			}
+			return res[i].Value > res[j].Value
+		})
+		return res, nil
+	case "histogram_quantile":
+		return histogramQuantile(float64(args[0].(*pmodel.Scalar).Value), args[1].(pmodel.Vector), ts), nil
+	case "label_replace":
+		return labelReplace(args, ts)
+	case "label_join":
+		return labelJoin(args, ts)
+	}
+
+	return nil, fmt.Errorf("unable to evaluate unsupported function %q", ex.Func.Name)
+}
+
+// mapVector applies the given function to the value of each sample in
+// the vector, dropping the metric name.
+func mapVector(vec pmodel.Vector, ts pmodel.Time, fn func(float64) float64) pmodel.Vector {
+	res := make(pmodel.Vector, len(vec))
+	for i, sample := range vec {
+		res[i] = &pmodel.Sample{Metric: dropMetricName(sample.Metric), Value: pmodel.SampleValue(fn(float64(sample.Value))), Timestamp: ts}
+	}
+	return res
+}
+
+// reduceMatrix reduces each series in the matrix to a single sample, dropping
+// the metric name.  Series for which fn returns false are omitted.
+func reduceMatrix(mat pmodel.Matrix, ts pmodel.Time, fn func([]pmodel.SamplePair) (float64, bool)) pmodel.Vector {
+	res := pmodel.Vector{}
+	for _, stream := range mat {
+		if len(stream.Values) == 0 {
+			continue
+		}
+		val, keep := fn(stream.Values)
+		if !keep {
+			continue
+		}
+		res = append(res, &pmodel.Sample{Metric: dropMetricName(stream.Metric), Value: pmodel.SampleValue(val), Timestamp: ts})
+	}
+	return res
+}
+
+func sampleValues(values []pmodel.SamplePair) []float64 {
+	res := make([]float64, len(values))
+	for i, sample := range values {
+		res[i] = float64(sample.Value)
+	}
+	return res
+}
+
+// rangeOf returns the range of the given range vector expression, and the
+// time at which that range ends when evaluated at the given time.
+func rangeOf(expr parser.Expr, ts pmodel.Time) (time.Duration, pmodel.Time) {
+	switch ex := expr.(type) {
+	case *parser.MatrixSelector:
+		sel := ex.VectorSelector.(*parser.VectorSelector)
+		return ex.Range, modifiedTime(ts, sel.Timestamp, sel.OriginalOffset)
+	case *parser.SubqueryExpr:
+		return ex.Range, modifiedTime(ts, ex.Timestamp, ex.OriginalOffset)
+	case *parser.ParenExpr:
+		return rangeOf(ex.Expr, ts)
+	}
+	return 0, ts
+}
+
+// extrapolatedRate implements rate, increase, and delta, extrapolating
+// the result to the edges of the range as Prometheus does.
+func extrapolatedRate(arg parser.Expr, ts pmodel.Time, isCounter, isRate bool) func([]pmodel.SamplePair) (float64, bool) {
+	rng, rangeEnd := rangeOf(arg, ts)
+	rangeStart := rangeEnd.Add(-rng)
+
+	return func(values []pmodel.SamplePair) (float64, bool) {
+		if len(values) < 2 {
+			return 0, false
+		}
+
+		first, last := values[0], values[len(values)-1]
+		resultValue := float64(last.Value - first.Value)
+		if isCounter {
+			prev := first.Value
+			for _, sample := range values[1:] {
+				if sample.Value < prev {
+					resultValue += float64(prev)
+				}
+				prev = sample.Value
+			}
+		}
+
+		durationToStart := float64(first.Timestamp-rangeStart) / 1000
+		durationToEnd := float64(rangeEnd-last.Timestamp) / 1000
+		sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+		averageDurationBetweenSamples := sampledInterval / float64(len(values)-1)
+
+		if isCounter && resultValue > 0 && first.Value >= 0 {
+			// counters can't go below zero, so don't extrapolate past that point
+			durationToZero := sampledInterval * (float64(first.Value) / resultValue)
+			if durationToZero < durationToStart {
+				durationToStart = durationToZero
+			}
+		}
+
+		extrapolationThreshold := averageDurationBetweenSamples * 1.1
+		extrapolateToInterval := sampledInterval
+		if durationToStart < extrapolationThreshold {
+			extrapolateToInterval += durationToStart
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+		if durationToEnd < extrapolationThreshold {
+			extrapolateToInterval += durationToEnd
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+
+		resultValue = resultValue * (extrapolateToInterval / sampledInterval)
+		if isRate {
+			resultValue = resultValue / rng.Seconds()
+		}
+		return resultValue, true
+	}
+}
+
+// instantValue implements irate and idelta, using the last two samples in the range.
+func instantValue(isRate bool) func([]pmodel.SamplePair) (float64, bool) {
+	return func(values []pmodel.SamplePair) (float64, bool) {
+		if len(values) < 2 {
+			return 0, false
+		}
+		last, previous := values[len(values)-1], values[len(values)-2]
+
+		resultValue := float64(last.Value - previous.Value)
+		if isRate && last.Value < previous.Value {
+			// counter reset
+			resultValue = float64(last.Value)
+		}
+
+		sampledInterval := last.Timestamp.Sub(previous.Timestamp)
+		if sampledInterval == 0 {
+			return 0, false
+		}
+		if isRate {
+			resultValue = resultValue / sampledInterval.Seconds()
+		}
+		return resultValue, true
+	}
+}
+
+// linearRegression calculates the slope (per second) and the intercept at
+// interceptTime of the least-squares fit of the given samples.
+func linearRegression(values []pmodel.SamplePair, interceptTime pmodel.Time) (float64, float64) {
+	var n, sumX, sumY, sumXY, sumX2 float64
+	for _, sample := range values {
+		x := float64(sample.Timestamp-interceptTime) / 1000
+		n++
+		sumX += x
+		sumY += float64(sample.Value)
+		sumXY += x * float64(sample.Value)
+		sumX2 += x * x
+	}
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+
+	slope := covXY / varX
+	intercept := sumY/n - slope*sumX/n
+	return slope, intercept
+}
+
+// holtWinters calculates the double exponential smoothing of the given values.
+func holtWinters(values []float64, sf, tf float64) float64 {
+	var s0, s1, b float64
+	s1 = values[0]
+	b = values[1] - values[0]
+
+	for i := 1; i < len(values); i++ {
+		if i > 1 {
+			b = tf*(s1-s0) + (1-tf)*b
+		}
+		s0 = s1
+		s1 = sf*values[i] + (1-sf)*(s0+b)
+	}
+	return s1
+}
+
+// absentMetric computes the labels of the result of absent or absent_over_time,
+// which are taken from the equality matchers of a lone selector argument.
+func absentMetric(arg parser.Expr) pmodel.Metric {
+	res := pmodel.Metric{}
+
+	var sel *parser.VectorSelector
+	switch ex := arg.(type) {
+	case *parser.VectorSelector:
+		sel = ex
+	case *parser.MatrixSelector:
+		sel = ex.VectorSelector.(*parser.VectorSelector)
+	default:
+		return res
+	}
+
+	seen := make(map[string]bool)
+	for _, matcher := range sel.LabelMatchers {
+		if matcher.Name == pmodel.MetricNameLabel {
+			continue
+		}
+		if matcher.Type == labels.MatchEqual && !seen[matcher.Name] {
+			res[pmodel.LabelName(matcher.Name)] = pmodel.LabelValue(matcher.Value)
+			seen[matcher.Name] = true
+		} else {
+			// multiple or non-equality matchers can't be translated into a value
+			delete(res, pmodel.LabelName(matcher.Name))
+		}
+	}
+	return res
+}
+
+// bucket is a single bucket of a histogram.
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile implements histogram_quantile, grouping the buckets
+// by all labels except for `le`.
+func histogramQuantile(q float64, vec pmodel.Vector, ts pmodel.Time) pmodel.Vector {
+	type histogram struct {
+		metric  pmodel.Metric
+		buckets []bucket
+	}
+
+	var histograms []*histogram
+	bySig := make(map[pmodel.Fingerprint]*histogram)
+	for _, sample := range vec {
+		upperBound, err := strconv.ParseFloat(string(sample.Metric[pmodel.BucketLabel]), 64)
+		if err != nil {
+			// samples without a valid `le` label are ignored
+			continue
+		}
+		metric := dropMetricName(sample.Metric)
+		delete(metric, pmodel.BucketLabel)
+
+		fp := metric.Fingerprint()
+		hist, exists := bySig[fp]
+		if !exists {
+			hist = &histogram{metric: metric}
+			bySig[fp] = hist
+			histograms = append(histograms, hist)
+		}
+		hist.buckets = append(hist.buckets, bucket{upperBound: upperBound, count: float64(sample.Value)})
+	}
+
+	res := pmodel.Vector{}
+	for _, hist := range histograms {
+		res = append(res, &pmodel.Sample{Metric: hist.metric, Value: pmodel.SampleValue(bucketQuantile(q, hist.buckets)), Timestamp: ts})
+	}
+	return res
+}
+
+// bucketQuantile calculates the quantile q from the given cumulative buckets,
+// assuming a linear distribution within each bucket, as in Prometheus.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	// ensure monotonicity, in case the buckets were scraped at slightly different times
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].upperBound
+		count       = buckets[b].count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+func labelReplace(args []pmodel.Value, ts pmodel.Time) (pmodel.Value, error) {
+	var (
+		vec         = args[0].(pmodel.Vector)
+		dst         = pmodel.LabelName(args[1].(*pmodel.String).Value)
+		replacement = args[2].(*pmodel.String).Value
+		src         = pmodel.LabelName(args[3].(*pmodel.String).Value)
+		regexStr    = args[4].(*pmodel.String).Value
+	)
+
+	regex, err := regexp.Compile("^(?:" + regexStr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in label_replace(): %s", regexStr)
+	}
+	if !dst.IsValid() {
+		return nil, fmt.Errorf("invalid destination label name in label_replace(): %s", dst)
+	}
+
+	res := make(pmodel.Vector, 0, len(vec))
+	for _, sample := range vec {
+		metric := sample.Metric.Clone()
+		srcVal := string(metric[src])
+		if indexes := regex.FindStringSubmatchIndex(srcVal); indexes != nil {
+			newVal := string(regex.ExpandString(nil, replacement, srcVal, indexes))
+			if newVal == "" {
+				delete(metric, dst)
+			} else {
+				metric[dst] = pmodel.LabelValue(newVal)
+			}
+		}
+		res = append(res, &pmodel.Sample{Metric: metric, Value: sample.Value, Timestamp: ts})
+	}
+	return res, nil
+}
+
+func labelJoin(args []pmodel.Value, ts pmodel.Time) (pmodel.Value, error) {
+	var (
+		vec       = args[0].(pmodel.Vector)
+		dst       = pmodel.LabelName(args[1].(*pmodel.String).Value)
+		separator = args[2].(*pmodel.String).Value
+	)
+	if !dst.IsValid() {
+		return nil, fmt.Errorf("invalid destination label name in label_join(): %s", dst)
+	}
+
+	var srcLabels []pmodel.LabelName
+	for _, arg := range args[3:] {
+		src := pmodel.LabelName(arg.(*pmodel.String).Value)
+		if !src.IsValid() {
+			return nil, fmt.Errorf("invalid source label name in label_join(): %s", src)
+		}
+		srcLabels = append(srcLabels, src)
+	}
+
+	res := make(pmodel.Vector, 0, len(vec))
+	for _, sample := range vec {
+		parts := make([]string, len(srcLabels))
+		for i, src := range srcLabels {
+			parts[i] = string(sample.Metric[src])
+		}
+
+		metric := sample.Metric.Clone()
+		if joined := strings.Join(parts, separator); joined == "" {
+			delete(metric, dst)
+		} else {
+			metric[dst] = pmodel.LabelValue(joined)
+		}
+		res = append(res, &pmodel.Sample{Metric: metric, Value: sample.Value, Timestamp: ts})
+	}
+	return res, nil
+}
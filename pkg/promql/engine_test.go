@@ -0,0 +1,176 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// matrixStorage is a Storage backed by a fixed matrix.
+type matrixStorage pmodel.Matrix
+
+func (s matrixStorage) Select(sel *parser.VectorSelector, start, end pmodel.Time) pmodel.Matrix {
+	res := pmodel.Matrix{}
+	for _, stream := range s {
+		if !MatchesSeries(sel, string(stream.Metric[pmodel.MetricNameLabel]), pmodel.LabelSet(stream.Metric)) {
+			continue
+		}
+		var values []pmodel.SamplePair
+		for _, sample := range stream.Values {
+			if sample.Timestamp >= start && sample.Timestamp <= end {
+				values = append(values, sample)
+			}
+		}
+		res = append(res, &pmodel.SampleStream{Metric: stream.Metric, Values: values})
+	}
+	return res
+}
+
+// linearStream produces a series with a sample every minute from time zero, starting
+// at the given value and increasing by step each minute.
+func linearStream(metric pmodel.Metric, start, step float64, count int) *pmodel.SampleStream {
+	stream := &pmodel.SampleStream{Metric: metric}
+	for i := 0; i < count; i++ {
+		stream.Values = append(stream.Values, pmodel.SamplePair{
+			Timestamp: pmodel.TimeFromUnix(int64(i * 60)),
+			Value:     pmodel.SampleValue(start + step*float64(i)),
+		})
+	}
+	return stream
+}
+
+var _ = Describe("PromQL Engine", func() {
+	var engine *Engine
+	evalTime := pmodel.TimeFromUnix(600)
+
+	BeforeEach(func() {
+		engine = &Engine{Storage: matrixStorage{
+			linearStream(pmodel.Metric{"__name__": "http_requests_total", "namespace": "ns1", "pod": "a"}, 0, 60, 11),
+			linearStream(pmodel.Metric{"__name__": "http_requests_total", "namespace": "ns1", "pod": "b"}, 0, 120, 11),
+			linearStream(pmodel.Metric{"__name__": "http_requests_total", "namespace": "ns2", "pod": "c"}, 0, 30, 11),
+			linearStream(pmodel.Metric{"__name__": "old_metric", "namespace": "ns1"}, 5, 0, 2),
+			linearStream(pmodel.Metric{"__name__": "kube_pod_labels", "namespace": "ns1", "pod": "a", "label_app": "web"}, 1, 0, 11),
+			linearStream(pmodel.Metric{"__name__": "kube_pod_labels", "namespace": "ns1", "pod": "b", "label_app": "web"}, 1, 0, 11),
+			linearStream(pmodel.Metric{"__name__": "latency_bucket", "le": "0.1"}, 0, 10, 11),
+			linearStream(pmodel.Metric{"__name__": "latency_bucket", "le": "1"}, 0, 20, 11),
+			linearStream(pmodel.Metric{"__name__": "latency_bucket", "le": "+Inf"}, 0, 20, 11),
+		}}
+	})
+
+	eval := func(query string) pmodel.Value {
+		expr, err := parser.ParseExpr(query)
+		Expect(err).NotTo(HaveOccurred())
+		res, err := engine.Eval(expr, evalTime)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	valuesByLabel := func(val pmodel.Value, label pmodel.LabelName) map[pmodel.LabelValue]float64 {
+		res := make(map[pmodel.LabelValue]float64)
+		for _, sample := range val.(pmodel.Vector) {
+			res[sample.Metric[label]] = float64(sample.Value)
+		}
+		return res
+	}
+
+	It("should select the latest sample within the lookback window", func() {
+		res := eval(`http_requests_total{namespace="ns1"}`)
+		Expect(valuesByLabel(res, "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 600, "b": 1200}))
+		Expect(res.(pmodel.Vector)[0].Timestamp).To(Equal(evalTime))
+
+		By("ignoring series whose last sample is older than the lookback delta")
+		Expect(eval(`old_metric`)).To(BeEmpty())
+
+		By("honoring offsets")
+		Expect(valuesByLabel(eval(`http_requests_total{pod="a"} offset 5m`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 300}))
+
+		By("honoring the @ modifier")
+		Expect(valuesByLabel(eval(`http_requests_total{pod="a"} @ 120`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 120}))
+		Expect(valuesByLabel(eval(`http_requests_total{pod="a"} @ end() offset 1m`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 540}))
+		Expect(valuesByLabel(eval(`increase(http_requests_total{pod="a"}[2m] @ 300)`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 120}))
+	})
+
+	It("should calculate rates as Prometheus does", func() {
+		Expect(valuesByLabel(eval(`rate(http_requests_total[5m])`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 1, "b": 2, "c": 0.5}))
+		Expect(valuesByLabel(eval(`increase(http_requests_total{pod="a"}[5m])`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 300}))
+		Expect(valuesByLabel(eval(`irate(http_requests_total{pod="b"}[5m])`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"b": 2}))
+	})
+
+	It("should evaluate aggregations", func() {
+		Expect(valuesByLabel(eval(`sum(rate(http_requests_total[5m])) by (namespace)`), "namespace")).To(Equal(map[pmodel.LabelValue]float64{"ns1": 3, "ns2": 0.5}))
+		Expect(valuesByLabel(eval(`max without(pod) (http_requests_total)`), "namespace")).To(Equal(map[pmodel.LabelValue]float64{"ns1": 1200, "ns2": 300}))
+		Expect(valuesByLabel(eval(`topk(1, http_requests_total)`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"b": 1200}))
+		Expect(valuesByLabel(eval(`count(http_requests_total)`), "")).To(Equal(map[pmodel.LabelValue]float64{"": 3}))
+	})
+
+	It("should match vectors in binary operations", func() {
+		By("matching one-to-one on all labels")
+		Expect(valuesByLabel(eval(`http_requests_total / http_requests_total`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 1, "b": 1, "c": 1}))
+
+		By("matching many-to-one with group_left, copying extra labels")
+		res := eval(`http_requests_total * on(namespace, pod) group_left(label_app) kube_pod_labels`)
+		Expect(valuesByLabel(res, "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 600, "b": 1200}))
+		Expect(valuesByLabel(res, "label_app")).To(HaveKey(pmodel.LabelValue("web")))
+
+		By("applying atan2")
+		Expect(valuesByLabel(eval(`http_requests_total{pod="a"} atan2 http_requests_total{pod="a"}`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": math.Pi / 4}))
+
+		By("filtering with comparisons")
+		Expect(valuesByLabel(eval(`http_requests_total > 500`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 600, "b": 1200}))
+
+		By("evaluating scalar arithmetic")
+		Expect(eval(`2 * 3 + 1`).(*pmodel.Scalar).Value).To(BeEquivalentTo(7))
+	})
+
+	It("should refuse many-to-many matching", func() {
+		expr, err := parser.ParseExpr(`http_requests_total * on(namespace) kube_pod_labels`)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = engine.Eval(expr, evalTime)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should evaluate functions", func() {
+		Expect(valuesByLabel(eval(`histogram_quantile(0.75, rate(latency_bucket[5m]))`), "")).To(HaveKeyWithValue(pmodel.LabelValue(""), BeNumerically("~", 0.55, 1e-9)))
+		Expect(valuesByLabel(eval(`absent(nonexistent{job="foo"})`), "job")).To(Equal(map[pmodel.LabelValue]float64{"foo": 1}))
+		Expect(eval(`absent(http_requests_total)`)).To(BeEmpty())
+		Expect(valuesByLabel(eval(`label_replace(http_requests_total{pod="a"}, "app", "$1-x", "pod", "(.*)")`), "app")).To(Equal(map[pmodel.LabelValue]float64{"a-x": 600}))
+		Expect(valuesByLabel(eval(`avg_over_time(http_requests_total{pod="a"}[2m])`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 540}))
+		Expect(math.IsNaN(float64(eval(`scalar(http_requests_total)`).(*pmodel.Scalar).Value))).To(BeTrue())
+		Expect(valuesByLabel(eval(`last_over_time(http_requests_total{pod="a"}[2m])`), "__name__")).To(Equal(map[pmodel.LabelValue]float64{"http_requests_total": 600}))
+		Expect(valuesByLabel(eval(`sgn(http_requests_total{pod="a"} - 700)`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": -1}))
+		Expect(valuesByLabel(eval(`clamp(http_requests_total{namespace="ns1"}, 700, 1000)`), "pod")).To(Equal(map[pmodel.LabelValue]float64{"a": 700, "b": 1000}))
+	})
+
+	It("should evaluate range queries", func() {
+		expr, err := parser.ParseExpr(`sum(http_requests_total)`)
+		Expect(err).NotTo(HaveOccurred())
+		res, err := engine.EvalRange(expr, pmodel.TimeFromUnix(0), pmodel.TimeFromUnix(120), time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].Values).To(Equal([]pmodel.SamplePair{
+			{Timestamp: pmodel.TimeFromUnix(0), Value: 0},
+			{Timestamp: pmodel.TimeFromUnix(60), Value: 210},
+			{Timestamp: pmodel.TimeFromUnix(120), Value: 420},
+		}))
+	})
+})
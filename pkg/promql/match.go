@@ -0,0 +1,38 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	pmodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MatchesSeries checks if a series with the given name and labels would be
+// selected by the given selector.  As in Prometheus, a missing label is
+// treated as having the empty value.
+func MatchesSeries(sel *parser.VectorSelector, name string, lbls pmodel.LabelSet) bool {
+	for _, matcher := range sel.LabelMatchers {
+		value := string(lbls[pmodel.LabelName(matcher.Name)])
+		if matcher.Name == pmodel.MetricNameLabel {
+			value = name
+		}
+		if !matcher.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+)
+
+var _ = Describe("PromQL Selector Matching", func() {
+	It("should match series as Prometheus does", func() {
+		sel, err := ParseSelector(`{__name__=~"container_.*",container_name!="POD",namespace!="",image=""}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(MatchesSeries(sel, "container_cpu_usage_seconds_total", pmodel.LabelSet{"container_name": "app", "namespace": "somens"})).To(BeTrue())
+		Expect(MatchesSeries(sel, "container_cpu_usage_seconds_total", pmodel.LabelSet{"container_name": "POD", "namespace": "somens"})).To(BeFalse())
+		Expect(MatchesSeries(sel, "container_cpu_usage_seconds_total", pmodel.LabelSet{"container_name": "app"})).To(BeFalse())
+		Expect(MatchesSeries(sel, "container_cpu_usage_seconds_total", pmodel.LabelSet{"container_name": "app", "namespace": "somens", "image": "x"})).To(BeFalse())
+		Expect(MatchesSeries(sel, "some_container_metric", pmodel.LabelSet{"namespace": "somens"})).To(BeFalse())
+
+		sel, err = ParseSelector(`http_requests_total{pod=~"a|b"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(MatchesSeries(sel, "http_requests_total", pmodel.LabelSet{"pod": "b"})).To(BeTrue())
+		Expect(MatchesSeries(sel, "http_requests_total", pmodel.LabelSet{"pod": "bb"})).To(BeFalse())
+		Expect(MatchesSeries(sel, "http_requests", pmodel.LabelSet{"pod": "a"})).To(BeFalse())
+	})
+})
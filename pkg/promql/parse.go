@@ -0,0 +1,40 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ParseSelector parses a single vector selector (e.g. `foo{bar="baz"}`), such
+// as is used for series queries.
+func ParseSelector(input string) (*parser.VectorSelector, error) {
+	expr, err := parser.ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	sel, isSel := expr.(*parser.VectorSelector)
+	if !isSel {
+		return nil, fmt.Errorf("expected a vector selector, got %s", parser.DocumentedType(expr.Type()))
+	}
+	if sel.OriginalOffset != 0 || sel.Timestamp != nil || sel.StartOrEnd != 0 {
+		return nil, fmt.Errorf("expected a vector selector without the offset or @ modifiers")
+	}
+	return sel, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var _ = Describe("PromQL Expression Helpers", func() {
+	It("should parse single selectors", func() {
+		sel, err := ParseSelector(`{__name__=~"^container_.*",container_name!="POD"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sel.LabelMatchers).To(Equal([]*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "__name__", "^container_.*"),
+			labels.MustNewMatcher(labels.MatchNotEqual, "container_name", "POD"),
+		}))
+
+		for _, input := range []string{`rate(foo[5m])`, `foo offset 5m`, `foo @ 123`, `foo{`} {
+			_, err = ParseSelector(input)
+			Expect(err).To(HaveOccurred(), "while parsing %q", input)
+		}
+	})
+
+	It("should replace nodes when rewriting an expression", func() {
+		expr, err := parser.ParseExpr(`sum(foo) by (pod) / bar`)
+		Expect(err).NotTo(HaveOccurred())
+
+		rewritten := Rewrite(expr, func(node parser.Expr) parser.Expr {
+			if sel, isSel := node.(*parser.VectorSelector); isSel {
+				arg := &parser.VectorSelector{Name: sel.Name + "_total", LabelMatchers: []*labels.Matcher{
+					labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, sel.Name+"_total"),
+				}}
+				return &parser.ParenExpr{Expr: &parser.Call{Func: parser.Functions["abs"], Args: parser.Expressions{arg}}}
+			}
+			return nil
+		})
+		Expect(rewritten.String()).To(Equal(`sum by(pod) ((abs(foo_total))) / (abs(bar_total))`))
+	})
+
+	It("should copy expressions so that the original is unchanged by rewriting", func() {
+		expr, err := parser.ParseExpr(`sum(rate(foo{a="b"}[5m] @ 60)) by (pod) / on(pod) bar`)
+		Expect(err).NotTo(HaveOccurred())
+
+		clone := Clone(expr)
+		Expect(clone.String()).To(Equal(expr.String()))
+
+		parser.Inspect(clone, func(node parser.Node, _ []parser.Node) error {
+			switch e := node.(type) {
+			case *parser.VectorSelector:
+				e.LabelMatchers = append(e.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, "c", "d"))
+				if e.Timestamp != nil {
+					*e.Timestamp = 120000
+				}
+			case *parser.AggregateExpr:
+				e.Grouping[0] = "node"
+			case *parser.BinaryExpr:
+				e.VectorMatching.MatchingLabels[0] = "node"
+			}
+			return nil
+		})
+		Expect(clone.String()).To(Equal(`sum by(node) (rate(foo{a="b",c="d"}[5m] @ 120.000)) / on(node) bar{c="d"}`))
+		Expect(expr.String()).To(Equal(`sum by(pod) (rate(foo{a="b"}[5m] @ 60.000)) / on(pod) bar`))
+	})
+
+	It("should find the largest range used in an expression", func() {
+		for input, expected := range map[string]time.Duration{
+			`foo`: 0,
+			`sum(rate(foo[2m])) by (pod) / sum(rate(bar[5m])) by (pod)`: 5 * time.Minute,
+			`max_over_time(rate(foo[1m])[10m:1m])`:                      11 * time.Minute,
+			`last_over_time(foo[1h30m])`:                                90 * time.Minute,
+		} {
+			expr, err := parser.ParseExpr(input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(MaxRange(expr)).To(Equal(expected), "for %q", input)
+		}
+	})
+})
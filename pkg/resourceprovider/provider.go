@@ -35,6 +35,7 @@ import (
 	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
 	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
 	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
 )
 
 var (
@@ -47,7 +48,12 @@ var (
 
 // newResourceQuery instantiates query information from the give configuration rule for querying
 // resource metrics for some resource.
-func newResourceQuery(cfg config.ResourceRule, mapper apimeta.RESTMapper) (resourceQuery, error) {
+func newResourceQuery(cfg config.ResourceRule, proms client.Backends, mapper apimeta.RESTMapper) (resourceQuery, error) {
+	prom, err := proms.For(cfg.Backend)
+	if err != nil {
+		return resourceQuery{}, err
+	}
+
 	converter, err := naming.NewResourceConverter(cfg.Resources.Template, cfg.Resources.Overrides, mapper)
 	if err != nil {
 		return resourceQuery{}, fmt.Errorf("unable to construct label-resource converter: %v", err)
@@ -63,6 +69,7 @@ func newResourceQuery(cfg config.ResourceRule, mapper apimeta.RESTMapper) (resou
 	}
 
 	return resourceQuery{
+		prom:           prom,
 		converter:      converter,
 		contQuery:      contQuery,
 		nodeQuery:      nodeQuery,
@@ -74,39 +81,133 @@ func newResourceQuery(cfg config.ResourceRule, mapper apimeta.RESTMapper) (resou
 // resourceQuery represents query information for querying resource metrics for some resource,
 // like CPU or memory.
 type resourceQuery struct {
+	prom           client.Client
 	converter      naming.ResourceConverter
 	contQuery      naming.MetricsQuery
 	nodeQuery      naming.MetricsQuery
 	containerLabel string
+	// globalMatchers are added to every selector in the query.
+	globalMatchers []*plabels.Matcher
 }
 
-// NewProvider constructs a new MetricsProvider to provide resource metrics from Prometheus using the given rules.
-func NewProvider(prom client.Client, mapper apimeta.RESTMapper, cfg *config.ResourceRules) (provider.MetricsProvider, error) {
-	cpuQuery, err := newResourceQuery(cfg.CPU, mapper)
+// resourceRules holds the compiled query information for each resource metric.
+type resourceRules struct {
+	cpu, mem resourceQuery
+
+	window time.Duration
+}
+
+// newResourceRules compiles the given configuration into query information for
+// each resource metric, with the given global label matchers added to every query.
+func newResourceRules(cfg *config.ResourceRules, globalLabelMatchers []string, proms client.Backends, mapper apimeta.RESTMapper) (*resourceRules, error) {
+	globalMatchers, err := naming.ParseLabelMatchers(globalLabelMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global label matchers: %v", err)
+	}
+	cpuQuery, err := newResourceQuery(cfg.CPU, proms, mapper)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct querier for CPU metrics: %v", err)
 	}
-	memQuery, err := newResourceQuery(cfg.Memory, mapper)
+	cpuQuery.globalMatchers = globalMatchers
+	memQuery, err := newResourceQuery(cfg.Memory, proms, mapper)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct querier for memory metrics: %v", err)
 	}
+	memQuery.globalMatchers = globalMatchers
 
-	return &resourceProvider{
-		prom:   prom,
+	return &resourceRules{
 		cpu:    cpuQuery,
 		mem:    memQuery,
 		window: time.Duration(cfg.Window),
 	}, nil
 }
 
+// ReloadableMetricsProvider is a MetricsProvider whose rules may be replaced while it's running.
+type ReloadableMetricsProvider interface {
+	provider.MetricsProvider
+
+	// PrepareRules compiles the given rules (and global label matchers) for use with
+	// SetRules, without applying them.  An error is returned if they're invalid.
+	PrepareRules(cfg *config.ResourceRules, globalLabelMatchers []string) (*PreparedRules, error)
+	// SetRules replaces the rules used to query resource metrics with the given
+	// prepared rules.
+	SetRules(rules *PreparedRules)
+	// UpdateRules prepares and then sets the given rules (and global label matchers).
+	// If the new rules are invalid, an error is returned and the existing rules are kept.
+	UpdateRules(cfg *config.ResourceRules, globalLabelMatchers []string) error
+}
+
+// PreparedRules are resource metrics rules which have been compiled (and so
+// validated) by a ReloadableMetricsProvider, ready to be applied to it.
+type PreparedRules struct {
+	rules *resourceRules
+}
+
+// NewProvider constructs a new MetricsProvider to provide resource metrics from Prometheus using the given rules,
+// adding the given global label matchers to every selector in every query.  Each rule queries the backend that it names (or the default backend, if it doesn't name one).  Each request
+// for metrics is given up on after the given query timeout (zero for no limit), and requests for more than the given
+// maximum number of objects (zero for no limit) are split into several queries, which are run concurrently.
+func NewProvider(proms client.Backends, mapper apimeta.RESTMapper, cfg *config.ResourceRules, globalLabelMatchers []string, queryTimeout time.Duration, maxNamesPerQuery int) (ReloadableMetricsProvider, error) {
+	rules, err := newResourceRules(cfg, globalLabelMatchers, proms, mapper)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resourceProvider{
+		proms:        proms,
+		mapper:       mapper,
+		rules:        rules,
+		queryTimeout: queryTimeout,
+
+		maxNamesPerQuery: maxNamesPerQuery,
+	}, nil
+}
+
 // resourceProvider is a MetricsProvider that contacts Prometheus to provide
 // the resource metrics.
 type resourceProvider struct {
-	prom client.Client
+	proms  client.Backends
+	mapper apimeta.RESTMapper
 
-	cpu, mem resourceQuery
+	// queryTimeout bounds each request for metrics (zero for no limit).
+	queryTimeout time.Duration
+	// maxNamesPerQuery is the largest number of objects that a single query
+	// is made for (zero for no limit).
+	maxNamesPerQuery int
 
-	window time.Duration
+	rulesMu sync.RWMutex
+	rules   *resourceRules
+}
+
+func (p *resourceProvider) PrepareRules(cfg *config.ResourceRules, globalLabelMatchers []string) (*PreparedRules, error) {
+	rules, err := newResourceRules(cfg, globalLabelMatchers, p.proms, p.mapper)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedRules{rules: rules}, nil
+}
+
+func (p *resourceProvider) SetRules(rules *PreparedRules) {
+	p.rulesMu.Lock()
+	defer p.rulesMu.Unlock()
+	p.rules = rules.rules
+}
+
+func (p *resourceProvider) UpdateRules(cfg *config.ResourceRules, globalLabelMatchers []string) error {
+	rules, err := p.PrepareRules(cfg, globalLabelMatchers)
+	if err != nil {
+		return err
+	}
+	p.SetRules(rules)
+	return nil
+}
+
+// currentRules returns the rules currently in use.  Callers should fetch the rules
+// once per request, so that a request never mixes old and new rules.
+func (p *resourceProvider) currentRules() *resourceRules {
+	p.rulesMu.RLock()
+	defer p.rulesMu.RUnlock()
+	return p.rules
 }
 
 // nsQueryResults holds the results of one set
@@ -125,7 +226,8 @@ func (p *resourceProvider) GetContainerMetrics(pods ...apitypes.NamespacedName)
 	}
 
 	// TODO(directxman12): figure out how well this scales if we go to list 1000+ pods
-	// (and consider adding timeouts)
+	ctx, cancel := client.NewRequestContext(p.queryTimeout)
+	defer cancel()
 
 	// group pods by namespace (we could be listing for all pods in the cluster)
 	podsByNs := make(map[string][]string, len(pods))
@@ -134,6 +236,7 @@ func (p *resourceProvider) GetContainerMetrics(pods ...apitypes.NamespacedName)
 	}
 
 	// actually fetch the results for each namespace
+	rules := p.currentRules()
 	now := pmodel.Now()
 	resChan := make(chan nsQueryResults, len(podsByNs))
 	var wg sync.WaitGroup
@@ -142,7 +245,7 @@ func (p *resourceProvider) GetContainerMetrics(pods ...apitypes.NamespacedName)
 	for ns, podNames := range podsByNs {
 		go func(ns string, podNames []string) {
 			defer wg.Done()
-			resChan <- p.queryBoth(now, podResource, ns, podNames...)
+			resChan <- p.queryBoth(ctx, rules, now, podResource, ns, podNames...)
 		}(ns, podNames)
 	}
 
@@ -164,7 +267,7 @@ func (p *resourceProvider) GetContainerMetrics(pods ...apitypes.NamespacedName)
 	resTimes := make([]provider.TimeInfo, len(pods))
 	resMetrics := make([][]metrics.ContainerMetrics, len(pods))
 	for i, pod := range pods {
-		p.assignForPod(pod, resultsByNs, &resMetrics[i], &resTimes[i])
+		p.assignForPod(rules, pod, resultsByNs, &resMetrics[i], &resTimes[i])
 	}
 
 	return resTimes, resMetrics, nil
@@ -174,7 +277,7 @@ func (p *resourceProvider) GetContainerMetrics(pods ...apitypes.NamespacedName)
 // from resultsByNs, and places them in MetricsProvider response format in resMetrics,
 // also recording the earliest time in resTime.  It will return without operating if
 // any data is missing.
-func (p *resourceProvider) assignForPod(pod apitypes.NamespacedName, resultsByNs map[string]nsQueryResults, resMetrics *[]metrics.ContainerMetrics, resTime *provider.TimeInfo) {
+func (p *resourceProvider) assignForPod(rules *resourceRules, pod apitypes.NamespacedName, resultsByNs map[string]nsQueryResults, resMetrics *[]metrics.ContainerMetrics, resTime *provider.TimeInfo) {
 	// check to make sure everything is present
 	nsRes, nsResPresent := resultsByNs[pod.Namespace]
 	if !nsResPresent {
@@ -197,7 +300,7 @@ func (p *resourceProvider) assignForPod(pod apitypes.NamespacedName, resultsByNs
 
 	// organize all the CPU results
 	for _, cpu := range cpuRes {
-		containerName := string(cpu.Metric[pmodel.LabelName(p.cpu.containerLabel)])
+		containerName := string(cpu.Metric[pmodel.LabelName(rules.cpu.containerLabel)])
 		if _, present := containerMetrics[containerName]; !present {
 			containerMetrics[containerName] = metrics.ContainerMetrics{
 				Name:  containerName,
@@ -212,7 +315,7 @@ func (p *resourceProvider) assignForPod(pod apitypes.NamespacedName, resultsByNs
 
 	// organize the memory results
 	for _, mem := range memRes {
-		containerName := string(mem.Metric[pmodel.LabelName(p.mem.containerLabel)])
+		containerName := string(mem.Metric[pmodel.LabelName(rules.mem.containerLabel)])
 		if _, present := containerMetrics[containerName]; !present {
 			containerMetrics[containerName] = metrics.ContainerMetrics{
 				Name:  containerName,
@@ -228,7 +331,7 @@ func (p *resourceProvider) assignForPod(pod apitypes.NamespacedName, resultsByNs
 	// store the time in the final format
 	*resTime = provider.TimeInfo{
 		Timestamp: earliestTs.Time(),
-		Window:    p.window,
+		Window:    rules.window,
 	}
 
 	// store the container metrics in the final format
@@ -245,10 +348,14 @@ func (p *resourceProvider) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo,
 		return nil, nil, nil
 	}
 
+	ctx, cancel := client.NewRequestContext(p.queryTimeout)
+	defer cancel()
+
+	rules := p.currentRules()
 	now := pmodel.Now()
 
 	// run the actual query
-	qRes := p.queryBoth(now, nodeResource, "", nodes...)
+	qRes := p.queryBoth(ctx, rules, now, nodeResource, "", nodes...)
 	if qRes.err != nil {
 		return nil, nil, qRes.err
 	}
@@ -284,7 +391,7 @@ func (p *resourceProvider) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo,
 		if rawMem.Timestamp.Before(rawCPU.Timestamp) {
 			resTimes[i] = provider.TimeInfo{
 				Timestamp: rawMem.Timestamp.Time(),
-				Window:    p.window,
+				Window:    rules.window,
 			}
 		} else {
 			resTimes[i] = provider.TimeInfo{
@@ -300,7 +407,7 @@ func (p *resourceProvider) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo,
 // queryBoth queries for both CPU and memory metrics on the given
 // Kubernetes API resource (pods or nodes), and errors out if
 // either query fails.
-func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResource, namespace string, names ...string) nsQueryResults {
+func (p *resourceProvider) queryBoth(ctx context.Context, rules *resourceRules, now pmodel.Time, resource schema.GroupResource, namespace string, names ...string) nsQueryResults {
 	var cpuRes, memRes queryResults
 	var cpuErr, memErr error
 
@@ -308,11 +415,11 @@ func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResou
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		cpuRes, cpuErr = p.runQuery(now, p.cpu, resource, namespace, names...)
+		cpuRes, cpuErr = p.runQuery(ctx, now, rules.cpu, resource, namespace, names...)
 	}()
 	go func() {
 		defer wg.Done()
-		memRes, memErr = p.runQuery(now, p.mem, resource, namespace, names...)
+		memRes, memErr = p.runQuery(ctx, now, rules.mem, resource, namespace, names...)
 	}()
 	wg.Wait()
 
@@ -339,9 +446,42 @@ func (p *resourceProvider) queryBoth(now pmodel.Time, resource schema.GroupResou
 // queryResults maps an object name to all the results matching that object
 type queryResults map[string][]*pmodel.Sample
 
-// runQuery actually queries Prometheus for the metric represented by the given query information, on
-// the given Kubernetes API resource (pods or nodes).
-func (p *resourceProvider) runQuery(now pmodel.Time, queryInfo resourceQuery, resource schema.GroupResource, namespace string, names ...string) (queryResults, error) {
+// runQuery queries Prometheus for the metric represented by the given query information, on the given
+// Kubernetes API resource (pods or nodes).  If there are too many objects for a single query, the objects
+// are split into chunks, which are queried concurrently, and the results are merged.
+func (p *resourceProvider) runQuery(ctx context.Context, now pmodel.Time, queryInfo resourceQuery, resource schema.GroupResource, namespace string, names ...string) (queryResults, error) {
+	chunks := naming.ChunkNames(names, p.maxNamesPerQuery)
+	if len(chunks) == 1 {
+		return p.runChunkQuery(ctx, now, queryInfo, resource, namespace, names)
+	}
+
+	results := make([]queryResults, len(chunks))
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	for i, chunk := range chunks {
+		go func(i int, chunk []string) {
+			defer wg.Done()
+			results[i], errs[i] = p.runChunkQuery(ctx, now, queryInfo, resource, namespace, chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	merged := make(queryResults)
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		for name, samples := range results[i] {
+			merged[name] = append(merged[name], samples...)
+		}
+	}
+	return merged, nil
+}
+
+// runChunkQuery actually queries Prometheus for the metric represented by the given query information, on
+// the given Kubernetes API resource (pods or nodes), with a single query.
+func (p *resourceProvider) runChunkQuery(ctx context.Context, now pmodel.Time, queryInfo resourceQuery, resource schema.GroupResource, namespace string, names []string) (queryResults, error) {
 	var query client.Selector
 	var err error
 
@@ -355,9 +495,13 @@ func (p *resourceProvider) runQuery(now pmodel.Time, queryInfo resourceQuery, re
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct query: %v", err)
 	}
+	query, err = naming.EnforceLabelMatchers(query, queryInfo.globalMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply global label matchers to query: %v", err)
+	}
 
 	// run the query
-	rawRes, err := p.prom.Query(context.Background(), now, query)
+	rawRes, err := queryInfo.prom.Query(client.WithNamespace(ctx, namespace), now, query)
 	if err != nil {
 		return nil, fmt.Errorf("unable to execute query: %v", err)
 	}
@@ -32,6 +32,7 @@ import (
 	config "github.com/directxman12/k8s-prometheus-adapter/cmd/config-gen/utils"
 	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
 	fakeprom "github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/naming"
 	pmodel "github.com/prometheus/common/model"
 )
 
@@ -93,7 +94,7 @@ func buildResList(cpu, memory float64) corev1.ResourceList {
 
 var _ = Describe("Resource Metrics Provider", func() {
 	var (
-		prov                   provider.MetricsProvider
+		prov                   ReloadableMetricsProvider
 		fakeProm               *fakeprom.FakePrometheusClient
 		cpuQueries, memQueries resourceQuery
 	)
@@ -104,16 +105,17 @@ var _ = Describe("Resource Metrics Provider", func() {
 
 		cfg := config.DefaultConfig(1*time.Minute, "")
 
+		fakeProm = &fakeprom.FakePrometheusClient{}
+		fakeProm.AcceptableInterval = pmodel.Interval{End: pmodel.Latest}
+		proms := prom.Backends{prom.DefaultBackend: fakeProm}
+
 		var err error
-		cpuQueries, err = newResourceQuery(cfg.ResourceRules.CPU, mapper)
+		cpuQueries, err = newResourceQuery(cfg.ResourceRules.CPU, proms, mapper)
 		Expect(err).NotTo(HaveOccurred())
-		memQueries, err = newResourceQuery(cfg.ResourceRules.Memory, mapper)
+		memQueries, err = newResourceQuery(cfg.ResourceRules.Memory, proms, mapper)
 		Expect(err).NotTo(HaveOccurred())
 
-		fakeProm = &fakeprom.FakePrometheusClient{}
-		fakeProm.AcceptableInterval = pmodel.Interval{End: pmodel.Latest}
-
-		prov, err = NewProvider(fakeProm, restMapper(), cfg.ResourceRules)
+		prov, err = NewProvider(proms, restMapper(), cfg.ResourceRules, nil, 0, 0)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -262,4 +264,125 @@ var _ = Describe("Resource Metrics Provider", func() {
 			{},
 		}))
 	})
+
+	It("should use the new rules after they're updated, and keep the old rules if the new ones are invalid", func() {
+		By("updating the rules to use a different window and node query")
+		cfg := config.DefaultConfig(2*time.Minute, "")
+		cfg.ResourceRules.CPU.NodeQuery = "sum(node_cpu_usage{<<.LabelMatchers>>}) by (<<.GroupBy>>)"
+		Expect(prov.UpdateRules(cfg.ResourceRules, nil)).To(Succeed())
+
+		newCPUQueries, err := newResourceQuery(cfg.ResourceRules.CPU, prom.Backends{prom.DefaultBackend: fakeProm}, restMapper())
+		Expect(err).NotTo(HaveOccurred())
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(newCPUQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")): buildQueryRes("node_cpu_usage",
+				buildNodeSample("node1", 1100.0, 10),
+			),
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 9),
+			),
+		}
+
+		By("attempting to update the rules with an invalid template")
+		invalidCfg := config.DefaultConfig(1*time.Minute, "")
+		invalidCfg.ResourceRules.CPU.NodeQuery = "sum(<<.LabelMatchers)"
+		Expect(prov.UpdateRules(invalidCfg.ResourceRules, nil)).NotTo(Succeed())
+
+		By("querying for metrics, and verifying that the valid updated rules were used")
+		times, metricVals, err := prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metricVals).To(Equal([]corev1.ResourceList{buildResList(1100.0, 2100.0)}))
+		Expect(times).To(Equal([]provider.TimeInfo{{Timestamp: pmodel.Time(9).Time(), Window: 2 * time.Minute}}))
+	})
+
+	It("should query the backend named by each rule", func() {
+		By("constructing a provider whose CPU rule uses a separate backend")
+		nodeProm := &fakeprom.FakePrometheusClient{AcceptableInterval: pmodel.Interval{End: pmodel.Latest}}
+		proms := prom.Backends{prom.DefaultBackend: fakeProm, "nodes": nodeProm}
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		cfg.ResourceRules.CPU.Backend = "nodes"
+		prov, err := NewProvider(proms, restMapper(), cfg.ResourceRules, nil, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		nodeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node1", 1100.0, 10),
+			),
+		}
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 11),
+			),
+		}
+
+		By("querying for metrics, and verifying that each came from the right backend")
+		_, metricVals, err := prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metricVals).To(Equal([]corev1.ResourceList{buildResList(1100.0, 2100.0)}))
+
+		By("refusing rules that refer to unknown backends")
+		cfg.ResourceRules.Memory.Backend = "missing"
+		Expect(prov.UpdateRules(cfg.ResourceRules, nil)).NotTo(Succeed())
+	})
+	It("should split queries for many objects into chunks, and merge the results", func() {
+		By("constructing a provider which queries for at most two nodes at once")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		prov, err := NewProvider(prom.Backends{prom.DefaultBackend: fakeProm}, restMapper(), cfg.ResourceRules, nil, 0, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, "node1", "node2")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node1", 1100.0, 10),
+				buildNodeSample("node2", 1200.0, 20),
+			),
+			mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, "node3")): buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node3", 1300.0, 30),
+			),
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, "node1", "node2")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 11),
+				buildNodeSample("node2", 2200.0, 21),
+			),
+			mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, "node3")): buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node3", 2300.0, 31),
+			),
+		}
+
+		By("querying for metrics, and verifying that every chunk's results were returned")
+		_, metricVals, err := prov.GetNodeMetrics("node1", "node2", "node3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metricVals).To(Equal([]corev1.ResourceList{
+			buildResList(1100.0, 2100.0),
+			buildResList(1200.0, 2200.0),
+			buildResList(1300.0, 2300.0),
+		}))
+	})
+	It("should add the global label matchers to every query", func() {
+		By("constructing a provider with global label matchers")
+		cfg := config.DefaultConfig(1*time.Minute, "")
+		prov, err := NewProvider(prom.Backends{prom.DefaultBackend: fakeProm}, restMapper(), cfg.ResourceRules, []string{`cluster="prod-eu"`}, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		globalMatchers, err := naming.ParseLabelMatchers([]string{`cluster="prod-eu"`})
+		Expect(err).NotTo(HaveOccurred())
+		cpuQuery, err := naming.EnforceLabelMatchers(mustBuild(cpuQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")), globalMatchers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(cpuQuery)).To(ContainSubstring(`cluster="prod-eu"`))
+		memQuery, err := naming.EnforceLabelMatchers(mustBuild(memQueries.nodeQuery.Build("", nodeResource, "", nil, "node1")), globalMatchers)
+		Expect(err).NotTo(HaveOccurred())
+		fakeProm.QueryResults = map[prom.Selector]prom.QueryResult{
+			cpuQuery: buildQueryRes("container_cpu_usage_seconds_total",
+				buildNodeSample("node1", 1100.0, 10),
+			),
+			memQuery: buildQueryRes("container_memory_working_set_bytes",
+				buildNodeSample("node1", 2100.0, 11),
+			),
+		}
+
+		By("querying for metrics, and verifying that the restricted queries were used")
+		_, metricVals, err := prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metricVals).To(Equal([]corev1.ResourceList{buildResList(1100.0, 2100.0)}))
+
+		By("refusing invalid global label matchers")
+		Expect(prov.UpdateRules(cfg.ResourceRules, []string{"cluster"})).NotTo(Succeed())
+	})
 })
@@ -0,0 +1,254 @@
+// Package ruletest runs declarative unit tests for metrics discovery configs,
+// evaluating the adapter's discovery and queries against an in-memory
+// Prometheus populated with the series described by each test.
+package ruletest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	prom "github.com/directxman12/k8s-prometheus-adapter/pkg/client"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/client/fake"
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/config"
+	cmprov "github.com/directxman12/k8s-prometheus-adapter/pkg/custom-provider"
+)
+
+// DefaultInterval is the default interval between the samples of input series.
+const DefaultInterval = 1 * time.Minute
+
+// Result is the result of a single test case.
+type Result struct {
+	// Name is the name of the test case.
+	Name string
+	// Failures describe the ways in which the test case failed, if any.
+	Failures []string
+}
+
+// Passed checks whether the test case passed.
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// FromFile loads a test file.  The path to the config under test is
+// resolved relative to the directory containing the test file.
+func FromFile(filename string) (*TestFile, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load test file: %v", err)
+	}
+
+	var testFile TestFile
+	if err := yaml.UnmarshalStrict(contents, &testFile); err != nil {
+		return nil, fmt.Errorf("unable to parse test file: %v", err)
+	}
+	if testFile.Config == "" {
+		return nil, fmt.Errorf("test file %s must specify a config to test", filename)
+	}
+	if !filepath.IsAbs(testFile.Config) {
+		testFile.Config = filepath.Join(filepath.Dir(filename), testFile.Config)
+	}
+
+	return &testFile, nil
+}
+
+// Run loads the config referenced by the given test file, and runs each
+// test case against it.  An error is only returned if the tests could not
+// be run at all; test failures are reported in the results.
+func Run(testFile *TestFile, mapper apimeta.RESTMapper) ([]Result, error) {
+	cfg, err := config.FromFile(testFile.Config)
+	if err != nil {
+		return nil, err
+	}
+	namers, err := cmprov.NamersFromConfig(cfg, mapper)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
+	}
+	derived, err := cmprov.DerivedMetricsFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct derived metrics: %v", err)
+	}
+
+	defaultInterval := time.Duration(testFile.Interval)
+	if defaultInterval == 0 {
+		defaultInterval = DefaultInterval
+	}
+
+	results := make([]Result, len(testFile.Tests))
+	for i, test := range testFile.Tests {
+		interval := time.Duration(test.Interval)
+		if interval == 0 {
+			interval = defaultInterval
+		}
+
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("tests[%d]", i)
+		}
+		results[i] = Result{
+			Name:     name,
+			Failures: runTest(test, interval, namers, derived, mapper),
+		}
+	}
+
+	return results, nil
+}
+
+// runTest runs a single test case, returning its failures.
+func runTest(test TestCase, interval time.Duration, namers []cmprov.MetricNamer, derived []*cmprov.DerivedMetric, mapper apimeta.RESTMapper) []string {
+	client := &fake.InMemoryPrometheusClient{}
+	for _, input := range test.InputSeries {
+		stream, err := parseSeries(input, interval)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		client.Data = append(client.Data, stream)
+	}
+	evalTime := pmodel.TimeFromUnixNano(time.Duration(test.EvalTime).Nanoseconds())
+
+	// populate the registry as the adapter would, at the evaluation time
+	seriesByNamer := make([][]prom.Series, len(namers))
+	for i, namer := range namers {
+		if static := namer.StaticSeries(); static != nil {
+			seriesByNamer[i] = static
+			continue
+		}
+		series, err := client.Series(context.Background(), pmodel.Interval{Start: 0, End: evalTime}, namer.Selector())
+		if err != nil {
+			return []string{fmt.Sprintf("unable to fetch series for query %q: %v", namer.Selector(), err)}
+		}
+		seriesByNamer[i] = namer.FilterSeries(series)
+	}
+	registry := cmprov.NewBasicSeriesRegistry(mapper)
+	registry.SetDerivedMetrics(derived)
+	if err := registry.SetSeries(seriesByNamer, namers); err != nil {
+		return []string{fmt.Sprintf("unable to register series: %v", err)}
+	}
+
+	var failures []string
+	if test.ExpectedMetrics != nil {
+		failures = append(failures, checkMetrics(test.ExpectedMetrics, registry, mapper)...)
+	}
+	for _, expected := range test.ExpectedValues {
+		if failure := checkValue(expected, evalTime, client, registry, mapper); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+// checkMetrics compares the discovered metrics against the expected ones.
+func checkMetrics(expectedMetrics []ExpectedMetric, registry cmprov.SeriesRegistry, mapper apimeta.RESTMapper) []string {
+	var failures []string
+
+	expected := make(map[provider.CustomMetricInfo]bool, len(expectedMetrics))
+	for _, metric := range expectedMetrics {
+		info, err := normalizedInfo(metric.Resource, metric.Namespaced, metric.Metric, mapper)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		expected[info] = true
+	}
+
+	actual := make(map[provider.CustomMetricInfo]bool)
+	for _, info := range registry.ListAllMetrics() {
+		actual[info] = true
+	}
+
+	var missing, unexpected []string
+	for info := range expected {
+		if !actual[info] {
+			missing = append(missing, info.String())
+		}
+	}
+	for info := range actual {
+		if !expected[info] {
+			unexpected = append(unexpected, info.String())
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+
+	for _, info := range missing {
+		failures = append(failures, fmt.Sprintf("expected metric %s was not discovered", info))
+	}
+	for _, info := range unexpected {
+		failures = append(failures, fmt.Sprintf("unexpected metric %s was discovered", info))
+	}
+	return failures
+}
+
+// checkValue fetches the value of a metric for a single object, as the adapter
+// would, and compares it against the expected value.  It returns a description
+// of the failure, or the empty string if the value matched.
+func checkValue(expected ExpectedValue, evalTime pmodel.Time, client prom.Client, registry cmprov.SeriesRegistry, mapper apimeta.RESTMapper) string {
+	object := expected.Name
+	if expected.Namespace != "" {
+		object = expected.Namespace + "/" + object
+	}
+	object = fmt.Sprintf("%s %s", expected.Resource, object)
+
+	expectedQuantity, err := resource.ParseQuantity(expected.Value)
+	if err != nil {
+		return fmt.Sprintf("invalid expected value %q for metric %s on %s: %v", expected.Value, expected.Metric, object, err)
+	}
+
+	info, err := normalizedInfo(expected.Resource, expected.Namespace != "", expected.Metric, mapper)
+	if err != nil {
+		return err.Error()
+	}
+
+	query, found := registry.QueryForMetric(info, expected.Namespace, expected.Name)
+	if !found {
+		return fmt.Sprintf("metric %s is not available for %s", expected.Metric, object)
+	}
+
+	queryResults, err := client.Query(context.Background(), evalTime, query)
+	if err != nil {
+		return fmt.Sprintf("unable to evaluate query %q for metric %s on %s: %v", query, expected.Metric, object, err)
+	}
+	if queryResults.Type != pmodel.ValVector {
+		return fmt.Sprintf("query %q for metric %s on %s returned a %s, not a vector", query, expected.Metric, object, queryResults.Type)
+	}
+
+	values, found := registry.MatchValuesToNames(info, *queryResults.Vector)
+	if !found {
+		return fmt.Sprintf("unable to match results of query %q to objects for metric %s", query, expected.Metric)
+	}
+	sample, found := values[expected.Name]
+	if !found {
+		return fmt.Sprintf("no value for metric %s on %s (query %q returned %d series)", expected.Metric, object, query, len(*queryResults.Vector))
+	}
+
+	// convert the value the same way that the provider does
+	actualQuantity := resource.NewMilliQuantity(int64(sample.Value*1000.0), resource.DecimalSI)
+	if actualQuantity.Cmp(expectedQuantity) != 0 {
+		return fmt.Sprintf("expected metric %s on %s to have value %s, got %s (query %q)", expected.Metric, object, expectedQuantity.String(), actualQuantity.String(), query)
+	}
+	return ""
+}
+
+// normalizedInfo constructs the normalized metric info for the given resource and metric.
+func normalizedInfo(resourceName string, namespaced bool, metric string, mapper apimeta.RESTMapper) (provider.CustomMetricInfo, error) {
+	info := provider.CustomMetricInfo{
+		GroupResource: schema.ParseGroupResource(resourceName),
+		Namespaced:    namespaced,
+		Metric:        metric,
+	}
+	normalized, _, err := info.Normalized(mapper)
+	if err != nil {
+		return provider.CustomMetricInfo{}, fmt.Errorf("unable to resolve resource %q: %v", resourceName, err)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,67 @@
+package ruletest
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	pmodel "github.com/prometheus/common/model"
+
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/mapper"
+)
+
+var _ = Describe("Rule Unit Tests", func() {
+	It("should expand values in promtool notation", func() {
+		vals, err := expandValues("1+1x3 _ 5-2x2 _x2 7 1e-3+1e-3x1")
+		Expect(err).NotTo(HaveOccurred())
+
+		var res []interface{}
+		for _, val := range vals {
+			if val == nil {
+				res = append(res, nil)
+			} else {
+				res = append(res, *val)
+			}
+		}
+		Expect(res).To(Equal([]interface{}{1.0, 2.0, 3.0, 4.0, nil, 5.0, 3.0, 1.0, nil, nil, 7.0, 0.001, 0.002}))
+
+		_, err = expandValues("1+ax3")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should parse input series, skipping missing samples", func() {
+		stream, err := parseSeries(InputSeries{Series: `some_metric{pod="a"}`, Values: "1 _ 3"}, DefaultInterval)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Metric).To(Equal(pmodel.Metric{"__name__": "some_metric", "pod": "a"}))
+		Expect(stream.Values).To(Equal([]pmodel.SamplePair{
+			{Timestamp: pmodel.TimeFromUnix(0), Value: 1},
+			{Timestamp: pmodel.TimeFromUnix(120), Value: 3},
+		}))
+
+		_, err = parseSeries(InputSeries{Series: `some_metric{pod=~"a"}`, Values: "1"}, DefaultInterval)
+		Expect(err).To(HaveOccurred())
+		_, err = parseSeries(InputSeries{Series: `{pod="a"}`, Values: "1"}, DefaultInterval)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should run the tests in a test file, reporting failures", func() {
+		testFile, err := FromFile("testdata/tests.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testFile.Config).To(Equal("testdata/config.yaml"))
+
+		results, err := Run(testFile, mapper.NewStatic())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(2))
+
+		By("passing tests whose expectations match")
+		Expect(results[0].Failures).To(BeEmpty())
+		Expect(results[0].Passed()).To(BeTrue())
+
+		By("reporting unexpected metrics, wrong values, and missing metrics")
+		Expect(results[1].Name).To(Equal("wrong expectations"))
+		Expect(results[1].Failures).To(ConsistOf(
+			"unexpected metric namespaces/http_requests_per_second was discovered",
+			`expected metric http_requests_per_second on pods default/web-1 to have value 2, got 1 (query "sum by(pod) (rate(http_requests_total{namespace=\"default\",pod=\"web-1\"}[2m]))")`,
+			`no value for metric http_requests_per_second on pods default/web-2 (query "sum by(pod) (rate(http_requests_total{namespace=\"default\",pod=\"web-2\"}[2m]))" returned 0 series)`,
+			"metric http_errors_per_second is not available for pods default/web-1",
+		))
+	})
+})
@@ -0,0 +1,134 @@
+package ruletest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	plabels "github.com/prometheus/prometheus/model/labels"
+
+	"github.com/directxman12/k8s-prometheus-adapter/pkg/promql"
+)
+
+// parseSeries parses the given input series into a stream of samples,
+// starting at time zero and spaced by the given interval.
+func parseSeries(input InputSeries, interval time.Duration) (*pmodel.SampleStream, error) {
+	metric, err := parseSeriesMetric(input.Series)
+	if err != nil {
+		return nil, err
+	}
+	values, err := expandValues(input.Values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid values for series %q: %v", input.Series, err)
+	}
+
+	stream := &pmodel.SampleStream{Metric: metric}
+	for i, val := range values {
+		if val == nil {
+			continue
+		}
+		stream.Values = append(stream.Values, pmodel.SamplePair{
+			Timestamp: pmodel.TimeFromUnixNano(int64(i) * interval.Nanoseconds()),
+			Value:     pmodel.SampleValue(*val),
+		})
+	}
+	return stream, nil
+}
+
+// parseSeriesMetric parses a series of the form `name{label="value",...}`.
+func parseSeriesMetric(series string) (pmodel.Metric, error) {
+	sel, err := promql.ParseSelector(series)
+	if err != nil {
+		return nil, fmt.Errorf("invalid series %q: %v", series, err)
+	}
+
+	metric := pmodel.Metric{}
+	for _, matcher := range sel.LabelMatchers {
+		if matcher.Type != plabels.MatchEqual {
+			return nil, fmt.Errorf("invalid series %q: only equality matchers may be used to describe a series", series)
+		}
+		metric[pmodel.LabelName(matcher.Name)] = pmodel.LabelValue(matcher.Value)
+	}
+	if _, hasName := metric[pmodel.MetricNameLabel]; !hasName {
+		return nil, fmt.Errorf("invalid series %q: series must have a name", series)
+	}
+	return metric, nil
+}
+
+// expandValues expands values written in promtool's expanding notation.
+// Missing samples are represented as nil.
+func expandValues(input string) ([]*float64, error) {
+	var res []*float64
+	for _, term := range strings.Fields(input) {
+		if term == "_" {
+			res = append(res, nil)
+			continue
+		}
+
+		xPos := strings.LastIndex(term, "x")
+		if xPos == -1 {
+			val, err := strconv.ParseFloat(term, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", term)
+			}
+			res = append(res, &val)
+			continue
+		}
+
+		times, err := strconv.ParseUint(term[xPos+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repetition count in %q", term)
+		}
+		expr := term[:xPos]
+
+		if expr == "_" {
+			for i := uint64(0); i < times; i++ {
+				res = append(res, nil)
+			}
+			continue
+		}
+
+		start, step, err := parseStartAndStep(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expanding term %q: %v", term, err)
+		}
+		for i := uint64(0); i <= times; i++ {
+			val := start + step*float64(i)
+			res = append(res, &val)
+		}
+	}
+	return res, nil
+}
+
+// parseStartAndStep parses the `a+b` or `a-b` part of an expanding term.
+// A lone `a` is treated as having a step of zero.
+func parseStartAndStep(expr string) (float64, float64, error) {
+	// find the operator, skipping a leading sign and the signs of exponents
+	opPos := -1
+	for i := 1; i < len(expr); i++ {
+		if (expr[i] == '+' || expr[i] == '-') && expr[i-1] != 'e' && expr[i-1] != 'E' {
+			opPos = i
+			break
+		}
+	}
+
+	if opPos == -1 {
+		start, err := strconv.ParseFloat(expr, 64)
+		return start, 0, err
+	}
+
+	start, err := strconv.ParseFloat(expr[:opPos], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	step, err := strconv.ParseFloat(expr[opPos+1:], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if expr[opPos] == '-' {
+		step = -step
+	}
+	return start, step, nil
+}
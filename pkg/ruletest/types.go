@@ -0,0 +1,77 @@
+package ruletest
+
+import (
+	pmodel "github.com/prometheus/common/model"
+)
+
+// TestFile is a set of unit tests for the discovery rules in a metrics
+// discovery config.  The format is loosely modeled on that of promtool's
+// rule unit tests.
+type TestFile struct {
+	// Config is the path to the metrics discovery config under test.
+	// Relative paths are interpreted relative to the directory containing
+	// the test file.
+	Config string `yaml:"config"`
+	// Interval is the default interval between the samples of input series.
+	// It defaults to one minute.
+	Interval pmodel.Duration `yaml:"interval,omitempty"`
+	// Tests are the individual test cases.
+	Tests []TestCase `yaml:"tests"`
+}
+
+// TestCase describes a set of input series, and the custom metrics
+// that the adapter is expected to produce from them.
+type TestCase struct {
+	// Name identifies the test case in the results.
+	Name string `yaml:"name"`
+	// Interval overrides the interval between the samples of the input series
+	// for this test case.
+	Interval pmodel.Duration `yaml:"interval,omitempty"`
+	// InputSeries are the series present in the fake Prometheus.
+	InputSeries []InputSeries `yaml:"inputSeries"`
+	// EvalTime is the time (relative to the first sample of the input series)
+	// at which discovery is run and metrics are queried.
+	EvalTime pmodel.Duration `yaml:"evalTime"`
+	// ExpectedMetrics, if specified, are exactly the custom metrics that should
+	// be discovered from the input series.
+	ExpectedMetrics []ExpectedMetric `yaml:"expectedMetrics,omitempty"`
+	// ExpectedValues are the values that should be returned for particular
+	// metrics on particular objects.
+	ExpectedValues []ExpectedValue `yaml:"expectedValues,omitempty"`
+}
+
+// InputSeries is a single series in the fake Prometheus.
+type InputSeries struct {
+	// Series is the series, in the form `name{label="value",...}`.
+	Series string `yaml:"series"`
+	// Values are the values of the series in expanding notation, as used by
+	// promtool.  For example, `1+1x3` expands to `1 2 3 4`, `5-2x2` expands
+	// to `5 3 1`, and `_` represents a missing sample (`_x3` represents three
+	// missing samples).
+	Values string `yaml:"values"`
+}
+
+// ExpectedMetric is a custom metric that should be discovered.
+type ExpectedMetric struct {
+	// Resource is the resource that the metric describes (e.g. `pods`).
+	Resource string `yaml:"resource"`
+	// Namespaced indicates whether the metric is namespaced.
+	Namespaced bool `yaml:"namespaced,omitempty"`
+	// Metric is the name of the metric.
+	Metric string `yaml:"metric"`
+}
+
+// ExpectedValue is the value that the adapter should return for a metric
+// describing a particular object.
+type ExpectedValue struct {
+	// Resource is the resource of the described object (e.g. `pods`).
+	Resource string `yaml:"resource"`
+	// Namespace is the namespace of the described object, if it's namespaced.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Name is the name of the described object.
+	Name string `yaml:"name"`
+	// Metric is the name of the metric.
+	Metric string `yaml:"metric"`
+	// Value is the expected value, as a Kubernetes quantity (e.g. `500m`, or `2`).
+	Value string `yaml:"value"`
+}